@@ -2,6 +2,7 @@ package client
 
 import (
 	"butler-server/config"
+	"butler-server/internals/encryption"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -11,18 +12,45 @@ import (
 
 type ClusterData struct {
 	Cluster struct {
-		ID          int       `json:"id"`
-		CreatedAt   time.Time `json:"createdAt"`
-		Name        string    `json:"name"`
-		Host        string    `json:"host"`
-		Port        string    `json:"port"`
-		Username    string    `json:"username"`
-		Password    string    `json:"password"`
-		Driver      string    `json:"type"`
-		WorkspaceID int       `json:"workspace_id"`
+		ID               int       `json:"id"`
+		CreatedAt        time.Time `json:"createdAt"`
+		Name             string    `json:"name"`
+		Host             string    `json:"host"`
+		Port             string    `json:"port"`
+		Username         string    `json:"username"`
+		Password         string    `json:"password"`
+		Driver           string    `json:"type"`
+		WorkspaceID      int       `json:"workspace_id"`
+		StatementTimeout int       `json:"statementTimeout"`
+		ReadOnly         bool      `json:"readOnly"`
 	} `json:"cluster"`
 }
 
+// PasswordContext binds the sealed password of a cluster to the cluster
+func PasswordContext(clusterID int) string {
+	return fmt.Sprintf("cluster:%d:password", clusterID)
+}
+
+// Seal returns the cluster data with its password sealed, to be stored
+func (d ClusterData) Seal(keyring *encryption.Keyring) (ClusterData, error) {
+	password, err := keyring.Seal(d.Cluster.Password, PasswordContext(d.Cluster.ID))
+	if err != nil {
+		return ClusterData{}, err
+	}
+	d.Cluster.Password = password
+	return d, nil
+}
+
+// Open returns stored cluster data with its password in plaintext
+func (d ClusterData) Open(keyring *encryption.Keyring) (ClusterData, error) {
+	password, err := keyring.Open(d.Cluster.Password, PasswordContext(d.Cluster.ID))
+	if err != nil {
+		return ClusterData{}, err
+	}
+	d.Cluster.Password = password
+	return d, nil
+}
+
 func GetClusterAPI(clusterId string) (ClusterData, error) {
 	url := fmt.Sprintf("%s/api/clusters/%s?admin=true", config.GetString("NEXT_CLIENT_URL"), clusterId)
 	method := "GET"
@@ -55,5 +83,7 @@ func GetClusterAPI(clusterId string) (ClusterData, error) {
 	fmt.Println("Cluster Name:", clusterData.Cluster.Name)
 	// Add more fields as needed
 
-	return clusterData, nil
+	// passwords stay plaintext unless the clusters table was re-encrypted,
+	// see repository.ReencryptClusterPasswords
+	return clusterData.Open(encryption.Default())
 }
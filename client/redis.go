@@ -1,6 +1,7 @@
 package client
 
 import (
+	"butler-server/internals/encryption"
 	"encoding/json"
 	"fmt"
 	"time"
@@ -109,6 +110,87 @@ func (r *RedisClient) GenerateMetadataKey(clusterID, databaseName, tableName str
 	return fmt.Sprintf("%s:%s~%s~%s", KeyPrefixMetadata, clusterID, databaseName, tableName)
 }
 
-func (r *RedisClient) GenerateDataKey(query string) string {
-	return fmt.Sprintf("%s:%s", KeyPrefixData, query)
+// GenerateDataKey keys the pages of table data read from a cluster. Pages
+// are cached masked for the role of the user who read them.
+func (r *RedisClient) GenerateDataKey(clusterID, role, query string) string {
+	return fmt.Sprintf("%s:%s~%s~%s", KeyPrefixData, clusterID, role, query)
+}
+
+// DeleteDataKeys drops the cached pages of table data of a cluster
+func (r *RedisClient) DeleteDataKeys(clusterID string) error {
+	var cursor uint64
+	for {
+		keys, next, err := r.client.Scan(cursor, fmt.Sprintf("%s:%s~*", KeyPrefixData, clusterID), 100).Result()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err := r.client.Del(keys...).Err(); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// ReencryptClusterKeys seals the passwords of the cached cluster data with the
+// current key, keeping the expiry of every key, and returns how many it
+// rewrote
+func (r *RedisClient) ReencryptClusterKeys(keyring *encryption.Keyring) (int, error) {
+	rewritten := 0
+	var cursor uint64
+	for {
+		keys, next, err := r.client.Scan(cursor, KeyPrefixCluster+":*", 100).Result()
+		if err != nil {
+			return rewritten, err
+		}
+		for _, key := range keys {
+			changed, err := r.reencryptClusterKey(key, keyring)
+			if err != nil {
+				return rewritten, fmt.Errorf("failed to re-encrypt %s: %w", key, err)
+			}
+			if changed {
+				rewritten++
+			}
+		}
+		if next == 0 {
+			return rewritten, nil
+		}
+		cursor = next
+	}
+}
+
+func (r *RedisClient) reencryptClusterKey(key string, keyring *encryption.Keyring) (bool, error) {
+	value, err := r.client.Get(key).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var data ClusterData
+	if err := json.Unmarshal([]byte(value), &data); err != nil {
+		return false, err
+	}
+	password, changed, err := keyring.Rewrap(data.Cluster.Password, PasswordContext(data.Cluster.ID))
+	if err != nil || !changed {
+		return false, err
+	}
+	data.Cluster.Password = password
+	byteData, err := json.Marshal(data)
+	if err != nil {
+		return false, err
+	}
+	ttl, err := r.client.TTL(key).Result()
+	if err != nil {
+		return false, err
+	}
+	// a negative ttl is a key without expiry, or one that just expired
+	if ttl < 0 {
+		ttl = 0
+	}
+	return r.client.SetXX(key, byteData, ttl).Result()
 }
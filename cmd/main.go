@@ -5,6 +5,13 @@ import (
 	"butler-server/config"
 	"butler-server/handlers"
 	"butler-server/initializers"
+	"butler-server/internals/core"
+	"butler-server/internals/encryption"
+	"butler-server/repository"
+	"flag"
+	"log"
+	"os"
+	"time"
 )
 
 func main() {
@@ -14,13 +21,56 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	if err := repository.Migrate(db); err != nil {
+		panic(err)
+	}
 	redis, err := initializers.InitRedis()
 	if err != nil {
 		panic(err)
 	}
+	keyring, err := initializers.InitEncryption()
+	if err != nil {
+		panic(err)
+	}
 
 	dbClient := client.NewDatabase(db)
 	redisClient := client.NewRedisClient(redis)
 
-	handlers.StartServer(dbClient, redisClient, config.GetString("PORT"))
+	if len(os.Args) > 1 && os.Args[1] == "reencrypt" {
+		flags := flag.NewFlagSet("reencrypt", flag.ExitOnError)
+		clustersTable := flags.Bool("clusters-table", false, "also rewrite the passwords of the clusters table of the Next app")
+		flags.Parse(os.Args[2:])
+		reencrypt(dbClient, redisClient, keyring, *clustersTable)
+		return
+	}
+
+	connections := core.NewConnectionManager(config.GetInt("CONNECTION_MAX_OPEN", 50), config.GetDuration("CONNECTION_IDLE_TIMEOUT", 10*time.Minute))
+	defer connections.Close()
+
+	handlers.StartServer(dbClient, redisClient, connections, config.GetString("PORT"))
+}
+
+// reencrypt seals the cached credentials with the current key, run after
+// adding a key version to ENCRYPTION_KEYS. Older versions may be dropped once
+// it succeeds. The clusters table belongs to the Next app, which must read
+// sealed passwords before its passwords are rewritten with clustersTable.
+func reencrypt(dbClient *client.Database, redisClient *client.RedisClient, keyring *encryption.Keyring, clustersTable bool) {
+	log.Printf("re-encrypting credentials with key version %d", keyring.Current())
+	clusters := 0
+	if clustersTable {
+		var err error
+		clusters, err = repository.ReencryptClusterPasswords(dbClient, keyring)
+		if err != nil {
+			log.Fatalf("failed to re-encrypt cluster passwords after %d: %v", clusters, err)
+		}
+	}
+	cached, err := redisClient.ReencryptClusterKeys(keyring)
+	if err != nil {
+		log.Fatalf("failed to re-encrypt cached clusters after %d: %v", cached, err)
+	}
+	if !clustersTable {
+		log.Printf("re-encrypted %d cached clusters, the clusters table was left as is", cached)
+		return
+	}
+	log.Printf("re-encrypted %d cluster passwords and %d cached clusters", clusters, cached)
 }
@@ -3,6 +3,8 @@ package config
 import (
 	"log"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -18,3 +20,21 @@ func LoadEnv() {
 func GetString(key string) string {
 	return os.Getenv(key)
 }
+
+// GetInt returns the value of an environment variable as an int, or fallback when unset or invalid
+func GetInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// GetDuration returns the value of an environment variable parsed as a time.Duration, or fallback when unset or invalid
+func GetDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
@@ -3,6 +3,7 @@ package handlers
 import (
 	"butler-server/client"
 	"butler-server/config"
+	"butler-server/internals/core"
 	"butler-server/repository"
 	"errors"
 	"log"
@@ -13,25 +14,36 @@ import (
 type HandlerContext struct {
 	DBClient    *client.Database
 	RedisClient *client.RedisClient
+	Connections *core.ConnectionManager
+	// User is the user the access token of the request was issued to
+	User *repository.User
+	// Role is the role of the user on the cluster of the request, set once
+	// the request is authorized
+	Role string
 }
 
 const HandlerContextKey = "HandlerContext"
 
 // NewHandlerContext creates a new HandlerContext instance
-func NewHandlerContext(dbClient *client.Database, redisClient *client.RedisClient) *HandlerContext {
+func NewHandlerContext(dbClient *client.Database, redisClient *client.RedisClient, connections *core.ConnectionManager) *HandlerContext {
 	return &HandlerContext{
 		DBClient:    dbClient,
 		RedisClient: redisClient,
+		Connections: connections,
 	}
 }
 
-func StartServer(dbClient *client.Database, redisClient *client.RedisClient, port string) {
+func StartServer(dbClient *client.Database, redisClient *client.RedisClient, connections *core.ConnectionManager, port string) {
 	r := gin.Default()
 	r.Use(corsMiddleware())
-	r.Use(setupHandlerContext(dbClient, redisClient))
+	r.Use(setupHandlerContext(dbClient, redisClient, connections))
+	r.Use(authenticate())
 
 	repo := repository.NewRepository(dbClient.Db)
 
+	InitRoleHandlers(r, repo)
+	InitMaskingHandlers(r, repo)
+	InitPolicyHandlers(r, repo)
 	InitClusterHandlers(r)
 	InitViewHandlers(r, repo)
 	InitCommitHandlers(r, repo)
@@ -44,7 +56,7 @@ func corsMiddleware() gin.HandlerFunc {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", config.GetString("NEXT_CLIENT_URL"))
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
 		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -55,9 +67,9 @@ func corsMiddleware() gin.HandlerFunc {
 	}
 }
 
-func setupHandlerContext(dbClient *client.Database, redisClient *client.RedisClient) gin.HandlerFunc {
+func setupHandlerContext(dbClient *client.Database, redisClient *client.RedisClient, connections *core.ConnectionManager) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		context := NewHandlerContext(dbClient, redisClient)
+		context := NewHandlerContext(dbClient, redisClient, connections)
 		c.Set(HandlerContextKey, context)
 		c.Next()
 	}
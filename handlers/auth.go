@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"butler-server/client"
+	"butler-server/config"
+	"butler-server/internals/errors"
+	"butler-server/internals/utils"
+	"butler-server/repository"
+	stderrors "errors"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// authenticate rejects requests without a valid bearer token in the
+// Authorization header and puts the user it was issued to on the handler
+// context
+func authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, err := GetClientContext(c)
+		if err != nil {
+			errors.InternalServerError(err, c, "Failed to get handler context")
+			c.Abort()
+			return
+		}
+		scheme, token, _ := strings.Cut(c.Request.Header.Get("Authorization"), " ")
+		if !strings.EqualFold(scheme, "Bearer") {
+			errors.UnAuthorizedError(nil, c, "a bearer token is required")
+			c.Abort()
+			return
+		}
+		user, err := repository.CheckAccount(ctx.DBClient, strings.TrimSpace(token))
+		if stderrors.Is(err, repository.ErrUnknownToken) || stderrors.Is(err, repository.ErrTokenExpired) {
+			errors.UnAuthorizedError(err, c, "you are unauthorized to access this resource")
+			c.Abort()
+			return
+		}
+		if err != nil {
+			errors.InternalServerError(err, c, "failed to check the access token")
+			c.Abort()
+			return
+		}
+		ctx.User = &user
+		c.Next()
+	}
+}
+
+// defaultRole is the role of the members of a workspace who were not given
+// one. Admins of new workspaces are given theirs in the roles table, or
+// through a DEFAULT_ROLE of admin while setting up.
+func defaultRole() string {
+	if role := config.GetString("DEFAULT_ROLE"); repository.RoleRank(role) >= 0 {
+		return role
+	}
+	return repository.RoleViewer
+}
+
+// requireClusterAccess lets the requests for the cluster of the id param
+// through when the user has at least role on it
+func requireClusterAccess(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if authorizeCluster(c, c.Param("id"), role) {
+			c.Next()
+		}
+	}
+}
+
+// requireCommitAccess lets the requests for the commit of the id param
+// through when the user has at least role on its cluster
+func requireCommitAccess(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := commitId(c)
+		if !ok {
+			c.Abort()
+			return
+		}
+		commit, err := commitRepository.GetCommit(id)
+		if stderrors.Is(err, gorm.ErrRecordNotFound) {
+			errors.NotFoundError(err, c, "commit not found")
+			c.Abort()
+			return
+		}
+		if err != nil {
+			errors.InternalServerError(err, c, "failed to fetch the commit")
+			c.Abort()
+			return
+		}
+		if authorizeCluster(c, commit.ClusterId, role) {
+			c.Next()
+		}
+	}
+}
+
+// authorizeCluster checks that the user has at least role on the cluster,
+// answering and aborting the request when not
+func authorizeCluster(c *gin.Context, clusterId string, role string) bool {
+	ctx, err := GetClientContext(c)
+	if err != nil {
+		errors.InternalServerError(err, c, "Failed to get handler context")
+		c.Abort()
+		return false
+	}
+	if clusterId == "" {
+		errors.BadRequestError(nil, c, "clusterId is mandatory")
+		c.Abort()
+		return false
+	}
+	clusterData, err := loadCluster(ctx, clusterId)
+	if err != nil {
+		errors.InternalServerError(err, c, "Failed to get Cluster Data")
+		c.Abort()
+		return false
+	}
+	if clusterData.Cluster.ID == 0 {
+		errors.NotFoundError(nil, c, "cluster not found")
+		c.Abort()
+		return false
+	}
+	return authorizeWorkspace(c, clusterData.Cluster.WorkspaceID, clusterId, role)
+}
+
+// authorizeWorkspace checks that the user belongs to the workspace and has
+// at least role there, on the cluster when clusterId is set. The role the
+// user has is put on the handler context.
+func authorizeWorkspace(c *gin.Context, workspaceId int, clusterId string, role string) bool {
+	ctx, err := GetClientContext(c)
+	if err != nil {
+		errors.InternalServerError(err, c, "Failed to get handler context")
+		c.Abort()
+		return false
+	}
+	member, err := repository.IsMember(ctx.DBClient, workspaceId, ctx.User.ID)
+	if err != nil {
+		errors.InternalServerError(err, c, "failed to check the workspace of the cluster")
+		c.Abort()
+		return false
+	}
+	if !member {
+		errors.ForbiddenError(fmt.Errorf("user %s is not a member of workspace %d", ctx.User.ID, workspaceId), c, "you are unauthorized to access this cluster")
+		c.Abort()
+		return false
+	}
+	userRole, err := roleRepository.GetRole(workspaceId, clusterId, ctx.User.ID, defaultRole())
+	if err != nil {
+		errors.InternalServerError(err, c, "failed to fetch the role of the user")
+		c.Abort()
+		return false
+	}
+	if repository.RoleRank(userRole) < repository.RoleRank(role) {
+		errors.ForbiddenError(fmt.Errorf("user %s is %s", ctx.User.ID, userRole), c, fmt.Sprintf("the %s role is required", role))
+		c.Abort()
+		return false
+	}
+	ctx.Role = userRole
+	return true
+}
+
+// loadCluster reads the cluster from the cache, and from the Next app for
+// clusters that were not pinged yet
+func loadCluster(ctx *HandlerContext, clusterId string) (client.ClusterData, error) {
+	if clusterData, err := utils.GetClusterData(ctx.RedisClient, clusterId); err == nil {
+		return clusterData, nil
+	}
+	return client.GetClusterAPI(clusterId)
+}
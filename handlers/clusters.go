@@ -2,11 +2,14 @@ package handlers
 
 import (
 	"butler-server/client"
+	"butler-server/config"
 	"butler-server/internals/core"
 	"butler-server/internals/errors"
+	"butler-server/internals/filters"
+	"butler-server/internals/sqlparse"
 	"butler-server/internals/utils"
 	"butler-server/repository"
-	"encoding/json"
+	stderrors "errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -16,6 +19,7 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 type Result struct {
@@ -27,17 +31,39 @@ type Result struct {
 func InitClusterHandlers(router *gin.Engine) {
 	clientRoutes := router.Group("/cluster")
 	{
-		clientRoutes.GET("/query/:id", handleQuery)
-		clientRoutes.GET("/databases/:id", handleDatabases)
-		clientRoutes.GET("/tables/:id", handleTables)
-		clientRoutes.GET("/metadata/:id", handleMetaData)
-		clientRoutes.GET("/data/:id", handleData)
-		clientRoutes.GET("/ping/:id", handlePing)
-		clientRoutes.POST("/execute/:id", handleExecute)
+		clientRoutes.GET("/query/:id", requireClusterAccess(repository.RoleAnalyst), handleQuery)
+		clientRoutes.POST("/query/:id", requireClusterAccess(repository.RoleAnalyst), handleScript)
+		clientRoutes.GET("/explain/:id", requireClusterAccess(repository.RoleAnalyst), handleExplain)
+		clientRoutes.GET("/query/:id/export", requireClusterAccess(repository.RoleAnalyst), handleQueryExport)
+		clientRoutes.GET("/databases/:id", requireClusterAccess(repository.RoleViewer), handleDatabases)
+		clientRoutes.GET("/tables/:id", requireClusterAccess(repository.RoleViewer), handleTables)
+		clientRoutes.GET("/metadata/:id", requireClusterAccess(repository.RoleViewer), handleMetaData)
+		clientRoutes.GET("/data/:id", requireClusterAccess(repository.RoleViewer), handleData)
+		clientRoutes.GET("/data/:id/export", requireClusterAccess(repository.RoleViewer), handleDataExport)
+		clientRoutes.GET("/ping/:id", requireClusterAccess(repository.RoleViewer), handlePing)
+		clientRoutes.POST("/execute/:id", requireClusterAccess(repository.RoleApprover), handleExecute)
 	}
 
 }
 
+func databaseConfig(clusterData client.ClusterData, dbName string) core.DatabaseConfig {
+	statementTimeout := time.Duration(clusterData.Cluster.StatementTimeout) * time.Second
+	if statementTimeout == 0 {
+		statementTimeout = config.GetDuration("STATEMENT_TIMEOUT", 0)
+	}
+	return core.DatabaseConfig{
+		Driver:           clusterData.Cluster.Driver,
+		Hostname:         clusterData.Cluster.Host,
+		Port:             clusterData.Cluster.Port,
+		Username:         clusterData.Cluster.Username,
+		Password:         clusterData.Cluster.Password,
+		Database:         dbName,
+		StatementTimeout: statementTimeout,
+		SampleSize:       config.GetInt("MONGO_SAMPLE_SIZE", 0),
+		ReadOnly:         clusterData.Cluster.ReadOnly,
+	}
+}
+
 func handleDatabases(c *gin.Context) {
 
 	ctx, err := GetClientContext(c)
@@ -59,24 +85,14 @@ func handleDatabases(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"messages": "Databases found", "databases": result["databases"]})
 		return
 	}
-	db, err := core.NewDatabase(core.DatabaseConfig{
-		Driver:   clusterData.Cluster.Driver,
-		Hostname: clusterData.Cluster.Host,
-		Port:     clusterData.Cluster.Port,
-		Username: clusterData.Cluster.Username,
-		Password: clusterData.Cluster.Password,
-	})
+	db, release, err := ctx.Connections.Acquire(c.Request.Context(), strconv.Itoa(clusterData.Cluster.ID), databaseConfig(clusterData, ""))
 	if err != nil {
-		errors.InternalServerError(err, c, "Failed connecting due to wrong configuration")
-		return
-	}
-	if err := db.Connect(); err != nil {
 		errors.InternalServerError(err, c, "Failed connecting to the db cluster")
 		return
 	}
-	defer db.Close()
+	defer release()
 
-	databases, err := db.Databases()
+	databases, err := db.Databases(c.Request.Context())
 	if err != nil {
 		errors.InternalServerError(err, c, "Failed to run query")
 		return
@@ -117,25 +133,14 @@ func handleTables(c *gin.Context) {
 		return
 	}
 
-	db, err := core.NewDatabase(core.DatabaseConfig{
-		Driver:   clusterData.Cluster.Driver,
-		Hostname: clusterData.Cluster.Host,
-		Port:     clusterData.Cluster.Port,
-		Username: clusterData.Cluster.Username,
-		Password: clusterData.Cluster.Password,
-		Database: dbName,
-	})
+	db, release, err := ctx.Connections.Acquire(c.Request.Context(), strconv.Itoa(clusterData.Cluster.ID), databaseConfig(clusterData, dbName))
 	if err != nil {
-		errors.InternalServerError(err, c, "Failed connecting due to wrong configuration")
-		return
-	}
-	if err := db.Connect(); err != nil {
 		errors.InternalServerError(err, c, "Failed connecting to the db cluster")
 		return
 	}
-	defer db.Close()
+	defer release()
 
-	tables, err := db.Tables()
+	tables, err := db.Tables(c.Request.Context())
 	if err != nil {
 		errors.InternalServerError(err, c, "Failed to run query")
 		return
@@ -176,32 +181,216 @@ func handleQuery(c *gin.Context) {
 		errors.InternalServerError(err, c, "Failed to get Cluster Data, Please reconnect again!")
 		return
 	}
+	if rejectWrites(c, ctx.Role, clusterData, query) {
+		return
+	}
+	masker, ok := resultMasker(c, c.Param("id"), dbName)
+	if !ok {
+		return
+	}
+	tables, ok := checkQuery(c, masker, clusterData.Cluster.Driver, query)
+	if !ok {
+		return
+	}
+	policies, ok := rowPolicies(c, c.Param("id"), dbName)
+	if !ok {
+		return
+	}
+	query, ok = restrictQuery(c, policies, clusterData.Cluster.Driver, query)
+	if !ok {
+		return
+	}
 
-	db, err := core.NewDatabase(core.DatabaseConfig{
-		Driver:   clusterData.Cluster.Driver,
-		Hostname: clusterData.Cluster.Host,
-		Port:     clusterData.Cluster.Port,
-		Username: clusterData.Cluster.Username,
-		Password: clusterData.Cluster.Password,
-		Database: dbName,
-	})
+	db, release, err := ctx.Connections.Acquire(c.Request.Context(), strconv.Itoa(clusterData.Cluster.ID), databaseConfig(clusterData, dbName))
 	if err != nil {
-		errors.InternalServerError(err, c, "Failed connecting due to wrong configuration")
+		errors.InternalServerError(err, c, "Failed connecting to the db cluster")
 		return
 	}
-	if err := db.Connect(); err != nil {
-		errors.InternalServerError(err, c, "Failed connecting to the db cluster")
+	defer release()
+	result, err := db.Query(c.Request.Context(), query, page, size)
+	if scriptError(c, err) {
 		return
 	}
-	defer db.Close()
-	result, err := db.Query(query, page, size)
 	if err != nil {
 		errors.InternalServerError(err, c, "Failed Execute the query")
 		return
 	}
+	masker.ResultSet(tables, result)
 	c.JSON(http.StatusOK, gin.H{"result": result, "message": "Results fetched"})
 }
 
+// handleScript runs a script of several statements, paging the plain queries
+// among them, and reports the outcome of every statement
+func handleScript(c *gin.Context) {
+	type req struct {
+		Db     string `json:"db"`
+		Script string `json:"script"`
+		Page   int    `json:"page"`
+		Size   int    `json:"size"`
+	}
+	request := req{Size: 10}
+	if err := c.BindJSON(&request); err != nil {
+		errors.BadRequestError(err, c, "failed to parse body")
+		return
+	}
+	if request.Db == "" || request.Script == "" {
+		errors.BadRequestError(nil, c, "mandatory fields db and script are missing in the body")
+		return
+	}
+	if request.Page < 0 || request.Size <= 0 {
+		errors.BadRequestError(nil, c, "page should not be negative and size should be positive")
+		return
+	}
+
+	ctx, err := GetClientContext(c)
+	if err != nil {
+		errors.InternalServerError(err, c, "Failed to get handler context")
+		return
+	}
+	clusterData, err := utils.GetClusterData(ctx.RedisClient, c.Param("id"))
+	if err != nil {
+		errors.InternalServerError(err, c, "Failed to get Cluster Data, Please reconnect again!")
+		return
+	}
+	if rejectWrites(c, ctx.Role, clusterData, request.Script) {
+		return
+	}
+	masker, ok := resultMasker(c, c.Param("id"), request.Db)
+	if !ok {
+		return
+	}
+	tables, ok := checkQuery(c, masker, clusterData.Cluster.Driver, request.Script)
+	if !ok {
+		return
+	}
+	policies, ok := rowPolicies(c, c.Param("id"), request.Db)
+	if !ok {
+		return
+	}
+	request.Script, ok = restrictQuery(c, policies, clusterData.Cluster.Driver, request.Script)
+	if !ok {
+		return
+	}
+
+	db, release, err := ctx.Connections.Acquire(c.Request.Context(), strconv.Itoa(clusterData.Cluster.ID), databaseConfig(clusterData, request.Db))
+	if err != nil {
+		errors.InternalServerError(err, c, "Failed connecting to the db cluster")
+		return
+	}
+	defer release()
+	results, err := db.Script(c.Request.Context(), request.Script, request.Page, request.Size)
+	if scriptError(c, err) {
+		return
+	}
+	if err != nil {
+		errors.InternalServerError(err, c, "Failed Execute the script")
+		return
+	}
+	for _, result := range results {
+		masker.ResultSet(tables, result.Result)
+	}
+	c.JSON(http.StatusOK, gin.H{"results": results, "message": "Script executed"})
+}
+
+// handleExplain returns the plan of a query, running it when analyze is set
+func handleExplain(c *gin.Context) {
+	dbName := c.Query("db")
+	if dbName == "" {
+		errors.BadRequestError(nil, c, "mandatory query parameter db is missing in the url")
+		return
+	}
+	query := c.Query("query")
+	if query == "" {
+		errors.BadRequestError(nil, c, "mandatory query parameter query is missing in the url")
+		return
+	}
+	analyze := false
+	if value := c.Query("analyze"); value != "" {
+		var err error
+		if analyze, err = strconv.ParseBool(value); err != nil {
+			errors.BadRequestError(err, c, "analyze query param should be true or false")
+			return
+		}
+	}
+
+	ctx, err := GetClientContext(c)
+	if err != nil {
+		errors.InternalServerError(err, c, "Failed to get handler context")
+		return
+	}
+	clusterData, err := utils.GetClusterData(ctx.RedisClient, c.Param("id"))
+	if err != nil {
+		errors.InternalServerError(err, c, "Failed to get Cluster Data, Please reconnect again!")
+		return
+	}
+	// plans report the rows matched by conditions on masked columns
+	masker, ok := resultMasker(c, c.Param("id"), dbName)
+	if !ok {
+		return
+	}
+	if _, ok := checkQuery(c, masker, clusterData.Cluster.Driver, query); !ok {
+		return
+	}
+	policies, ok := rowPolicies(c, c.Param("id"), dbName)
+	if !ok {
+		return
+	}
+	query, ok = restrictQuery(c, policies, clusterData.Cluster.Driver, query)
+	if !ok {
+		return
+	}
+
+	db, release, err := ctx.Connections.Acquire(c.Request.Context(), strconv.Itoa(clusterData.Cluster.ID), databaseConfig(clusterData, dbName))
+	if err != nil {
+		errors.InternalServerError(err, c, "Failed connecting to the db cluster")
+		return
+	}
+	defer release()
+	plan, err := db.Explain(c.Request.Context(), query, analyze)
+	if scriptError(c, err) {
+		return
+	}
+	if stderrors.Is(err, core.ErrAnalyzeWrite) {
+		errors.BadRequestError(err, c, "Analyzing runs the query, use a plain explain for statements that change data")
+		return
+	}
+	if err != nil {
+		errors.InternalServerError(err, c, "Failed to explain the query")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"plan": plan, "message": "Plan fetched"})
+}
+
+// scriptError answers the errors caused by the script itself, reporting
+// whether err was one of them
+func scriptError(c *gin.Context, err error) bool {
+	var syntaxErr *sqlparse.SyntaxError
+	var readOnlyErr *core.ReadOnlyError
+	switch {
+	case stderrors.As(err, &syntaxErr):
+		c.JSON(http.StatusBadRequest, gin.H{"error": syntaxErr.Message, "line": syntaxErr.Line, "column": syntaxErr.Column, "message": "Failed to parse the script"})
+	case stderrors.As(err, &readOnlyErr):
+		errors.ForbiddenError(err, c, "Changes have to go through a commit")
+	default:
+		return false
+	}
+	return true
+}
+
+// rejectWrites answers the request when it sends a statement that may change
+// data to a read only cluster, or to any cluster for a user ranked below
+// approver, as changes otherwise only go through the commit workflow
+func rejectWrites(c *gin.Context, role string, clusterData client.ClusterData, script string) bool {
+	if !clusterData.Cluster.ReadOnly && repository.RoleRank(role) >= repository.RoleRank(repository.RoleApprover) {
+		return false
+	}
+	err := core.CheckReadOnly(clusterData.Cluster.Driver, script)
+	if err != nil && !scriptError(c, err) {
+		errors.BadRequestError(err, c, "Failed to parse the query")
+	}
+	return err != nil
+}
+
 func handleMetaData(c *gin.Context) {
 
 	dbName := c.Query("db")
@@ -238,25 +427,14 @@ func handleMetaData(c *gin.Context) {
 		return
 	}
 
-	db, err := core.NewDatabase(core.DatabaseConfig{
-		Driver:   clusterData.Cluster.Driver,
-		Hostname: clusterData.Cluster.Host,
-		Port:     clusterData.Cluster.Port,
-		Username: clusterData.Cluster.Username,
-		Password: clusterData.Cluster.Password,
-		Database: dbName,
-	})
+	db, release, err := ctx.Connections.Acquire(c.Request.Context(), strconv.Itoa(clusterData.Cluster.ID), databaseConfig(clusterData, dbName))
 	if err != nil {
-		errors.InternalServerError(err, c, "Failed connecting due to wrong configuration")
-		return
-	}
-	if err := db.Connect(); err != nil {
 		errors.InternalServerError(err, c, "Failed connecting to the db cluster")
 		return
 	}
-	defer db.Close()
+	defer release()
 
-	schemaDetails, err := db.Metadata(table)
+	schemaDetails, err := db.Metadata(c.Request.Context(), table)
 	if err != nil {
 		errors.InternalServerError(err, c, "Failed to run query")
 		return
@@ -273,11 +451,30 @@ func handleData(c *gin.Context) {
 	dbName := c.Query("db")
 	if dbName == "" {
 		errors.BadRequestError(nil, c, "mandatory query parameter db is missing in the url")
+		return
 	}
 
 	table := c.Query("table")
 	if table == "" {
 		errors.BadRequestError(nil, c, "mandatory query parameter table is missing in the url")
+		return
+	}
+
+	filter, err := filters.Parse(c.Query("filter"), c.Query("operator"))
+	if err != nil {
+		errors.BadRequestError(err, c, "invalid filter parameter")
+		return
+	}
+
+	pagination := c.DefaultQuery("pagination", core.PaginationOffset)
+	if pagination != core.PaginationOffset && pagination != core.PaginationCursor {
+		errors.BadRequestError(nil, c, "pagination query param should be offset or cursor")
+		return
+	}
+	count := c.DefaultQuery("count", core.CountExact)
+	if count != core.CountExact && count != core.CountEstimate && count != core.CountNone {
+		errors.BadRequestError(nil, c, "count query param should be exact, estimate or none")
+		return
 	}
 
 	ctx, err := GetClientContext(c)
@@ -292,56 +489,82 @@ func handleData(c *gin.Context) {
 		return
 	}
 
-	key := ctx.RedisClient.GenerateDataKey(c.Request.URL.RawQuery)
+	masker, ok := resultMasker(c, c.Param("id"), dbName)
+	if !ok {
+		return
+	}
+	policies, ok := rowPolicies(c, c.Param("id"), dbName)
+	if !ok {
+		return
+	}
+	key := ctx.RedisClient.GenerateDataKey(c.Param("id"), ctx.Role, c.Request.URL.RawQuery)
 	res, err := ctx.RedisClient.GetMap(key)
 	if err != nil {
 		log.Printf("Cache hit miss for data")
 	} else {
-		c.JSON(http.StatusOK, gin.H{"messages": "Data found for table", "data": res["data"], "count": res["count"]})
+		c.JSON(http.StatusOK, dataResponse(res))
 		return
 	}
 
-	db, err := core.NewDatabase(core.DatabaseConfig{
-		Driver:   clusterData.Cluster.Driver,
-		Hostname: clusterData.Cluster.Host,
-		Port:     clusterData.Cluster.Port,
-		Username: clusterData.Cluster.Username,
-		Password: clusterData.Cluster.Password,
-		Database: dbName,
-	})
+	db, release, err := ctx.Connections.Acquire(c.Request.Context(), strconv.Itoa(clusterData.Cluster.ID), databaseConfig(clusterData, dbName))
 	if err != nil {
-		errors.InternalServerError(err, c, "Failed connecting due to wrong configuration")
-		return
-	}
-	if err := db.Connect(); err != nil {
 		errors.InternalServerError(err, c, "Failed connecting to the db cluster")
 		return
 	}
-	defer db.Close()
+	defer release()
 
 	pageStr := c.DefaultQuery("page", "0")
 	sizeStr := c.DefaultQuery("size", "50")
 	sortBy := c.Query("sort")
 	orderParam := c.DefaultQuery("order", "asc")
-	filterParam := c.Query("filter")
-	filterOperator := c.Query("operator")
-
-	dbMap, err := db.Data(table, core.Filter{
-		Page:     pageStr,
-		Size:     sizeStr,
-		Sort:     sortBy,
-		Order:    orderParam,
-		Filter:   filterParam,
-		Operator: filterOperator,
-	})
+
+	dataFilter := core.Filter{
+		Page:       pageStr,
+		Size:       sizeStr,
+		Sort:       sortBy,
+		Order:      orderParam,
+		Filter:     filter,
+		Policy:     policies.For(table),
+		Pagination: pagination,
+		Cursor:     c.Query("cursor"),
+		Count:      count,
+	}
+	if !prepareFilter(c, db, table, &dataFilter) {
+		return
+	}
+	if !checkDataFilter(c, masker, table, dataFilter) {
+		return
+	}
+
+	dbMap, err := db.Data(c.Request.Context(), table, dataFilter)
+	if stderrors.Is(err, core.ErrInvalidCursor) {
+		errors.BadRequestError(err, c, "invalid cursor query param")
+		return
+	}
+	if stderrors.Is(err, core.ErrNullableCursorKey) {
+		errors.BadRequestError(err, c, "sort column holds NULL values, which cursor pagination cannot page past")
+		return
+	}
 	if err != nil {
 		errors.InternalServerError(err, c, "Failed to run query")
 		return
 	}
+	maskData(masker, table, dbMap)
 	if err := ctx.RedisClient.SetMap(key, dbMap, time.Duration(time.Hour)); err != nil {
 		fmt.Println("failed to save table data into cache")
 	}
-	c.JSON(http.StatusOK, gin.H{"messages": "Data found for table", "data": dbMap["data"], "count": dbMap["count"]})
+	c.JSON(http.StatusOK, dataResponse(dbMap))
+}
+
+// dataResponse renders a page of table data, with the next and prev cursor
+// tokens when it was read with cursor pagination
+func dataResponse(dbMap map[string]interface{}) gin.H {
+	response := gin.H{"messages": "Data found for table", "data": dbMap["data"], "count": dbMap["count"]}
+	if next, ok := dbMap["next"]; ok {
+		response["next"] = next
+		response["prev"] = dbMap["prev"]
+	}
+	return response
 }
 
 func handlePing(c *gin.Context) {
@@ -352,15 +575,7 @@ func handlePing(c *gin.Context) {
 		return
 	}
 
-	token := c.Request.Header.Get("Authorization")
-	found := repository.CheckAccount(ctx.DBClient, token)
 	clusterId := c.Param("id")
-	if found {
-		if err != nil {
-			errors.UnAuthorizedError(err, c, "you are unauthorized to access this resource")
-			return
-		}
-	}
 	data, err := client.GetClusterAPI(clusterId)
 	if err != nil {
 		errors.InternalServerError(err, c, "Failed to get Cluster Data")
@@ -372,31 +587,18 @@ func handlePing(c *gin.Context) {
 	go func() {
 		defer wg.Done()
 
-		byteData, err := json.Marshal(data)
-		if err != nil {
-			return
-		}
-		redisClient := ctx.RedisClient
-		if err := redisClient.SetString(redisClient.GenerateClusterKey(strconv.Itoa(data.Cluster.ID)), string(byteData), time.Duration(24*time.Hour)); err != nil {
+		if err := utils.SetClusterData(ctx.RedisClient, data, time.Duration(24*time.Hour)); err != nil {
 			fmt.Println("failed to save cluster data into cache")
 		}
 	}()
-	db, err := core.NewDatabase(core.DatabaseConfig{
-		Driver:   data.Cluster.Driver,
-		Hostname: data.Cluster.Host,
-		Port:     data.Cluster.Port,
-		Username: data.Cluster.Username,
-		Password: data.Cluster.Password,
-	})
+	// credentials may have changed, drop pooled connections opened with the old ones
+	ctx.Connections.Invalidate(strconv.Itoa(data.Cluster.ID))
+	_, release, err := ctx.Connections.Acquire(c.Request.Context(), strconv.Itoa(data.Cluster.ID), databaseConfig(data, ""))
 	if err != nil {
-		errors.InternalServerError(err, c, "Failed connecting due to wrong configuration")
-		return
-	}
-	if err := db.Connect(); err != nil {
 		errors.InternalServerError(err, c, "Failed connecting to the db cluster")
 		return
 	}
-	defer db.Close()
+	defer release()
 	wg.Wait()
 	c.JSON(http.StatusOK, gin.H{"status": "success", "message": "Database server connected"})
 }
@@ -405,6 +607,9 @@ func handleExecute(c *gin.Context) {
 	type req struct {
 		Commits     []string `json:"commits"`
 		ExecuteType string   `json:"type"`
+		// DryRun runs the queries and rolls them back, reporting what each
+		// of them did instead of applying the commits
+		DryRun bool `json:"dryRun"`
 	}
 	var request req
 	if err := c.BindJSON(&request); err != nil {
@@ -412,9 +617,9 @@ func handleExecute(c *gin.Context) {
 		return
 	}
 
-	dbName := c.Query("db")
-	if dbName == "" {
-		errors.BadRequestError(nil, c, "mandatory query parameter db is missing in the url")
+	if request.ExecuteType != "default" && request.ExecuteType != "revert" {
+		errors.BadRequestError(fmt.Errorf("unknown type %q", request.ExecuteType), c, "type should be default or revert")
+		return
 	}
 
 	ctx, err := GetClientContext(c)
@@ -434,16 +639,19 @@ func handleExecute(c *gin.Context) {
 		return
 	}
 
-	db, err := core.NewDatabase(core.DatabaseConfig{
-		Driver:   clusterData.Cluster.Driver,
-		Hostname: clusterData.Cluster.Host,
-		Port:     clusterData.Cluster.Port,
-		Username: clusterData.Cluster.Username,
-		Password: clusterData.Cluster.Password,
-		Database: dbName,
-	})
-	if err != nil {
-		errors.InternalServerError(err, c, "Failed connecting due to wrong configuration")
+	for _, commit := range commits {
+		if commit.ClusterId != c.Param("id") {
+			errors.ForbiddenError(fmt.Errorf("commit %d belongs to cluster %s", commit.ID, commit.ClusterId), c, "commits can only be executed on their own cluster")
+			return
+		}
+	}
+	// the review approved the commits for their database, they run on no other
+	dbName, ok := commitsDatabase(c, commits, c.Query("db"))
+	if !ok {
+		return
+	}
+
+	if !request.DryRun && rejectUnapproved(c, commits, request.ExecuteType) {
 		return
 	}
 
@@ -458,35 +666,299 @@ func handleExecute(c *gin.Context) {
 		return
 	}
 
-	commitMap := make(map[int][]string, 0)
+	commitMap := make(map[int][]repository.Query, 0)
+	// commits saved without revert queries get theirs written when they
+	// are applied
+	needsRevert := make(map[int]bool)
+	if request.ExecuteType == "default" {
+		for _, id := range commitIds {
+			needsRevert[id] = true
+		}
+	}
 
 	sort.Ints(commitIds)
+	if request.ExecuteType == "revert" {
+		// undo the latest commit first
+		sort.Sort(sort.Reverse(sort.IntSlice(commitIds)))
+	}
 	for _, query := range queryRecords {
 		if query.Type == request.ExecuteType {
-			commitMap[query.CommitId] = append(commitMap[query.CommitId], query.Query)
+			commitMap[query.CommitId] = append(commitMap[query.CommitId], query)
+		}
+		if query.Type == "revert" {
+			delete(needsRevert, query.CommitId)
 		}
 	}
 	queries := make([]string, 0)
+	queryRecords = make([]repository.Query, 0)
 	for _, val := range commitIds {
-		queries = append(queries, commitMap[val]...)
+		for _, query := range commitMap[val] {
+			queries = append(queries, query.Query)
+			queryRecords = append(queryRecords, query)
+		}
 	}
-	if err := db.Connect(); err != nil {
+	db, release, err := ctx.Connections.Acquire(c.Request.Context(), strconv.Itoa(clusterData.Cluster.ID), databaseConfig(clusterData, dbName))
+	if err != nil {
 		errors.InternalServerError(err, c, "Failed connecting to the db cluster")
 		return
 	}
+	defer release()
+
+	if request.DryRun {
+		results, err := db.DryRun(c.Request.Context(), queries)
+		if stderrors.Is(err, core.ErrNoTransactions) {
+			errors.BadRequestError(err, c, "Dry runs need a cluster with transactions")
+			return
+		}
+		var implicitCommit *core.ImplicitCommitError
+		if stderrors.As(err, &implicitCommit) {
+			errors.BadRequestError(err, c, "Dry runs cannot include statements that commit implicitly")
+			return
+		}
+		if err != nil {
+			errors.InternalServerError(err, c, "dry run failed")
+			return
+		}
+		type dryRunResult struct {
+			CommitId int `json:"commitId"`
+			core.StatementResult
+		}
+		report := make([]dryRunResult, len(results))
+		for i, result := range results {
+			report[i] = dryRunResult{CommitId: queryRecords[i].CommitId, StatementResult: result}
+		}
+		c.JSON(http.StatusOK, gin.H{"results": report, "message": "Dry run finished, nothing was applied"})
+		return
+	}
 
-	if err := db.Execute(queries); err != nil {
-		errors.InternalServerError(err, c, "executing queries failed")
+	from := executableStatus(request.ExecuteType)
+	if err := claimCommits(commits, from); err != nil {
+		if stderrors.Is(err, errCommitClaimed) {
+			errors.ConflictError(err, c, "the commits changed state while being executed")
+			return
+		}
+		errors.InternalServerError(err, c, "failed to claim the commits")
 		return
 	}
+
+	startedAt := time.Now()
+	results, err := db.Execute(c.Request.Context(), queries, len(needsRevert) > 0)
+	run := executionRun(c.Param("id"), dbName, request.ExecuteType, queryRecords, results, err)
+	run.StartedAt = startedAt
+	run.FinishedAt = time.Now()
+	// the outcome of the run matters more than its record, a failed save
+	// only gets logged
+	if run, err = runRepository.SaveRun(run); err != nil {
+		log.Printf("saving the run of commits %v failed: %v", commitIds, err)
+	}
+	if run.Status == repository.RunFailed {
+		releaseCommits(commits, from)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": run.Error, "message": "executing queries failed", "run": run})
+		return
+	}
+
+	queryIds := make([]int, len(queryRecords))
+	for i, query := range queryRecords {
+		queryIds[i] = query.ID
+	}
+	// the queries ran, so failing to record it only gets logged and reported
+	// for an admin to fix the records by hand
+	var warnings []string
+	if err := queryRepository.MarkExecuted(queryIds, run.FinishedAt); err != nil {
+		log.Printf("marking the queries of commits %v executed failed: %v", commitIds, err)
+		warnings = append(warnings, "the queries ran but could not be marked executed")
+	}
+	reverted := saveReverts(queryRecords, results, needsRevert)
 	var result bool
 	if request.ExecuteType == "default" {
 		result = true
 	} else {
 		result = false
 	}
-	commitRepository.UpdateCommits(commits, result)
+	if err := commitRepository.UpdateCommits(commits, result); err != nil {
+		log.Printf("updating the status of commits %v failed: %v", commitIds, err)
+		warnings = append(warnings, "the queries ran but the commits could not be updated, they are left executing")
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "success", "message": "Executed commits", "run": run, "revertsWritten": reverted, "warnings": warnings})
+
+}
+
+// saveReverts stores the reverts Execute wrote as the revert queries of the
+// commits that had none, undoing the last query first. Commits with a query
+// that could not be undone get none, a partial revert being worse than none.
+// It returns the commits whose reverts were saved.
+func saveReverts(queries []repository.Query, results []core.StatementResult, needsRevert map[int]bool) []int {
+	byCommit := make(map[int][]int)
+	var commitIds []int
+	for i, query := range queries {
+		if !needsRevert[query.CommitId] {
+			continue
+		}
+		if _, ok := byCommit[query.CommitId]; !ok {
+			commitIds = append(commitIds, query.CommitId)
+		}
+		if i >= len(results) || results[i].Revert == nil {
+			needsRevert[query.CommitId] = false
+		}
+		byCommit[query.CommitId] = append(byCommit[query.CommitId], i)
+	}
+
+	saved := make([]int, 0)
+	for _, commitId := range commitIds {
+		if !needsRevert[commitId] {
+			log.Printf("no revert written for commit %d, some of its queries cannot be undone", commitId)
+			continue
+		}
+		err := repo.Transaction(func(tx *gorm.DB) error {
+			indexes := byCommit[commitId]
+			for j := len(indexes) - 1; j >= 0; j-- {
+				query, revert := queries[indexes[j]], results[indexes[j]].Revert
+				if len(revert) == 0 {
+					continue
+				}
+				entities := make([]repository.Query, len(revert))
+				for i, statement := range revert {
+					entities[i] = repository.Query{Query: statement, TableId: query.TableId, Tables: query.Tables, CommitId: commitId, Type: "revert"}
+				}
+				if _, err := queryRepository.SaveQueriesWithTx(tx, entities); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("saving the revert of commit %d failed: %v", commitId, err)
+			continue
+		}
+		saved = append(saved, commitId)
+	}
+	return saved
+}
+
+// prepareFilter checks the table and the columns of a data filter against
+// the catalog of db, answering the request when they are not valid
+func prepareFilter(c *gin.Context, db core.Database, table string, filter *core.Filter) bool {
+	err := core.PrepareFilter(c.Request.Context(), db, table, filter)
+	if err == nil {
+		return true
+	}
+	var unknown *core.UnknownIdentifierError
+	if stderrors.As(err, &unknown) || stderrors.Is(err, core.ErrNoCursorKey) || stderrors.Is(err, core.ErrNullableCursorKey) {
+		errors.BadRequestError(err, c, "invalid table, sort or filter column")
+		return false
+	}
+	errors.InternalServerError(err, c, "Failed to fetch table metadata")
+	return false
+}
+
+// rejectUnapproved refuses to apply commits that were not approved, or to
+// revert commits that were not executed. Dry runs are left to reviewers.
+func rejectUnapproved(c *gin.Context, commits []repository.Commit, executeType string) bool {
+	want := executableStatus(executeType)
+	var refused []int
+	for _, commit := range commits {
+		if commit.Status != want {
+			refused = append(refused, commit.ID)
+		}
+	}
+	if len(refused) == 0 {
+		return false
+	}
+	errors.ForbiddenError(fmt.Errorf("commits %v are not %s", refused, want), c, "only approved commits can be executed and executed ones reverted")
+	return true
+}
+
+// commitsDatabase returns the database the commits were saved for, which is
+// the one they were reviewed for. Commits of different databases and a
+// requested database other than theirs are refused.
+func commitsDatabase(c *gin.Context, commits []repository.Commit, requested string) (string, bool) {
+	database := requested
+	for i, commit := range commits {
+		if commit.DatabaseId == "" {
+			errors.BadRequestError(fmt.Errorf("commit %d has no database", commit.ID), c, "commits need a database to be executed")
+			return "", false
+		}
+		if i > 0 && commit.DatabaseId != database {
+			errors.BadRequestError(fmt.Errorf("commit %d targets database %s, not %s", commit.ID, commit.DatabaseId, database), c, "commits executed together should target the same database")
+			return "", false
+		}
+		database = commit.DatabaseId
+	}
+	if requested != "" && requested != database {
+		errors.ForbiddenError(fmt.Errorf("the commits target database %s, not %s", database, requested), c, "commits can only be executed on their own database")
+		return "", false
+	}
+	if database == "" {
+		errors.BadRequestError(nil, c, "mandatory query parameter db is missing in the url")
+		return "", false
+	}
+	return database, true
+}
 
-	c.JSON(http.StatusOK, gin.H{"status": "success", "message": "Executed commits"})
+// executableStatus is the status commits need to be executed as executeType
+func executableStatus(executeType string) string {
+	if executeType == "revert" {
+		return repository.CommitExecuted
+	}
+	return repository.CommitApproved
+}
 
+var errCommitClaimed = stderrors.New("the commit is no longer in the state it was executed from")
+
+// claimCommits moves commits from status from to executing, so that
+// concurrent requests cannot run them a second time. When one of them was
+// claimed first the others are released and errCommitClaimed returned.
+func claimCommits(commits []repository.Commit, from string) error {
+	for i, commit := range commits {
+		claimed, err := commitRepository.SetStatus(commit.ID, repository.CommitExecuting, from)
+		if err == nil && !claimed {
+			err = fmt.Errorf("commit %d: %w", commit.ID, errCommitClaimed)
+		}
+		if err != nil {
+			releaseCommits(commits[:i], from)
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseCommits moves claimed commits back to status from after a failed run
+func releaseCommits(commits []repository.Commit, from string) {
+	for _, commit := range commits {
+		if _, err := commitRepository.SetStatus(commit.ID, from, repository.CommitExecuting); err != nil {
+			log.Printf("releasing commit %d failed: %v", commit.ID, err)
+		}
+	}
+}
+
+// executionRun builds the record of a run from the results Execute reported
+// for queries. Execute may fail before running anything, leaving every query
+// without a result.
+func executionRun(clusterId, database, executeType string, queries []repository.Query, results []core.StatementResult, err error) repository.Run {
+	run := repository.Run{ClusterId: clusterId, Database: database, Type: executeType, Status: repository.RunSucceeded}
+	if err != nil {
+		run.Status = repository.RunFailed
+		run.Error = err.Error()
+	}
+	run.Statements = make([]repository.RunStatement, len(queries))
+	for i, query := range queries {
+		statement := repository.RunStatement{CommitId: query.CommitId, QueryId: query.ID, Position: i, Statement: query.Query, Status: repository.StatementSkipped}
+		if i < len(results) {
+			result := results[i]
+			statement.RowsAffected = result.RowsAffected
+			statement.DurationMs = result.DurationMs
+			statement.Error = result.Error
+			switch {
+			case result.Error != "":
+				statement.Status = repository.StatementFailed
+			case result.RolledBack:
+				statement.Status = repository.StatementRolledBack
+			case !result.Skipped:
+				statement.Status = repository.StatementSucceeded
+			}
+		}
+		run.Statements[i] = statement
+	}
+	return run
 }
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"butler-server/client"
+	"butler-server/internals"
+	"butler-server/internals/core"
+	"butler-server/internals/filters"
+	"butler-server/repository"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// catalog is a database whose only known tables and columns are the ones
+// given, every other method panics
+type catalog struct {
+	core.Database
+	tables   []string
+	metadata map[string]internals.SchemaDetails
+}
+
+func (c catalog) Tables(ctx context.Context) ([]string, error) {
+	return c.tables, nil
+}
+
+func (c catalog) Metadata(ctx context.Context, table string) (map[string]internals.SchemaDetails, error) {
+	return c.metadata, nil
+}
+
+func TestPrepareFilter(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := catalog{
+		tables: []string{"users"},
+		metadata: map[string]internals.SchemaDetails{
+			"id":    {Position: "1", IsNullable: "NO", IsPrimary: true},
+			"email": {Position: "2", IsNullable: "YES"},
+		},
+	}
+	tests := []struct {
+		name   string
+		table  string
+		filter core.Filter
+		status int
+	}{
+		{"valid", "users", core.Filter{Sort: "email", Filter: &filters.Node{Column: "id", Operator: "=", Value: int64(1)}}, http.StatusOK},
+		{"table injection", `users"; DROP TABLE users; --`, core.Filter{}, http.StatusBadRequest},
+		{"table backticks", "`users`", core.Filter{}, http.StatusBadRequest},
+		{"table brackets", "[users]", core.Filter{}, http.StatusBadRequest},
+		{"qualified table", "public.users", core.Filter{}, http.StatusBadRequest},
+		{"sort injection", "users", core.Filter{Sort: "id; DROP TABLE users"}, http.StatusBadRequest},
+		{"qualified sort", "users", core.Filter{Sort: "users.id"}, http.StatusBadRequest},
+		{"filter injection", "users", core.Filter{Filter: &filters.Node{Column: "[id]) OR (1=1", Operator: "=", Value: "x"}}, http.StatusBadRequest},
+		{"nullable cursor key", "users", core.Filter{Sort: "email", Pagination: core.PaginationCursor}, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+			filter := test.filter
+			ok := prepareFilter(c, db, test.table, &filter)
+			if ok != (test.status == http.StatusOK) {
+				t.Errorf("prepareFilter(%q) = %v, want %v", test.table, ok, test.status == http.StatusOK)
+			}
+			if recorder.Code != test.status {
+				t.Errorf("prepareFilter(%q) answered %d, want %d", test.table, recorder.Code, test.status)
+			}
+		})
+	}
+}
+
+func TestCommitsDatabase(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	commit := func(id int, database string) repository.Commit {
+		return repository.Commit{ID: id, DatabaseId: database}
+	}
+	tests := []struct {
+		name      string
+		commits   []repository.Commit
+		requested string
+		database  string
+		status    int
+	}{
+		{"own database", []repository.Commit{commit(1, "shop"), commit(2, "shop")}, "", "shop", http.StatusOK},
+		{"requested own database", []repository.Commit{commit(1, "shop")}, "shop", "shop", http.StatusOK},
+		{"requested other database", []repository.Commit{commit(1, "shop")}, "billing", "", http.StatusForbidden},
+		{"mixed databases", []repository.Commit{commit(1, "shop"), commit(2, "billing")}, "", "", http.StatusBadRequest},
+		{"mixed databases requested", []repository.Commit{commit(1, "shop"), commit(2, "billing")}, "billing", "", http.StatusBadRequest},
+		{"no database", []repository.Commit{commit(1, "")}, "shop", "", http.StatusBadRequest},
+		{"no commits", nil, "", "", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			c.Request = httptest.NewRequest(http.MethodPost, "/", nil)
+			database, ok := commitsDatabase(c, test.commits, test.requested)
+			if ok != (test.status == http.StatusOK) || database != test.database {
+				t.Errorf("commitsDatabase = %q, %v, want %q", database, ok, test.database)
+			}
+			if recorder.Code != test.status {
+				t.Errorf("commitsDatabase answered %d, want %d", recorder.Code, test.status)
+			}
+		})
+	}
+}
+
+func TestRejectWrites(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name     string
+		role     string
+		readOnly bool
+		script   string
+		rejected bool
+	}{
+		{"analyst reads", repository.RoleAnalyst, false, "SELECT * FROM users", false},
+		{"analyst updates", repository.RoleAnalyst, false, "UPDATE users SET name = 'x'", true},
+		{"editor drops", repository.RoleEditor, false, "DROP TABLE users", true},
+		{"editor writes in a cte", repository.RoleEditor, false, "WITH d AS (DELETE FROM users RETURNING *) SELECT * FROM d", true},
+		{"approver updates", repository.RoleApprover, false, "UPDATE users SET name = 'x'", false},
+		{"admin deletes", repository.RoleAdmin, false, "DELETE FROM users", false},
+		{"approver on a read only cluster", repository.RoleApprover, true, "DELETE FROM users", true},
+		{"admin reads a read only cluster", repository.RoleAdmin, true, "SELECT 1", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			c.Request = httptest.NewRequest(http.MethodPost, "/", nil)
+			var clusterData client.ClusterData
+			clusterData.Cluster.Driver = "postgres"
+			clusterData.Cluster.ReadOnly = test.readOnly
+			if rejected := rejectWrites(c, test.role, clusterData, test.script); rejected != test.rejected {
+				t.Errorf("rejectWrites(%q) as %s = %v, want %v", test.script, test.role, rejected, test.rejected)
+			}
+			if test.rejected && recorder.Code != http.StatusForbidden {
+				t.Errorf("rejectWrites(%q) answered %d, want %d", test.script, recorder.Code, http.StatusForbidden)
+			}
+		})
+	}
+}
@@ -3,10 +3,13 @@ package handlers
 import (
 	"butler-server/internals/errors"
 	"butler-server/internals/models"
+	"butler-server/internals/sqlparse"
 	"butler-server/internals/utils"
 	"butler-server/repository"
+	stderrors "errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -15,6 +18,8 @@ import (
 var repo repository.Repository
 var commitRepository repository.CommitRepository
 var queryRepository repository.QueryRepository
+var runRepository repository.RunRepository
+var reviewRepository repository.ReviewRepository
 
 func InitCommitHandlers(router *gin.Engine, rep repository.Repository) {
 
@@ -22,10 +27,18 @@ func InitCommitHandlers(router *gin.Engine, rep repository.Repository) {
 	{
 		commitRoutes.POST("", handleSaveCommits)
 		commitRoutes.GET("", handleGetCommits)
+		commitRoutes.GET("/:id/runs", requireCommitAccess(repository.RoleViewer), handleGetRuns)
+		commitRoutes.POST("/:id/submit", requireCommitAccess(repository.RoleEditor), handleSubmitCommit)
+		commitRoutes.POST("/:id/reviews", requireCommitAccess(repository.RoleViewer), handleReviewCommit)
+		commitRoutes.GET("/:id/reviews", requireCommitAccess(repository.RoleViewer), handleGetReviews)
+		commitRoutes.GET("/policy", handleGetReviewPolicy)
+		commitRoutes.PUT("/policy", handleSaveReviewPolicy)
 	}
 	repo = rep
 	queryRepository = repository.NewQueryRepository(rep)
 	commitRepository = repository.NewCommitRepository(rep)
+	runRepository = repository.NewRunRepository(rep)
+	reviewRepository = repository.NewReviewRepository(rep)
 
 }
 
@@ -35,6 +48,30 @@ func handleSaveCommits(c *gin.Context) {
 		errors.InternalServerError(err, c, "failed to parse body")
 		return
 	}
+	if !authorizeCluster(c, commitReq.ClusterId, repository.RoleEditor) {
+		return
+	}
+	ctx, err := GetClientContext(c)
+	if err != nil {
+		errors.InternalServerError(err, c, "Failed to get handler context")
+		return
+	}
+	clusterData, err := utils.GetClusterData(ctx.RedisClient, commitReq.ClusterId)
+	if err != nil {
+		errors.InternalServerError(err, c, "Failed to get Cluster Data, Please reconnect again!")
+		return
+	}
+	queries, err := utils.ProcessQueries(clusterData.Cluster.Driver, commitReq.Queries)
+	if err != nil {
+		queryError(c, err, "queries", "failed to parse sql queries")
+		return
+	}
+	revertQueries, err := utils.ProcessQueries(clusterData.Cluster.Driver, commitReq.RevertQueries)
+	if err != nil {
+		queryError(c, err, "revertQueries", "failed to parse revert sql queries")
+		return
+	}
+
 	tx := repo.Begin()
 	defer func() {
 		if r := recover(); r != nil {
@@ -44,37 +81,34 @@ func handleSaveCommits(c *gin.Context) {
 		}
 	}()
 
-	commit := repository.Commit{Title: commitReq.Title, DatabaseId: commitReq.DatabaseId, ClusterId: commitReq.ClusterId, CreatedAT: time.Now()}
+	commit := repository.Commit{Title: commitReq.Title, DatabaseId: commitReq.DatabaseId, ClusterId: commitReq.ClusterId, CreatedAT: time.Now(), Status: repository.CommitDraft, AuthorId: ctx.User.ID}
 
-	commit, err := commitRepository.SaveCommitWithTx(tx, commit)
+	commit, err = commitRepository.SaveCommitWithTx(tx, commit)
 	if err != nil {
 		tx.Rollback()
 		errors.InternalServerError(err, c, "failed to save commit")
 		return
 	}
 
-	processAndSaveQueries := func(queries []string, queryType string) error {
-		groupedQueries, err := utils.ProcessQueries(queries)
-		if err != nil {
-			return err
+	saveQueries := func(queries []utils.ProcessedQuery, queryType string) error {
+		if len(queries) == 0 {
+			return nil
 		}
-		for k, v := range groupedQueries {
-			_, err := queryRepository.SaveQueriesWithTx(tx, v, k, commit.ID, queryType)
-			if err != nil {
-				return err
-			}
-
+		entities := make([]repository.Query, len(queries))
+		for i, query := range queries {
+			entities[i] = repository.Query{Query: query.Query, TableId: query.Table, Tables: query.Tables, CommitId: commit.ID, Type: queryType}
 		}
-		return nil
+		_, err := queryRepository.SaveQueriesWithTx(tx, entities)
+		return err
 	}
 
-	if err := processAndSaveQueries(commitReq.Queries, "default"); err != nil {
+	if err := saveQueries(queries, "default"); err != nil {
 		tx.Rollback()
 		errors.InternalServerError(err, c, "failed to save sql queries")
 		return
 	}
 
-	if err := processAndSaveQueries(commitReq.RevertQueries, "revert"); err != nil {
+	if err := saveQueries(revertQueries, "revert"); err != nil {
 		tx.Rollback()
 		errors.InternalServerError(err, c, "failed to save revert sql queries")
 		return
@@ -84,14 +118,36 @@ func handleSaveCommits(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "commit saved successfully"})
 }
 
+// queryError answers with the position in the list field of the query that
+// failed to parse and, for syntax errors, the position of the error in it
+func queryError(c *gin.Context, err error, field string, message string) {
+	var queryErr *utils.QueryError
+	if !stderrors.As(err, &queryErr) {
+		errors.BadRequestError(err, c, message)
+		return
+	}
+	response := gin.H{"error": queryErr.Err.Error(), "message": message, "field": field, "index": queryErr.Index}
+	var syntaxErr *sqlparse.SyntaxError
+	if stderrors.As(err, &syntaxErr) {
+		response["error"] = syntaxErr.Message
+		response["line"] = syntaxErr.Line
+		response["column"] = syntaxErr.Column
+	}
+	c.JSON(http.StatusBadRequest, response)
+}
+
 func handleGetCommits(c *gin.Context) {
 	databaseId := c.Query("databaseId")
 	clusterId := c.Query("clusterId")
 	commitType := c.Query("type")
+	status := c.Query("status")
 	page := c.Query("page")
 	size := c.Query("size")
+	if !authorizeCluster(c, clusterId, repository.RoleViewer) {
+		return
+	}
 
-	commits, total, err := commitRepository.GetCommits(databaseId, clusterId, commitType, page, size)
+	commits, total, err := commitRepository.GetCommits(databaseId, clusterId, commitType, status, page, size)
 	if err != nil {
 		errors.InternalServerError(err, c, "failed to fetch commits")
 		return
@@ -116,3 +172,17 @@ func handleGetCommits(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{"message": "commits found", "commits": commits, "queries": commitMap, "total": total})
 }
+
+func handleGetRuns(c *gin.Context) {
+	commitId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		errors.BadRequestError(err, c, "commit id should be a number")
+		return
+	}
+	runs, err := runRepository.GetRunsByCommit(commitId)
+	if err != nil {
+		errors.InternalServerError(err, c, "failed to fetch runs of the commit")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "runs found", "runs": runs})
+}
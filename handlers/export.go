@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"butler-server/internals/core"
+	"butler-server/internals/errors"
+	"butler-server/internals/export"
+	"butler-server/internals/filters"
+	"butler-server/internals/utils"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// flushWriter sends every write to the client right away, so that exports
+// go out in chunks as they are encoded instead of piling up in buffers
+type flushWriter struct {
+	writer gin.ResponseWriter
+}
+
+func (w flushWriter) Write(data []byte) (int, error) {
+	n, err := w.writer.Write(data)
+	w.writer.Flush()
+	return n, err
+}
+
+// attachmentWriter announces the attachment once the columns of the export
+// are known, so that failures before that are not saved as files
+type attachmentWriter struct {
+	export.Writer
+	begin func()
+}
+
+func (w *attachmentWriter) Begin(columns []export.Column) error {
+	w.begin()
+	return w.Writer.Begin(columns)
+}
+
+// streamExport writes the rows produced by run as an attachment in the
+// requested format
+func streamExport(c *gin.Context, name string, run func(w export.Writer) error) {
+	format, ok := export.FormatByName(c.DefaultQuery("format", "csv"))
+	if !ok {
+		errors.BadRequestError(nil, c, "format query param should be csv, ndjson, parquet or xlsx")
+		return
+	}
+
+	w := &attachmentWriter{Writer: format.NewWriter(flushWriter{writer: c.Writer}), begin: func() {
+		c.Header("Content-Type", format.ContentType)
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, name, format.Extension))
+		c.Header("X-Content-Type-Options", "nosniff")
+		c.Status(http.StatusOK)
+	}}
+	if err := run(w); err != nil {
+		if !c.Writer.Written() {
+			// errors before the first row are answered as JSON, not as a
+			// file to save
+			c.Writer.Header().Del("Content-Disposition")
+			c.Writer.Header().Del("Content-Type")
+			errors.InternalServerError(err, c, "Failed to export the results")
+			return
+		}
+		// the status is gone already, cut the response short so that the
+		// client sees a failed transfer rather than a truncated file
+		log.Printf("export of %s failed: %v", name, err)
+		c.Abort()
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func handleQueryExport(c *gin.Context) {
+	dbName := c.Query("db")
+	if dbName == "" {
+		errors.BadRequestError(nil, c, "mandatory query parameter db is missing in the url")
+		return
+	}
+	query := c.Query("query")
+	if query == "" {
+		errors.BadRequestError(nil, c, "mandatory query parameter query is missing in the url")
+		return
+	}
+
+	ctx, err := GetClientContext(c)
+	if err != nil {
+		errors.InternalServerError(err, c, "Failed to get handler context")
+		return
+	}
+	clusterData, err := utils.GetClusterData(ctx.RedisClient, c.Param("id"))
+	if err != nil {
+		errors.InternalServerError(err, c, "Failed to get Cluster Data, Please reconnect again!")
+		return
+	}
+	if rejectWrites(c, ctx.Role, clusterData, query) {
+		return
+	}
+	masker, ok := resultMasker(c, c.Param("id"), dbName)
+	if !ok {
+		return
+	}
+	tables, ok := checkQuery(c, masker, clusterData.Cluster.Driver, query)
+	if !ok {
+		return
+	}
+	policies, ok := rowPolicies(c, c.Param("id"), dbName)
+	if !ok {
+		return
+	}
+	query, ok = restrictQuery(c, policies, clusterData.Cluster.Driver, query)
+	if !ok {
+		return
+	}
+
+	db, release, err := ctx.Connections.Acquire(c.Request.Context(), strconv.Itoa(clusterData.Cluster.ID), databaseConfig(clusterData, dbName))
+	if err != nil {
+		errors.InternalServerError(err, c, "Failed connecting to the db cluster")
+		return
+	}
+	defer release()
+
+	streamExport(c, "query", func(w export.Writer) error {
+		return db.ExportQuery(c.Request.Context(), query, masker.Writer(tables, w))
+	})
+}
+
+func handleDataExport(c *gin.Context) {
+	dbName := c.Query("db")
+	if dbName == "" {
+		errors.BadRequestError(nil, c, "mandatory query parameter db is missing in the url")
+		return
+	}
+	table := c.Query("table")
+	if table == "" {
+		errors.BadRequestError(nil, c, "mandatory query parameter table is missing in the url")
+		return
+	}
+	filter, err := filters.Parse(c.Query("filter"), c.Query("operator"))
+	if err != nil {
+		errors.BadRequestError(err, c, "invalid filter parameter")
+		return
+	}
+
+	ctx, err := GetClientContext(c)
+	if err != nil {
+		errors.InternalServerError(err, c, "Failed to get handler context")
+		return
+	}
+	clusterData, err := utils.GetClusterData(ctx.RedisClient, c.Param("id"))
+	if err != nil {
+		errors.InternalServerError(err, c, "Failed to get Cluster Data, Please reconnect again!")
+		return
+	}
+
+	db, release, err := ctx.Connections.Acquire(c.Request.Context(), strconv.Itoa(clusterData.Cluster.ID), databaseConfig(clusterData, dbName))
+	if err != nil {
+		errors.InternalServerError(err, c, "Failed connecting to the db cluster")
+		return
+	}
+	defer release()
+
+	policies, ok := rowPolicies(c, c.Param("id"), dbName)
+	if !ok {
+		return
+	}
+	dataFilter := core.Filter{
+		Sort:   c.Query("sort"),
+		Order:  c.DefaultQuery("order", "asc"),
+		Filter: filter,
+		Policy: policies.For(table),
+	}
+	if !prepareFilter(c, db, table, &dataFilter) {
+		return
+	}
+	masker, ok := resultMasker(c, c.Param("id"), dbName)
+	if !ok {
+		return
+	}
+	if !checkDataFilter(c, masker, table, dataFilter) {
+		return
+	}
+
+	streamExport(c, table, func(w export.Writer) error {
+		return db.Export(c.Request.Context(), table, dataFilter, masker.Writer([]string{table}, w))
+	})
+}
@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"butler-server/config"
+	"butler-server/internals"
+	"butler-server/internals/core"
+	"butler-server/internals/errors"
+	"butler-server/internals/masking"
+	"butler-server/repository"
+	stderrors "errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var maskingRepository repository.MaskingRepository
+
+func InitMaskingHandlers(router *gin.Engine, repo repository.Repository) {
+	maskingRoutes := router.Group("/masking")
+	{
+		maskingRoutes.GET("", handleGetMaskingRules)
+		maskingRoutes.PUT("", handleSaveMaskingRule)
+		maskingRoutes.DELETE("/:id", handleDeleteMaskingRule)
+	}
+	maskingRepository = repository.NewMaskingRepository(repo)
+}
+
+// maskingKey is the secret of the hash and format masks, which keeps masked
+// values from being matched against the hashes of guessed ones
+func maskingKey() []byte {
+	if key := config.GetString("MASKING_KEY"); key != "" {
+		return []byte(key)
+	}
+	return []byte(config.GetString("SECRET"))
+}
+
+// resultMasker returns the masks applying to the results the user reads from
+// a database of the cluster, answering the request when they cannot be read
+func resultMasker(c *gin.Context, clusterId, database string) (*masking.Masker, bool) {
+	ctx, err := GetClientContext(c)
+	if err != nil {
+		errors.InternalServerError(err, c, "Failed to get handler context")
+		return nil, false
+	}
+	rules, err := maskingRepository.GetMaskingRules(clusterId)
+	if err != nil {
+		errors.InternalServerError(err, c, "failed to fetch the masking rules")
+		return nil, false
+	}
+	maskingRules := make([]masking.Rule, len(rules))
+	for i, rule := range rules {
+		maskingRules[i] = rule.Rule()
+	}
+	return masking.New(maskingRules, database, ctx.Role, maskingKey()), true
+}
+
+// maskingError answers the errors of queries that may reveal masked columns,
+// reporting whether err was one of them
+func maskingError(c *gin.Context, err error) bool {
+	var revealErr *masking.RevealError
+	if stderrors.As(err, &revealErr) {
+		errors.ForbiddenError(err, c, "The query may reveal masked columns")
+		return true
+	}
+	return false
+}
+
+func handleGetMaskingRules(c *gin.Context) {
+	clusterId := c.Query("clusterId")
+	if !authorizeCluster(c, clusterId, repository.RoleViewer) {
+		return
+	}
+	rules, err := maskingRepository.GetMaskingRules(clusterId)
+	if err != nil {
+		errors.InternalServerError(err, c, "failed to fetch the masking rules")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "masking rules found", "rules": rules})
+}
+
+// handleSaveMaskingRule creates a masking rule, or replaces the one of the
+// id of the body. Only admins of the cluster may.
+func handleSaveMaskingRule(c *gin.Context) {
+	var rule repository.MaskingRule
+	if err := c.BindJSON(&rule); err != nil {
+		errors.BadRequestError(err, c, "failed to parse body")
+		return
+	}
+	if err := rule.Rule().Validate(); err != nil {
+		errors.BadRequestError(err, c, "invalid masking rule")
+		return
+	}
+	for _, role := range rule.ExemptRoles {
+		if repository.RoleRank(role) < 0 {
+			errors.BadRequestError(fmt.Errorf("unknown role %q", role), c, "exemptRoles should be viewer, analyst, editor, approver or admin")
+			return
+		}
+	}
+	if !authorizeCluster(c, rule.ClusterId, repository.RoleAdmin) {
+		return
+	}
+	if rule.ID != 0 {
+		previous, ok := authorizeMaskingRule(c, rule.ID)
+		if !ok {
+			return
+		}
+		defer dropCachedData(c, previous.ClusterId)
+	}
+	rule, err := maskingRepository.SaveMaskingRule(rule)
+	if err != nil {
+		errors.InternalServerError(err, c, "failed to save the masking rule")
+		return
+	}
+	dropCachedData(c, rule.ClusterId)
+	c.JSON(http.StatusOK, gin.H{"message": "masking rule saved", "rule": rule})
+}
+
+func handleDeleteMaskingRule(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		errors.BadRequestError(err, c, "masking rule id should be a number")
+		return
+	}
+	rule, ok := authorizeMaskingRule(c, id)
+	if !ok {
+		return
+	}
+	if err := maskingRepository.DeleteMaskingRule(id); err != nil {
+		errors.InternalServerError(err, c, "failed to delete the masking rule")
+		return
+	}
+	dropCachedData(c, rule.ClusterId)
+	c.JSON(http.StatusOK, gin.H{"message": "masking rule deleted"})
+}
+
+// authorizeMaskingRule checks that the user is admin of the cluster of an
+// existing rule, so that rules are not moved from clusters of other
+// workspaces
+func authorizeMaskingRule(c *gin.Context, id int) (repository.MaskingRule, bool) {
+	rule, err := maskingRepository.GetMaskingRule(id)
+	if stderrors.Is(err, gorm.ErrRecordNotFound) {
+		errors.NotFoundError(err, c, "masking rule not found")
+		return rule, false
+	}
+	if err != nil {
+		errors.InternalServerError(err, c, "failed to fetch the masking rule")
+		return rule, false
+	}
+	return rule, authorizeCluster(c, rule.ClusterId, repository.RoleAdmin)
+}
+
+// dropCachedData drops the pages of table data cached with the masks in
+// place before a change
+func dropCachedData(c *gin.Context, clusterId string) {
+	ctx, err := GetClientContext(c)
+	if err != nil {
+		log.Printf("failed to drop the cached data of cluster %s: %v", clusterId, err)
+		return
+	}
+	if err := ctx.RedisClient.DeleteDataKeys(clusterId); err != nil {
+		log.Printf("failed to drop the cached data of cluster %s: %v", clusterId, err)
+	}
+}
+
+// checkQuery refuses the ad-hoc queries that may reveal masked columns,
+// returning the tables the query reads for the masks of its results
+func checkQuery(c *gin.Context, masker *masking.Masker, driver, query string) ([]string, bool) {
+	if masker.Empty() {
+		return nil, true
+	}
+	// statements whose tables cannot be told may read masked columns of any
+	err := core.CheckPlainQueries(driver, query)
+	var opaqueErr *core.OpaqueStatementError
+	if stderrors.As(err, &opaqueErr) {
+		errors.ForbiddenError(err, c, "Only plain queries may run on a database with masked columns")
+		return nil, false
+	}
+	if scriptError(c, err) {
+		return nil, false
+	}
+	if err != nil {
+		errors.BadRequestError(err, c, "Failed to parse the query")
+		return nil, false
+	}
+	tables, references, err := core.QueryReferences(driver, query)
+	if scriptError(c, err) {
+		return nil, false
+	}
+	if err != nil {
+		errors.BadRequestError(err, c, "Failed to parse the query")
+		return nil, false
+	}
+	if maskingError(c, masker.Check(tables, references)) {
+		return nil, false
+	}
+	return tables, true
+}
+
+// checkDataFilter refuses filtering, sorting and paging table data by masked
+// columns, which would let their values be inferred or leak them through
+// cursor tokens
+func checkDataFilter(c *gin.Context, masker *masking.Masker, table string, filter core.Filter) bool {
+	columns := append(filter.Filter.Columns(), filter.Keys...)
+	if filter.Sort != "" {
+		columns = append(columns, filter.Sort)
+	}
+	for _, column := range columns {
+		if masker.Masked([]string{table}, column) {
+			errors.ForbiddenError(&masking.RevealError{Column: column}, c, "masked columns cannot be used to filter, sort or page data")
+			return false
+		}
+	}
+	return true
+}
+
+// maskData masks a page of table data, rows of SQL tables or documents of
+// Mongo collections
+func maskData(masker *masking.Masker, table string, dbMap map[string]interface{}) {
+	switch data := dbMap["data"].(type) {
+	case *internals.ResultSet:
+		masker.ResultSet([]string{table}, data)
+	case []map[string]interface{}:
+		masker.Documents(table, data)
+	}
+}
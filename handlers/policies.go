@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"butler-server/internals/core"
+	"butler-server/internals/errors"
+	"butler-server/internals/filters"
+	"butler-server/repository"
+	stderrors "errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var policyRepository repository.PolicyRepository
+
+func InitPolicyHandlers(router *gin.Engine, repo repository.Repository) {
+	policyRoutes := router.Group("/policies")
+	{
+		policyRoutes.GET("", handleGetRowPolicies)
+		policyRoutes.PUT("", handleSaveRowPolicy)
+		policyRoutes.DELETE("/:id", handleDeleteRowPolicy)
+	}
+	policyRepository = repository.NewPolicyRepository(repo)
+}
+
+// rowPolicies returns the policies the user is under in a database of the
+// cluster, answering the request when they cannot be read
+func rowPolicies(c *gin.Context, clusterId, database string) (core.Policies, bool) {
+	ctx, err := GetClientContext(c)
+	if err != nil {
+		errors.InternalServerError(err, c, "Failed to get handler context")
+		return nil, false
+	}
+	rows, err := policyRepository.GetRolePolicies(clusterId, database, ctx.Role)
+	if err != nil {
+		errors.InternalServerError(err, c, "failed to fetch the row policies")
+		return nil, false
+	}
+	policies := make(core.Policies)
+	for _, row := range rows {
+		node, err := row.Node()
+		if err != nil {
+			errors.InternalServerError(err, c, fmt.Sprintf("invalid filter in row policy %d", row.ID))
+			return nil, false
+		}
+		if previous := policies[row.Table]; previous != nil {
+			node = &filters.Node{And: []*filters.Node{previous, node}}
+		}
+		policies[row.Table] = node
+	}
+	return policies, true
+}
+
+// restrictQuery rewrites an ad-hoc query so that it only reads the rows the
+// policies let through, answering the request when it cannot be
+func restrictQuery(c *gin.Context, policies core.Policies, driver, query string) (string, bool) {
+	restricted, err := core.RestrictQuery(driver, query, policies)
+	var restrictedErr *core.RestrictedError
+	if stderrors.As(err, &restrictedErr) {
+		errors.ForbiddenError(err, c, "The query touches a table under a row policy")
+		return "", false
+	}
+	var opaqueErr *core.OpaqueStatementError
+	if stderrors.As(err, &opaqueErr) {
+		errors.ForbiddenError(err, c, "Only plain queries may run under row policies")
+		return "", false
+	}
+	if scriptError(c, err) {
+		return "", false
+	}
+	if err != nil {
+		errors.BadRequestError(err, c, "Failed to apply the row policies to the query")
+		return "", false
+	}
+	return restricted, true
+}
+
+func handleGetRowPolicies(c *gin.Context) {
+	clusterId := c.Query("clusterId")
+	if !authorizeCluster(c, clusterId, repository.RoleViewer) {
+		return
+	}
+	policies, err := policyRepository.GetRowPolicies(clusterId)
+	if err != nil {
+		errors.InternalServerError(err, c, "failed to fetch the row policies")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "row policies found", "policies": policies})
+}
+
+// handleSaveRowPolicy creates a row policy, or replaces the one of the id of
+// the body. Only admins of the cluster may.
+func handleSaveRowPolicy(c *gin.Context) {
+	var policy repository.RowPolicy
+	if err := c.BindJSON(&policy); err != nil {
+		errors.BadRequestError(err, c, "failed to parse body")
+		return
+	}
+	if policy.Table == "" {
+		errors.BadRequestError(nil, c, "table is mandatory")
+		return
+	}
+	if repository.RoleRank(policy.Role) < 0 {
+		errors.BadRequestError(fmt.Errorf("unknown role %q", policy.Role), c, "role should be viewer, analyst, editor, approver or admin")
+		return
+	}
+	node, err := policy.Node()
+	if err != nil {
+		errors.BadRequestError(err, c, "invalid filter")
+		return
+	}
+	if node == nil {
+		errors.BadRequestError(nil, c, "filter is mandatory")
+		return
+	}
+	if !authorizeCluster(c, policy.ClusterId, repository.RoleAdmin) {
+		return
+	}
+	if policy.ID != 0 {
+		previous, ok := authorizeRowPolicy(c, policy.ID)
+		if !ok {
+			return
+		}
+		defer dropCachedData(c, previous.ClusterId)
+	}
+	policy, err = policyRepository.SaveRowPolicy(policy)
+	if err != nil {
+		errors.InternalServerError(err, c, "failed to save the row policy")
+		return
+	}
+	dropCachedData(c, policy.ClusterId)
+	c.JSON(http.StatusOK, gin.H{"message": "row policy saved", "policy": policy})
+}
+
+func handleDeleteRowPolicy(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		errors.BadRequestError(err, c, "row policy id should be a number")
+		return
+	}
+	policy, ok := authorizeRowPolicy(c, id)
+	if !ok {
+		return
+	}
+	if err := policyRepository.DeleteRowPolicy(id); err != nil {
+		errors.InternalServerError(err, c, "failed to delete the row policy")
+		return
+	}
+	dropCachedData(c, policy.ClusterId)
+	c.JSON(http.StatusOK, gin.H{"message": "row policy deleted"})
+}
+
+// authorizeRowPolicy checks that the user is admin of the cluster of an
+// existing policy
+func authorizeRowPolicy(c *gin.Context, id int) (repository.RowPolicy, bool) {
+	policy, err := policyRepository.GetRowPolicy(id)
+	if stderrors.Is(err, gorm.ErrRecordNotFound) {
+		errors.NotFoundError(err, c, "row policy not found")
+		return policy, false
+	}
+	if err != nil {
+		errors.InternalServerError(err, c, "failed to fetch the row policy")
+		return policy, false
+	}
+	return policy, authorizeCluster(c, policy.ClusterId, repository.RoleAdmin)
+}
@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"butler-server/config"
+	"butler-server/internals/errors"
+	"butler-server/repository"
+	stderrors "errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// requiredApprovals is the number of approvals of clusters without a review
+// policy of their own
+func requiredApprovals() int {
+	return config.GetInt("REVIEW_REQUIRED_APPROVALS", 1)
+}
+
+var errNotInReview = stderrors.New("the commit is not pending review")
+
+var errOwnCommit = stderrors.New("authors cannot approve their own commits")
+
+func commitId(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		errors.BadRequestError(err, c, "commit id should be a number")
+		return 0, false
+	}
+	return id, true
+}
+
+// handleSubmitCommit asks for reviews of a draft commit, or of one that was
+// rejected or reverted and changed since
+func handleSubmitCommit(c *gin.Context) {
+	id, ok := commitId(c)
+	if !ok {
+		return
+	}
+	commit, err := commitRepository.GetCommit(id)
+	if stderrors.Is(err, gorm.ErrRecordNotFound) {
+		errors.NotFoundError(err, c, "commit not found")
+		return
+	}
+	if err != nil {
+		errors.InternalServerError(err, c, "failed to fetch the commit")
+		return
+	}
+	ctx, err := GetClientContext(c)
+	if err != nil {
+		errors.InternalServerError(err, c, "Failed to get handler context")
+		return
+	}
+	moved, err := commitRepository.Submit(id, ctx.User.ID, repository.CommitDraft, repository.CommitRejected, repository.CommitReverted)
+	if err != nil {
+		errors.InternalServerError(err, c, "failed to submit the commit")
+		return
+	}
+	if !moved {
+		errors.ConflictError(fmt.Errorf("the commit is %s", commit.Status), c, "only draft, rejected or reverted commits can be submitted for review")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "commit submitted for review"})
+}
+
+// handleReviewCommit records the approval, rejection or comment of the
+// signed in user, only approvers may approve or reject. A rejection rejects
+// the commit, while approvals make it approved once enough reviewers gave
+// theirs. Comments are taken in any state.
+func handleReviewCommit(c *gin.Context) {
+	type req struct {
+		Decision string `json:"decision"`
+		Comment  string `json:"comment"`
+	}
+	id, ok := commitId(c)
+	if !ok {
+		return
+	}
+	var request req
+	if err := c.BindJSON(&request); err != nil {
+		errors.BadRequestError(err, c, "failed to parse body")
+		return
+	}
+	ctx, err := GetClientContext(c)
+	if err != nil {
+		errors.InternalServerError(err, c, "Failed to get handler context")
+		return
+	}
+	if request.Decision != repository.ReviewComment && repository.RoleRank(ctx.Role) < repository.RoleRank(repository.RoleApprover) {
+		errors.ForbiddenError(fmt.Errorf("user %s is %s", ctx.User.ID, ctx.Role), c, "only approvers can approve or reject commits")
+		return
+	}
+	switch request.Decision {
+	case repository.ReviewApprove, repository.ReviewReject:
+	case repository.ReviewComment:
+		if request.Comment == "" {
+			errors.BadRequestError(nil, c, "comment is mandatory for comments")
+			return
+		}
+	default:
+		errors.BadRequestError(nil, c, "decision should be approve, reject or comment")
+		return
+	}
+
+	var review repository.Review
+	var commit repository.Commit
+	err = repo.Transaction(func(tx *gorm.DB) error {
+		txRepo := repository.NewRepository(tx)
+		commits := repository.NewCommitRepository(txRepo)
+		reviews := repository.NewReviewRepository(txRepo)
+
+		// the lock keeps concurrent approvals from each counting short of
+		// the policy
+		var err error
+		if commit, err = commits.LockCommit(id); err != nil {
+			return err
+		}
+		if request.Decision != repository.ReviewComment && commit.Status != repository.CommitPendingReview {
+			return errNotInReview
+		}
+		if request.Decision == repository.ReviewApprove {
+			for _, author := range commitAuthors(commit) {
+				if author == ctx.User.ID {
+					return errOwnCommit
+				}
+			}
+		}
+		review, err = reviews.SaveReview(repository.Review{CommitId: id, Reviewer: ctx.User.ID, Decision: request.Decision, Comment: request.Comment, CreatedAt: time.Now()})
+		if err != nil {
+			return err
+		}
+
+		switch request.Decision {
+		case repository.ReviewReject:
+			commit.Status = repository.CommitRejected
+		case repository.ReviewApprove:
+			policy, err := reviews.GetPolicy(commit.ClusterId, requiredApprovals())
+			if err != nil {
+				return err
+			}
+			approvals, err := reviews.CountApprovals(id, *commit.SubmittedAt, commitAuthors(commit)...)
+			if err != nil {
+				return err
+			}
+			if approvals < int64(policy.RequiredApprovals) {
+				return nil
+			}
+			commit.Status = repository.CommitApproved
+		default:
+			return nil
+		}
+		_, err = commits.SetStatus(id, commit.Status, repository.CommitPendingReview)
+		return err
+	})
+	if stderrors.Is(err, gorm.ErrRecordNotFound) {
+		errors.NotFoundError(err, c, "commit not found")
+		return
+	}
+	if stderrors.Is(err, errNotInReview) {
+		errors.ConflictError(fmt.Errorf("the commit is %s", commit.Status), c, "only commits pending review can be approved or rejected")
+		return
+	}
+	if stderrors.Is(err, errOwnCommit) {
+		errors.ForbiddenError(fmt.Errorf("user %s authored commit %d", ctx.User.ID, id), c, "authors cannot approve their own commits")
+		return
+	}
+	if err != nil {
+		errors.InternalServerError(err, c, "failed to save the review")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "review saved", "review": review, "status": commit.Status})
+}
+
+// commitAuthors returns the users who saved or submitted a commit, commits
+// saved before authors were recorded have none
+func commitAuthors(commit repository.Commit) []string {
+	var authors []string
+	for _, author := range []string{commit.AuthorId, commit.SubmittedBy} {
+		if author != "" {
+			authors = append(authors, author)
+		}
+	}
+	return authors
+}
+
+func handleGetReviews(c *gin.Context) {
+	id, ok := commitId(c)
+	if !ok {
+		return
+	}
+	reviews, err := reviewRepository.GetReviews(id)
+	if err != nil {
+		errors.InternalServerError(err, c, "failed to fetch reviews of the commit")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "reviews found", "reviews": reviews})
+}
+
+func handleGetReviewPolicy(c *gin.Context) {
+	clusterId := c.Query("clusterId")
+	if clusterId == "" {
+		errors.BadRequestError(nil, c, "mandatory query parameter clusterId is missing in the url")
+		return
+	}
+	if !authorizeCluster(c, clusterId, repository.RoleViewer) {
+		return
+	}
+	policy, err := reviewRepository.GetPolicy(clusterId, requiredApprovals())
+	if err != nil {
+		errors.InternalServerError(err, c, "failed to fetch the review policy")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "review policy found", "policy": policy})
+}
+
+func handleSaveReviewPolicy(c *gin.Context) {
+	var policy repository.ReviewPolicy
+	if err := c.BindJSON(&policy); err != nil {
+		errors.BadRequestError(err, c, "failed to parse body")
+		return
+	}
+	if policy.ClusterId == "" {
+		errors.BadRequestError(nil, c, "clusterId is mandatory")
+		return
+	}
+	if !authorizeCluster(c, policy.ClusterId, repository.RoleAdmin) {
+		return
+	}
+	if policy.RequiredApprovals < 1 {
+		errors.BadRequestError(nil, c, "requiredApprovals should be at least 1")
+		return
+	}
+	policy, err := reviewRepository.SavePolicy(policy)
+	if err != nil {
+		errors.InternalServerError(err, c, "failed to save the review policy")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "review policy saved", "policy": policy})
+}
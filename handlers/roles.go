@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"butler-server/internals/errors"
+	"butler-server/repository"
+	stderrors "errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var roleRepository repository.RoleRepository
+
+func InitRoleHandlers(router *gin.Engine, repo repository.Repository) {
+	roleRoutes := router.Group("/roles")
+	{
+		roleRoutes.GET("", handleGetRoles)
+		roleRoutes.PUT("", handleSaveRole)
+		roleRoutes.DELETE("/:id", handleDeleteRole)
+	}
+	roleRepository = repository.NewRoleRepository(repo)
+}
+
+func handleGetRoles(c *gin.Context) {
+	workspaceId, err := strconv.Atoi(c.Query("workspaceId"))
+	if err != nil {
+		errors.BadRequestError(err, c, "query parameter workspaceId should be a number")
+		return
+	}
+	if !authorizeWorkspace(c, workspaceId, "", repository.RoleViewer) {
+		return
+	}
+	roles, err := roleRepository.GetRoles(workspaceId)
+	if err != nil {
+		errors.InternalServerError(err, c, "failed to fetch roles")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "roles found", "roles": roles, "defaultRole": defaultRole()})
+}
+
+// handleSaveRole gives a user a role in a workspace, or on one of its
+// clusters when clusterId is set. Only admins of the workspace may.
+func handleSaveRole(c *gin.Context) {
+	var assignment repository.RoleAssignment
+	if err := c.BindJSON(&assignment); err != nil {
+		errors.BadRequestError(err, c, "failed to parse body")
+		return
+	}
+	if assignment.UserId == "" {
+		errors.BadRequestError(nil, c, "userId is mandatory")
+		return
+	}
+	if repository.RoleRank(assignment.Role) < 0 {
+		errors.BadRequestError(nil, c, "role should be viewer, analyst, editor, approver or admin")
+		return
+	}
+	if !authorizeWorkspace(c, assignment.WorkspaceId, "", repository.RoleAdmin) {
+		return
+	}
+	ctx, err := GetClientContext(c)
+	if err != nil {
+		errors.InternalServerError(err, c, "Failed to get handler context")
+		return
+	}
+	if assignment.ClusterId != "" {
+		clusterData, err := loadCluster(ctx, assignment.ClusterId)
+		if err != nil {
+			errors.InternalServerError(err, c, "Failed to get Cluster Data")
+			return
+		}
+		if clusterData.Cluster.WorkspaceID != assignment.WorkspaceId {
+			errors.BadRequestError(fmt.Errorf("cluster %s is not in workspace %d", assignment.ClusterId, assignment.WorkspaceId), c, "the cluster should belong to the workspace")
+			return
+		}
+	}
+	member, err := repository.IsMember(ctx.DBClient, assignment.WorkspaceId, assignment.UserId)
+	if err != nil {
+		errors.InternalServerError(err, c, "failed to check the workspace of the user")
+		return
+	}
+	if !member {
+		errors.BadRequestError(fmt.Errorf("user %s is not a member of workspace %d", assignment.UserId, assignment.WorkspaceId), c, "roles can only be given to members of the workspace")
+		return
+	}
+	assignment, err = roleRepository.SaveRole(assignment)
+	if err != nil {
+		errors.InternalServerError(err, c, "failed to save the role")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "role saved", "role": assignment})
+}
+
+func handleDeleteRole(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		errors.BadRequestError(err, c, "role id should be a number")
+		return
+	}
+	assignment, err := roleRepository.GetRoleAssignment(id)
+	if stderrors.Is(err, gorm.ErrRecordNotFound) {
+		errors.NotFoundError(err, c, "role not found")
+		return
+	}
+	if err != nil {
+		errors.InternalServerError(err, c, "failed to fetch the role")
+		return
+	}
+	if !authorizeWorkspace(c, assignment.WorkspaceId, "", repository.RoleAdmin) {
+		return
+	}
+	if err := roleRepository.DeleteRole(id); err != nil {
+		errors.InternalServerError(err, c, "failed to delete the role")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "role deleted"})
+}
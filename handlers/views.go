@@ -28,6 +28,9 @@ func handleSaveView(c *gin.Context) {
 		errors.BadRequestError(err, c, "unable to parse request body")
 		return
 	}
+	if !authorizeCluster(c, view.ClusterID, repository.RoleAnalyst) {
+		return
+	}
 	view.CreatedAt = time.Now()
 	err := viewRepository.SaveView(view)
 	if err != nil {
@@ -40,6 +43,9 @@ func handleSaveView(c *gin.Context) {
 func handleGetViews(c *gin.Context) {
 	clusterId := c.Query("clusterId")
 	databaseId := c.Query("databaseId")
+	if !authorizeCluster(c, clusterId, repository.RoleViewer) {
+		return
+	}
 
 	views, err := viewRepository.GetViews(clusterId, databaseId)
 	if err != nil {
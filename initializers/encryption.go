@@ -0,0 +1,39 @@
+package initializers
+
+import (
+	"butler-server/config"
+	"butler-server/internals/encryption"
+	"errors"
+	"strconv"
+)
+
+// InitEncryption loads the key encryption keys of ENCRYPTION_KEYS, written
+// version:base64key and comma separated, sealing new values with the version
+// of ENCRYPTION_KEY_VERSION or else the highest one. The keys are required,
+// they are used for nothing but sealing credentials.
+func InitEncryption() (*encryption.Keyring, error) {
+	keys, err := encryption.ParseKeys(config.GetString("ENCRYPTION_KEYS"))
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("ENCRYPTION_KEYS must be set to seal credentials")
+	}
+	current := -1
+	for version := range keys {
+		if version > current {
+			current = version
+		}
+	}
+	if version := config.GetString("ENCRYPTION_KEY_VERSION"); version != "" {
+		if current, err = strconv.Atoi(version); err != nil {
+			return nil, errors.New("ENCRYPTION_KEY_VERSION should be a number")
+		}
+	}
+	keyring, err := encryption.NewKeyring(keys, current)
+	if err != nil {
+		return nil, err
+	}
+	encryption.SetDefault(keyring)
+	return keyring, nil
+}
@@ -0,0 +1,69 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// killTimeout bounds the statement sent to the server to kill a cancelled query
+const killTimeout = 5 * time.Second
+
+// withTimeout derives a context bounded by the cluster's statement timeout
+func withTimeout(ctx context.Context, config DatabaseConfig) (context.Context, context.CancelFunc) {
+	if config.StatementTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, config.StatementTimeout)
+}
+
+// killOnCancel runs fn on a dedicated connection and, if ctx is cancelled while
+// fn is still running, kills the statement on the server from another pooled
+// connection. idQuery must return the server side id of the connection and
+// killQuery is formatted with that id. This is needed for drivers such as
+// go-sql-driver/mysql that only drop the socket on cancellation and would
+// otherwise leave the query running on the server.
+func killOnCancel(ctx context.Context, db *sql.DB, idQuery, killQuery string, fn func(conn *sql.Conn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var id int64
+	if err := conn.QueryRowContext(ctx, idQuery).Scan(&id); err != nil {
+		return err
+	}
+
+	var mu sync.Mutex
+	running := true
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-finished:
+		case <-ctx.Done():
+			mu.Lock()
+			defer mu.Unlock()
+			if !running {
+				return
+			}
+			killCtx, cancel := context.WithTimeout(context.Background(), killTimeout)
+			defer cancel()
+			if _, err := db.ExecContext(killCtx, fmt.Sprintf(killQuery, id)); err != nil {
+				fmt.Println("failed to kill cancelled query:", err)
+			}
+		}
+	}()
+	defer func() {
+		// hold the lock so the connection is not handed back to the pool
+		// while a kill for it is still in flight
+		mu.Lock()
+		running = false
+		mu.Unlock()
+		close(finished)
+	}()
+
+	return fn(conn)
+}
@@ -2,20 +2,42 @@ package core
 
 import (
 	"butler-server/internals"
+	"butler-server/internals/dialect"
+	"butler-server/internals/export"
+	"butler-server/internals/filters"
+	"context"
 	"fmt"
 	"strconv"
-	"strings"
+	"time"
 )
 
 type Database interface {
-	Connect() error
-	Query(query string, page int, size int) ([]map[string]interface{}, error)
+	Connect(ctx context.Context) error
+	Query(ctx context.Context, query string, page int, size int) (*internals.ResultSet, error)
+	// Script runs the statements of a script one after the other on a
+	// single connection, paging the plain queries, and reports each of them.
+	// Statements after a failing one are skipped.
+	Script(ctx context.Context, script string, page int, size int) ([]StatementResult, error)
+	// Explain returns the plan of a single statement. With analyze set the
+	// statement is run, which is refused for statements that may change data.
+	Explain(ctx context.Context, query string, analyze bool) (*Plan, error)
 	Close() error
-	Execute([]string) error
-	Databases() ([]string, error)
-	Tables() ([]string, error)
-	Metadata(table string) (map[string]internals.SchemaDetails, error)
-	Data(table string, filter Filter) (map[string]interface{}, error)
+	// Execute runs the queries of commits in one transaction and reports
+	// each of them, the error is that of the failing one. With revert set it
+	// also writes the statements undoing every query it applies.
+	Execute(ctx context.Context, queries []string, revert bool) ([]StatementResult, error)
+	// DryRun runs the queries Execute would, reporting each of them, and
+	// rolls everything back
+	DryRun(ctx context.Context, queries []string) ([]StatementResult, error)
+	Databases(ctx context.Context) ([]string, error)
+	Tables(ctx context.Context) ([]string, error)
+	Metadata(ctx context.Context, table string) (map[string]internals.SchemaDetails, error)
+	Data(ctx context.Context, table string, filter Filter) (map[string]interface{}, error)
+	// Export streams every row of table matching the filter into w, ordered
+	// by the sort column and without paging
+	Export(ctx context.Context, table string, filter Filter, w export.Writer) error
+	// ExportQuery streams the full result of an ad-hoc query into w
+	ExportQuery(ctx context.Context, query string, w export.Writer) error
 }
 
 type Result struct {
@@ -31,15 +53,32 @@ type DatabaseConfig struct {
 	Username string
 	Password string
 	Database string
+	// StatementTimeout bounds Query and Data calls, zero means no limit
+	StatementTimeout time.Duration
+	// SampleSize is the number of documents sampled to infer a collection
+	// schema on drivers without a catalog, zero uses the driver default
+	SampleSize int
+	// ReadOnly runs ad-hoc queries, scripts and query exports in transactions
+	// that are rolled back, read only where the server supports it
+	ReadOnly bool
 }
 
 type Filter struct {
-	Page     string
-	Size     string
-	Sort     string
-	Order    string
-	Filter   string
-	Operator string
+	Page   string
+	Size   string
+	Sort   string
+	Order  string
+	Filter *filters.Node
+	// Policy restricts the rows of the table the user may read, it is merged
+	// into every query reading them alongside Filter
+	Policy *filters.Node
+	// Pagination is PaginationOffset (the default) or PaginationCursor, which
+	// reads the page after or before Cursor ordered by Keys
+	Pagination string
+	Cursor     string
+	Keys       []string
+	// Count is CountExact (the default), CountEstimate or CountNone
+	Count string
 }
 
 func NewDatabase(config DatabaseConfig) (Database, error) {
@@ -54,49 +93,64 @@ func NewDatabase(config DatabaseConfig) (Database, error) {
 		return &MariaDatabase{config: config}, nil
 	case "mongodb":
 		return &MongoDBDatabase{config: config}, nil
+	case "sqlite":
+		return &SQLiteDatabase{config: config}, nil
+	case "duckdb":
+		return &DuckDBDatabase{config: config}, nil
 	default:
 		return nil, fmt.Errorf("unsupported database driver: %s", config.Driver)
 	}
 }
 
-func ParseSQLQuery(table string, filter Filter, filterMap map[string]string) (string, error) {
+func ParseSQLQuery(d dialect.Dialect, table string, filter Filter) (string, []interface{}, error) {
 	page, err := strconv.Atoi(filter.Page)
 	if err != nil {
-		return "", nil
+		return "", nil, err
 	}
 	size, err := strconv.Atoi(filter.Size)
 	if err != nil {
-		return "", nil
+		return "", nil, err
 	}
 	if filter.Order != "asc" && filter.Order != "desc" {
-		return "", fmt.Errorf("invalid order parameter")
+		return "", nil, fmt.Errorf("invalid order parameter")
 	}
 	offset := (page) * size
 
-	query := fmt.Sprintf(`SELECT * FROM "%s"`, table)
-	var operator string
-	if filter.Operator == "and" {
-		operator = "AND"
-	} else if filter.Operator == "or" {
-		operator = "OR"
-	}
-
-	if len(filterMap) > 0 {
-		whereClauses := make([]string, 0)
-		for key, value := range filterMap {
-			operator, conditionValue := internals.ParseOperatorAndValue(value)
-			whereClauses = append(whereClauses, internals.ConstructCondition(key, operator, conditionValue, whereClauses))
-		}
-		if operator != "" {
-			query += " WHERE " + strings.Join(whereClauses, " "+operator+" ")
-		} else {
-			query += " WHERE " + whereClauses[0]
-		}
+	query := fmt.Sprintf(`SELECT * FROM %s`, d.QuoteIdentifier(table))
+	where, args, err := whereClause(d, filter.conditions())
+	if err != nil {
+		return "", nil, err
 	}
+	query += where
 	if filter.Sort != "" {
-		query += fmt.Sprintf(" ORDER BY %s %s", filter.Sort, filter.Order)
+		query += fmt.Sprintf(" ORDER BY %s %s", d.QuoteIdentifier(filter.Sort), filter.Order)
 	}
 	query += fmt.Sprintf(" LIMIT %d OFFSET %d;", size, offset)
 
-	return query, nil
+	return query, args, nil
+}
+
+// conditions combines the filter of the user with the row policy of the
+// table, nil when there is neither
+func (filter Filter) conditions() *filters.Node {
+	if filter.Policy == nil {
+		return filter.Filter
+	}
+	if filter.Filter == nil {
+		return filter.Policy
+	}
+	return &filters.Node{And: []*filters.Node{filter.Filter, filter.Policy}}
+}
+
+// whereClause compiles the filter tree into a WHERE clause for the dialect,
+// returning an empty clause when there is nothing to filter on
+func whereClause(d dialect.Dialect, filter *filters.Node) (string, []interface{}, error) {
+	if filter == nil {
+		return "", nil, nil
+	}
+	condition, args, err := filter.SQL(d, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	return " WHERE " + condition, args, nil
 }
@@ -0,0 +1,456 @@
+package core
+
+import (
+	"butler-server/internals"
+	"butler-server/internals/dialect"
+	"butler-server/internals/export"
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	_ "github.com/marcboeker/go-duckdb"
+)
+
+// DuckDBDatabase browses a local DuckDB file. The cluster host holds the path
+// of the file and the database name selects one of the attached catalogs,
+// defaulting to the file itself. Only tables of the main schema are listed.
+type DuckDBDatabase struct {
+	conn   *sql.DB
+	config DatabaseConfig
+}
+
+var (
+	duckDBIndexPattern      = regexp.MustCompile(`(?is)\bON\s+\S+?\s*\((.*)\)\s*;?\s*$`)
+	duckDBForeignKeyPattern = regexp.MustCompile(`(?i)FOREIGN KEY\s*\(([^)]*)\)\s*REFERENCES\s+"?([^"(\s]+)"?\s*\(([^)]*)\)`)
+)
+
+func (this *DuckDBDatabase) Connect(ctx context.Context) error {
+	db, err := sql.Open("duckdb", this.config.Hostname)
+	if err != nil {
+		return err
+	}
+
+	if err = db.PingContext(ctx); err != nil {
+		return err
+	}
+
+	this.conn = db
+	fmt.Println("Connected to DuckDB database")
+	return nil
+}
+
+// catalogCondition restricts a duckdb_* or information_schema query on the
+// given column to the configured catalog
+func (this *DuckDBDatabase) catalogCondition(column string) string {
+	if this.config.Database == "" {
+		return column + " = current_database()"
+	}
+	return fmt.Sprintf("%s = '%s'", column, strings.ReplaceAll(this.config.Database, "'", "''"))
+}
+
+func (this *DuckDBDatabase) qualifiedTable(table string) string {
+	if this.config.Database == "" {
+		return `"main".` + dialect.DuckDB.QuoteIdentifier(table)
+	}
+	return dialect.DuckDB.QuoteIdentifier(this.config.Database) + `."main".` + dialect.DuckDB.QuoteIdentifier(table)
+}
+
+// Databases lists the attached catalogs
+func (this *DuckDBDatabase) Databases(ctx context.Context) ([]string, error) {
+	rows, err := this.conn.QueryContext(ctx, "SELECT database_name FROM duckdb_databases() WHERE NOT internal ORDER BY database_name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var databases []string
+	for rows.Next() {
+		var dbName string
+		err := rows.Scan(&dbName)
+		if err != nil {
+			return nil, err
+		}
+		databases = append(databases, dbName)
+	}
+	return databases, nil
+}
+
+func (this *DuckDBDatabase) Tables(ctx context.Context) ([]string, error) {
+	query := fmt.Sprintf(`
+		SELECT table_name FROM information_schema.tables
+		WHERE table_type = 'BASE TABLE' AND table_schema = 'main' AND %s
+		ORDER BY table_name`, this.catalogCondition("table_catalog"))
+	rows, err := this.conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var tableName string
+		err := rows.Scan(&tableName)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, tableName)
+	}
+
+	return tables, nil
+}
+
+func (this *DuckDBDatabase) Metadata(ctx context.Context, table string) (map[string]internals.SchemaDetails, error) {
+	resultCh := make(chan Result, 3)
+	var wg sync.WaitGroup
+
+	wg.Add(3)
+
+	go func() {
+		defer wg.Done()
+		schemaDetails, err := this.fetchSchemaDetails(ctx, table)
+		if err != nil {
+			resultCh <- Result{Details: nil, Error: err, Type: "schema"}
+			return
+		}
+		resultCh <- Result{Details: schemaDetails, Error: nil, Type: "schema"}
+	}()
+	go func() {
+		defer wg.Done()
+		foreignKeyDetails, err := this.fetchForeignKeyDetails(ctx, table)
+		if err != nil {
+			resultCh <- Result{Details: nil, Error: err, Type: "foreign key"}
+			return
+		}
+		resultCh <- Result{Details: foreignKeyDetails, Error: nil, Type: "foreign key"}
+	}()
+
+	go func() {
+		defer wg.Done()
+		indexDetails, err := this.fetchIndexDetails(ctx, table)
+		if err != nil {
+			resultCh <- Result{Details: nil, Error: err, Type: "index"}
+			return
+		}
+		resultCh <- Result{Details: indexDetails, Error: nil, Type: "index"}
+	}()
+
+	wg.Wait()
+
+	results := make(map[string]interface{})
+
+	for i := 0; i < 3; i++ {
+		result := <-resultCh
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		results[result.Type] = result.Details
+	}
+	schemaDetails := internals.MergeMetaData(results["schema"].(map[string]internals.SchemaDetails), results["index"].([]internals.IndexDetails), results["foreign key"].([]internals.ForeignKeyDetails))
+	return schemaDetails, nil
+}
+
+func (this *DuckDBDatabase) Data(ctx context.Context, table string, filter Filter) (map[string]interface{}, error) {
+	ctx, cancel := withTimeout(ctx, this.config)
+	defer cancel()
+	if filter.Pagination == PaginationCursor {
+		return keysetData(ctx, this.source(table), filter)
+	}
+
+	query, args, err := this.parseSQLQuery(table, filter)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := this.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result, count, err := internals.ParsePage(rows, pageCountColumn)
+	if err != nil {
+		return nil, err
+	}
+	if !filter.exactCount() {
+		if count, err = countRows(ctx, this.source(table), filter); err != nil {
+			return nil, err
+		}
+	}
+
+	dbMap := make(map[string]interface{})
+	dbMap["data"] = result
+	dbMap["count"] = count
+	return dbMap, nil
+}
+
+func (this *DuckDBDatabase) source(table string) sqlSource {
+	return sqlSource{
+		dialect:  dialect.DuckDB,
+		table:    table,
+		from:     this.qualifiedTable(table),
+		fetch:    this.fetch,
+		stream:   this.stream,
+		estimate: this.estimatedCount,
+	}
+}
+
+func (this *DuckDBDatabase) fetch(ctx context.Context, query string, args []interface{}) (*internals.ResultSet, error) {
+	var result *internals.ResultSet
+	err := this.stream(ctx, query, args, func(rows *sql.Rows) error {
+		var err error
+		result, err = internals.ParseRows(rows)
+		return err
+	})
+	return result, err
+}
+
+func (this *DuckDBDatabase) stream(ctx context.Context, query string, args []interface{}, fn func(rows *sql.Rows) error) error {
+	rows, err := this.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	return fn(rows)
+}
+
+func (this *DuckDBDatabase) Export(ctx context.Context, table string, filter Filter, w export.Writer) error {
+	return exportData(ctx, this.source(table), filter, w)
+}
+
+func (this *DuckDBDatabase) ExportQuery(ctx context.Context, query string, w export.Writer) error {
+	return exportAdHoc(ctx, this.conn, this.config, dialect.DuckDB, query, w)
+}
+
+// estimatedCount reads the row count DuckDB keeps for each table
+func (this *DuckDBDatabase) estimatedCount(ctx context.Context, table string) (interface{}, error) {
+	query := fmt.Sprintf(`
+		SELECT estimated_size AS count FROM duckdb_tables()
+		WHERE schema_name = 'main' AND table_name = $1 AND %s`, this.catalogCondition("database_name"))
+	rows, err := this.fetch(ctx, query, []interface{}{table})
+	if err != nil {
+		return nil, err
+	}
+	return firstValue(rows, "count"), nil
+}
+
+func (this *DuckDBDatabase) Query(ctx context.Context, query string, page int, size int) (*internals.ResultSet, error) {
+	return queryAdHoc(ctx, this.conn, this.config, dialect.DuckDB, query, page, size)
+}
+
+func (this *DuckDBDatabase) parseSQLQuery(table string, filter Filter) (string, []interface{}, error) {
+	page, err := strconv.Atoi(filter.Page)
+	if err != nil {
+		return "", nil, err
+	}
+	size, err := strconv.Atoi(filter.Size)
+	if err != nil {
+		return "", nil, err
+	}
+	if filter.Order != "asc" && filter.Order != "desc" {
+		return "", nil, fmt.Errorf("invalid order parameter")
+	}
+	offset := (page) * size
+
+	query := fmt.Sprintf(`SELECT %s FROM %s`, offsetColumns(filter), this.qualifiedTable(table))
+	where, args, err := whereClause(dialect.DuckDB, filter.conditions())
+	if err != nil {
+		return "", nil, err
+	}
+	query += where
+	if filter.Sort != "" {
+		query += fmt.Sprintf(" ORDER BY %s %s", dialect.DuckDB.QuoteIdentifier(filter.Sort), filter.Order)
+	}
+	query += fmt.Sprintf(" LIMIT %d OFFSET %d;", size, offset)
+
+	return query, args, nil
+}
+
+func (this *DuckDBDatabase) Script(ctx context.Context, script string, page int, size int) ([]StatementResult, error) {
+	return runScript(ctx, this.conn, this.config, dialect.DuckDB, script, page, size, nil)
+}
+
+func (this *DuckDBDatabase) DryRun(ctx context.Context, queries []string) ([]StatementResult, error) {
+	return dryRun(ctx, this.conn, this.config, dialect.DuckDB, queries, nil)
+}
+
+// Explain returns the plan DuckDB draws as text, it has no structured format
+// to build a tree from
+func (this *DuckDBDatabase) Explain(ctx context.Context, query string, analyze bool) (*Plan, error) {
+	statement, err := explainable(dialect.DuckDB, query, analyze)
+	if err != nil {
+		return nil, err
+	}
+	explain := "EXPLAIN "
+	if analyze {
+		explain = "EXPLAIN ANALYZE "
+	}
+	raw, err := explainText(ctx, this.conn, explainConfig(this.config, analyze), dialect.DuckDB, explain+statement.Text, 1)
+	if err != nil {
+		return nil, err
+	}
+	return &Plan{Analyzed: analyze, Raw: raw, Format: "text"}, nil
+}
+
+func (this *DuckDBDatabase) Close() error {
+	if this.conn != nil {
+		if err := this.conn.Close(); err != nil {
+			return err
+		}
+		fmt.Println("Closed DuckDB database connection")
+	}
+	return nil
+}
+
+func (this *DuckDBDatabase) Execute(ctx context.Context, queries []string, revert bool) ([]StatementResult, error) {
+	return execute(ctx, this, this.conn, dialect.DuckDB, queries, revert, nil)
+}
+
+func (this *DuckDBDatabase) fetchSchemaDetails(ctx context.Context, table string) (map[string]internals.SchemaDetails, error) {
+	query := fmt.Sprintf(`
+		SELECT column_name, data_type, character_maximum_length, is_nullable, column_default, ordinal_position
+		FROM information_schema.columns
+		WHERE table_schema = 'main' AND table_name = ? AND %s
+		ORDER BY ordinal_position`, this.catalogCondition("table_catalog"))
+	rows, err := this.conn.QueryContext(ctx, query, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schemaDetails := make(map[string]internals.SchemaDetails)
+	for rows.Next() {
+		var columnName, dataType, isNullable string
+		var ordinalPosition int
+		var maxLength sql.NullInt64
+		var columnDefault sql.NullString
+
+		err := rows.Scan(&columnName, &dataType, &maxLength, &isNullable, &columnDefault, &ordinalPosition)
+		if err != nil {
+			return nil, err
+		}
+		schemaDetails[columnName] = internals.SchemaDetails{
+			DataType:      dataType,
+			MaxLength:     maxLength,
+			IsNullable:    isNullable,
+			Position:      strconv.Itoa(ordinalPosition),
+			ColumnDefault: columnDefault,
+		}
+	}
+
+	return schemaDetails, nil
+}
+
+// fetchIndexDetails reports the columns of primary key and unique constraints
+// from duckdb_constraints along with the explicit indexes from duckdb_indexes,
+// whose column list is only available in their CREATE INDEX statement
+func (this *DuckDBDatabase) fetchIndexDetails(ctx context.Context, table string) ([]internals.IndexDetails, error) {
+	query := fmt.Sprintf(`
+		SELECT constraint_type, unnest(constraint_column_names) AS column_name
+		FROM duckdb_constraints()
+		WHERE constraint_type IN ('PRIMARY KEY', 'UNIQUE') AND schema_name = 'main' AND table_name = ? AND %s`, this.catalogCondition("database_name"))
+	rows, err := this.conn.QueryContext(ctx, query, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var indexes []internals.IndexDetails
+	for rows.Next() {
+		var constraintType, columnName string
+		err := rows.Scan(&constraintType, &columnName)
+		if err != nil {
+			return nil, err
+		}
+		indexName := fmt.Sprintf("%s_%s_key", table, columnName)
+		if constraintType == "PRIMARY KEY" {
+			indexName = table + "_pkey"
+		}
+		indexes = append(indexes, internals.IndexDetails{
+			IndexName:      indexName,
+			IndexAlgorithm: "art",
+			IsUnique:       true,
+			ColumnName:     columnName,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query = fmt.Sprintf(`
+		SELECT index_name, is_unique, sql
+		FROM duckdb_indexes()
+		WHERE schema_name = 'main' AND table_name = ? AND %s`, this.catalogCondition("database_name"))
+	indexRows, err := this.conn.QueryContext(ctx, query, table)
+	if err != nil {
+		return nil, err
+	}
+	defer indexRows.Close()
+
+	for indexRows.Next() {
+		var indexName string
+		var isUnique bool
+		var indexDef sql.NullString
+		err := indexRows.Scan(&indexName, &isUnique, &indexDef)
+		if err != nil {
+			return nil, err
+		}
+		matches := duckDBIndexPattern.FindStringSubmatch(indexDef.String)
+		if len(matches) == 0 {
+			continue
+		}
+		for _, column := range strings.Split(matches[1], ",") {
+			indexes = append(indexes, internals.IndexDetails{
+				IndexName:      indexName,
+				IndexDef:       indexDef.String,
+				IndexAlgorithm: "art",
+				IsUnique:       isUnique,
+				ColumnName:     strings.Trim(strings.TrimSpace(column), `"`),
+			})
+		}
+	}
+
+	return indexes, indexRows.Err()
+}
+
+// fetchForeignKeyDetails parses the referenced table and columns out of the
+// constraint text, which is the only place duckdb_constraints exposes them
+func (this *DuckDBDatabase) fetchForeignKeyDetails(ctx context.Context, table string) ([]internals.ForeignKeyDetails, error) {
+	query := fmt.Sprintf(`
+		SELECT constraint_index, constraint_text
+		FROM duckdb_constraints()
+		WHERE constraint_type = 'FOREIGN KEY' AND schema_name = 'main' AND table_name = ? AND %s`, this.catalogCondition("database_name"))
+	rows, err := this.conn.QueryContext(ctx, query, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var foreignKeys []internals.ForeignKeyDetails
+	for rows.Next() {
+		var constraintIndex int
+		var constraintText string
+		err := rows.Scan(&constraintIndex, &constraintText)
+		if err != nil {
+			return nil, err
+		}
+		matches := duckDBForeignKeyPattern.FindStringSubmatch(constraintText)
+		if len(matches) == 0 {
+			continue
+		}
+		columns := strings.Split(matches[1], ",")
+		foreignColumns := strings.Split(matches[3], ",")
+		for i := 0; i < len(columns) && i < len(foreignColumns); i++ {
+			foreignKeys = append(foreignKeys, internals.ForeignKeyDetails{
+				ConstraintName:    fmt.Sprintf("%s_fk_%d", table, constraintIndex),
+				TableName:         table,
+				ColumnName:        strings.Trim(strings.TrimSpace(columns[i]), `"`),
+				ForeignTableName:  matches[2],
+				ForeignColumnName: strings.Trim(strings.TrimSpace(foreignColumns[i]), `"`),
+			})
+		}
+	}
+	return foreignKeys, nil
+}
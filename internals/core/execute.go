@@ -0,0 +1,155 @@
+package core
+
+import (
+	"butler-server/internals/dialect"
+	"butler-server/internals/sqlparse"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrNoTransactions is returned for dry runs on servers that cannot roll
+// back, such as standalone MongoDB servers
+var ErrNoTransactions = errors.New("the server has no transactions to roll back a dry run with")
+
+// ImplicitCommitError is a dry run refused because one of its statements
+// commits the transaction it runs in, as DDL does on MySQL, which would apply
+// the statements before it
+type ImplicitCommitError struct {
+	Statement string
+}
+
+func (e *ImplicitCommitError) Error() string {
+	return fmt.Sprintf("dry runs cannot roll back %q, it commits implicitly", e.Statement)
+}
+
+// execute runs the queries of commits in one transaction, committed when all
+// of them succeed. On failure the queries that ran before the failing one are
+// reported as rolled back and the ones after it as skipped. With revert set
+// the rows the queries change are read from db before they run to write the
+// statements undoing them.
+func execute(ctx context.Context, db Database, s session, d dialect.Dialect, queries []string, revert bool, notices noticeReader) ([]StatementResult, error) {
+	var reverts *reverter
+	if revert {
+		reverts = planReverts(ctx, db, d, queries)
+	}
+	tx, err := s.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	results, err := runQueries(ctx, tx, d, queries, notices, false, reverts)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		for i := range results {
+			results[i].RolledBack = results[i].Error == "" && !results[i].Skipped
+			results[i].Revert = nil
+		}
+		return results, err
+	}
+	return results, nil
+}
+
+// dryRun runs the queries Execute would in a transaction that is always
+// rolled back and reports what each of them did. The queries after a failing
+// one are skipped, as are the ones that would end the transaction and apply
+// everything run before them.
+func dryRun(ctx context.Context, s session, config DatabaseConfig, d dialect.Dialect, queries []string, notices noticeReader) ([]StatementResult, error) {
+	ctx, cancel := withTimeout(ctx, config)
+	defer cancel()
+	tx, err := s.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	results, _ := runQueries(ctx, tx, d, queries, notices, true, nil)
+	return results, nil
+}
+
+// runQueries runs queries one after the other in tx until one fails, whose
+// error it returns. Dry runs leave out the queries ending the transaction.
+// Given reverts, the rows of every query are read before it runs.
+func runQueries(ctx context.Context, tx *sql.Tx, d dialect.Dialect, queries []string, notices noticeReader, dry bool, reverts *reverter) ([]StatementResult, error) {
+	results := make([]StatementResult, len(queries))
+	var failure error
+	for i, query := range queries {
+		results[i] = StatementResult{Statement: query}
+		if failure != nil {
+			results[i].Skipped = true
+			continue
+		}
+		if dry && endsTransaction(d, query) {
+			results[i].Skipped = true
+			results[i].Notices = []Notice{{Level: "warning", Message: "not run, the statement would commit the dry run"}}
+			continue
+		}
+
+		if reverts != nil {
+			if err := reverts.snapshot(ctx, tx, i); err != nil {
+				results[i].Error = fmt.Sprintf("reading the rows to revert: %v", err)
+				failure = err
+				continue
+			}
+		}
+		start := time.Now()
+		res, err := tx.ExecContext(ctx, query)
+		results[i].DurationMs = float64(time.Since(start).Microseconds()) / 1000
+		if notices != nil {
+			results[i].Notices = notices(ctx, tx)
+		}
+		if err != nil {
+			results[i].Error = err.Error()
+			failure = err
+			continue
+		}
+		if affected, err := res.RowsAffected(); err == nil {
+			results[i].RowsAffected = &affected
+		}
+		if reverts != nil {
+			statements, err := reverts.statements(i)
+			if err != nil {
+				results[i].Notices = append(results[i].Notices, Notice{Level: "warning", Message: "no revert written: " + err.Error()})
+				continue
+			}
+			results[i].Revert = statements
+		}
+	}
+	return results, failure
+}
+
+// endsTransaction reports whether any statement of a query ends the
+// transaction it runs in. Queries that cannot be split are left for the
+// server to reject.
+func endsTransaction(d dialect.Dialect, query string) bool {
+	statements, err := sqlparse.Split(d, query)
+	if err != nil {
+		return false
+	}
+	for _, statement := range statements {
+		if statement.EndsTransaction(d) {
+			return true
+		}
+	}
+	return false
+}
+
+// writes reports whether any statement of a query is not a plain query.
+// Queries that cannot be split count as writes.
+func writes(d dialect.Dialect, query string) bool {
+	statements, err := sqlparse.Split(d, query)
+	if err != nil {
+		return true
+	}
+	for _, statement := range statements {
+		if !statement.IsQuery() {
+			return true
+		}
+	}
+	return false
+}
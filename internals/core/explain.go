@@ -0,0 +1,155 @@
+package core
+
+import (
+	"butler-server/internals/dialect"
+	"butler-server/internals/sqlparse"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Plan is the query plan of a statement in a shape common to every driver
+type Plan struct {
+	// Root is nil on drivers that only describe plans as text, such as
+	// DuckDB
+	Root *PlanNode `json:"root"`
+	// Analyzed is set when the statement was run and the nodes carry actual
+	// rows and timings
+	Analyzed    bool     `json:"analyzed"`
+	PlanningMs  *float64 `json:"planningMs,omitempty"`
+	ExecutionMs *float64 `json:"executionMs,omitempty"`
+	// Raw is the plan as the server described it, in Format: json, xml or
+	// text
+	Raw    string `json:"raw"`
+	Format string `json:"format"`
+}
+
+// PlanNode is one operation of a plan. Costs are in the unit of the server
+// and only comparable within a plan. Actual rows and times are totals over
+// all the loops of the node.
+type PlanNode struct {
+	Type          string      `json:"type"`
+	Relation      string      `json:"relation,omitempty"`
+	Index         string      `json:"index,omitempty"`
+	Detail        string      `json:"detail,omitempty"`
+	EstimatedRows *float64    `json:"estimatedRows,omitempty"`
+	ActualRows    *float64    `json:"actualRows,omitempty"`
+	StartupCost   *float64    `json:"startupCost,omitempty"`
+	Cost          *float64    `json:"cost,omitempty"`
+	ActualTimeMs  *float64    `json:"actualTimeMs,omitempty"`
+	Loops         *float64    `json:"loops,omitempty"`
+	Children      []*PlanNode `json:"children"`
+}
+
+func newPlanNode(nodeType string) *PlanNode {
+	return &PlanNode{Type: nodeType, Children: []*PlanNode{}}
+}
+
+// ErrAnalyzeWrite refuses to analyze a statement that may change data, since
+// analyzing runs the statement
+var ErrAnalyzeWrite = errors.New("only statements that read data can be analyzed")
+
+// explainable returns the single statement of query, checking that it may be
+// analyzed when analyze is set
+func explainable(d dialect.Dialect, query string, analyze bool) (sqlparse.Statement, error) {
+	statements, err := sqlparse.Split(d, query)
+	if err != nil {
+		return sqlparse.Statement{}, err
+	}
+	if len(statements) != 1 {
+		return sqlparse.Statement{}, fmt.Errorf("explain takes a single statement, got %d", len(statements))
+	}
+	if analyze && !statements[0].ReadOnly() {
+		return sqlparse.Statement{}, ErrAnalyzeWrite
+	}
+	return statements[0], nil
+}
+
+// explainConfig is the configuration to run an explain with. Analyzed
+// statements always run in a transaction that is rolled back.
+func explainConfig(config DatabaseConfig, analyze bool) DatabaseConfig {
+	config.ReadOnly = config.ReadOnly || analyze
+	return config
+}
+
+// explainText runs an explain statement on s and returns the text of its
+// single row, joining the rows of drivers returning the plan line by line
+func explainText(ctx context.Context, s session, config DatabaseConfig, d dialect.Dialect, query string, column int) (string, error) {
+	ctx, cancel := withTimeout(ctx, config)
+	defer cancel()
+	var text string
+	err := readOnly(ctx, s, config, d, func(q querier) error {
+		rows, err := q.QueryContext(ctx, query)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		result, err := fetchAll(rows)
+		if err != nil {
+			return err
+		}
+		for i, row := range result {
+			if i > 0 {
+				text += "\n"
+			}
+			text += row[column]
+		}
+		return nil
+	})
+	return text, err
+}
+
+// fetchAll scans every row of rows as strings
+func fetchAll(rows *sql.Rows) ([][]string, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var result [][]string
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		row := make([]string, len(columns))
+		for i, value := range values {
+			row[i] = value.String
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// planNumber reads a number given as a JSON number or string
+func planNumber(value interface{}) *float64 {
+	var f float64
+	switch v := value.(type) {
+	case float64:
+		f = v
+	case string:
+		parsed, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil
+		}
+		f = parsed
+	default:
+		return nil
+	}
+	return &f
+}
+
+// perLoop turns a per loop average into a total, keeping it as is when the
+// number of loops is unknown
+func perLoop(average, loops *float64) *float64 {
+	if average == nil || loops == nil {
+		return average
+	}
+	total := *average * *loops
+	return &total
+}
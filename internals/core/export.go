@@ -0,0 +1,41 @@
+package core
+
+import (
+	"butler-server/internals/dialect"
+	"butler-server/internals/export"
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// exportData streams every row of a table matching the filter. Exports are
+// not bound by the statement timeout, they run for as long as the client
+// keeps reading.
+func exportData(ctx context.Context, source sqlSource, filter Filter, w export.Writer) error {
+	if filter.Order != "asc" && filter.Order != "desc" {
+		return fmt.Errorf("invalid order parameter")
+	}
+	where, args, err := whereClause(source.dialect, filter.conditions())
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf("SELECT * FROM %s%s", source.from, where)
+	if filter.Sort != "" {
+		query += fmt.Sprintf(" ORDER BY %s %s", source.dialect.QuoteIdentifier(filter.Sort), filter.Order)
+	}
+	return source.stream(ctx, query, args, func(rows *sql.Rows) error {
+		return export.Rows(rows, w)
+	})
+}
+
+// exportAdHoc streams the rows of an ad-hoc query run on s
+func exportAdHoc(ctx context.Context, s session, config DatabaseConfig, d dialect.Dialect, query string, w export.Writer) error {
+	return readOnly(ctx, s, config, d, func(q querier) error {
+		rows, err := q.QueryContext(ctx, query)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		return export.Rows(rows, w)
+	})
+}
@@ -0,0 +1,113 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeRows are the canned rows a fake server answers a query with, types
+// being the database type names of the columns
+type fakeRows struct {
+	columns []string
+	types   []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+func (r *fakeRows) ColumnTypeDatabaseTypeName(index int) string {
+	if index < len(r.types) {
+		return r.types[index]
+	}
+	return ""
+}
+
+// fakeServer is a database/sql driver answering queries from canned rows,
+// picked by a fragment of the query text, and recording the arguments each
+// query was given and the statements it was sent to execute, each of which
+// affects one row
+type fakeServer struct {
+	mu      sync.Mutex
+	answers map[string]fakeRows
+	args    map[string][]interface{}
+	execs   []string
+}
+
+func (f *fakeServer) Open(name string) (driver.Conn, error) { return fakeConn{f}, nil }
+
+type fakeConn struct{ server *fakeServer }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("fake connections do not prepare statements")
+}
+
+func (c fakeConn) Close() error { return nil }
+
+func (c fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+func (c fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	c.server.execs = append(c.server.execs, query)
+	return driver.RowsAffected(1), nil
+}
+
+func (c fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	for fragment, rows := range c.server.answers {
+		if !strings.Contains(query, fragment) {
+			continue
+		}
+		values := make([]interface{}, len(args))
+		for i, arg := range args {
+			values[i] = arg.Value
+		}
+		c.server.args[fragment] = values
+		return &fakeRows{columns: rows.columns, types: rows.types, values: append([][]driver.Value(nil), rows.values...)}, nil
+	}
+	return nil, errors.New("unexpected query: " + query)
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error { return nil }
+
+func (fakeTx) Rollback() error { return nil }
+
+// fakeServers numbers the drivers registered, which must be named apart
+var fakeServers int32
+
+// openFakeServer opens a database answering queries containing a key of
+// answers with its rows
+func openFakeServer(t *testing.T, answers map[string]fakeRows) (*sql.DB, *fakeServer) {
+	t.Helper()
+	server := &fakeServer{answers: answers, args: map[string][]interface{}{}}
+	name := fmt.Sprintf("fakeserver%d", atomic.AddInt32(&fakeServers, 1))
+	sql.Register(name, server)
+	conn, err := sql.Open(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, server
+}
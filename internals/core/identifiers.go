@@ -0,0 +1,128 @@
+package core
+
+import (
+	"butler-server/internals"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// UnknownIdentifierError reports a table or column that does not exist in the
+// catalog of the database being browsed
+type UnknownIdentifierError struct {
+	Kind string
+	Name string
+}
+
+func (e *UnknownIdentifierError) Error() string {
+	return fmt.Sprintf("unknown %s %q", e.Kind, e.Name)
+}
+
+// PrepareFilter checks the table and every column used by the sort and
+// filter of a Data call against the tables and metadata of db, so that only
+// identifiers that actually exist ever reach a query. Collections have no
+// fixed schema, so for MongoDB only the collection is checked and field names
+// may not start with $ where they would be read as operators.
+//
+// For cursor pagination it also sets the key columns pages are ordered by:
+// the sort column followed by the primary key, or _id for a collection.
+func PrepareFilter(ctx context.Context, db Database, table string, filter *Filter) error {
+	tables, err := db.Tables(ctx)
+	if err != nil {
+		return err
+	}
+	if !contains(tables, table) {
+		return &UnknownIdentifierError{Kind: "table", Name: table}
+	}
+
+	columns := filter.conditions().Columns()
+	if filter.Sort != "" {
+		columns = append(columns, filter.Sort)
+	}
+	cursor := filter.Pagination == PaginationCursor
+
+	if _, ok := db.(*MongoDBDatabase); ok {
+		for _, column := range columns {
+			if column == "" || strings.HasPrefix(column, "$") {
+				return &UnknownIdentifierError{Kind: "field", Name: column}
+			}
+		}
+		if cursor {
+			filter.Keys = keyColumns(filter.Sort, []string{"_id"})
+		}
+		return nil
+	}
+
+	if len(columns) == 0 && !cursor {
+		return nil
+	}
+	metadata, err := db.Metadata(ctx, table)
+	if err != nil {
+		return err
+	}
+	for _, column := range columns {
+		if _, ok := metadata[column]; !ok {
+			return &UnknownIdentifierError{Kind: "column", Name: column}
+		}
+	}
+	if cursor {
+		if filter.Sort != "" && !strings.EqualFold(metadata[filter.Sort].IsNullable, "NO") {
+			return ErrNullableCursorKey
+		}
+		filter.Keys = keyColumns(filter.Sort, primaryKey(metadata))
+		if len(filter.Keys) == 0 {
+			return ErrNoCursorKey
+		}
+	}
+	return nil
+}
+
+// keyColumns puts the sort column ahead of the primary key, which breaks
+// ties between rows sharing a sort value
+func keyColumns(sort string, primaryKey []string) []string {
+	if sort == "" {
+		return primaryKey
+	}
+	keys := []string{sort}
+	for _, column := range primaryKey {
+		if column != sort {
+			keys = append(keys, column)
+		}
+	}
+	return keys
+}
+
+// primaryKey returns the primary key columns in table order
+func primaryKey(metadata map[string]internals.SchemaDetails) []string {
+	return byPosition(metadata, func(details internals.SchemaDetails) bool {
+		return details.IsPrimary
+	})
+}
+
+// byPosition returns the columns accepted by keep in table order, all of
+// them when keep is nil
+func byPosition(metadata map[string]internals.SchemaDetails, keep func(details internals.SchemaDetails) bool) []string {
+	var columns []string
+	for column, details := range metadata {
+		if keep == nil || keep(details) {
+			columns = append(columns, column)
+		}
+	}
+	sort.Slice(columns, func(i, j int) bool {
+		a, _ := strconv.Atoi(metadata[columns[i]].Position)
+		b, _ := strconv.Atoi(metadata[columns[j]].Position)
+		return a < b
+	})
+	return columns
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
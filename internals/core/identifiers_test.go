@@ -0,0 +1,214 @@
+package core
+
+import (
+	"butler-server/internals"
+	"butler-server/internals/dialect"
+	"butler-server/internals/filters"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// catalog is a database whose only known tables and columns are the ones
+// given, every other method panics
+type catalog struct {
+	Database
+	tables   []string
+	metadata map[string]internals.SchemaDetails
+}
+
+func (c catalog) Tables(ctx context.Context) ([]string, error) {
+	return c.tables, nil
+}
+
+func (c catalog) Metadata(ctx context.Context, table string) (map[string]internals.SchemaDetails, error) {
+	return c.metadata, nil
+}
+
+var usersCatalog = catalog{
+	tables: []string{"users"},
+	metadata: map[string]internals.SchemaDetails{
+		"id":    {Position: "1", IsNullable: "NO", IsPrimary: true},
+		"email": {Position: "2", IsNullable: "YES"},
+		"name":  {Position: "3", IsNullable: "NO"},
+	},
+}
+
+func TestPrepareFilterUnknownIdentifiers(t *testing.T) {
+	equals := func(column string) *filters.Node {
+		return &filters.Node{Column: column, Operator: "=", Value: "x"}
+	}
+	tests := []struct {
+		name   string
+		table  string
+		filter Filter
+		kind   string
+		bad    string
+	}{
+		{"table injection", `users"; DROP TABLE users; --`, Filter{}, "table", `users"; DROP TABLE users; --`},
+		{"table backticks", "`users`", Filter{}, "table", "`users`"},
+		{"table brackets", "[users]", Filter{}, "table", "[users]"},
+		{"table qualified", "public.users", Filter{}, "table", "public.users"},
+		{"sort injection", "users", Filter{Sort: `id"; DROP TABLE users; --`}, "column", `id"; DROP TABLE users; --`},
+		{"sort backticks", "users", Filter{Sort: "`id`"}, "column", "`id`"},
+		{"sort brackets", "users", Filter{Sort: "[id]"}, "column", "[id]"},
+		{"sort qualified", "users", Filter{Sort: "users.id"}, "column", "users.id"},
+		{"filter injection", "users", Filter{Filter: equals(`email"; DROP TABLE users; --`)}, "column", `email"; DROP TABLE users; --`},
+		{"filter backticks", "users", Filter{Filter: equals("`email`")}, "column", "`email`"},
+		{"filter brackets", "users", Filter{Filter: equals("[email]")}, "column", "[email]"},
+		{"filter qualified", "users", Filter{Filter: equals("users.email")}, "column", "users.email"},
+		{"nested filter", "users", Filter{Filter: &filters.Node{Or: []*filters.Node{equals("id"), equals(`x") OR 1=1 --`)}}}, "column", `x") OR 1=1 --`},
+		{"cursor sort injection", "users", Filter{Pagination: PaginationCursor, Sort: `id"; DROP TABLE users; --`}, "column", `id"; DROP TABLE users; --`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter := test.filter
+			err := PrepareFilter(context.Background(), usersCatalog, test.table, &filter)
+			var unknown *UnknownIdentifierError
+			if !errors.As(err, &unknown) {
+				t.Fatalf("PrepareFilter(%q) = %v, want an UnknownIdentifierError", test.table, err)
+			}
+			if unknown.Kind != test.kind || unknown.Name != test.bad {
+				t.Errorf("PrepareFilter(%q) refused %s %q, want %s %q", test.table, unknown.Kind, unknown.Name, test.kind, test.bad)
+			}
+		})
+	}
+}
+
+func TestPrepareFilterCursorKeys(t *testing.T) {
+	tests := []struct {
+		sort string
+		keys []string
+		err  error
+	}{
+		{"", []string{"id"}, nil},
+		{"name", []string{"name", "id"}, nil},
+		{"id", []string{"id"}, nil},
+		{"email", nil, ErrNullableCursorKey},
+	}
+	for _, test := range tests {
+		filter := Filter{Pagination: PaginationCursor, Sort: test.sort}
+		err := PrepareFilter(context.Background(), usersCatalog, "users", &filter)
+		if !errors.Is(err, test.err) {
+			t.Errorf("PrepareFilter sorted by %q = %v, want %v", test.sort, err, test.err)
+			continue
+		}
+		if !reflect.DeepEqual(filter.Keys, test.keys) {
+			t.Errorf("PrepareFilter sorted by %q set keys %q, want %q", test.sort, filter.Keys, test.keys)
+		}
+	}
+}
+
+// recordingSource reads a table of dialect d through a fetch that records
+// the queries it is given and returns no rows
+func recordingSource(d dialect.Dialect, table, from string, queries *[]string, args *[][]interface{}) sqlSource {
+	return sqlSource{
+		dialect: d,
+		table:   table,
+		from:    from,
+		fetch: func(ctx context.Context, query string, queryArgs []interface{}) (*internals.ResultSet, error) {
+			*queries = append(*queries, query)
+			*args = append(*args, queryArgs)
+			return &internals.ResultSet{}, nil
+		},
+	}
+}
+
+func TestKeysetDataQuoting(t *testing.T) {
+	table, column := "or`d]e\"rs", "na\"m`e]"
+	weird := catalog{
+		tables: []string{table},
+		metadata: map[string]internals.SchemaDetails{
+			"id":   {Position: "1", IsNullable: "NO", IsPrimary: true},
+			column: {Position: "2", IsNullable: "NO"},
+		},
+	}
+	doubleQuoted := "SELECT * FROM \"or`d]e\"\"rs\" WHERE \"na\"\"m`e]\" = $1 AND ((\"na\"\"m`e]\" > $2) OR (\"na\"\"m`e]\" = $3 AND \"id\" > $4)) ORDER BY \"na\"\"m`e]\" ASC, \"id\" ASC LIMIT 11"
+	tests := []struct {
+		dialect dialect.Dialect
+		from    string
+		want    string
+	}{
+		{dialect.Postgres, dialect.Postgres.QuoteIdentifier(table), doubleQuoted},
+		{dialect.SQLite, dialect.SQLite.QuoteIdentifier(table), doubleQuoted},
+		{dialect.DuckDB, dialect.DuckDB.QuoteIdentifier(table), doubleQuoted},
+		{
+			dialect.MySQL, dialect.MySQL.QuoteIdentifier(table),
+			"SELECT * FROM `or``d]e\"rs` WHERE `na\"m``e]` = ? AND ((`na\"m``e]` > ?) OR (`na\"m``e]` = ? AND `id` > ?)) ORDER BY `na\"m``e]` ASC, `id` ASC LIMIT 11",
+		},
+		{
+			dialect.MSSQL, quoteMsSQLTable(table),
+			"SELECT TOP 11 * FROM [dbo].[or`d]]e\"rs] WHERE [na\"m`e]]] = @p1 AND (([na\"m`e]]] > @p2) OR ([na\"m`e]]] = @p3 AND [id] > @p4)) ORDER BY [na\"m`e]]] ASC, [id] ASC",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.dialect.Name, func(t *testing.T) {
+			filter := Filter{
+				Size:       "10",
+				Sort:       column,
+				Order:      "asc",
+				Filter:     &filters.Node{Column: column, Operator: "=", Value: "x"},
+				Pagination: PaginationCursor,
+				Count:      CountNone,
+			}
+			if err := PrepareFilter(context.Background(), weird, table, &filter); err != nil {
+				t.Fatalf("PrepareFilter failed: %v", err)
+			}
+			cursor, err := encodeCursor(cursorToken{Direction: cursorNext, Table: table, Keys: filter.Keys, Order: "asc", Values: json.RawMessage(`["y", 7]`)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			filter.Cursor = cursor
+
+			var queries []string
+			var args [][]interface{}
+			if _, err := keysetData(context.Background(), recordingSource(test.dialect, table, test.from, &queries, &args), filter); err != nil {
+				t.Fatalf("keysetData failed: %v", err)
+			}
+			if len(queries) != 1 || queries[0] != test.want {
+				t.Errorf("keysetData ran %q, want %q", queries, test.want)
+			}
+			if want := []interface{}{"x", "y", "y", int64(7)}; len(args) != 1 || !reflect.DeepEqual(args[0], want) {
+				t.Errorf("keysetData bound %v, want %v", args, want)
+			}
+		})
+	}
+}
+
+func TestKeysetDataCursorKeys(t *testing.T) {
+	tests := []struct {
+		name  string
+		token cursorToken
+	}{
+		{"injected key", cursorToken{Direction: cursorNext, Table: "users", Keys: []string{`id"; DROP TABLE users; --`}, Order: "asc", Values: json.RawMessage(`[1]`)}},
+		{"bracketed key", cursorToken{Direction: cursorNext, Table: "users", Keys: []string{"[id]"}, Order: "asc", Values: json.RawMessage(`[1]`)}},
+		{"qualified key", cursorToken{Direction: cursorNext, Table: "users", Keys: []string{"users.id"}, Order: "asc", Values: json.RawMessage(`[1]`)}},
+		{"other table", cursorToken{Direction: cursorNext, Table: "`orders`", Keys: []string{"id"}, Order: "asc", Values: json.RawMessage(`[1]`)}},
+		{"other order", cursorToken{Direction: cursorNext, Table: "users", Keys: []string{"id"}, Order: "desc; DROP", Values: json.RawMessage(`[1]`)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter := Filter{Size: "10", Order: "asc", Pagination: PaginationCursor, Count: CountNone}
+			if err := PrepareFilter(context.Background(), usersCatalog, "users", &filter); err != nil {
+				t.Fatalf("PrepareFilter failed: %v", err)
+			}
+			cursor, err := encodeCursor(test.token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			filter.Cursor = cursor
+
+			var queries []string
+			var args [][]interface{}
+			_, err = keysetData(context.Background(), recordingSource(dialect.Postgres, "users", `"users"`, &queries, &args), filter)
+			if !errors.Is(err, ErrInvalidCursor) {
+				t.Errorf("keysetData = %v, want ErrInvalidCursor", err)
+			}
+			if len(queries) > 0 {
+				t.Errorf("keysetData ran %q with a forged cursor", queries)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ConnectionManager keeps connected Database instances alive between requests so
+// that handlers can reuse the underlying driver pools instead of dialing the
+// cluster on every call. Connections are keyed by cluster ID and database name,
+// closed after sitting idle for idleTimeout and capped at maxOpen entries.
+type ConnectionManager struct {
+	mu          sync.Mutex
+	entries     map[string]*connectionEntry
+	maxOpen     int
+	idleTimeout time.Duration
+	done        chan struct{}
+}
+
+type connectionEntry struct {
+	clusterID string
+	config    DatabaseConfig
+	db        Database
+	refs      int
+	lastUsed  time.Time
+	stale     bool
+}
+
+// NewConnectionManager creates a ConnectionManager and starts the idle reaper
+func NewConnectionManager(maxOpen int, idleTimeout time.Duration) *ConnectionManager {
+	m := &ConnectionManager{
+		entries:     make(map[string]*connectionEntry),
+		maxOpen:     maxOpen,
+		idleTimeout: idleTimeout,
+		done:        make(chan struct{}),
+	}
+	go m.reap()
+	return m
+}
+
+func connectionKey(clusterID, database string) string {
+	return fmt.Sprintf("%s~%s", clusterID, database)
+}
+
+// Acquire returns a connected Database for the cluster and database in config,
+// reusing a pooled connection when one with the same configuration exists. The
+// returned release func must be called once the caller is done with it.
+func (m *ConnectionManager) Acquire(ctx context.Context, clusterID string, config DatabaseConfig) (Database, func(), error) {
+	key := connectionKey(clusterID, config.Database)
+
+	m.mu.Lock()
+	if entry, ok := m.entries[key]; ok {
+		if entry.config == config {
+			entry.refs++
+			entry.lastUsed = time.Now()
+			m.mu.Unlock()
+			return entry.db, m.releaseFunc(entry), nil
+		}
+		// credentials changed since the connection was opened
+		m.removeLocked(key, entry)
+	}
+	m.mu.Unlock()
+
+	db, err := NewDatabase(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := db.Connect(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	m.mu.Lock()
+	if entry, ok := m.entries[key]; ok && entry.config == config {
+		// another request connected first, keep theirs
+		entry.refs++
+		entry.lastUsed = time.Now()
+		m.mu.Unlock()
+		db.Close()
+		return entry.db, m.releaseFunc(entry), nil
+	}
+	if m.maxOpen > 0 && len(m.entries) >= m.maxOpen && !m.evictLocked() {
+		m.mu.Unlock()
+		db.Close()
+		return nil, nil, fmt.Errorf("connection limit of %d open clusters reached", m.maxOpen)
+	}
+	entry := &connectionEntry{clusterID: clusterID, config: config, db: db, refs: 1, lastUsed: time.Now()}
+	m.entries[key] = entry
+	m.mu.Unlock()
+
+	return db, m.releaseFunc(entry), nil
+}
+
+// Invalidate drops every pooled connection of a cluster. Connections still in
+// use are closed as soon as their last holder releases them.
+func (m *ConnectionManager) Invalidate(clusterID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, entry := range m.entries {
+		if entry.clusterID == clusterID {
+			m.removeLocked(key, entry)
+		}
+	}
+}
+
+// Close stops the idle reaper and closes every pooled connection
+func (m *ConnectionManager) Close() {
+	close(m.done)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, entry := range m.entries {
+		m.removeLocked(key, entry)
+	}
+}
+
+func (m *ConnectionManager) releaseFunc(entry *connectionEntry) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			entry.refs--
+			entry.lastUsed = time.Now()
+			if entry.stale && entry.refs == 0 {
+				closeDatabase(entry.db)
+			}
+		})
+	}
+}
+
+// removeLocked takes the entry out of the pool and closes it when unused.
+// m.mu must be held.
+func (m *ConnectionManager) removeLocked(key string, entry *connectionEntry) {
+	delete(m.entries, key)
+	entry.stale = true
+	if entry.refs == 0 {
+		closeDatabase(entry.db)
+	}
+}
+
+// evictLocked closes the least recently used idle connection to make room for
+// a new one and reports whether it found one. m.mu must be held.
+func (m *ConnectionManager) evictLocked() bool {
+	var oldestKey string
+	var oldest *connectionEntry
+	for key, entry := range m.entries {
+		if entry.refs > 0 {
+			continue
+		}
+		if oldest == nil || entry.lastUsed.Before(oldest.lastUsed) {
+			oldestKey, oldest = key, entry
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	m.removeLocked(oldestKey, oldest)
+	return true
+}
+
+func (m *ConnectionManager) reap() {
+	if m.idleTimeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(m.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case now := <-ticker.C:
+			m.mu.Lock()
+			for key, entry := range m.entries {
+				if entry.refs == 0 && now.Sub(entry.lastUsed) > m.idleTimeout {
+					m.removeLocked(key, entry)
+				}
+			}
+			m.mu.Unlock()
+		}
+	}
+}
+
+func closeDatabase(db Database) {
+	go func() {
+		if err := db.Close(); err != nil {
+			fmt.Println("failed to close pooled connection:", err)
+		}
+	}()
+}
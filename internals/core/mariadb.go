@@ -2,6 +2,9 @@ package core
 
 import (
 	"butler-server/internals"
+	"butler-server/internals/dialect"
+	"butler-server/internals/export"
+	"context"
 	"database/sql"
 	"fmt"
 	"sync"
@@ -12,7 +15,7 @@ type MariaDatabase struct {
 	config DatabaseConfig
 }
 
-func (this *MariaDatabase) Connect() error {
+func (this *MariaDatabase) Connect(ctx context.Context) error {
 	connectionString := fmt.Sprintf("%s:%s@tcp(%s:%s)",
 		this.config.Username, this.config.Password, this.config.Hostname, this.config.Port)
 	if this.config.Database != "" {
@@ -24,7 +27,7 @@ func (this *MariaDatabase) Connect() error {
 		return err
 	}
 
-	if err = db.Ping(); err != nil {
+	if err = db.PingContext(ctx); err != nil {
 		return err
 	}
 
@@ -33,8 +36,8 @@ func (this *MariaDatabase) Connect() error {
 	return nil
 }
 
-func (this *MariaDatabase) Databases() ([]string, error) {
-	rows, err := this.conn.Query("SHOW DATABASES")
+func (this *MariaDatabase) Databases(ctx context.Context) ([]string, error) {
+	rows, err := this.conn.QueryContext(ctx, "SHOW DATABASES")
 	if err != nil {
 		return nil, err
 	}
@@ -52,9 +55,9 @@ func (this *MariaDatabase) Databases() ([]string, error) {
 
 	return databases, nil
 }
-func (this *MariaDatabase) Tables() ([]string, error) {
-	query := fmt.Sprintf("SHOW TABLES FROM %s", this.config.Database)
-	rows, err := this.conn.Query(query)
+func (this *MariaDatabase) Tables(ctx context.Context) ([]string, error) {
+	query := fmt.Sprintf("SHOW TABLES FROM %s", dialect.MySQL.QuoteIdentifier(this.config.Database))
+	rows, err := this.conn.QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -72,7 +75,7 @@ func (this *MariaDatabase) Tables() ([]string, error) {
 
 	return tables, nil
 }
-func (this *MariaDatabase) Metadata(table string) (map[string]internals.SchemaDetails, error) {
+func (this *MariaDatabase) Metadata(ctx context.Context, table string) (map[string]internals.SchemaDetails, error) {
 	resultCh := make(chan Result, 3)
 	var wg sync.WaitGroup
 
@@ -89,7 +92,7 @@ func (this *MariaDatabase) Metadata(table string) (map[string]internals.SchemaDe
 			ordinal_position
 		FROM information_schema.COLUMNS
 		WHERE table_name = ?;`
-		schemaDetails, err := internals.FetchSchemaDetails(this.conn, query, table)
+		schemaDetails, err := internals.FetchSchemaDetails(ctx, this.conn, query, table)
 		if err != nil {
 			resultCh <- Result{Details: nil, Error: err, Type: "schema"}
 			return
@@ -118,7 +121,7 @@ func (this *MariaDatabase) Metadata(table string) (map[string]internals.SchemaDe
 			ON rc.UNIQUE_CONSTRAINT_NAME = ccu.CONSTRAINT_NAME
 			AND rc.CONSTRAINT_SCHEMA = ccu.CONSTRAINT_SCHEMA
 		WHERE tc.CONSTRAINT_TYPE = 'FOREIGN KEY';`
-		foreignKeyDetails, err := internals.FetchForeignKeyDetails(this.conn, query, table)
+		foreignKeyDetails, err := internals.FetchForeignKeyDetails(ctx, this.conn, query, table)
 		if err != nil {
 			resultCh <- Result{Details: nil, Error: err, Type: "foreign key"}
 			return
@@ -132,7 +135,7 @@ func (this *MariaDatabase) Metadata(table string) (map[string]internals.SchemaDe
 		SELECT index_name AS indexname, index_definition AS indexdef
 		FROM information_schema.STATISTICS
 		WHERE table_name = ?;`
-		indexDetails, err := internals.FetchIndexDetails(this.conn, query, table)
+		indexDetails, err := internals.FetchIndexDetails(ctx, this.conn, query, table)
 		if err != nil {
 			resultCh <- Result{Details: nil, Error: err, Type: "index"}
 			return
@@ -155,21 +158,23 @@ func (this *MariaDatabase) Metadata(table string) (map[string]internals.SchemaDe
 	return schemaDetails, nil
 }
 
-func (this *MariaDatabase) Data(table string, filter Filter) (map[string]interface{}, error) {
+func (this *MariaDatabase) Data(ctx context.Context, table string, filter Filter) (map[string]interface{}, error) {
+	ctx, cancel := withTimeout(ctx, this.config)
+	defer cancel()
+	if filter.Pagination == PaginationCursor {
+		return keysetData(ctx, this.source(table), filter)
+	}
 
-	filterMap := internals.ParseFilterParam(filter.Filter)
-	query, err := ParseSQLQuery(table, filter, filterMap)
+	query, args, err := ParseSQLQuery(dialect.MySQL, table, filter)
 	if err != nil {
 		return nil, err
 	}
-
-	rows, err := this.conn.Query(query, internals.FilterValues(filterMap)...)
+	result, err := this.fetch(ctx, query, args)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	result, count, err := internals.ParseRows(rows)
+	// counted in a query of its own as window functions need MySQL 8
+	count, err := countRows(ctx, this.source(table), filter)
 	if err != nil {
 		return nil, err
 	}
@@ -180,8 +185,51 @@ func (this *MariaDatabase) Data(table string, filter Filter) (map[string]interfa
 	return dbMap, nil
 }
 
-func (this *MariaDatabase) Query(query string, page int, size int) ([]map[string]interface{}, error) {
-	return nil, nil
+func (this *MariaDatabase) source(table string) sqlSource {
+	return sqlSource{
+		dialect:  dialect.MySQL,
+		table:    table,
+		from:     dialect.MySQL.QuoteIdentifier(table),
+		fetch:    this.fetch,
+		stream:   this.stream,
+		estimate: this.estimatedCount,
+	}
+}
+
+func (this *MariaDatabase) fetch(ctx context.Context, query string, args []interface{}) (*internals.ResultSet, error) {
+	return fetchMySQL(ctx, this.conn, query, args)
+}
+
+func (this *MariaDatabase) stream(ctx context.Context, query string, args []interface{}, fn func(rows *sql.Rows) error) error {
+	return streamMySQL(ctx, this.conn, query, args, fn)
+}
+
+func (this *MariaDatabase) Export(ctx context.Context, table string, filter Filter, w export.Writer) error {
+	return exportData(ctx, this.source(table), filter, w)
+}
+
+func (this *MariaDatabase) ExportQuery(ctx context.Context, query string, w export.Writer) error {
+	return exportMySQL(ctx, this.conn, this.config, query, w)
+}
+
+func (this *MariaDatabase) estimatedCount(ctx context.Context, table string) (interface{}, error) {
+	return estimatedMySQLCount(ctx, this.conn, this.config.Database, table)
+}
+
+func (this *MariaDatabase) Query(ctx context.Context, query string, page int, size int) (*internals.ResultSet, error) {
+	return queryMySQL(ctx, this.conn, this.config, query, page, size)
+}
+
+func (this *MariaDatabase) Script(ctx context.Context, script string, page int, size int) ([]StatementResult, error) {
+	return scriptMySQL(ctx, this.conn, this.config, script, page, size)
+}
+
+func (this *MariaDatabase) DryRun(ctx context.Context, queries []string) ([]StatementResult, error) {
+	return dryRunMySQL(ctx, this.conn, this.config, queries)
+}
+
+func (this *MariaDatabase) Explain(ctx context.Context, query string, analyze bool) (*Plan, error) {
+	return explainMySQL(ctx, this.conn, this.config, query, analyze, true)
 }
 
 func (this *MariaDatabase) Close() error {
@@ -194,27 +242,6 @@ func (this *MariaDatabase) Close() error {
 	return nil
 }
 
-func (this *MariaDatabase) Execute(queries []string) error {
-	tx, err := this.conn.Begin()
-	if err != nil {
-		return err
-	}
-
-	defer func() {
-		if err := tx.Rollback(); err != nil {
-			fmt.Println(err)
-		}
-	}()
-
-	for _, query := range queries {
-		_, err := tx.Exec(query)
-		if err != nil {
-			return err
-		}
-	}
-
-	if err := tx.Commit(); err != nil {
-		return err
-	}
-	return nil
+func (this *MariaDatabase) Execute(ctx context.Context, queries []string, revert bool) ([]StatementResult, error) {
+	return execute(ctx, this, this.conn, dialect.MySQL, queries, revert, mysqlWarnings)
 }
@@ -1,14 +1,15 @@
 package core
 
 import (
-	"butler-server/internals"
 	"context"
-	"errors"
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -18,7 +19,7 @@ type MongoDBDatabase struct {
 	conn   *mongo.Client
 }
 
-func (this *MongoDBDatabase) Connect() error {
+func (this *MongoDBDatabase) Connect(ctx context.Context) error {
 
 	connectionString := fmt.Sprintf("mongodb://%s:%s@%s:%s",
 		this.config.Username, this.config.Password, this.config.Hostname, this.config.Port)
@@ -28,12 +29,12 @@ func (this *MongoDBDatabase) Connect() error {
 	}
 
 	clientOptions := options.Client().ApplyURI(connectionString)
-	client, err := mongo.Connect(context.TODO(), clientOptions)
+	client, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
 		return err
 	}
 
-	err = client.Ping(context.TODO(), nil)
+	err = client.Ping(ctx, nil)
 	if err != nil {
 		return err
 	}
@@ -42,31 +43,36 @@ func (this *MongoDBDatabase) Connect() error {
 	fmt.Println("Connected to MongoDB database")
 	return nil
 }
-func (this *MongoDBDatabase) Databases() ([]string, error) {
-	ctx := context.TODO()
-	databases, err := this.conn.ListDatabaseNames(ctx, nil)
+func (this *MongoDBDatabase) Databases(ctx context.Context) ([]string, error) {
+	databases, err := this.conn.ListDatabaseNames(ctx, bson.D{})
 	if err != nil {
 		return nil, err
 	}
 	return databases, nil
 }
-func (this *MongoDBDatabase) Tables() ([]string, error) {
-	ctx := context.TODO()
-	collections, err := this.conn.Database(this.config.Database).ListCollectionNames(ctx, nil)
+func (this *MongoDBDatabase) Tables(ctx context.Context) ([]string, error) {
+	collections, err := this.conn.Database(this.config.Database).ListCollectionNames(ctx, bson.D{})
 	if err != nil {
 		return nil, err
 	}
 	return collections, nil
 }
 
-func (this *MongoDBDatabase) Metadata(table string) (map[string]internals.SchemaDetails, error) {
-	return nil, nil
-}
+func (this *MongoDBDatabase) Data(ctx context.Context, table string, filter Filter) (map[string]interface{}, error) {
+	var err error
+	filterBson := bson.D{}
+	if conditions := filter.conditions(); conditions != nil {
+		filterBson, err = conditions.BSON()
+		if err != nil {
+			return nil, err
+		}
+	}
 
-func (this *MongoDBDatabase) Data(table string, filter Filter) (map[string]interface{}, error) {
-	filterBson, err := parseMongoDBFilters(filter.Filter)
-	if err != nil {
-		return nil, err
+	ctx, cancel := withTimeout(ctx, this.config)
+	defer cancel()
+	collection := this.conn.Database(this.config.Database).Collection(table)
+	if filter.Pagination == PaginationCursor {
+		return this.keysetData(ctx, collection, filter, filterBson)
 	}
 
 	// parse the sort parameter into a BSON sort
@@ -74,124 +80,234 @@ func (this *MongoDBDatabase) Data(table string, filter Filter) (map[string]inter
 
 	// Set up options for pagination
 	skip, limit := parseMongoDBPagination(filter.Page, filter.Size)
-	options := options.Find().SetSkip(skip).SetLimit(limit).SetSort(sortBson)
 
-	// Perform the MongoDB find operation
-	collection := this.conn.Database(this.config.Database).Collection(table)
-	ctx := context.TODO()
-	cursor, err := collection.Find(ctx, filterBson, options)
+	var results []map[string]interface{}
+	var count interface{}
+	err = this.killOnCancel(ctx, func(comment string) error {
+		findOptions := options.Find().SetSkip(skip).SetLimit(limit).SetSort(sortBson).SetComment(comment)
+
+		// Perform the MongoDB find operation
+		cursor, err := collection.Find(ctx, filterBson, findOptions)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+
+		// Decode the results into a slice of maps
+		if err := cursor.All(ctx, &results); err != nil {
+			return err
+		}
+
+		count, err = this.count(ctx, collection, filter, filterBson, comment)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer cursor.Close(ctx)
 
-	// Decode the results into a slice of maps
-	var results []map[string]interface{}
-	err = cursor.All(ctx, &results)
+	// Create the result map
+	dbMap := make(map[string]interface{})
+	dbMap["data"] = results
+	dbMap["count"] = count
+	return dbMap, nil
+}
+
+// keysetData reads one page of a collection with keyset pagination
+func (this *MongoDBDatabase) keysetData(ctx context.Context, collection *mongo.Collection, filter Filter, filterBson bson.D) (map[string]interface{}, error) {
+	k, err := newKeyset(collection.Name(), filter, extJSONKeys)
 	if err != nil {
 		return nil, err
 	}
+	pageBson := filterBson
+	if condition := keysetBSONCondition(k); condition != nil {
+		pageBson = bson.D{{Key: "$and", Value: bson.A{filterBson, condition}}}
+	}
 
-	// Get the total count of documents matching the filter
-	count, err := collection.CountDocuments(ctx, filterBson)
+	var results []map[string]interface{}
+	var count interface{}
+	err = this.killOnCancel(ctx, func(comment string) error {
+		// one document past the page tells whether there is a next one
+		findOptions := options.Find().SetLimit(int64(k.size + 1)).SetSort(keysetBSONSort(k)).SetComment(comment)
+		cursor, err := collection.Find(ctx, pageBson, findOptions)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+		if err := cursor.All(ctx, &results); err != nil {
+			return err
+		}
+
+		count, err = this.count(ctx, collection, filter, filterBson, comment)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	results, next, prev, err := keysetPage(k, results, documentValue)
 	if err != nil {
 		return nil, err
 	}
 
-	// Create the result map
 	dbMap := make(map[string]interface{})
 	dbMap["data"] = results
 	dbMap["count"] = count
+	dbMap["next"] = next
+	dbMap["prev"] = prev
 	return dbMap, nil
 }
 
-func (this *MongoDBDatabase) Query(query string, page int, size int) ([]map[string]interface{}, error) {
-	return nil, nil
+// count returns the count reported with a page, nil when none is wanted
+func (this *MongoDBDatabase) count(ctx context.Context, collection *mongo.Collection, filter Filter, filterBson bson.D, comment string) (interface{}, error) {
+	switch filter.Count {
+	case CountNone:
+		return nil, nil
+	case CountEstimate:
+		// the estimate counts every document, those the policy hides too
+		if filter.Policy == nil {
+			return collection.EstimatedDocumentCount(ctx, options.EstimatedDocumentCount().SetComment(comment))
+		}
+	}
+	return collection.CountDocuments(ctx, filterBson, options.Count().SetComment(comment))
 }
 
-func (this *MongoDBDatabase) Close() error {
-	if this.conn != nil {
-		err := this.conn.Disconnect(context.TODO())
-		if err != nil {
-			return err
+// extJSONKeys keeps key values as canonical extended JSON so that ObjectIDs,
+// dates and the numeric types survive the round trip through a cursor token
+var extJSONKeys = keyCodec{
+	encode: func(values []interface{}) (json.RawMessage, error) {
+		return bson.MarshalExtJSON(bson.D{{Key: "v", Value: values}}, true, false)
+	},
+	decode: func(data json.RawMessage) ([]interface{}, error) {
+		var document struct {
+			V bson.A `bson:"v"`
 		}
-		fmt.Println("Closed MongoDB database connection")
-	}
-	return nil
+		if err := bson.UnmarshalExtJSON(data, true, &document); err != nil {
+			return nil, ErrInvalidCursor
+		}
+		return document.V, nil
+	},
 }
 
-func parseMongoDBFilters(filters string) (bson.D, error) {
-	if filters == "" {
-		return bson.D{}, nil
+// documentValue reads a possibly dotted field path of a decoded document
+func documentValue(row map[string]interface{}, key string) interface{} {
+	var value interface{} = row
+	for _, part := range strings.Split(key, ".") {
+		switch document := value.(type) {
+		case map[string]interface{}:
+			value = document[part]
+		case primitive.M:
+			value = document[part]
+		case primitive.D:
+			value = document.Map()[part]
+		default:
+			return nil
+		}
 	}
+	return value
+}
 
-	// Split the filters string into individual filters
-	filterStrings := strings.Split(filters, "|")
-
-	// Create an array to store individual BSON filters
-	var bsonFilters []bson.D
-
-	// parse each filter string and convert it to BSON filter
-	for _, filterStr := range filterStrings {
-		bsonFilter, err := parseSingleMongoDBFilter(filterStr)
-		if err != nil {
-			return nil, err
+// keysetBSONCondition matches the documents after the cursor, nil on the
+// first page
+func keysetBSONCondition(k *keyset) bson.D {
+	if k.after == nil {
+		return nil
+	}
+	comparison := "$gt"
+	if k.descending {
+		comparison = "$lt"
+	}
+	alternatives := make(bson.A, len(k.keys))
+	for i := range k.keys {
+		term := bson.D{}
+		for j := 0; j < i; j++ {
+			term = append(term, bson.E{Key: k.keys[j], Value: k.after[j]})
 		}
-		bsonFilters = append(bsonFilters, bsonFilter)
+		term = append(term, bson.E{Key: k.keys[i], Value: bson.D{{Key: comparison, Value: k.after[i]}}})
+		alternatives[i] = term
 	}
-
-	// Combine individual BSON filters into a single BSON filter with "$and" operator
-	result := bson.D{{Key: "$and", Value: bsonFilters}}
-
-	return result, nil
+	return bson.D{{Key: "$or", Value: alternatives}}
 }
 
-func parseSingleMongoDBFilter(filter string) (bson.D, error) {
-	// Split the filter string into its components
-	parts := strings.Split(filter, ":")
-	if len(parts) != 3 {
-		return nil, errors.New("invalid filter format")
+func keysetBSONSort(k *keyset) bson.D {
+	direction := 1
+	if k.descending {
+		direction = -1
 	}
+	sort := bson.D{}
+	for _, key := range k.keys {
+		sort = append(sort, bson.E{Key: key, Value: direction})
+	}
+	return sort
+}
 
-	column := parts[0]
-	operator := parts[1]
-	value := parts[2]
+// killOnCancel runs fn with a comment unique to this call that fn must attach
+// to the operations it sends. If ctx is cancelled while fn is still running,
+// the tagged operations are looked up with $currentOp and stopped with killOp,
+// since the driver only abandons the cursor on its side.
+func (this *MongoDBDatabase) killOnCancel(ctx context.Context, fn func(comment string) error) error {
+	comment := "butler:" + primitive.NewObjectID().Hex()
+
+	var mu sync.Mutex
+	running := true
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-finished:
+		case <-ctx.Done():
+			mu.Lock()
+			defer mu.Unlock()
+			if running {
+				this.killOperations(comment)
+			}
+		}
+	}()
+	defer func() {
+		mu.Lock()
+		running = false
+		mu.Unlock()
+		close(finished)
+	}()
+
+	return fn(comment)
+}
+
+func (this *MongoDBDatabase) killOperations(comment string) {
+	ctx, cancel := context.WithTimeout(context.Background(), killTimeout)
+	defer cancel()
 
-	// Map the operator to MongoDB query format
-	mongoOperator := map[string]string{
-		"=":               "$eq",
-		"!=":              "$ne",
-		"<":               "$lt",
-		">":               "$gt",
-		">=":              "$gte",
-		"<=":              "$lte",
-		"in":              "$in",
-		"not in":          "$nin",
-		"is null":         "$eq",
-		"is not null":     "$ne",
-		"between":         "$gte",
-		"not between":     "$lt",
-		"contains":        "$regex",
-		"not contains":    "$not_regex",
-		"contains_ci":     "$regex",
-		"not contains_ci": "$not_regex",
-		"has suffix":      "$regex",
-		"has prefix":      "$regex",
+	admin := this.conn.Database("admin")
+	cursor, err := admin.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$currentOp", Value: bson.D{}}},
+		{{Key: "$match", Value: bson.D{{Key: "command.comment", Value: comment}}}},
+	})
+	if err != nil {
+		fmt.Println("failed to look up cancelled operations:", err)
+		return
 	}
+	defer cursor.Close(ctx)
 
-	var bsonFilter bson.D
-	switch operator {
-	case "in", "not in":
-		values := strings.Split(value, ",")
-		bsonFilter = bson.D{{Key: column, Value: bson.M{mongoOperator[operator]: values}}}
-	case "between", "not between":
-		rangeValues := strings.Split(value, ",")
-		bsonFilter = bson.D{{Key: column, Value: bson.M{mongoOperator[operator]: rangeValues}}}
-	default:
-		bsonFilter = bson.D{{Key: column, Value: bson.M{mongoOperator[operator]: value}}}
+	var operations []struct {
+		OpID interface{} `bson:"opid"`
 	}
+	if err := cursor.All(ctx, &operations); err != nil {
+		fmt.Println("failed to look up cancelled operations:", err)
+		return
+	}
+	for _, operation := range operations {
+		if err := admin.RunCommand(ctx, bson.D{{Key: "killOp", Value: 1}, {Key: "op", Value: operation.OpID}}).Err(); err != nil {
+			fmt.Println("failed to kill cancelled operation:", err)
+		}
+	}
+}
 
-	return bsonFilter, nil
+func (this *MongoDBDatabase) Close() error {
+	if this.conn != nil {
+		err := this.conn.Disconnect(context.Background())
+		if err != nil {
+			return err
+		}
+		fmt.Println("Closed MongoDB database connection")
+	}
+	return nil
 }
 
 func parseMongoDBSort(sort, order string) bson.D {
@@ -224,7 +340,3 @@ func parseMongoDBPagination(page, size string) (int64, int64) {
 
 	return skip, limit
 }
-
-func (this *MongoDBDatabase) Execute(queries []string) error {
-	return nil
-}
@@ -0,0 +1,180 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Explain runs the explain command on a console command described on
+// mongoQuery, with the executionStats verbosity when analyze is set
+func (this *MongoDBDatabase) Explain(ctx context.Context, query string, analyze bool) (*Plan, error) {
+	parsed, err := parseMongoQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if analyze && parsed.writes() {
+		return nil, ErrAnalyzeWrite
+	}
+	verbosity := "queryPlanner"
+	if analyze {
+		verbosity = "executionStats"
+	}
+	db := this.conn.Database(this.config.Database)
+
+	ctx, cancel := withTimeout(ctx, this.config)
+	defer cancel()
+
+	var explained bson.Raw
+	err = this.killOnCancel(ctx, func(comment string) error {
+		command := bson.D{
+			{Key: "explain", Value: explainedCommand(parsed)},
+			{Key: "verbosity", Value: verbosity},
+			{Key: "comment", Value: comment},
+		}
+		return db.RunCommand(ctx, command).Decode(&explained)
+	})
+	if err != nil {
+		return nil, err
+	}
+	raw, err := bson.MarshalExtJSON(explained, false, false)
+	if err != nil {
+		return nil, err
+	}
+	return parseMongoPlan(string(raw), analyze)
+}
+
+// explainedCommand is the database command a console command runs as
+func explainedCommand(parsed mongoQuery) bson.D {
+	switch {
+	case parsed.Find != "":
+		command := bson.D{{Key: "find", Value: parsed.Find}, {Key: "filter", Value: parsed.Filter}}
+		if parsed.Projection != nil {
+			command = append(command, bson.E{Key: "projection", Value: parsed.Projection})
+		}
+		if parsed.Sort != nil {
+			command = append(command, bson.E{Key: "sort", Value: parsed.Sort})
+		}
+		return command
+	case parsed.Aggregate != "":
+		pipeline := parsed.Pipeline
+		if pipeline == nil {
+			pipeline = []bson.D{}
+		}
+		return bson.D{{Key: "aggregate", Value: parsed.Aggregate}, {Key: "pipeline", Value: pipeline}, {Key: "cursor", Value: bson.D{}}}
+	case parsed.Count != "":
+		return bson.D{{Key: "count", Value: parsed.Count}, {Key: "query", Value: parsed.Filter}}
+	}
+	return bson.D{{Key: "distinct", Value: parsed.Distinct}, {Key: "key", Value: parsed.Key}, {Key: "query", Value: parsed.Filter}}
+}
+
+func parseMongoPlan(raw string, analyze bool) (*Plan, error) {
+	var explained map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &explained); err != nil {
+		return nil, fmt.Errorf("failed to read the plan: %w", err)
+	}
+	plan := &Plan{Root: mongoPlanNode(explained, analyze), Analyzed: analyze, Raw: raw, Format: "json"}
+	if plan.Root == nil {
+		return nil, fmt.Errorf("the server returned no plan")
+	}
+	if stats, ok := explained["executionStats"].(map[string]interface{}); ok {
+		plan.ExecutionMs = planNumber(stats["executionTimeMillis"])
+	}
+	return plan, nil
+}
+
+// mongoPlanNode reads the plan of an explain result. Aggregations that are
+// not pushed down to the query layer list their stages, each of which is
+// fed by the one before, the first being the $cursor holding the query plan.
+func mongoPlanNode(explained map[string]interface{}, analyze bool) *PlanNode {
+	if stages, ok := explained["stages"].([]interface{}); ok {
+		var node *PlanNode
+		for _, stage := range stages {
+			stage, _ := stage.(map[string]interface{})
+			for name, value := range stage {
+				if !strings.HasPrefix(name, "$") {
+					continue
+				}
+				var next *PlanNode
+				if cursor, ok := value.(map[string]interface{}); ok && name == "$cursor" {
+					next = mongoPlanNode(cursor, analyze)
+				}
+				if next == nil {
+					next = newPlanNode(name)
+					if detail, err := json.Marshal(value); err == nil {
+						next.Detail = string(detail)
+					}
+				}
+				next.ActualRows = planNumber(stage["nReturned"])
+				next.ActualTimeMs = planNumber(stage["executionTimeMillisEstimate"])
+				if node != nil {
+					next.Children = append(next.Children, node)
+				}
+				node = next
+			}
+		}
+		return node
+	}
+
+	planner, _ := explained["queryPlanner"].(map[string]interface{})
+	var stage map[string]interface{}
+	if stats, ok := explained["executionStats"].(map[string]interface{}); ok && analyze {
+		stage, _ = stats["executionStages"].(map[string]interface{})
+	}
+	if stage == nil && planner != nil {
+		stage, _ = planner["winningPlan"].(map[string]interface{})
+		// slot based execution wraps the classic plan
+		if queryPlan, ok := stage["queryPlan"].(map[string]interface{}); ok {
+			stage = queryPlan
+		}
+	}
+	if stage == nil {
+		return nil
+	}
+	node := mongoStageNode(stage)
+	if namespace, ok := planner["namespace"].(string); ok && node.Relation == "" {
+		node.Relation = namespace[strings.Index(namespace, ".")+1:]
+	}
+	return node
+}
+
+// mongoStageNode reads a stage of a query plan and the stages feeding it
+func mongoStageNode(stage map[string]interface{}) *PlanNode {
+	node := newPlanNode(fmt.Sprint(stage["stage"]))
+	node.Index, _ = stage["indexName"].(string)
+	for _, key := range []string{"filter", "indexBounds", "sortPattern"} {
+		if value, ok := stage[key]; ok {
+			if detail, err := json.Marshal(value); err == nil {
+				node.Detail = string(detail)
+				break
+			}
+		}
+	}
+	node.ActualRows = planNumber(stage["nReturned"])
+	node.ActualTimeMs = planNumber(stage["executionTimeMillisEstimate"])
+
+	if input, ok := stage["inputStage"].(map[string]interface{}); ok {
+		node.Children = append(node.Children, mongoStageNode(input))
+	}
+	for _, key := range []string{"inputStages", "shards"} {
+		inputs, _ := stage[key].([]interface{})
+		for _, input := range inputs {
+			input, ok := input.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			// the shards of a sharded plan each carry a plan of their own
+			if shardPlan, ok := input["winningPlan"].(map[string]interface{}); ok {
+				input = shardPlan
+			}
+			if shardStages, ok := input["executionStages"].(map[string]interface{}); ok {
+				input = shardStages
+			}
+			node.Children = append(node.Children, mongoStageNode(input))
+		}
+	}
+	return node
+}
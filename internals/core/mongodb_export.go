@@ -0,0 +1,313 @@
+package core
+
+import (
+	"butler-server/internals/export"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoExportSampleSize is the number of documents read ahead to settle the
+// exported columns. Top level fields that first appear after them are not
+// exported.
+const mongoExportSampleSize = 1000
+
+// kindUndecided marks a column only seen holding nulls so far
+const kindUndecided export.Kind = -1
+
+// Export streams the documents of a collection matching the filter
+func (this *MongoDBDatabase) Export(ctx context.Context, table string, filter Filter, w export.Writer) error {
+	var err error
+	filterBson := bson.D{}
+	if conditions := filter.conditions(); conditions != nil {
+		filterBson, err = conditions.BSON()
+		if err != nil {
+			return err
+		}
+	}
+	collection := this.conn.Database(this.config.Database).Collection(table)
+	return this.killOnCancel(ctx, func(comment string) error {
+		findOptions := options.Find().SetSort(parseMongoDBSort(filter.Sort, filter.Order)).SetComment(comment)
+		cursor, err := collection.Find(ctx, filterBson, findOptions)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+		return streamDocuments(ctx, cursor, w)
+	})
+}
+
+// ExportQuery streams the full result of a console command described on
+// mongoQuery
+func (this *MongoDBDatabase) ExportQuery(ctx context.Context, query string, w export.Writer) error {
+	parsed, err := parseMongoQuery(query)
+	if err != nil {
+		return err
+	}
+	if this.config.ReadOnly && parsed.writes() {
+		return &ReadOnlyError{Statement: query, Line: 1}
+	}
+	db := this.conn.Database(this.config.Database)
+
+	return this.killOnCancel(ctx, func(comment string) error {
+		var cursor *mongo.Cursor
+		switch {
+		case parsed.Find != "":
+			findOptions := options.Find().SetComment(comment)
+			if parsed.Projection != nil {
+				findOptions.SetProjection(parsed.Projection)
+			}
+			if parsed.Sort != nil {
+				findOptions.SetSort(parsed.Sort)
+			}
+			cursor, err = db.Collection(parsed.Find).Find(ctx, parsed.Filter, findOptions)
+		case parsed.Aggregate != "":
+			pipeline := make(mongo.Pipeline, 0, len(parsed.Pipeline))
+			for _, stage := range parsed.Pipeline {
+				pipeline = append(pipeline, stage)
+			}
+			cursor, err = db.Collection(parsed.Aggregate).Aggregate(ctx, pipeline, options.Aggregate().SetComment(comment))
+		case parsed.Count != "":
+			count, err := db.Collection(parsed.Count).CountDocuments(ctx, parsed.Filter, options.Count().SetComment(comment))
+			if err != nil {
+				return err
+			}
+			return writeValues(w, []export.Column{{Name: "count", Kind: export.KindInt}}, [][]interface{}{{count}})
+		default:
+			values, err := db.Collection(parsed.Distinct).Distinct(ctx, parsed.Key, parsed.Filter, options.Distinct().SetComment(comment))
+			if err != nil {
+				return err
+			}
+			rows := make([][]interface{}, len(values))
+			for i, value := range values {
+				t, data, err := bson.MarshalValue(value)
+				if err != nil {
+					return err
+				}
+				rows[i] = []interface{}{mongoJSON(bson.RawValue{Type: t, Value: data})}
+			}
+			return writeValues(w, []export.Column{{Name: parsed.Key, Kind: export.KindJSON}}, rows)
+		}
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+		return streamDocuments(ctx, cursor, w)
+	})
+}
+
+func writeValues(w export.Writer, columns []export.Column, rows [][]interface{}) error {
+	if err := w.Begin(columns); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// streamDocuments writes the documents of cursor as rows. The columns are the
+// top level fields of the documents read ahead, in order of appearance, each
+// typed after the values seen for it; fields holding values of different
+// kinds are exported as text.
+func streamDocuments(ctx context.Context, cursor *mongo.Cursor, w export.Writer) error {
+	var sample []bson.Raw
+	for len(sample) < mongoExportSampleSize && cursor.Next(ctx) {
+		sample = append(sample, append(bson.Raw(nil), cursor.Current...))
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	var columns []export.Column
+	positions := make(map[string]int)
+	for _, document := range sample {
+		elements, err := document.Elements()
+		if err != nil {
+			return err
+		}
+		for _, element := range elements {
+			kind, known := mongoKind(element.Value().Type)
+			position, ok := positions[element.Key()]
+			if !ok {
+				positions[element.Key()] = len(columns)
+				columns = append(columns, export.Column{Name: element.Key(), Kind: kind})
+				if !known {
+					columns[len(columns)-1].Kind = kindUndecided
+				}
+				continue
+			}
+			if known {
+				columns[position].Kind = mergeKinds(columns[position].Kind, kind)
+			}
+		}
+	}
+	for i := range columns {
+		if columns[i].Kind == kindUndecided {
+			columns[i].Kind = export.KindString
+		}
+	}
+	if err := w.Begin(columns); err != nil {
+		return err
+	}
+
+	values := make([]interface{}, len(columns))
+	write := func(document bson.Raw) error {
+		for i := range values {
+			values[i] = nil
+		}
+		elements, err := document.Elements()
+		if err != nil {
+			return err
+		}
+		for _, element := range elements {
+			position, ok := positions[element.Key()]
+			if !ok {
+				continue
+			}
+			values[position], err = mongoValue(columns[position].Kind, element.Value())
+			if err != nil {
+				return fmt.Errorf("field %s: %w", element.Key(), err)
+			}
+		}
+		return w.Write(values)
+	}
+
+	for _, document := range sample {
+		if err := write(document); err != nil {
+			return err
+		}
+	}
+	for cursor.Next(ctx) {
+		if err := write(cursor.Current); err != nil {
+			return err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// mongoKind returns the export kind of a BSON type, false for null and
+// undefined
+func mongoKind(t bsontype.Type) (export.Kind, bool) {
+	switch t {
+	case bsontype.Null, bsontype.Undefined:
+		return export.KindString, false
+	case bsontype.Int32, bsontype.Int64:
+		return export.KindInt, true
+	case bsontype.Double:
+		return export.KindFloat, true
+	case bsontype.Decimal128:
+		return export.KindDecimal, true
+	case bsontype.Boolean:
+		return export.KindBool, true
+	case bsontype.DateTime:
+		return export.KindTime, true
+	case bsontype.Binary:
+		return export.KindBytes, true
+	case bsontype.EmbeddedDocument, bsontype.Array:
+		return export.KindJSON, true
+	}
+	return export.KindString, true
+}
+
+func mergeKinds(current, next export.Kind) export.Kind {
+	switch {
+	case current == kindUndecided || current == next:
+		return next
+	case current == export.KindInt && next == export.KindFloat, current == export.KindFloat && next == export.KindInt:
+		return export.KindFloat
+	}
+	return export.KindString
+}
+
+// mongoValue converts a field value for a column of the given kind
+func mongoValue(kind export.Kind, value bson.RawValue) (interface{}, error) {
+	switch value.Type {
+	case bsontype.Null, bsontype.Undefined:
+		return nil, nil
+	}
+	if kind == export.KindString {
+		return mongoText(value), nil
+	}
+	natural, _ := mongoKind(value.Type)
+	if natural != kind && !(kind == export.KindFloat && natural == export.KindInt) {
+		return nil, fmt.Errorf("holds a %s value after the documents the %s column type was taken from", natural, kind)
+	}
+
+	switch value.Type {
+	case bsontype.Int32:
+		if kind == export.KindFloat {
+			return float64(value.Int32()), nil
+		}
+		return int64(value.Int32()), nil
+	case bsontype.Int64:
+		if kind == export.KindFloat {
+			return float64(value.Int64()), nil
+		}
+		return value.Int64(), nil
+	case bsontype.Double:
+		return value.Double(), nil
+	case bsontype.Decimal128:
+		return value.Decimal128().String(), nil
+	case bsontype.Boolean:
+		return value.Boolean(), nil
+	case bsontype.DateTime:
+		return time.UnixMilli(value.DateTime()).UTC(), nil
+	case bsontype.Binary:
+		_, data := value.Binary()
+		return data, nil
+	case bsontype.EmbeddedDocument, bsontype.Array:
+		return mongoJSON(value), nil
+	}
+	return nil, fmt.Errorf("cannot export %s value", value.Type)
+}
+
+// mongoText renders a value for a text column
+func mongoText(value bson.RawValue) string {
+	switch value.Type {
+	case bsontype.String:
+		return value.StringValue()
+	case bsontype.ObjectID:
+		return value.ObjectID().Hex()
+	case bsontype.Int32:
+		return strconv.FormatInt(int64(value.Int32()), 10)
+	case bsontype.Int64:
+		return strconv.FormatInt(value.Int64(), 10)
+	case bsontype.Double:
+		return strconv.FormatFloat(value.Double(), 'g', -1, 64)
+	case bsontype.Boolean:
+		return strconv.FormatBool(value.Boolean())
+	case bsontype.DateTime:
+		return time.UnixMilli(value.DateTime()).UTC().Format(time.RFC3339Nano)
+	case bsontype.Decimal128:
+		return value.Decimal128().String()
+	}
+	return string(mongoJSON(value))
+}
+
+// mongoJSON renders a value as relaxed extended JSON
+func mongoJSON(value bson.RawValue) json.RawMessage {
+	data, err := bson.MarshalExtJSON(bson.D{{Key: "v", Value: value}}, false, false)
+	if err != nil {
+		return json.RawMessage("null")
+	}
+	var wrapper struct {
+		V json.RawMessage `json:"v"`
+	}
+	if err := json.Unmarshal(data, &wrapper); err != nil {
+		return json.RawMessage("null")
+	}
+	return wrapper.V
+}
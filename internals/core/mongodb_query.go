@@ -0,0 +1,450 @@
+package core
+
+import (
+	"butler-server/internals"
+	"butler-server/internals/export"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoQuery is a read command of the Mongo query console, written as extended
+// JSON with exactly one of find, aggregate, count or distinct naming the
+// collection, e.g.
+//
+//	{"find": "users", "filter": {"age": {"$gt": 30}}, "projection": {"name": 1}, "sort": {"age": -1}}
+//	{"aggregate": "orders", "pipeline": [{"$group": {"_id": "$status", "total": {"$sum": 1}}}]}
+//	{"count": "users", "filter": {"active": true}}
+//	{"distinct": "users", "key": "country", "filter": {}}
+type mongoQuery struct {
+	Find       string   `bson:"find"`
+	Aggregate  string   `bson:"aggregate"`
+	Count      string   `bson:"count"`
+	Distinct   string   `bson:"distinct"`
+	Key        string   `bson:"key"`
+	Filter     bson.D   `bson:"filter"`
+	Projection bson.D   `bson:"projection"`
+	Sort       bson.D   `bson:"sort"`
+	Pipeline   []bson.D `bson:"pipeline"`
+}
+
+// mongoStatement is a write statement executed by Execute, written as extended
+// JSON with exactly one of the operation keys naming the collection, e.g.
+//
+//	{"insertOne": "users", "document": {"name": "ada"}}
+//	{"updateMany": "users", "filter": {"active": false}, "update": {"$set": {"archived": true}}}
+//	{"deleteMany": "sessions", "filter": {"expiresAt": {"$lt": {"$date": "2024-01-01T00:00:00Z"}}}}
+//	{"bulkWrite": "users", "operations": [{"insertOne": {"document": {"name": "bob"}}}, {"deleteOne": {"filter": {"name": "eve"}}}]}
+type mongoStatement struct {
+	InsertOne  string        `bson:"insertOne"`
+	InsertMany string        `bson:"insertMany"`
+	UpdateOne  string        `bson:"updateOne"`
+	UpdateMany string        `bson:"updateMany"`
+	DeleteOne  string        `bson:"deleteOne"`
+	DeleteMany string        `bson:"deleteMany"`
+	BulkWrite  string        `bson:"bulkWrite"`
+	Document   bson.D        `bson:"document"`
+	Documents  []interface{} `bson:"documents"`
+	Filter     bson.D        `bson:"filter"`
+	Update     interface{}   `bson:"update"`
+	Upsert     bool          `bson:"upsert"`
+	Operations []bson.M      `bson:"operations"`
+	Ordered    *bool         `bson:"ordered"`
+}
+
+// bulkOperation is the body of a single bulkWrite operation, following the
+// shape used by the mongo shell
+type bulkOperation struct {
+	Document    bson.D      `bson:"document"`
+	Filter      bson.D      `bson:"filter"`
+	Update      interface{} `bson:"update"`
+	Replacement bson.D      `bson:"replacement"`
+	Upsert      bool        `bson:"upsert"`
+}
+
+func parseMongoQuery(query string) (mongoQuery, error) {
+	var parsed mongoQuery
+	if err := bson.UnmarshalExtJSON([]byte(query), false, &parsed); err != nil {
+		return parsed, fmt.Errorf("invalid mongo query: %w", err)
+	}
+	if parsed.Filter == nil {
+		parsed.Filter = bson.D{}
+	}
+	set := 0
+	for _, collection := range []string{parsed.Find, parsed.Aggregate, parsed.Count, parsed.Distinct} {
+		if collection != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return parsed, errors.New("mongo query must contain exactly one of find, aggregate, count or distinct")
+	}
+	if parsed.Distinct != "" && parsed.Key == "" {
+		return parsed, errors.New("distinct requires a key")
+	}
+	return parsed, nil
+}
+
+// writes reports whether the command stores its output, which aggregations
+// do with an $out or $merge stage
+func (q mongoQuery) writes() bool {
+	return writesOutput(mongo.Pipeline(q.Pipeline))
+}
+
+// Query runs a console command written in the JSON language described on
+// mongoQuery. find and aggregate are paged with skip/limit, distinct values
+// are paged in memory and count returns a single count row. The columns of
+// the result are the top level fields of the returned documents.
+func (this *MongoDBDatabase) Query(ctx context.Context, query string, page int, size int) (*internals.ResultSet, error) {
+	parsed, err := parseMongoQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if this.config.ReadOnly && parsed.writes() {
+		return nil, &ReadOnlyError{Statement: query, Line: 1}
+	}
+	skip, limit := int64(page*size), int64(size)
+	db := this.conn.Database(this.config.Database)
+
+	ctx, cancel := withTimeout(ctx, this.config)
+	defer cancel()
+
+	var result *internals.ResultSet
+	err = this.killOnCancel(ctx, func(comment string) error {
+		result, err = runMongoQuery(ctx, db, parsed, skip, limit, comment)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// runMongoQuery runs a parsed console command tagged with comment, paging it
+// with skip and limit
+func runMongoQuery(ctx context.Context, db *mongo.Database, parsed mongoQuery, skip, limit int64, comment string) (*internals.ResultSet, error) {
+	result := &internals.ResultSet{}
+	switch {
+	case parsed.Find != "":
+		findOptions := options.Find().SetSkip(skip).SetLimit(limit).SetComment(comment)
+		if parsed.Projection != nil {
+			findOptions.SetProjection(parsed.Projection)
+		}
+		if parsed.Sort != nil {
+			findOptions.SetSort(parsed.Sort)
+		}
+		cursor, err := db.Collection(parsed.Find).Find(ctx, parsed.Filter, findOptions)
+		if err != nil {
+			return nil, err
+		}
+		defer cursor.Close(ctx)
+		return result, streamDocuments(ctx, cursor, result)
+	case parsed.Aggregate != "":
+		pipeline := make(mongo.Pipeline, 0, len(parsed.Pipeline)+2)
+		for _, stage := range parsed.Pipeline {
+			pipeline = append(pipeline, stage)
+		}
+		if !writesOutput(pipeline) {
+			pipeline = append(pipeline, bson.D{{Key: "$skip", Value: skip}}, bson.D{{Key: "$limit", Value: limit}})
+		}
+		cursor, err := db.Collection(parsed.Aggregate).Aggregate(ctx, pipeline, options.Aggregate().SetComment(comment))
+		if err != nil {
+			return nil, err
+		}
+		defer cursor.Close(ctx)
+		return result, streamDocuments(ctx, cursor, result)
+	case parsed.Count != "":
+		count, err := db.Collection(parsed.Count).CountDocuments(ctx, parsed.Filter, options.Count().SetComment(comment))
+		if err != nil {
+			return nil, err
+		}
+		return result, writeValues(result, []export.Column{{Name: "count", Kind: export.KindInt}}, [][]interface{}{{count}})
+	default:
+		values, err := db.Collection(parsed.Distinct).Distinct(ctx, parsed.Key, parsed.Filter, options.Distinct().SetComment(comment))
+		if err != nil {
+			return nil, err
+		}
+		rows := make([][]interface{}, 0, limit)
+		for i := skip; i < int64(len(values)) && i < skip+limit; i++ {
+			t, data, err := bson.MarshalValue(values[i])
+			if err != nil {
+				return nil, err
+			}
+			rows = append(rows, []interface{}{mongoJSON(bson.RawValue{Type: t, Value: data})})
+		}
+		return result, writeValues(result, []export.Column{{Name: parsed.Key, Kind: export.KindJSON}}, rows)
+	}
+}
+
+// writesOutput reports whether the pipeline ends with a stage that writes its
+// result to a collection, after which no further stages may follow
+func writesOutput(pipeline mongo.Pipeline) bool {
+	if len(pipeline) == 0 || len(pipeline[len(pipeline)-1]) == 0 {
+		return false
+	}
+	stage := pipeline[len(pipeline)-1][0].Key
+	return stage == "$out" || stage == "$merge"
+}
+
+func parseMongoStatement(statement string) (mongoStatement, error) {
+	var parsed mongoStatement
+	if err := bson.UnmarshalExtJSON([]byte(statement), false, &parsed); err != nil {
+		return parsed, fmt.Errorf("invalid mongo statement: %w", err)
+	}
+	if parsed.Filter == nil {
+		parsed.Filter = bson.D{}
+	}
+	set := 0
+	for _, collection := range parsed.collections() {
+		if collection != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return parsed, errors.New("mongo statement must contain exactly one of insertOne, insertMany, updateOne, updateMany, deleteOne, deleteMany or bulkWrite")
+	}
+	return parsed, nil
+}
+
+// collections lists the collection of every kind of statement, only one of
+// which is set on a valid statement
+func (statement mongoStatement) collections() []string {
+	return []string{statement.InsertOne, statement.InsertMany, statement.UpdateOne, statement.UpdateMany, statement.DeleteOne, statement.DeleteMany, statement.BulkWrite}
+}
+
+// collection returns the collection the statement writes to
+func (statement mongoStatement) collection() string {
+	for _, collection := range statement.collections() {
+		if collection != "" {
+			return collection
+		}
+	}
+	return ""
+}
+
+// Execute runs the write statements described on mongoStatement in order.
+// On replica sets and sharded clusters they run inside a single multi-document
+// transaction; standalone servers have no transactions, so there a failing
+// statement leaves the earlier ones applied. Reverts are not written for
+// collections.
+func (this *MongoDBDatabase) Execute(ctx context.Context, queries []string, revert bool) ([]StatementResult, error) {
+	statements, err := parseMongoStatements(queries)
+	if err != nil {
+		return nil, err
+	}
+	db := this.conn.Database(this.config.Database)
+
+	transactional, err := this.supportsTransactions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !transactional {
+		return runMongoStatements(ctx, db, queries, statements)
+	}
+
+	session, err := this.conn.StartSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.EndSession(ctx)
+
+	var results []StatementResult
+	_, err = session.WithTransaction(ctx, func(sessionCtx mongo.SessionContext) (interface{}, error) {
+		// the callback runs again on transient errors, only the last
+		// attempt is reported
+		var err error
+		results, err = runMongoStatements(sessionCtx, db, queries, statements)
+		return nil, err
+	})
+	if err != nil {
+		for i := range results {
+			results[i].RolledBack = results[i].Error == "" && !results[i].Skipped
+		}
+	}
+	return results, err
+}
+
+// DryRun runs the write statements in a transaction that is aborted once they
+// have run, which needs a replica set or a sharded cluster
+func (this *MongoDBDatabase) DryRun(ctx context.Context, queries []string) ([]StatementResult, error) {
+	statements, err := parseMongoStatements(queries)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withTimeout(ctx, this.config)
+	defer cancel()
+
+	transactional, err := this.supportsTransactions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !transactional {
+		return nil, ErrNoTransactions
+	}
+	session, err := this.conn.StartSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.EndSession(ctx)
+	if err := session.StartTransaction(); err != nil {
+		return nil, err
+	}
+	defer session.AbortTransaction(context.Background())
+
+	db := this.conn.Database(this.config.Database)
+	var results []StatementResult
+	err = mongo.WithSession(ctx, session, func(sessionCtx mongo.SessionContext) error {
+		results, _ = runMongoStatements(sessionCtx, db, queries, statements)
+		return nil
+	})
+	return results, err
+}
+
+func parseMongoStatements(queries []string) ([]mongoStatement, error) {
+	statements := make([]mongoStatement, 0, len(queries))
+	for _, query := range queries {
+		statement, err := parseMongoStatement(query)
+		if err != nil {
+			return nil, err
+		}
+		statements = append(statements, statement)
+	}
+	return statements, nil
+}
+
+// runMongoStatements runs statements one after the other until one fails,
+// whose error it returns, and reports each of them
+func runMongoStatements(ctx context.Context, db *mongo.Database, queries []string, statements []mongoStatement) ([]StatementResult, error) {
+	results := make([]StatementResult, len(statements))
+	var failure error
+	for i, statement := range statements {
+		results[i] = StatementResult{Statement: queries[i]}
+		if failure != nil {
+			results[i].Skipped = true
+			continue
+		}
+		start := time.Now()
+		affected, err := runMongoStatement(ctx, db, statement)
+		results[i].DurationMs = float64(time.Since(start).Microseconds()) / 1000
+		if err != nil {
+			results[i].Error = err.Error()
+			failure = err
+			continue
+		}
+		results[i].RowsAffected = &affected
+	}
+	return results, failure
+}
+
+// supportsTransactions reports whether the server is a replica set member or
+// a mongos, the deployments that support multi-document transactions
+func (this *MongoDBDatabase) supportsTransactions(ctx context.Context) (bool, error) {
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	if err := this.conn.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		return false, err
+	}
+	return hello.SetName != "" || hello.Msg == "isdbgrid", nil
+}
+
+// runMongoStatement runs a write statement and returns the number of
+// documents it inserted, modified, upserted or deleted
+func runMongoStatement(ctx context.Context, db *mongo.Database, statement mongoStatement) (int64, error) {
+	switch {
+	case statement.InsertOne != "":
+		if _, err := db.Collection(statement.InsertOne).InsertOne(ctx, statement.Document); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	case statement.InsertMany != "":
+		result, err := db.Collection(statement.InsertMany).InsertMany(ctx, statement.Documents)
+		if err != nil {
+			return 0, err
+		}
+		return int64(len(result.InsertedIDs)), nil
+	case statement.UpdateOne != "":
+		result, err := db.Collection(statement.UpdateOne).UpdateOne(ctx, statement.Filter, statement.Update, options.Update().SetUpsert(statement.Upsert))
+		if err != nil {
+			return 0, err
+		}
+		return result.ModifiedCount + result.UpsertedCount, nil
+	case statement.UpdateMany != "":
+		result, err := db.Collection(statement.UpdateMany).UpdateMany(ctx, statement.Filter, statement.Update, options.Update().SetUpsert(statement.Upsert))
+		if err != nil {
+			return 0, err
+		}
+		return result.ModifiedCount + result.UpsertedCount, nil
+	case statement.DeleteOne != "":
+		result, err := db.Collection(statement.DeleteOne).DeleteOne(ctx, statement.Filter)
+		if err != nil {
+			return 0, err
+		}
+		return result.DeletedCount, nil
+	case statement.DeleteMany != "":
+		result, err := db.Collection(statement.DeleteMany).DeleteMany(ctx, statement.Filter)
+		if err != nil {
+			return 0, err
+		}
+		return result.DeletedCount, nil
+	}
+
+	models, err := parseBulkOperations(statement.Operations)
+	if err != nil {
+		return 0, err
+	}
+	bulkOptions := options.BulkWrite()
+	if statement.Ordered != nil {
+		bulkOptions.SetOrdered(*statement.Ordered)
+	}
+	result, err := db.Collection(statement.BulkWrite).BulkWrite(ctx, models, bulkOptions)
+	if err != nil {
+		return 0, err
+	}
+	return result.InsertedCount + result.ModifiedCount + result.UpsertedCount + result.DeletedCount, nil
+}
+
+func parseBulkOperations(operations []bson.M) ([]mongo.WriteModel, error) {
+	models := make([]mongo.WriteModel, 0, len(operations))
+	for i, operation := range operations {
+		if len(operation) != 1 {
+			return nil, fmt.Errorf("bulkWrite operation %d must have exactly one key", i)
+		}
+		for name, body := range operation {
+			raw, err := bson.Marshal(body)
+			if err != nil {
+				return nil, fmt.Errorf("bulkWrite operation %d: %w", i, err)
+			}
+			var op bulkOperation
+			if err := bson.Unmarshal(raw, &op); err != nil {
+				return nil, fmt.Errorf("bulkWrite operation %d: %w", i, err)
+			}
+			if op.Filter == nil {
+				op.Filter = bson.D{}
+			}
+			switch name {
+			case "insertOne":
+				models = append(models, mongo.NewInsertOneModel().SetDocument(op.Document))
+			case "updateOne":
+				models = append(models, mongo.NewUpdateOneModel().SetFilter(op.Filter).SetUpdate(op.Update).SetUpsert(op.Upsert))
+			case "updateMany":
+				models = append(models, mongo.NewUpdateManyModel().SetFilter(op.Filter).SetUpdate(op.Update).SetUpsert(op.Upsert))
+			case "replaceOne":
+				models = append(models, mongo.NewReplaceOneModel().SetFilter(op.Filter).SetReplacement(op.Replacement).SetUpsert(op.Upsert))
+			case "deleteOne":
+				models = append(models, mongo.NewDeleteOneModel().SetFilter(op.Filter))
+			case "deleteMany":
+				models = append(models, mongo.NewDeleteManyModel().SetFilter(op.Filter))
+			default:
+				return nil, fmt.Errorf("unsupported bulkWrite operation %q", name)
+			}
+		}
+	}
+	return models, nil
+}
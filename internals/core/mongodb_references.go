@@ -0,0 +1,106 @@
+package core
+
+import (
+	"butler-server/internals/sqlparse"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// mongoReferences returns the collections the commands of a script read and
+// the top level fields they name. Fields included as they are by the
+// projection of a find or by a $project stage are plain references, every
+// other mention, as in filters, sorts and expressions, is not.
+func mongoReferences(script string) ([]string, []sqlparse.Reference, error) {
+	entries, err := splitMongoScript(script)
+	if err != nil {
+		return nil, nil, err
+	}
+	var collections []string
+	var references []sqlparse.Reference
+	for _, entry := range entries {
+		parsed, err := parseMongoQuery(entry.Text)
+		if err != nil {
+			return nil, nil, err
+		}
+		var document bson.D
+		if err := bson.UnmarshalExtJSON([]byte(entry.Text), false, &document); err != nil {
+			return nil, nil, err
+		}
+		collections = append(collections, parsed.Find+parsed.Aggregate+parsed.Count+parsed.Distinct)
+		for _, element := range document {
+			switch element.Key {
+			case "find", "aggregate", "count", "distinct":
+			case "projection":
+				references = mongoProjection(element.Value, references)
+			case "pipeline":
+				stages, _ := element.Value.(bson.A)
+				for _, stage := range stages {
+					if stage, ok := stage.(bson.D); ok && len(stage) == 1 && stage[0].Key == "$project" {
+						references = mongoProjection(stage[0].Value, references)
+						continue
+					}
+					references = mongoNames(stage, references)
+				}
+			case "key":
+				if key, ok := element.Value.(string); ok {
+					references = append(references, mongoReference(key, false))
+				}
+			default:
+				references = mongoNames(element.Value, references)
+			}
+		}
+	}
+	return collections, references, nil
+}
+
+// mongoProjection adds the fields of a projection, plain when included as
+// they are
+func mongoProjection(projection interface{}, references []sqlparse.Reference) []sqlparse.Reference {
+	fields, ok := projection.(bson.D)
+	if !ok {
+		return mongoNames(projection, references)
+	}
+	for _, field := range fields {
+		switch value := field.Value.(type) {
+		case bool:
+			references = append(references, mongoReference(field.Key, value && !strings.Contains(field.Key, ".")))
+		case int32, int64, float64:
+			included := value != int32(0) && value != int64(0) && value != float64(0)
+			references = append(references, mongoReference(field.Key, included && !strings.Contains(field.Key, ".")))
+		default:
+			references = append(references, mongoReference(field.Key, false))
+			references = mongoNames(value, references)
+		}
+	}
+	return references
+}
+
+// mongoNames adds the field names and field paths found anywhere in value
+func mongoNames(value interface{}, references []sqlparse.Reference) []sqlparse.Reference {
+	switch value := value.(type) {
+	case bson.D:
+		for _, element := range value {
+			if !strings.HasPrefix(element.Key, "$") {
+				references = append(references, mongoReference(element.Key, false))
+			}
+			references = mongoNames(element.Value, references)
+		}
+	case bson.A:
+		for _, item := range value {
+			references = mongoNames(item, references)
+		}
+	case string:
+		// "$field.path" refers to a field, "$$variable" to a variable
+		if strings.HasPrefix(value, "$") && !strings.HasPrefix(value, "$$") {
+			references = append(references, mongoReference(value[1:], false))
+		}
+	}
+	return references
+}
+
+// mongoReference refers to the top level field of a dotted path
+func mongoReference(path string, plain bool) sqlparse.Reference {
+	name, _, _ := strings.Cut(path, ".")
+	return sqlparse.Reference{Name: name, Plain: plain}
+}
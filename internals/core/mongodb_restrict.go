@@ -0,0 +1,144 @@
+package core
+
+import (
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// restrictMongo adds the policy of the collection each command of a script
+// reads to its filter, or as a first $match stage of an aggregation. Writes to
+// collections under a policy and stages reading them from or writing them to
+// another collection, such as $lookup or $out, are refused.
+func restrictMongo(script string, policies Policies) (string, error) {
+	entries, err := splitMongoScript(script)
+	if err != nil {
+		return "", err
+	}
+	var restricted strings.Builder
+	last := 0
+	for _, entry := range entries {
+		parsed, err := parseMongoQuery(entry.Text)
+		if err != nil {
+			statement, statementErr := parseMongoStatement(entry.Text)
+			if statementErr != nil {
+				return "", err
+			}
+			if collection := statement.collection(); policies.For(collection) != nil {
+				return "", &RestrictedError{Table: collection}
+			}
+			continue
+		}
+		for _, stage := range parsed.Pipeline {
+			for _, collection := range mongoStageCollections(stage) {
+				if policies.For(collection) != nil {
+					return "", &RestrictedError{Table: collection}
+				}
+			}
+		}
+		policy := policies.For(parsed.Find + parsed.Aggregate + parsed.Count + parsed.Distinct)
+		if policy == nil {
+			continue
+		}
+		filter, err := policy.BSON()
+		if err != nil {
+			return "", err
+		}
+		var document bson.D
+		if err := bson.UnmarshalExtJSON([]byte(entry.Text), false, &document); err != nil {
+			return "", err
+		}
+		if parsed.Aggregate != "" {
+			document = restrictPipeline(document, filter)
+		} else {
+			document = restrictFilter(document, filter)
+		}
+		text, err := bson.MarshalExtJSON(document, false, false)
+		if err != nil {
+			return "", err
+		}
+		restricted.WriteString(script[last:entry.Pos])
+		restricted.Write(text)
+		last = entry.Pos + len(entry.Text)
+	}
+	restricted.WriteString(script[last:])
+	return restricted.String(), nil
+}
+
+// restrictFilter adds the policy to the filter of a find, count or distinct
+func restrictFilter(document bson.D, policy bson.D) bson.D {
+	for i, element := range document {
+		if element.Key != "filter" {
+			continue
+		}
+		if element.Value != nil {
+			document[i].Value = bson.D{{Key: "$and", Value: bson.A{element.Value, policy}}}
+		} else {
+			document[i].Value = policy
+		}
+		return document
+	}
+	return append(document, bson.E{Key: "filter", Value: policy})
+}
+
+// restrictPipeline makes the policy the first stage of an aggregation
+func restrictPipeline(document bson.D, policy bson.D) bson.D {
+	pipeline := bson.A{bson.D{{Key: "$match", Value: policy}}}
+	for i, element := range document {
+		if element.Key != "pipeline" {
+			continue
+		}
+		stages, _ := element.Value.(bson.A)
+		document[i].Value = append(pipeline, stages...)
+		return document
+	}
+	return append(document, bson.E{Key: "pipeline", Value: pipeline})
+}
+
+// mongoStageCollections returns the other collections a stage reads or
+// writes, those of the stages nested in it included
+func mongoStageCollections(value interface{}) []string {
+	var collections []string
+	switch value := value.(type) {
+	case bson.D:
+		for _, element := range value {
+			switch element.Key {
+			case "$lookup", "$graphLookup":
+				collections = append(collections, mongoStageField(element.Value, "from")...)
+			case "$unionWith", "$out":
+				collections = append(collections, mongoStageField(element.Value, "coll")...)
+			case "$merge":
+				collections = append(collections, mongoStageField(element.Value, "into")...)
+				if stage, ok := element.Value.(bson.D); ok {
+					for _, into := range stage {
+						if into.Key == "into" {
+							collections = append(collections, mongoStageField(into.Value, "coll")...)
+						}
+					}
+				}
+			}
+			collections = append(collections, mongoStageCollections(element.Value)...)
+		}
+	case bson.A:
+		for _, item := range value {
+			collections = append(collections, mongoStageCollections(item)...)
+		}
+	}
+	return collections
+}
+
+// mongoStageField returns the collection a stage names either as its value or
+// as the field key of its document
+func mongoStageField(value interface{}, key string) []string {
+	switch value := value.(type) {
+	case string:
+		return []string{value}
+	case bson.D:
+		for _, element := range value {
+			if name, ok := element.Value.(string); ok && element.Key == key {
+				return []string{name}
+			}
+		}
+	}
+	return nil
+}
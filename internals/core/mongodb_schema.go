@@ -0,0 +1,228 @@
+package core
+
+import (
+	"butler-server/internals"
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// defaultMongoSampleSize is the number of documents sampled when the config
+// does not set one
+const defaultMongoSampleSize = 100
+
+// mongoTypeNames maps BSON types to the aliases used by the $type operator
+var mongoTypeNames = map[bsontype.Type]string{
+	bsontype.Double:           "double",
+	bsontype.String:           "string",
+	bsontype.EmbeddedDocument: "object",
+	bsontype.Array:            "array",
+	bsontype.Binary:           "binData",
+	bsontype.Undefined:        "undefined",
+	bsontype.ObjectID:         "objectId",
+	bsontype.Boolean:          "bool",
+	bsontype.DateTime:         "date",
+	bsontype.Null:             "null",
+	bsontype.Regex:            "regex",
+	bsontype.DBPointer:        "dbPointer",
+	bsontype.JavaScript:       "javascript",
+	bsontype.Symbol:           "symbol",
+	bsontype.CodeWithScope:    "javascriptWithScope",
+	bsontype.Int32:            "int",
+	bsontype.Timestamp:        "timestamp",
+	bsontype.Int64:            "long",
+	bsontype.Decimal128:       "decimal",
+	bsontype.MinKey:           "minKey",
+	bsontype.MaxKey:           "maxKey",
+}
+
+type fieldStats struct {
+	position int
+	present  int
+	lastDoc  int
+	types    map[string]int
+}
+
+// schemaSampler accumulates the field paths and types seen across sampled
+// documents. Nested document fields are reported as dotted paths and array
+// elements under the array path suffixed with [], e.g. items[].sku.
+type schemaSampler struct {
+	fields   map[string]*fieldStats
+	document int
+}
+
+func (s *schemaSampler) addDocument(doc bson.Raw) error {
+	s.document++
+	return s.walkDocument("", doc)
+}
+
+func (s *schemaSampler) walkDocument(prefix string, doc bson.Raw) error {
+	elements, err := doc.Elements()
+	if err != nil {
+		return err
+	}
+	for _, element := range elements {
+		path := element.Key()
+		if prefix != "" {
+			path = prefix + "." + path
+		}
+		if err := s.observe(path, element.Value()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *schemaSampler) observe(path string, value bson.RawValue) error {
+	stats, ok := s.fields[path]
+	if !ok {
+		stats = &fieldStats{position: len(s.fields) + 1, types: make(map[string]int)}
+		s.fields[path] = stats
+	}
+	if stats.lastDoc != s.document {
+		stats.lastDoc = s.document
+		stats.present++
+	}
+	typeName, ok := mongoTypeNames[value.Type]
+	if !ok {
+		typeName = value.Type.String()
+	}
+	stats.types[typeName]++
+
+	switch value.Type {
+	case bsontype.EmbeddedDocument:
+		return s.walkDocument(path, value.Document())
+	case bsontype.Array:
+		values, err := value.Array().Values()
+		if err != nil {
+			return err
+		}
+		for _, item := range values {
+			if err := s.observe(path+"[]", item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *schemaSampler) schema() map[string]internals.SchemaDetails {
+	schemaDetails := make(map[string]internals.SchemaDetails, len(s.fields))
+	for path, stats := range s.fields {
+		total := 0
+		types := make([]internals.TypeFrequency, 0, len(stats.types))
+		for typeName, count := range stats.types {
+			total += count
+			types = append(types, internals.TypeFrequency{Type: typeName, Count: count})
+		}
+		sort.Slice(types, func(i, j int) bool {
+			if types[i].Count != types[j].Count {
+				return types[i].Count > types[j].Count
+			}
+			return types[i].Type < types[j].Type
+		})
+		names := make([]string, 0, len(types))
+		nullable := stats.present < s.document
+		for i := range types {
+			types[i].Frequency = float64(types[i].Count) / float64(total)
+			if types[i].Type == "null" || types[i].Type == "undefined" {
+				nullable = true
+				continue
+			}
+			names = append(names, types[i].Type)
+		}
+		if len(names) == 0 {
+			names = append(names, "null")
+		}
+		isNullable := "NO"
+		if nullable {
+			isNullable = "YES"
+		}
+		schemaDetails[path] = internals.SchemaDetails{
+			DataType:   strings.Join(names, "|"),
+			IsNullable: isNullable,
+			Position:   strconv.Itoa(stats.position),
+			IsPrimary:  path == "_id",
+			Frequency:  float64(stats.present) / float64(s.document),
+			Types:      types,
+		}
+	}
+	return schemaDetails
+}
+
+// Metadata infers the schema of a collection from a $sample of its documents,
+// reporting every observed field path with its BSON types, how often each
+// occurs and whether the field can be missing or null. Fields that are part
+// of an index key are marked as indexed.
+func (this *MongoDBDatabase) Metadata(ctx context.Context, table string) (map[string]internals.SchemaDetails, error) {
+	sampleSize := this.config.SampleSize
+	if sampleSize <= 0 {
+		sampleSize = defaultMongoSampleSize
+	}
+	collection := this.conn.Database(this.config.Database).Collection(table)
+	sampler := &schemaSampler{fields: make(map[string]*fieldStats)}
+
+	err := this.killOnCancel(ctx, func(comment string) error {
+		pipeline := mongo.Pipeline{{{Key: "$sample", Value: bson.D{{Key: "size", Value: sampleSize}}}}}
+		cursor, err := collection.Aggregate(ctx, pipeline, options.Aggregate().SetComment(comment))
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+		for cursor.Next(ctx) {
+			if err := sampler.addDocument(cursor.Current); err != nil {
+				return err
+			}
+		}
+		return cursor.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	schemaDetails := make(map[string]internals.SchemaDetails)
+	if sampler.document > 0 {
+		schemaDetails = sampler.schema()
+	}
+
+	indexed, err := this.indexedFields(ctx, collection)
+	if err != nil {
+		return nil, err
+	}
+	for path, details := range schemaDetails {
+		if indexed[strings.ReplaceAll(path, "[]", "")] {
+			details.Index = true
+			schemaDetails[path] = details
+		}
+	}
+	return schemaDetails, nil
+}
+
+// indexedFields returns the field paths used in any index key of the collection
+func (this *MongoDBDatabase) indexedFields(ctx context.Context, collection *mongo.Collection) (map[string]bool, error) {
+	cursor, err := collection.Indexes().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var indexes []struct {
+		Key bson.D `bson:"key"`
+	}
+	if err := cursor.All(ctx, &indexes); err != nil {
+		return nil, err
+	}
+	fields := make(map[string]bool)
+	for _, index := range indexes {
+		for _, key := range index.Key {
+			fields[key.Key] = true
+		}
+	}
+	return fields, nil
+}
@@ -0,0 +1,141 @@
+package core
+
+import (
+	"butler-server/internals/sqlparse"
+	"context"
+	"fmt"
+	"time"
+)
+
+// mongoScriptEntry is one command of a Mongo script, Pos is the byte offset
+// of Text in the script
+type mongoScriptEntry struct {
+	Text string
+	Pos  int
+	Line int
+}
+
+// splitMongoScript splits a script into its top level JSON documents, which
+// may be separated by whitespace, commas or semicolons
+func splitMongoScript(script string) ([]mongoScriptEntry, error) {
+	var entries []mongoScriptEntry
+	depth, start := 0, -1
+	var opens []int
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+		switch {
+		case c == '"' || c == '\'':
+			end := i + 1
+			for end < len(script) && script[end] != c {
+				if script[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(script) {
+				return nil, mongoSyntaxError(script, i, "unterminated string")
+			}
+			i = end
+		case c == '{' || c == '[':
+			if depth == 0 {
+				start = i
+			}
+			opens = append(opens, i)
+			depth++
+		case c == '}' || c == ']':
+			if depth == 0 {
+				return nil, mongoSyntaxError(script, i, "unexpected %c", c)
+			}
+			opens = opens[:len(opens)-1]
+			depth--
+			if depth == 0 {
+				line, _ := sqlparse.Position(script, start)
+				entries = append(entries, mongoScriptEntry{Text: script[start : i+1], Pos: start, Line: line})
+			}
+		case depth == 0 && c != ';' && c != ',' && c != ' ' && c != '\t' && c != '\r' && c != '\n':
+			return nil, mongoSyntaxError(script, i, "expected a JSON document")
+		}
+	}
+	if depth > 0 {
+		return nil, mongoSyntaxError(script, opens[0], "unclosed %c", script[opens[0]])
+	}
+	return entries, nil
+}
+
+func mongoSyntaxError(script string, pos int, format string, args ...interface{}) error {
+	line, column := sqlparse.Position(script, pos)
+	return &sqlparse.SyntaxError{Pos: pos, Line: line, Column: column, Message: fmt.Sprintf(format, args...)}
+}
+
+// Script runs the commands of a script one after the other. Each is either a
+// console command as described on mongoQuery, paged like Query, or a write
+// statement as described on mongoStatement. Writes are not wrapped in a
+// transaction and the commands after a failing one are skipped. Read only
+// clusters refuse scripts containing any write.
+func (this *MongoDBDatabase) Script(ctx context.Context, script string, page int, size int) ([]StatementResult, error) {
+	entries, err := splitMongoScript(script)
+	if err != nil {
+		return nil, err
+	}
+	if this.config.ReadOnly {
+		if err := checkMongoReadOnly(script); err != nil {
+			return nil, err
+		}
+	}
+	skip, limit := int64(page*size), int64(size)
+	db := this.conn.Database(this.config.Database)
+
+	ctx, cancel := withTimeout(ctx, this.config)
+	defer cancel()
+
+	results := make([]StatementResult, len(entries))
+	failed := false
+	for i, entry := range entries {
+		results[i] = StatementResult{Statement: entry.Text, Line: entry.Line}
+		if failed {
+			results[i].Skipped = true
+			continue
+		}
+
+		start := time.Now()
+		err := this.killOnCancel(ctx, func(comment string) error {
+			if parsed, err := parseMongoQuery(entry.Text); err == nil {
+				results[i].Result, err = runMongoQuery(ctx, db, parsed, skip, limit, comment)
+				return err
+			}
+			statement, err := parseMongoStatement(entry.Text)
+			if err != nil {
+				return err
+			}
+			affected, err := runMongoStatement(ctx, db, statement)
+			results[i].RowsAffected = &affected
+			return err
+		})
+		results[i].DurationMs = float64(time.Since(start).Microseconds()) / 1000
+		if err != nil {
+			results[i].Error = err.Error()
+			failed = true
+		}
+	}
+	return results, nil
+}
+
+// checkMongoReadOnly refuses write statements and aggregations storing their
+// output
+func checkMongoReadOnly(script string) error {
+	entries, err := splitMongoScript(script)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		parsed, err := parseMongoQuery(entry.Text)
+		if err == nil && !parsed.writes() {
+			continue
+		}
+		if _, statementErr := parseMongoStatement(entry.Text); err != nil && statementErr != nil {
+			return err
+		}
+		return &ReadOnlyError{Statement: entry.Text, Line: entry.Line}
+	}
+	return nil
+}
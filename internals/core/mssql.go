@@ -2,29 +2,45 @@ package core
 
 import (
 	"butler-server/internals"
+	"butler-server/internals/dialect"
+	"butler-server/internals/export"
+	"context"
 	"database/sql"
 	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+
+	_ "github.com/microsoft/go-mssqldb"
 )
 
+// msSQLDefaultSchema is the schema unqualified table names resolve to
+const msSQLDefaultSchema = "dbo"
+
 type MsSQLDatabase struct {
 	conn   *sql.DB
 	config DatabaseConfig
 }
 
-func (this *MsSQLDatabase) Connect() error {
-	connectionString := fmt.Sprintf("server=%s;user id=%s;password=%s;port=%s;",
-		this.config.Hostname, this.config.Username, this.config.Password, this.config.Port)
+func (this *MsSQLDatabase) Connect(ctx context.Context) error {
+	query := url.Values{}
 	if this.config.Database != "" {
-		connectionString += "database=" + this.config.Database
+		query.Add("database", this.config.Database)
+	}
+	connectionURL := url.URL{
+		Scheme:   "sqlserver",
+		User:     url.UserPassword(this.config.Username, this.config.Password),
+		Host:     fmt.Sprintf("%s:%s", this.config.Hostname, this.config.Port),
+		RawQuery: query.Encode(),
 	}
 
-	db, err := sql.Open("sqlserver", connectionString)
+	db, err := sql.Open("sqlserver", connectionURL.String())
 	if err != nil {
 		return err
 	}
 
-	if err = db.Ping(); err != nil {
+	if err = db.PingContext(ctx); err != nil {
 		return err
 	}
 
@@ -33,8 +49,8 @@ func (this *MsSQLDatabase) Connect() error {
 	return nil
 }
 
-func (this *MsSQLDatabase) Databases() ([]string, error) {
-	rows, err := this.conn.Query("SELECT name FROM sys.databases")
+func (this *MsSQLDatabase) Databases(ctx context.Context) ([]string, error) {
+	rows, err := this.conn.QueryContext(ctx, "SELECT name FROM sys.databases")
 	if err != nil {
 		return nil, err
 	}
@@ -52,9 +68,16 @@ func (this *MsSQLDatabase) Databases() ([]string, error) {
 
 	return databases, nil
 }
-func (this *MsSQLDatabase) Tables() ([]string, error) {
-	query := fmt.Sprintf("SELECT table_name FROM information_schema.tables WHERE table_type = 'BASE TABLE' AND table_catalog = '%s'", this.config.Database)
-	rows, err := this.conn.Query(query)
+
+// Tables lists the base tables of the database. Tables outside the default
+// dbo schema are returned qualified as schema.table.
+func (this *MsSQLDatabase) Tables(ctx context.Context) ([]string, error) {
+	query := `
+		SELECT table_schema, table_name
+		FROM information_schema.tables
+		WHERE table_type = 'BASE TABLE' AND table_catalog = @p1
+		ORDER BY table_schema, table_name;`
+	rows, err := this.conn.QueryContext(ctx, query, this.config.Database)
 	if err != nil {
 		return nil, err
 	}
@@ -62,39 +85,29 @@ func (this *MsSQLDatabase) Tables() ([]string, error) {
 
 	var tables []string
 	for rows.Next() {
-		var tableName string
-		err := rows.Scan(&tableName)
+		var schemaName, tableName string
+		err := rows.Scan(&schemaName, &tableName)
 		if err != nil {
 			return nil, err
 		}
+		if schemaName != msSQLDefaultSchema {
+			tableName = schemaName + "." + tableName
+		}
 		tables = append(tables, tableName)
 	}
 
 	return tables, nil
 }
-func (this *MsSQLDatabase) Metadata(table string) (map[string]internals.SchemaDetails, error) {
+
+func (this *MsSQLDatabase) Metadata(ctx context.Context, table string) (map[string]internals.SchemaDetails, error) {
 	resultCh := make(chan Result, 3)
 	var wg sync.WaitGroup
 
+	wg.Add(3)
+
 	go func() {
 		defer wg.Done()
-		query := `
-		SELECT
-			fk.name AS constraint_name,
-			OBJECT_NAME(fk.parent_object_id) AS table_name,
-			c1.name AS column_name,
-			OBJECT_NAME(fk.referenced_object_id) AS foreign_table_name,
-			c2.name AS foreign_column_name
-		FROM sys.foreign_keys AS fk
-		JOIN sys.foreign_key_columns AS fkc
-			ON fk.object_id = fkc.constraint_object_id
-		JOIN sys.columns AS c1
-			ON fkc.parent_object_id = c1.object_id
-			AND fkc.parent_column_id = c1.column_id
-		JOIN sys.columns AS c2
-			ON fkc.referenced_object_id = c2.object_id
-			AND fkc.referenced_column_id = c2.column_id;`
-		schemaDetails, err := internals.FetchSchemaDetails(this.conn, query, table)
+		schemaDetails, err := this.fetchSchemaDetails(ctx, table)
 		if err != nil {
 			resultCh <- Result{Details: nil, Error: err, Type: "schema"}
 			return
@@ -103,25 +116,7 @@ func (this *MsSQLDatabase) Metadata(table string) (map[string]internals.SchemaDe
 	}()
 	go func() {
 		defer wg.Done()
-		query := `
-		SELECT
-			conname AS constraint_name,
-			conrelid::regclass AS table_name,
-			ta.attname AS column_name,
-			confrelid::regclass AS foreign_table_name,
-			fa.attname AS foreign_column_name
-		FROM (
-			SELECT
-				conname,
-				conrelid,
-				confrelid,
-				unnest(conkey) AS conkey,
-				unnest(confkey) AS confkey
-			FROM pg_constraint
-		) sub
-		JOIN pg_attribute AS ta ON ta.attrelid = conrelid AND ta.attnum = conkey
-		JOIN pg_attribute AS fa ON fa.attrelid = confrelid AND fa.attnum = confkey;`
-		foreignKeyDetails, err := internals.FetchForeignKeyDetails(this.conn, query, table)
+		foreignKeyDetails, err := this.fetchForeignKeyDetails(ctx, table)
 		if err != nil {
 			resultCh <- Result{Details: nil, Error: err, Type: "foreign key"}
 			return
@@ -131,14 +126,7 @@ func (this *MsSQLDatabase) Metadata(table string) (map[string]internals.SchemaDe
 
 	go func() {
 		defer wg.Done()
-		query := `
-		SELECT 
-			i.name AS indexname,
-			i.definition AS indexdef
-		FROM sys.indexes i
-		INNER JOIN sys.objects o ON i.object_id = o.object_id
-		WHERE o.name = ?;`
-		indexDetails, err := internals.FetchIndexDetails(this.conn, query, table)
+		indexDetails, err := this.fetchIndexDetails(ctx, table)
 		if err != nil {
 			resultCh <- Result{Details: nil, Error: err, Type: "index"}
 			return
@@ -161,24 +149,34 @@ func (this *MsSQLDatabase) Metadata(table string) (map[string]internals.SchemaDe
 	return schemaDetails, nil
 }
 
-func (this *MsSQLDatabase) Data(table string, filter Filter) (map[string]interface{}, error) {
+func (this *MsSQLDatabase) Data(ctx context.Context, table string, filter Filter) (map[string]interface{}, error) {
+	// go-mssqldb sends an attention packet when ctx is done, which aborts the
+	// batch on the server
+	ctx, cancel := withTimeout(ctx, this.config)
+	defer cancel()
+	if filter.Pagination == PaginationCursor {
+		return keysetData(ctx, this.source(table), filter)
+	}
 
-	filterMap := internals.ParseFilterParam(filter.Filter)
-	query, err := ParseSQLQuery(table, filter, filterMap)
+	query, args, err := this.parseSQLQuery(table, filter)
 	if err != nil {
 		return nil, err
 	}
-
-	rows, err := this.conn.Query(query, internals.FilterValues(filterMap)...)
+	rows, err := this.conn.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	result, count, err := internals.ParseRows(rows)
+	result, count, err := internals.ParsePage(rows, pageCountColumn)
 	if err != nil {
 		return nil, err
 	}
+	if !filter.exactCount() {
+		if count, err = countRows(ctx, this.source(table), filter); err != nil {
+			return nil, err
+		}
+	}
 
 	dbMap := make(map[string]interface{})
 	dbMap["data"] = result
@@ -186,8 +184,65 @@ func (this *MsSQLDatabase) Data(table string, filter Filter) (map[string]interfa
 	return dbMap, nil
 }
 
-func (this *MsSQLDatabase) Query(query string, page int, size int) ([]map[string]interface{}, error) {
-	return nil, nil
+func (this *MsSQLDatabase) source(table string) sqlSource {
+	return sqlSource{
+		dialect:  dialect.MSSQL,
+		table:    table,
+		from:     quoteMsSQLTable(table),
+		fetch:    this.fetch,
+		stream:   this.stream,
+		estimate: this.estimatedCount,
+	}
+}
+
+func (this *MsSQLDatabase) fetch(ctx context.Context, query string, args []interface{}) (*internals.ResultSet, error) {
+	var result *internals.ResultSet
+	err := this.stream(ctx, query, args, func(rows *sql.Rows) error {
+		var err error
+		result, err = internals.ParseRows(rows)
+		return err
+	})
+	return result, err
+}
+
+func (this *MsSQLDatabase) stream(ctx context.Context, query string, args []interface{}, fn func(rows *sql.Rows) error) error {
+	rows, err := this.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	return fn(rows)
+}
+
+func (this *MsSQLDatabase) Export(ctx context.Context, table string, filter Filter, w export.Writer) error {
+	return exportData(ctx, this.source(table), filter, w)
+}
+
+func (this *MsSQLDatabase) ExportQuery(ctx context.Context, query string, w export.Writer) error {
+	return exportAdHoc(ctx, this.conn, this.config, dialect.MSSQL, query, w)
+}
+
+// estimatedCount sums the row counts of the heap or clustered index partitions
+func (this *MsSQLDatabase) estimatedCount(ctx context.Context, table string) (interface{}, error) {
+	query := `SELECT SUM(rows) AS count FROM sys.partitions WHERE object_id = OBJECT_ID(@p1) AND index_id IN (0, 1)`
+	rows, err := this.fetch(ctx, query, []interface{}{quoteMsSQLTable(table)})
+	if err != nil {
+		return nil, err
+	}
+	return firstValue(rows, "count"), nil
+}
+
+// Query runs an ad-hoc statement, paging plain queries with Paginate
+func (this *MsSQLDatabase) Query(ctx context.Context, query string, page int, size int) (*internals.ResultSet, error) {
+	return queryAdHoc(ctx, this.conn, this.config, dialect.MSSQL, query, page, size)
+}
+
+func (this *MsSQLDatabase) Script(ctx context.Context, script string, page int, size int) ([]StatementResult, error) {
+	return runScript(ctx, this.conn, this.config, dialect.MSSQL, script, page, size, nil)
+}
+
+func (this *MsSQLDatabase) DryRun(ctx context.Context, queries []string) ([]StatementResult, error) {
+	return dryRun(ctx, this.conn, this.config, dialect.MSSQL, queries, nil)
 }
 
 func (this *MsSQLDatabase) Close() error {
@@ -200,27 +255,180 @@ func (this *MsSQLDatabase) Close() error {
 	return nil
 }
 
-func (this *MsSQLDatabase) Execute(queries []string) error {
-	tx, err := this.conn.Begin()
+func (this *MsSQLDatabase) Execute(ctx context.Context, queries []string, revert bool) ([]StatementResult, error) {
+	return execute(ctx, this, this.conn, dialect.MSSQL, queries, revert, nil)
+}
+
+func (this *MsSQLDatabase) parseSQLQuery(table string, filter Filter) (string, []interface{}, error) {
+	page, err := strconv.Atoi(filter.Page)
 	if err != nil {
-		return err
+		return "", nil, err
+	}
+	size, err := strconv.Atoi(filter.Size)
+	if err != nil {
+		return "", nil, err
+	}
+	if filter.Order != "asc" && filter.Order != "desc" {
+		return "", nil, fmt.Errorf("invalid order parameter")
+	}
+	offset := (page) * size
+
+	query := fmt.Sprintf(`SELECT %s FROM %s`, offsetColumns(filter), quoteMsSQLTable(table))
+	where, args, err := whereClause(dialect.MSSQL, filter.conditions())
+	if err != nil {
+		return "", nil, err
+	}
+	query += where
+	// OFFSET/FETCH is only valid after an ORDER BY
+	if filter.Sort != "" {
+		query += fmt.Sprintf(" ORDER BY %s %s", quoteMsSQLIdentifier(filter.Sort), strings.ToUpper(filter.Order))
+	} else {
+		query += " ORDER BY (SELECT NULL)"
 	}
+	query += fmt.Sprintf(" OFFSET %d ROWS FETCH NEXT %d ROWS ONLY;", offset, size)
 
-	defer func() {
-		if err := tx.Rollback(); err != nil {
-			fmt.Println(err)
+	return query, args, nil
+}
+
+// splitMsSQLTable splits an optionally schema qualified table name
+func splitMsSQLTable(table string) (string, string) {
+	if i := strings.Index(table, "."); i >= 0 {
+		return table[:i], table[i+1:]
+	}
+	return msSQLDefaultSchema, table
+}
+
+func quoteMsSQLIdentifier(name string) string {
+	return "[" + strings.ReplaceAll(name, "]", "]]") + "]"
+}
+
+func quoteMsSQLTable(table string) string {
+	schemaName, tableName := splitMsSQLTable(table)
+	return quoteMsSQLIdentifier(schemaName) + "." + quoteMsSQLIdentifier(tableName)
+}
+
+func (this *MsSQLDatabase) fetchSchemaDetails(ctx context.Context, table string) (map[string]internals.SchemaDetails, error) {
+	query := `
+		SELECT
+			c.name AS column_name,
+			t.name AS data_type,
+			CASE WHEN t.name IN ('nchar', 'nvarchar') AND c.max_length > 0 THEN c.max_length / 2 ELSE c.max_length END AS max_length,
+			CASE WHEN c.is_nullable = 1 THEN 'YES' ELSE 'NO' END AS is_nullable,
+			OBJECT_DEFINITION(c.default_object_id) AS column_default,
+			c.column_id AS ordinal_position,
+			CASE WHEN EXISTS (
+				SELECT 1 FROM sys.indexes i
+				JOIN sys.index_columns ic ON ic.object_id = i.object_id AND ic.index_id = i.index_id
+				WHERE i.object_id = c.object_id AND i.is_primary_key = 1 AND ic.column_id = c.column_id
+			) THEN 1 ELSE 0 END AS is_primary
+		FROM sys.columns c
+		JOIN sys.types t ON t.user_type_id = c.user_type_id
+		WHERE c.object_id = OBJECT_ID(@p1)
+		ORDER BY c.column_id;`
+	rows, err := this.conn.QueryContext(ctx, query, quoteMsSQLTable(table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schemaDetails := make(map[string]internals.SchemaDetails)
+	for rows.Next() {
+		var columnName, dataType, isNullable, ordinalPosition string
+		var maxLength sql.NullInt64
+		var columnDefault sql.NullString
+		var isPrimary int
+
+		err := rows.Scan(&columnName, &dataType, &maxLength, &isNullable, &columnDefault, &ordinalPosition, &isPrimary)
+		if err != nil {
+			return nil, err
 		}
-	}()
+		schemaDetails[columnName] = internals.SchemaDetails{
+			DataType:      dataType,
+			MaxLength:     maxLength,
+			IsNullable:    isNullable,
+			Position:      ordinalPosition,
+			ColumnDefault: columnDefault,
+			IsPrimary:     isPrimary == 1,
+		}
+	}
+
+	return schemaDetails, nil
+}
+
+func (this *MsSQLDatabase) fetchIndexDetails(ctx context.Context, table string) ([]internals.IndexDetails, error) {
+	query := `
+		SELECT i.name AS index_name, i.type_desc AS index_algorithm, i.is_unique, col.name AS column_name
+		FROM sys.indexes i
+		JOIN sys.index_columns ic ON ic.object_id = i.object_id AND ic.index_id = i.index_id
+		JOIN sys.columns col ON col.object_id = ic.object_id AND col.column_id = ic.column_id
+		WHERE i.object_id = OBJECT_ID(@p1) AND ic.is_included_column = 0
+		ORDER BY i.name, ic.key_ordinal;`
+	rows, err := this.conn.QueryContext(ctx, query, quoteMsSQLTable(table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	for _, query := range queries {
-		_, err := tx.Exec(query)
+	var indexes []internals.IndexDetails
+	for rows.Next() {
+		var indexName, indexAlgorithm, columnName string
+		var isUnique bool
+		err := rows.Scan(&indexName, &indexAlgorithm, &isUnique, &columnName)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		indexes = append(indexes, internals.IndexDetails{
+			IndexName:      indexName,
+			IndexAlgorithm: indexAlgorithm,
+			IsUnique:       isUnique,
+			ColumnName:     columnName,
+		})
 	}
 
-	if err := tx.Commit(); err != nil {
-		return err
+	return indexes, nil
+}
+
+func (this *MsSQLDatabase) fetchForeignKeyDetails(ctx context.Context, table string) ([]internals.ForeignKeyDetails, error) {
+	query := `
+		SELECT
+			fk.name AS constraint_name,
+			c1.name AS column_name,
+			OBJECT_SCHEMA_NAME(fk.referenced_object_id) AS foreign_schema_name,
+			OBJECT_NAME(fk.referenced_object_id) AS foreign_table_name,
+			c2.name AS foreign_column_name
+		FROM sys.foreign_keys AS fk
+		JOIN sys.foreign_key_columns AS fkc
+			ON fk.object_id = fkc.constraint_object_id
+		JOIN sys.columns AS c1
+			ON fkc.parent_object_id = c1.object_id
+			AND fkc.parent_column_id = c1.column_id
+		JOIN sys.columns AS c2
+			ON fkc.referenced_object_id = c2.object_id
+			AND fkc.referenced_column_id = c2.column_id
+		WHERE fk.parent_object_id = OBJECT_ID(@p1);`
+	rows, err := this.conn.QueryContext(ctx, query, quoteMsSQLTable(table))
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	defer rows.Close()
+
+	var foreignKeys []internals.ForeignKeyDetails
+	for rows.Next() {
+		var constraintName, columnName, foreignSchemaName, foreignTableName, foreignColumnName string
+		err := rows.Scan(&constraintName, &columnName, &foreignSchemaName, &foreignTableName, &foreignColumnName)
+		if err != nil {
+			return nil, err
+		}
+		if foreignSchemaName != msSQLDefaultSchema {
+			foreignTableName = foreignSchemaName + "." + foreignTableName
+		}
+		foreignKeys = append(foreignKeys, internals.ForeignKeyDetails{
+			ConstraintName:    constraintName,
+			TableName:         table,
+			ColumnName:        columnName,
+			ForeignTableName:  foreignTableName,
+			ForeignColumnName: foreignColumnName,
+		})
+	}
+	return foreignKeys, nil
 }
@@ -0,0 +1,219 @@
+package core
+
+import (
+	"butler-server/internals/dialect"
+	"context"
+	"database/sql/driver"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Explain reads the XML showplan of the statement with SET SHOWPLAN_XML or,
+// when analyze is set, runs it under SET STATISTICS XML to get the actual
+// plan
+func (this *MsSQLDatabase) Explain(ctx context.Context, query string, analyze bool) (*Plan, error) {
+	statement, err := explainable(dialect.MSSQL, query, analyze)
+	if err != nil {
+		return nil, err
+	}
+	config := explainConfig(this.config, analyze)
+	ctx, cancel := withTimeout(ctx, config)
+	defer cancel()
+
+	conn, err := this.conn.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	option := "SHOWPLAN_XML"
+	if analyze {
+		option = "STATISTICS XML"
+	}
+	if _, err := conn.ExecContext(ctx, "SET "+option+" ON"); err != nil {
+		return nil, err
+	}
+	defer func() {
+		// a connection left in showplan mode must not go back to the pool
+		if _, err := conn.ExecContext(context.Background(), "SET "+option+" OFF"); err != nil {
+			conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		}
+	}()
+
+	var raw string
+	err = readOnly(ctx, conn, config, dialect.MSSQL, func(q querier) error {
+		raw, err = mssqlShowplan(ctx, q, statement.Text)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return parseMsSQLPlan(raw, analyze)
+}
+
+// mssqlShowplan runs the statement and returns the showplan among its
+// results, which under STATISTICS XML follows the rows of the statement
+func mssqlShowplan(ctx context.Context, q querier, statement string) (string, error) {
+	rows, err := q.QueryContext(ctx, statement)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	plan := ""
+	for {
+		columns, err := rows.Columns()
+		if err != nil {
+			return "", err
+		}
+		if len(columns) == 1 && strings.HasSuffix(columns[0], "Showplan") {
+			for rows.Next() {
+				if err := rows.Scan(&plan); err != nil {
+					return "", err
+				}
+			}
+		} else {
+			for rows.Next() {
+			}
+		}
+		if !rows.NextResultSet() {
+			break
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	if plan == "" {
+		return "", fmt.Errorf("the server returned no plan")
+	}
+	return plan, nil
+}
+
+// xmlElement is any element of a showplan
+type xmlElement struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr   `xml:",any,attr"`
+	Children []xmlElement `xml:",any"`
+}
+
+func (e *xmlElement) attr(name string) string {
+	for _, attr := range e.Attrs {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// find returns the first descendant called name that is not part of a
+// nested operator
+func (e *xmlElement) find(name string) *xmlElement {
+	for i := range e.Children {
+		child := &e.Children[i]
+		if child.XMLName.Local == name {
+			return child
+		}
+		if child.XMLName.Local == "RelOp" {
+			continue
+		}
+		if found := child.find(name); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// operators returns the operators directly below e
+func (e *xmlElement) operators() []*xmlElement {
+	var operators []*xmlElement
+	for i := range e.Children {
+		child := &e.Children[i]
+		if child.XMLName.Local == "RelOp" {
+			operators = append(operators, child)
+		} else {
+			operators = append(operators, child.operators()...)
+		}
+	}
+	return operators
+}
+
+func parseMsSQLPlan(raw string, analyze bool) (*Plan, error) {
+	var showplan xmlElement
+	decoder := xml.NewDecoder(strings.NewReader(raw))
+	// the driver decodes the plan already but leaves the utf-16 declaration
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	if err := decoder.Decode(&showplan); err != nil {
+		return nil, fmt.Errorf("failed to read the plan: %w", err)
+	}
+	plan := &Plan{Analyzed: analyze, Raw: raw, Format: "xml"}
+	if stats := showplan.find("QueryTimeStats"); stats != nil {
+		plan.ExecutionMs = planNumber(stats.attr("ElapsedTime"))
+	}
+	operators := showplan.operators()
+	if len(operators) == 0 {
+		// statements without a query plan, such as a SELECT of constants
+		statement := showplan.find("StmtSimple")
+		if statement == nil {
+			return nil, fmt.Errorf("the plan has no statement")
+		}
+		plan.Root = newPlanNode(statement.attr("StatementType"))
+		plan.Root.Cost = planNumber(statement.attr("StatementSubTreeCost"))
+		return plan, nil
+	}
+	plan.Root = mssqlPlanNode(operators[0])
+	return plan, nil
+}
+
+func mssqlPlanNode(operator *xmlElement) *PlanNode {
+	node := newPlanNode(operator.attr("PhysicalOp"))
+	if logical := operator.attr("LogicalOp"); logical != "" && logical != node.Type {
+		node.Type += " (" + logical + ")"
+	}
+	if object := operator.find("Object"); object != nil {
+		node.Relation = strings.Trim(object.attr("Table"), "[]")
+		node.Index = strings.Trim(object.attr("Index"), "[]")
+	}
+	for _, name := range []string{"SeekPredicates", "Predicate", "OrderBy", "GroupBy"} {
+		if element := operator.find(name); element != nil {
+			if scalar := element.find("ScalarOperator"); scalar != nil {
+				node.Detail = scalar.attr("ScalarString")
+				break
+			}
+		}
+	}
+	node.EstimatedRows = planNumber(operator.attr("EstimateRows"))
+	node.Cost = planNumber(operator.attr("EstimatedTotalSubtreeCost"))
+
+	// actual counters are kept per thread, rows and executions add up and
+	// the slowest thread gives the elapsed time
+	if runtime := operator.find("RunTimeInformation"); runtime != nil {
+		var rows, executions, elapsed float64
+		timed := false
+		for i := range runtime.Children {
+			counters := &runtime.Children[i]
+			if value := planNumber(counters.attr("ActualRows")); value != nil {
+				rows += *value
+			}
+			if value := planNumber(counters.attr("ActualExecutions")); value != nil {
+				executions += *value
+			}
+			if value := planNumber(counters.attr("ActualElapsedms")); value != nil {
+				timed = true
+				if *value > elapsed {
+					elapsed = *value
+				}
+			}
+		}
+		node.ActualRows, node.Loops = &rows, &executions
+		if timed {
+			node.ActualTimeMs = &elapsed
+		}
+	}
+
+	for _, child := range operator.operators() {
+		node.Children = append(node.Children, mssqlPlanNode(child))
+	}
+	return node
+}
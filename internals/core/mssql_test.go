@@ -0,0 +1,223 @@
+package core
+
+import (
+	"butler-server/internals"
+	"butler-server/internals/dialect"
+	"butler-server/internals/filters"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestQuoteMsSQLTable(t *testing.T) {
+	tests := []struct {
+		table string
+		want  string
+	}{
+		{"users", "[dbo].[users]"},
+		{"sales.orders", "[sales].[orders]"},
+		{"a]b", "[dbo].[a]]b]"},
+		{"s]x.t]y", "[s]]x].[t]]y]"},
+		{"[users]", "[dbo].[[users]]]"},
+		{"sales.order.lines", "[sales].[order.lines]"},
+	}
+	for _, test := range tests {
+		if got := quoteMsSQLTable(test.table); got != test.want {
+			t.Errorf("quoteMsSQLTable(%q) = %q, want %q", test.table, got, test.want)
+		}
+	}
+}
+
+func TestMsSQLParseSQLQuery(t *testing.T) {
+	tests := []struct {
+		name   string
+		table  string
+		filter Filter
+		want   string
+		args   []interface{}
+	}{
+		{
+			"unsorted", "users",
+			Filter{Page: "0", Size: "10", Order: "asc"},
+			"SELECT *, COUNT(*) OVER() AS butler_total_count FROM [dbo].[users] ORDER BY (SELECT NULL) OFFSET 0 ROWS FETCH NEXT 10 ROWS ONLY;",
+			nil,
+		},
+		{
+			"sorted descending", "sales.orders",
+			Filter{Page: "2", Size: "25", Sort: "placed]at", Order: "desc", Count: CountNone},
+			"SELECT * FROM [sales].[orders] ORDER BY [placed]]at] DESC OFFSET 50 ROWS FETCH NEXT 25 ROWS ONLY;",
+			nil,
+		},
+		{
+			"filtered", "users",
+			Filter{
+				Page: "1", Size: "10", Sort: "id", Order: "asc", Count: CountExact,
+				Filter: &filters.Node{And: []*filters.Node{
+					{Column: "email", Operator: "=", Value: "a@b.c"},
+					{Column: "id", Operator: ">", Value: int64(3)},
+				}},
+			},
+			"SELECT *, COUNT(*) OVER() AS butler_total_count FROM [dbo].[users] WHERE ([email] = @p1 AND [id] > @p2) ORDER BY [id] ASC OFFSET 10 ROWS FETCH NEXT 10 ROWS ONLY;",
+			[]interface{}{"a@b.c", int64(3)},
+		},
+	}
+	db := &MsSQLDatabase{}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query, args, err := db.parseSQLQuery(test.table, test.filter)
+			if err != nil {
+				t.Fatalf("parseSQLQuery failed: %v", err)
+			}
+			if query != test.want {
+				t.Errorf("parseSQLQuery = %q, want %q", query, test.want)
+			}
+			if len(args) != 0 || len(test.args) != 0 {
+				if !reflect.DeepEqual(args, test.args) {
+					t.Errorf("parseSQLQuery bound %v, want %v", args, test.args)
+				}
+			}
+		})
+	}
+}
+
+func TestMsSQLParseSQLQueryOrder(t *testing.T) {
+	db := &MsSQLDatabase{}
+	_, _, err := db.parseSQLQuery("users", Filter{Page: "0", Size: "10", Sort: "id", Order: "asc; DROP TABLE users"})
+	if err == nil {
+		t.Error("parseSQLQuery accepted an injected order")
+	}
+}
+
+func TestMsSQLKeysetData(t *testing.T) {
+	tests := []struct {
+		name      string
+		order     string
+		direction string
+		want      string
+	}{
+		{"next ascending", "asc", cursorNext, "SELECT TOP 6 * FROM [sales].[orders] WHERE [status] = @p1 AND (([id] > @p2)) ORDER BY [id] ASC"},
+		{"next descending", "desc", cursorNext, "SELECT TOP 6 * FROM [sales].[orders] WHERE [status] = @p1 AND (([id] < @p2)) ORDER BY [id] DESC"},
+		{"previous ascending", "asc", cursorPrev, "SELECT TOP 6 * FROM [sales].[orders] WHERE [status] = @p1 AND (([id] < @p2)) ORDER BY [id] DESC"},
+	}
+	orders := catalog{
+		tables:   []string{"sales.orders"},
+		metadata: map[string]internals.SchemaDetails{"id": {Position: "1", IsNullable: "NO", IsPrimary: true}, "status": {Position: "2", IsNullable: "NO"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter := Filter{
+				Size:       "5",
+				Order:      test.order,
+				Filter:     &filters.Node{Column: "status", Operator: "=", Value: "paid"},
+				Pagination: PaginationCursor,
+				Count:      CountNone,
+			}
+			if err := PrepareFilter(context.Background(), orders, "sales.orders", &filter); err != nil {
+				t.Fatalf("PrepareFilter failed: %v", err)
+			}
+			cursor, err := encodeCursor(cursorToken{Direction: test.direction, Table: "sales.orders", Keys: filter.Keys, Order: test.order, Values: json.RawMessage(`[40]`)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			filter.Cursor = cursor
+
+			var queries []string
+			var args [][]interface{}
+			db := &MsSQLDatabase{}
+			if _, err := keysetData(context.Background(), recordingSource(dialect.MSSQL, "sales.orders", db.source("sales.orders").from, &queries, &args), filter); err != nil {
+				t.Fatalf("keysetData failed: %v", err)
+			}
+			if len(queries) != 1 || queries[0] != test.want {
+				t.Errorf("keysetData ran %q, want %q", queries, test.want)
+			}
+			if want := []interface{}{"paid", int64(40)}; len(args) != 1 || !reflect.DeepEqual(args[0], want) {
+				t.Errorf("keysetData bound %v, want %v", args, want)
+			}
+		})
+	}
+}
+
+func TestMsSQLTables(t *testing.T) {
+	conn, fake := openFakeServer(t, map[string]fakeRows{
+		"information_schema.tables": {
+			columns: []string{"table_schema", "table_name"},
+			values:  [][]driver.Value{{"dbo", "users"}, {"sales", "orders"}, {"dbo", "order]lines"}},
+		},
+	})
+	db := &MsSQLDatabase{conn: conn, config: DatabaseConfig{Database: "shop"}}
+	tables, err := db.Tables(context.Background())
+	if err != nil {
+		t.Fatalf("Tables failed: %v", err)
+	}
+	if want := []string{"users", "sales.orders", "order]lines"}; !reflect.DeepEqual(tables, want) {
+		t.Errorf("Tables = %q, want %q", tables, want)
+	}
+	if want := []interface{}{"shop"}; !reflect.DeepEqual(fake.args["information_schema.tables"], want) {
+		t.Errorf("Tables bound %v, want %v", fake.args["information_schema.tables"], want)
+	}
+}
+
+func TestMsSQLMetadata(t *testing.T) {
+	// the column query tests sys.indexes for the primary key too, so each
+	// query is told apart by a fragment only it contains
+	conn, fake := openFakeServer(t, map[string]fakeRows{
+		"c.column_id AS ordinal_position": {
+			columns: []string{"column_name", "data_type", "max_length", "is_nullable", "column_default", "ordinal_position", "is_primary"},
+			values: [][]driver.Value{
+				{"id", "int", int64(4), "NO", nil, int64(1), int64(1)},
+				{"customer", "int", int64(4), "NO", nil, int64(2), int64(0)},
+				{"warehouse", "int", int64(4), "YES", nil, int64(3), int64(0)},
+				{"note", "nvarchar", int64(100), "YES", "(N'')", int64(4), int64(0)},
+			},
+		},
+		"ic.is_included_column = 0": {
+			columns: []string{"index_name", "index_algorithm", "is_unique", "column_name"},
+			values:  [][]driver.Value{{"PK_orders", "CLUSTERED", true, "id"}, {"IX_orders_customer", "NONCLUSTERED", false, "customer"}},
+		},
+		"FROM sys.foreign_keys": {
+			columns: []string{"constraint_name", "column_name", "foreign_schema_name", "foreign_table_name", "foreign_column_name"},
+			values: [][]driver.Value{
+				{"FK_orders_customer", "customer", "crm", "customers", "id"},
+				{"FK_orders_warehouse", "warehouse", "dbo", "warehouses", "id"},
+			},
+		},
+	})
+
+	db := &MsSQLDatabase{conn: conn}
+	metadata, err := db.Metadata(context.Background(), "sales.orders")
+	if err != nil {
+		t.Fatalf("Metadata failed: %v", err)
+	}
+	want := map[string]internals.SchemaDetails{
+		"id": {
+			DataType: "int", MaxLength: sql.NullInt64{Int64: 4, Valid: true}, IsNullable: "NO", Position: "1",
+			Index: true, IsPrimary: true,
+		},
+		"customer": {
+			DataType: "int", MaxLength: sql.NullInt64{Int64: 4, Valid: true}, IsNullable: "NO", Position: "2",
+			Index: true, ForeignKey: "crm.customers.id",
+		},
+		"warehouse": {
+			DataType: "int", MaxLength: sql.NullInt64{Int64: 4, Valid: true}, IsNullable: "YES", Position: "3",
+			ForeignKey: "warehouses.id",
+		},
+		"note": {
+			DataType: "nvarchar", MaxLength: sql.NullInt64{Int64: 100, Valid: true}, IsNullable: "YES", Position: "4",
+			ColumnDefault: sql.NullString{String: "(N'')", Valid: true},
+		},
+	}
+	if !reflect.DeepEqual(metadata, want) {
+		t.Errorf("Metadata = %+v, want %+v", metadata, want)
+	}
+	for fragment, args := range fake.args {
+		if want := []interface{}{"[sales].[orders]"}; !reflect.DeepEqual(args, want) {
+			t.Errorf("query matching %q bound %v, want %v", fragment, args, want)
+		}
+	}
+	if len(fake.args) != 3 {
+		t.Errorf("Metadata ran %d catalog queries, want 3", len(fake.args))
+	}
+}
@@ -2,21 +2,29 @@ package core
 
 import (
 	"butler-server/internals"
+	"butler-server/internals/dialect"
+	"butler-server/internals/export"
+	"butler-server/internals/sqlparse"
+	"context"
 	"database/sql"
 	"fmt"
 	"strconv"
-	"strings"
 	"sync"
 
 	_ "github.com/go-sql-driver/mysql"
 )
 
+const (
+	mysqlConnectionIDQuery = "SELECT CONNECTION_ID()"
+	mysqlKillQuery         = "KILL QUERY %d"
+)
+
 type MySQLDatabase struct {
 	conn   *sql.DB
 	config DatabaseConfig
 }
 
-func (this *MySQLDatabase) Connect() error {
+func (this *MySQLDatabase) Connect(ctx context.Context) error {
 	connectionString := fmt.Sprintf("%s:%s@tcp(%s:%s)/",
 		this.config.Username, this.config.Password, this.config.Hostname, this.config.Port)
 	if this.config.Database != "" {
@@ -27,7 +35,7 @@ func (this *MySQLDatabase) Connect() error {
 		return err
 	}
 
-	if err = db.Ping(); err != nil {
+	if err = db.PingContext(ctx); err != nil {
 		return err
 	}
 
@@ -36,9 +44,9 @@ func (this *MySQLDatabase) Connect() error {
 	return nil
 }
 
-func (this *MySQLDatabase) Databases() ([]string, error) {
+func (this *MySQLDatabase) Databases(ctx context.Context) ([]string, error) {
 	databaseQuery := "SHOW DATABASES"
-	rows, err := this.conn.Query(databaseQuery)
+	rows, err := this.conn.QueryContext(ctx, databaseQuery)
 	if err != nil {
 		return nil, err
 	}
@@ -55,9 +63,9 @@ func (this *MySQLDatabase) Databases() ([]string, error) {
 	}
 	return databases, nil
 }
-func (this *MySQLDatabase) Tables() ([]string, error) {
-	query := fmt.Sprintf("SHOW TABLES FROM %s", this.config.Database)
-	rows, err := this.conn.Query(query)
+func (this *MySQLDatabase) Tables(ctx context.Context) ([]string, error) {
+	query := fmt.Sprintf("SHOW TABLES FROM %s", dialect.MySQL.QuoteIdentifier(this.config.Database))
+	rows, err := this.conn.QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -75,7 +83,7 @@ func (this *MySQLDatabase) Tables() ([]string, error) {
 
 	return tables, nil
 }
-func (this *MySQLDatabase) Metadata(table string) (map[string]internals.SchemaDetails, error) {
+func (this *MySQLDatabase) Metadata(ctx context.Context, table string) (map[string]internals.SchemaDetails, error) {
 	resultCh := make(chan Result, 3)
 	var wg sync.WaitGroup
 
@@ -83,7 +91,7 @@ func (this *MySQLDatabase) Metadata(table string) (map[string]internals.SchemaDe
 
 	go func() {
 		defer wg.Done()
-		schemaDetails, err := this.fetchSchemaDetails(table)
+		schemaDetails, err := this.fetchSchemaDetails(ctx, table)
 		if err != nil {
 			resultCh <- Result{Details: nil, Error: err, Type: "schema"}
 			return
@@ -92,7 +100,7 @@ func (this *MySQLDatabase) Metadata(table string) (map[string]internals.SchemaDe
 	}()
 	go func() {
 		defer wg.Done()
-		foreignKeyDetails, err := this.fetchForeignKeyDetails(table)
+		foreignKeyDetails, err := this.fetchForeignKeyDetails(ctx, table)
 		if err != nil {
 			resultCh <- Result{Details: nil, Error: err, Type: "fk"}
 			return
@@ -102,7 +110,7 @@ func (this *MySQLDatabase) Metadata(table string) (map[string]internals.SchemaDe
 
 	go func() {
 		defer wg.Done()
-		indexes, err := this.fetchIndexDetails(table)
+		indexes, err := this.fetchIndexDetails(ctx, table)
 		if err != nil {
 			resultCh <- Result{Details: nil, Error: err, Type: "index"}
 			return
@@ -125,21 +133,23 @@ func (this *MySQLDatabase) Metadata(table string) (map[string]internals.SchemaDe
 	return schemaDetails, nil
 }
 
-func (this *MySQLDatabase) Data(table string, filter Filter) (map[string]interface{}, error) {
+func (this *MySQLDatabase) Data(ctx context.Context, table string, filter Filter) (map[string]interface{}, error) {
+	ctx, cancel := withTimeout(ctx, this.config)
+	defer cancel()
+	if filter.Pagination == PaginationCursor {
+		return keysetData(ctx, this.source(table), filter)
+	}
 
-	filterMap := internals.ParseFilterParam(filter.Filter)
-	query, err := this.parseSQLQuery(table, filter, filterMap)
+	query, args, err := this.parseSQLQuery(table, filter)
 	if err != nil {
 		return nil, err
 	}
-
-	rows, err := this.conn.Query(query, internals.FilterValues(filterMap)...)
+	result, err := this.fetch(ctx, query, args)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	result, count, err := internals.ParseRows(rows)
+	// counted in a query of its own as window functions need MySQL 8
+	count, err := countRows(ctx, this.source(table), filter)
 	if err != nil {
 		return nil, err
 	}
@@ -150,18 +160,51 @@ func (this *MySQLDatabase) Data(table string, filter Filter) (map[string]interfa
 	return dbMap, nil
 }
 
-func (this *MySQLDatabase) Query(query string, page int, size int) ([]map[string]interface{}, error) {
-	rows, err := this.conn.Query(query)
-	if err != nil {
-		return nil, err
+func (this *MySQLDatabase) source(table string) sqlSource {
+	return sqlSource{
+		dialect:  dialect.MySQL,
+		table:    table,
+		from:     dialect.MySQL.QuoteIdentifier(table),
+		fetch:    this.fetch,
+		stream:   this.stream,
+		estimate: this.estimatedCount,
 	}
-	defer rows.Close()
+}
 
-	result, _, err := internals.ParseRows(rows)
-	if err != nil {
-		return nil, err
-	}
-	return result, nil
+func (this *MySQLDatabase) fetch(ctx context.Context, query string, args []interface{}) (*internals.ResultSet, error) {
+	return fetchMySQL(ctx, this.conn, query, args)
+}
+
+func (this *MySQLDatabase) stream(ctx context.Context, query string, args []interface{}, fn func(rows *sql.Rows) error) error {
+	return streamMySQL(ctx, this.conn, query, args, fn)
+}
+
+func (this *MySQLDatabase) Export(ctx context.Context, table string, filter Filter, w export.Writer) error {
+	return exportData(ctx, this.source(table), filter, w)
+}
+
+func (this *MySQLDatabase) ExportQuery(ctx context.Context, query string, w export.Writer) error {
+	return exportMySQL(ctx, this.conn, this.config, query, w)
+}
+
+func (this *MySQLDatabase) estimatedCount(ctx context.Context, table string) (interface{}, error) {
+	return estimatedMySQLCount(ctx, this.conn, this.config.Database, table)
+}
+
+func (this *MySQLDatabase) Query(ctx context.Context, query string, page int, size int) (*internals.ResultSet, error) {
+	return queryMySQL(ctx, this.conn, this.config, query, page, size)
+}
+
+func (this *MySQLDatabase) Script(ctx context.Context, script string, page int, size int) ([]StatementResult, error) {
+	return scriptMySQL(ctx, this.conn, this.config, script, page, size)
+}
+
+func (this *MySQLDatabase) DryRun(ctx context.Context, queries []string) ([]StatementResult, error) {
+	return dryRunMySQL(ctx, this.conn, this.config, queries)
+}
+
+func (this *MySQLDatabase) Explain(ctx context.Context, query string, analyze bool) (*Plan, error) {
+	return explainMySQL(ctx, this.conn, this.config, query, analyze, false)
 }
 
 func (this *MySQLDatabase) Close() error {
@@ -174,49 +217,35 @@ func (this *MySQLDatabase) Close() error {
 	return nil
 }
 
-func (this *MySQLDatabase) parseSQLQuery(table string, filter Filter, filterMap map[string]string) (string, error) {
+func (this *MySQLDatabase) parseSQLQuery(table string, filter Filter) (string, []interface{}, error) {
 	page, err := strconv.Atoi(filter.Page)
 	if err != nil {
-		return "", nil
+		return "", nil, err
 	}
 	size, err := strconv.Atoi(filter.Size)
 	if err != nil {
-		return "", nil
+		return "", nil, err
 	}
 	if filter.Order != "asc" && filter.Order != "desc" {
-		return "", fmt.Errorf("invalid order parameter")
+		return "", nil, fmt.Errorf("invalid order parameter")
 	}
 	offset := (page) * size
 
-	query := fmt.Sprintf(`SELECT *, (SELECT COUNT(*) FROM %s) as total_count FROM %s`, table, table)
-	var operator string
-	if filter.Operator == "and" {
-		operator = "AND"
-	} else if filter.Operator == "or" {
-		operator = "OR"
-	}
-
-	if len(filterMap) > 0 {
-		whereClauses := make([]string, 0)
-		for key, value := range filterMap {
-			operator, conditionValue := internals.ParseOperatorAndValue(value)
-			whereClauses = append(whereClauses, internals.ConstructCondition(key, operator, conditionValue, whereClauses))
-		}
-		if operator != "" {
-			query += " WHERE " + strings.Join(whereClauses, " "+operator+" ")
-		} else {
-			query += " WHERE " + whereClauses[0]
-		}
+	query := fmt.Sprintf(`SELECT * FROM %s`, dialect.MySQL.QuoteIdentifier(table))
+	where, args, err := whereClause(dialect.MySQL, filter.conditions())
+	if err != nil {
+		return "", nil, err
 	}
+	query += where
 	if filter.Sort != "" {
-		query += fmt.Sprintf(" ORDER BY %s %s", filter.Sort, filter.Order)
+		query += fmt.Sprintf(" ORDER BY %s %s", dialect.MySQL.QuoteIdentifier(filter.Sort), filter.Order)
 	}
 	query += fmt.Sprintf(" LIMIT %d OFFSET %d;", size, offset)
 
-	return query, nil
+	return query, args, nil
 }
 
-func (this *MySQLDatabase) fetchSchemaDetails(table string) (map[string]internals.SchemaDetails, error) {
+func (this *MySQLDatabase) fetchSchemaDetails(ctx context.Context, table string) (map[string]internals.SchemaDetails, error) {
 	query := fmt.Sprintf(`
 		SELECT ordinal_position as ordinal_position,
 			column_name as column_name,
@@ -226,7 +255,7 @@ func (this *MySQLDatabase) fetchSchemaDetails(table string) (map[string]internal
 		FROM information_schema.columns
 		WHERE table_schema='%s' AND table_name='%s';
 	`, this.config.Database, table)
-	rows, err := this.conn.Query(query)
+	rows, err := this.conn.QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -253,14 +282,14 @@ func (this *MySQLDatabase) fetchSchemaDetails(table string) (map[string]internal
 	return schemaDetails, nil
 }
 
-func (this *MySQLDatabase) fetchIndexDetails(table string) ([]internals.IndexDetails, error) {
+func (this *MySQLDatabase) fetchIndexDetails(ctx context.Context, table string) ([]internals.IndexDetails, error) {
 	query := fmt.Sprintf(`
 		SELECT index_name as index_name, index_type AS index_algorithm,
 		CASE non_unique WHEN 0 THEN'TRUE'ELSE'FALSE'END AS is_unique,
 		column_name as column_name FROM information_schema.statistics 
 		WHERE table_schema='%s' AND table_name='%s' ORDER BY seq_in_index ASC;
 	`, this.config.Database, table)
-	rows, err := this.conn.Query(query)
+	rows, err := this.conn.QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -290,13 +319,13 @@ func (this *MySQLDatabase) fetchIndexDetails(table string) ([]internals.IndexDet
 	return indexes, nil
 }
 
-func (this *MySQLDatabase) fetchForeignKeyDetails(table string) ([]internals.ForeignKeyDetails, error) {
+func (this *MySQLDatabase) fetchForeignKeyDetails(ctx context.Context, table string) ([]internals.ForeignKeyDetails, error) {
 	query := fmt.Sprintf(`
 		SELECT constraint_name,referenced_table_name,referenced_column_name,
 		column_name FROM information_schema.key_column_usage WHERE 
 		table_name='%s' AND table_schema='%s' AND referenced_column_name is not NULL;
 	`, table, this.config.Database)
-	rows, err := this.conn.Query(query)
+	rows, err := this.conn.QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -327,27 +356,128 @@ func (this *MySQLDatabase) fetchForeignKeyDetails(table string) ([]internals.For
 	return foreignKeys, nil
 }
 
-func (this *MySQLDatabase) Execute(queries []string) error {
-	tx, err := this.conn.Begin()
+func (this *MySQLDatabase) Execute(ctx context.Context, queries []string, revert bool) ([]StatementResult, error) {
+	return execute(ctx, this, this.conn, dialect.MySQL, queries, revert, mysqlWarnings)
+}
+
+func fetchMySQL(ctx context.Context, db *sql.DB, query string, args []interface{}) (*internals.ResultSet, error) {
+	var result *internals.ResultSet
+	err := streamMySQL(ctx, db, query, args, func(rows *sql.Rows) error {
+		var err error
+		result, err = internals.ParseRows(rows)
+		return err
+	})
+	return result, err
+}
+
+// streamMySQL runs a query on its own connection, killing it on the server
+// when ctx is done
+func streamMySQL(ctx context.Context, db *sql.DB, query string, args []interface{}, fn func(rows *sql.Rows) error) error {
+	return killOnCancel(ctx, db, mysqlConnectionIDQuery, mysqlKillQuery, func(conn *sql.Conn) error {
+		rows, err := conn.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		return fn(rows)
+	})
+}
+
+// estimatedMySQLCount reads the row count InnoDB keeps in its statistics
+func estimatedMySQLCount(ctx context.Context, db *sql.DB, database, table string) (interface{}, error) {
+	query := `SELECT TABLE_ROWS AS count FROM information_schema.TABLES WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ?`
+	rows, err := fetchMySQL(ctx, db, query, []interface{}{database, table})
 	if err != nil {
+		return nil, err
+	}
+	return firstValue(rows, "count"), nil
+}
+
+// queryMySQL runs an ad-hoc statement on its own connection, paging plain
+// queries with Paginate
+func queryMySQL(ctx context.Context, db *sql.DB, config DatabaseConfig, query string, page int, size int) (*internals.ResultSet, error) {
+	ctx, cancel := withTimeout(ctx, config)
+	defer cancel()
+	var result *internals.ResultSet
+	err := killOnCancel(ctx, db, mysqlConnectionIDQuery, mysqlKillQuery, func(conn *sql.Conn) error {
+		var err error
+		result, err = queryAdHoc(ctx, conn, config, dialect.MySQL, query, page, size)
 		return err
+	})
+	if err != nil {
+		return nil, err
 	}
+	return result, nil
+}
 
-	defer func() {
-		if err := tx.Rollback(); err != nil {
-			fmt.Println(err)
-		}
-	}()
+// exportMySQL streams the rows of an ad-hoc query run on its own connection
+func exportMySQL(ctx context.Context, db *sql.DB, config DatabaseConfig, query string, w export.Writer) error {
+	return killOnCancel(ctx, db, mysqlConnectionIDQuery, mysqlKillQuery, func(conn *sql.Conn) error {
+		return exportAdHoc(ctx, conn, config, dialect.MySQL, query, w)
+	})
+}
 
+// scriptMySQL runs the statements of a script on one connection, reporting
+// the warnings each of them raised
+func scriptMySQL(ctx context.Context, db *sql.DB, config DatabaseConfig, script string, page int, size int) ([]StatementResult, error) {
+	statements, err := sqlparse.Split(dialect.MySQL, script)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withTimeout(ctx, config)
+	defer cancel()
+	var results []StatementResult
+	err = killOnCancel(ctx, db, mysqlConnectionIDQuery, mysqlKillQuery, func(conn *sql.Conn) error {
+		return readOnly(ctx, conn, config, dialect.MySQL, func(q querier) error {
+			results = runStatements(ctx, q, dialect.MySQL, statements, page, size, mysqlWarnings)
+			return nil
+		})
+	})
+	return results, err
+}
+
+// mysqlNonTransactional warns that a dry run cannot undo a write, as tables of
+// engines without transactions such as MyISAM keep their changes
+const mysqlNonTransactional = "writes to tables without transactions, such as MyISAM ones, are not rolled back"
+
+// dryRunMySQL dry runs queries on one connection, reporting the warnings each
+// of them raised. Queries committing implicitly are refused with an
+// ImplicitCommitError before anything runs.
+func dryRunMySQL(ctx context.Context, db *sql.DB, config DatabaseConfig, queries []string) ([]StatementResult, error) {
 	for _, query := range queries {
-		_, err := tx.Exec(query)
-		if err != nil {
-			return err
+		if endsTransaction(dialect.MySQL, query) {
+			return nil, &ImplicitCommitError{Statement: query}
 		}
 	}
-
-	if err := tx.Commit(); err != nil {
+	ctx, cancel := withTimeout(ctx, config)
+	defer cancel()
+	var results []StatementResult
+	err := killOnCancel(ctx, db, mysqlConnectionIDQuery, mysqlKillQuery, func(conn *sql.Conn) error {
+		var err error
+		results, err = dryRun(ctx, conn, config, dialect.MySQL, queries, mysqlWarnings)
 		return err
+	})
+	for i, result := range results {
+		if result.Error == "" && !result.Skipped && writes(dialect.MySQL, result.Statement) {
+			results[i].Notices = append(results[i].Notices, Notice{Level: "warning", Message: mysqlNonTransactional})
+		}
 	}
-	return nil
+	return results, err
+}
+
+func mysqlWarnings(ctx context.Context, q querier) []Notice {
+	rows, err := q.QueryContext(ctx, "SHOW WARNINGS")
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	var notices []Notice
+	for rows.Next() {
+		var notice Notice
+		if err := rows.Scan(&notice.Level, &notice.Code, &notice.Message); err != nil {
+			return notices
+		}
+		notices = append(notices, notice)
+	}
+	return notices
 }
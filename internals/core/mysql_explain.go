@@ -0,0 +1,250 @@
+package core
+
+import (
+	"butler-server/internals/dialect"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// explainMySQL runs EXPLAIN FORMAT=JSON on its own connection. Analyzing uses
+// ANALYZE FORMAT=JSON on MariaDB and EXPLAIN ANALYZE on MySQL, which only
+// describes the executed plan as a text tree.
+func explainMySQL(ctx context.Context, db *sql.DB, config DatabaseConfig, query string, analyze bool, mariadb bool) (*Plan, error) {
+	statement, err := explainable(dialect.MySQL, query, analyze)
+	if err != nil {
+		return nil, err
+	}
+	explain := "EXPLAIN FORMAT=JSON "
+	switch {
+	case analyze && mariadb:
+		explain = "ANALYZE FORMAT=JSON "
+	case analyze:
+		explain = "EXPLAIN ANALYZE "
+	}
+	config = explainConfig(config, analyze)
+	ctx, cancel := withTimeout(ctx, config)
+	defer cancel()
+
+	var raw string
+	err = killOnCancel(ctx, db, mysqlConnectionIDQuery, mysqlKillQuery, func(conn *sql.Conn) error {
+		raw, err = explainText(ctx, conn, config, dialect.MySQL, explain+statement.Text, 0)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if analyze && !mariadb {
+		return parseMySQLTree(raw), nil
+	}
+	return parseMySQLPlan(raw, analyze)
+}
+
+// mysqlOperations are the keys of a JSON plan wrapping the operations they
+// name
+var mysqlOperations = map[string]string{
+	"nested_loop":                "Nested loop",
+	"ordering_operation":         "Sort",
+	"grouping_operation":         "Group",
+	"duplicates_removal":         "Distinct",
+	"windowing":                  "Window",
+	"union_result":               "Union",
+	"materialized_from_subquery": "Materialize",
+	"attached_subqueries":        "Subquery",
+	"optimized_away_subqueries":  "Subquery",
+	"subqueries":                 "Subquery",
+	"block-nl-join":              "Block nested loop",
+	"filesort":                   "Sort",
+	"temporary_table":            "Temporary table",
+	"read_sorted_file":           "Read sorted file",
+}
+
+// mysqlAccessTypes name the ways a table is read
+var mysqlAccessTypes = map[string]string{
+	"ALL":             "Table scan",
+	"index":           "Index scan",
+	"range":           "Index range scan",
+	"ref":             "Index lookup",
+	"eq_ref":          "Unique index lookup",
+	"const":           "Constant lookup",
+	"system":          "Constant lookup",
+	"ref_or_null":     "Index lookup",
+	"index_merge":     "Index merge",
+	"fulltext":        "Fulltext index lookup",
+	"unique_subquery": "Unique subquery lookup",
+	"index_subquery":  "Index subquery lookup",
+}
+
+func parseMySQLPlan(raw string, analyze bool) (*Plan, error) {
+	var explained map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &explained); err != nil {
+		return nil, fmt.Errorf("failed to read the plan: %w", err)
+	}
+	block, _ := explained["query_block"].(map[string]interface{})
+	plan := &Plan{Root: mysqlPlanNode("Query block", block), Analyzed: analyze, Raw: raw, Format: "json"}
+	if block != nil {
+		plan.ExecutionMs = planNumber(block["r_total_time_ms"])
+	}
+	return plan, nil
+}
+
+// mysqlPlanNode builds the node of a query block, table or operation
+func mysqlPlanNode(nodeType string, object map[string]interface{}) *PlanNode {
+	node := newPlanNode(nodeType)
+	if name, ok := object["table_name"].(string); ok {
+		node.Relation = name
+		node.Type = "Table"
+		if access, ok := mysqlAccessTypes[fmt.Sprint(object["access_type"])]; ok {
+			node.Type = access
+		}
+	}
+	node.Index, _ = object["key"].(string)
+	node.Detail, _ = object["attached_condition"].(string)
+	if message, ok := object["message"].(string); ok {
+		node.Detail = message
+	}
+
+	cost, _ := object["cost_info"].(map[string]interface{})
+	for _, key := range []string{"query_cost", "prefix_cost", "sort_cost"} {
+		if node.Cost == nil && cost != nil {
+			node.Cost = planNumber(cost[key])
+		}
+	}
+	if node.Cost == nil {
+		node.Cost = planNumber(object["cost"])
+	}
+	for _, key := range []string{"rows_produced_per_join", "rows"} {
+		if node.EstimatedRows == nil {
+			node.EstimatedRows = planNumber(object[key])
+		}
+	}
+	loops := planNumber(object["r_loops"])
+	node.Loops = loops
+	node.ActualRows = perLoop(planNumber(object["r_rows"]), loops)
+	node.ActualTimeMs = planNumber(object["r_total_time_ms"])
+	if node.ActualTimeMs == nil {
+		node.ActualTimeMs = planNumber(object["r_table_time_ms"])
+	}
+
+	node.Children = append(node.Children, mysqlChildren(object)...)
+	return node
+}
+
+// mysqlChildren returns the nodes found in the values of a plan object, in
+// key order so that plans come out the same every time. Keys that are not
+// operations, such as query_specifications, are looked through.
+func mysqlChildren(value interface{}) []*PlanNode {
+	children := []*PlanNode{}
+	switch value := value.(type) {
+	case []interface{}:
+		for _, item := range value {
+			children = append(children, mysqlChildren(item)...)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			switch child := value[key].(type) {
+			case map[string]interface{}:
+				switch {
+				case key == "table":
+					children = append(children, mysqlPlanNode("Table", child))
+				case key == "query_block":
+					children = append(children, mysqlPlanNode("Query block", child))
+				case mysqlOperations[key] != "":
+					children = append(children, mysqlPlanNode(mysqlOperations[key], child))
+				case key != "cost_info":
+					children = append(children, mysqlChildren(child)...)
+				}
+			case []interface{}:
+				if operation, ok := mysqlOperations[key]; ok {
+					node := newPlanNode(operation)
+					node.Children = mysqlChildren(child)
+					children = append(children, node)
+				} else {
+					children = append(children, mysqlChildren(child)...)
+				}
+			}
+		}
+	}
+	return children
+}
+
+// mysqlTreeLine matches a line of EXPLAIN ANALYZE, such as
+//
+//	-> Filter: (t.a > 1)  (cost=0.55 rows=1) (actual time=0.02..0.03 rows=2 loops=1)
+var mysqlTreeLine = regexp.MustCompile(`^( *)-> (.*?)(?:  \(cost=([\d.e+-]+)(?:\.\.([\d.e+-]+))? rows=([\d.e+-]+)\))?(?: \(actual time=([\d.e+-]+)\.\.([\d.e+-]+) rows=([\d.e+-]+) loops=([\d.e+-]+)\))?(?: \(never executed\))?$`)
+
+// parseMySQLTree reads the tree of EXPLAIN ANALYZE, where every level is
+// indented by four more spaces than its parent
+func parseMySQLTree(raw string) *Plan {
+	plan := &Plan{Analyzed: true, Raw: raw, Format: "text"}
+	var stack []*PlanNode
+	var depths []int
+	for _, line := range strings.Split(raw, "\n") {
+		match := mysqlTreeLine.FindStringSubmatch(line)
+		if match == nil {
+			// conditions too long for one line carry on without an arrow
+			if len(stack) > 0 && strings.TrimSpace(line) != "" {
+				top := stack[len(stack)-1]
+				top.Detail = strings.TrimSpace(top.Detail + " " + strings.TrimSpace(line))
+			}
+			continue
+		}
+		node := mysqlTreeNode(match)
+		depth := len(match[1])
+		for len(depths) > 0 && depths[len(depths)-1] >= depth {
+			stack, depths = stack[:len(stack)-1], depths[:len(depths)-1]
+		}
+		if len(stack) == 0 {
+			if plan.Root != nil {
+				break
+			}
+			plan.Root = node
+		} else {
+			parent := stack[len(stack)-1]
+			parent.Children = append(parent.Children, node)
+		}
+		stack, depths = append(stack, node), append(depths, depth)
+	}
+	return plan
+}
+
+func mysqlTreeNode(match []string) *PlanNode {
+	description := match[2]
+	node := newPlanNode(description)
+	if i := strings.Index(description, ": "); i >= 0 {
+		node.Type, node.Detail = description[:i], description[i+2:]
+	}
+	if i := strings.Index(node.Type, " on "); i >= 0 {
+		target := strings.Fields(node.Type[i+4:])
+		node.Type = node.Type[:i]
+		if len(target) > 0 {
+			node.Relation, target = target[0], target[1:]
+		}
+		if len(target) > 1 && target[0] == "using" {
+			node.Index, target = target[1], target[2:]
+		}
+		if node.Detail == "" {
+			node.Detail = strings.Join(target, " ")
+		}
+	}
+	if match[4] != "" {
+		node.StartupCost, node.Cost = planNumber(match[3]), planNumber(match[4])
+	} else {
+		node.Cost = planNumber(match[3])
+	}
+	node.EstimatedRows = planNumber(match[5])
+	loops := planNumber(match[9])
+	node.Loops = loops
+	node.ActualRows = perLoop(planNumber(match[8]), loops)
+	node.ActualTimeMs = perLoop(planNumber(match[7]), loops)
+	return node
+}
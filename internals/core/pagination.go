@@ -0,0 +1,368 @@
+package core
+
+import (
+	"butler-server/internals"
+	"butler-server/internals/dialect"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Pagination modes of a Data call
+const (
+	PaginationOffset = "offset"
+	PaginationCursor = "cursor"
+)
+
+// Count modes of a Data call. An estimate comes from the table statistics of
+// the database and ignores the filter.
+const (
+	CountExact    = "exact"
+	CountEstimate = "estimate"
+	CountNone     = "none"
+)
+
+const (
+	cursorNext = "next"
+	cursorPrev = "prev"
+)
+
+var (
+	// ErrNoCursorKey is returned when cursor pagination is asked for on a table
+	// without a primary key and without a sort column
+	ErrNoCursorKey = errors.New("cursor pagination needs a primary key or a sort column")
+	// ErrNullableCursorKey is returned when cursor pagination is asked for
+	// with a sort column that may hold NULL, which no cursor can seek past
+	ErrNullableCursorKey = errors.New("cursor pagination needs a sort column without NULL values")
+	// ErrInvalidCursor is returned for a cursor token that was not issued for
+	// the table and sort of the request
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// cursorToken is the content of the opaque next/prev tokens, holding the key
+// values of the first or last row of a page along with the table, the key
+// columns and the order they were read in
+type cursorToken struct {
+	Direction string          `json:"d"`
+	Table     string          `json:"t"`
+	Keys      []string        `json:"k"`
+	Order     string          `json:"o"`
+	Values    json.RawMessage `json:"v"`
+}
+
+func encodeCursor(token cursorToken) (string, error) {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor(token string) (*cursorToken, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var cursor cursorToken
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if cursor.Direction != cursorNext && cursor.Direction != cursorPrev {
+		return nil, ErrInvalidCursor
+	}
+	return &cursor, nil
+}
+
+// keyCodec serializes the key values of a row into a cursor token
+type keyCodec struct {
+	encode func(values []interface{}) (json.RawMessage, error)
+	decode func(data json.RawMessage) ([]interface{}, error)
+}
+
+// jsonKeys keeps key values as plain JSON, numbers are read back as int64 or
+// float64 and everything else as the string the driver binds
+var jsonKeys = keyCodec{
+	encode: func(values []interface{}) (json.RawMessage, error) {
+		return json.Marshal(values)
+	},
+	decode: func(data json.RawMessage) ([]interface{}, error) {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		var values []interface{}
+		if err := decoder.Decode(&values); err != nil {
+			return nil, ErrInvalidCursor
+		}
+		for i, value := range values {
+			number, ok := value.(json.Number)
+			if !ok {
+				continue
+			}
+			if n, err := number.Int64(); err == nil {
+				values[i] = n
+			} else if f, err := number.Float64(); err == nil {
+				values[i] = f
+			}
+		}
+		return values, nil
+	},
+}
+
+// keyset is one page of keyset pagination. Rows are ordered by the key
+// columns and the page starts right after (or, reading backwards, right
+// before) the row whose key values the cursor holds.
+type keyset struct {
+	table      string
+	order      string
+	keys       []string
+	size       int
+	descending bool
+	backward   bool
+	after      []interface{}
+	codec      keyCodec
+}
+
+func newKeyset(table string, filter Filter, codec keyCodec) (*keyset, error) {
+	if len(filter.Keys) == 0 {
+		return nil, ErrNoCursorKey
+	}
+	size, err := strconv.Atoi(filter.Size)
+	if err != nil {
+		return nil, err
+	}
+	if filter.Order != "asc" && filter.Order != "desc" {
+		return nil, fmt.Errorf("invalid order parameter")
+	}
+	k := &keyset{table: table, order: filter.Order, keys: filter.Keys, size: size, descending: filter.Order == "desc", codec: codec}
+	if filter.Cursor == "" {
+		return k, nil
+	}
+
+	cursor, err := decodeCursor(filter.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	if cursor.Table != k.table || cursor.Order != k.order || strings.Join(cursor.Keys, "\x00") != strings.Join(k.keys, "\x00") {
+		return nil, ErrInvalidCursor
+	}
+	values, err := codec.decode(cursor.Values)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != len(k.keys) {
+		return nil, ErrInvalidCursor
+	}
+	k.after = values
+	if cursor.Direction == cursorPrev {
+		// read the previous page in reverse and flip it back afterwards
+		k.backward = true
+		k.descending = !k.descending
+	}
+	return k, nil
+}
+
+// sqlCondition expands the row comparison (k1, k2) > (v1, v2) into
+// k1 > v1 OR (k1 = v1 AND k2 > v2), which every dialect understands
+func (k *keyset) sqlCondition(d dialect.Dialect, args []interface{}) (string, []interface{}) {
+	if k.after == nil {
+		return "", args
+	}
+	comparison := ">"
+	if k.descending {
+		comparison = "<"
+	}
+	bind := func(value interface{}) string {
+		args = append(args, value)
+		return d.Placeholder(len(args))
+	}
+
+	alternatives := make([]string, len(k.keys))
+	for i := range k.keys {
+		terms := make([]string, 0, i+1)
+		for j := 0; j < i; j++ {
+			terms = append(terms, fmt.Sprintf("%s = %s", d.QuoteIdentifier(k.keys[j]), bind(k.after[j])))
+		}
+		terms = append(terms, fmt.Sprintf("%s %s %s", d.QuoteIdentifier(k.keys[i]), comparison, bind(k.after[i])))
+		alternatives[i] = "(" + strings.Join(terms, " AND ") + ")"
+	}
+	return "(" + strings.Join(alternatives, " OR ") + ")", args
+}
+
+func (k *keyset) sqlOrderBy(d dialect.Dialect) string {
+	direction := "ASC"
+	if k.descending {
+		direction = "DESC"
+	}
+	columns := make([]string, len(k.keys))
+	for i, key := range k.keys {
+		columns[i] = d.QuoteIdentifier(key) + " " + direction
+	}
+	return " ORDER BY " + strings.Join(columns, ", ")
+}
+
+// keysetPage drops the lookahead row fetched past the page size, restores
+// the requested order and returns the tokens of the neighbouring pages, empty
+// when there is none. value reads a key column of a row.
+func keysetPage[R any](k *keyset, rows []R, value func(row R, key string) interface{}) ([]R, string, string, error) {
+	more := len(rows) > k.size
+	if more {
+		rows = rows[:k.size]
+	}
+	if k.backward {
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+	}
+	if len(rows) == 0 {
+		return rows, "", "", nil
+	}
+
+	hasNext, hasPrev := more, k.after != nil
+	if k.backward {
+		hasNext, hasPrev = true, more
+	}
+	var next, prev string
+	var err error
+	if hasNext {
+		if next, err = k.cursor(cursorNext, func(key string) interface{} { return value(rows[len(rows)-1], key) }); err != nil {
+			return nil, "", "", err
+		}
+	}
+	if hasPrev {
+		if prev, err = k.cursor(cursorPrev, func(key string) interface{} { return value(rows[0], key) }); err != nil {
+			return nil, "", "", err
+		}
+	}
+	return rows, next, prev, nil
+}
+
+func (k *keyset) cursor(direction string, value func(key string) interface{}) (string, error) {
+	values := make([]interface{}, len(k.keys))
+	for i, key := range k.keys {
+		// the schema of collections does not tell nullable fields apart
+		if values[i] = value(key); values[i] == nil {
+			return "", ErrNullableCursorKey
+		}
+	}
+	data, err := k.codec.encode(values)
+	if err != nil {
+		return "", err
+	}
+	return encodeCursor(cursorToken{Direction: direction, Table: k.table, Keys: k.keys, Order: k.order, Values: data})
+}
+
+// rowFetcher runs a query and returns its rows
+type rowFetcher func(ctx context.Context, query string, args []interface{}) (*internals.ResultSet, error)
+
+// sqlSource is what the shared paging helpers need to read a table of a SQL
+// database
+type sqlSource struct {
+	dialect dialect.Dialect
+	// table is the name as given by the caller and from the quoted
+	// FROM target
+	table string
+	from  string
+	fetch rowFetcher
+	// stream runs a query and hands its rows to fn
+	stream func(ctx context.Context, query string, args []interface{}, fn func(rows *sql.Rows) error) error
+	// estimate returns the row count kept in the table statistics, an exact
+	// count is taken when the database keeps none
+	estimate func(ctx context.Context, table string) (interface{}, error)
+}
+
+// keysetData reads one page of a table with keyset pagination
+func keysetData(ctx context.Context, source sqlSource, filter Filter) (map[string]interface{}, error) {
+	k, err := newKeyset(source.table, filter, jsonKeys)
+	if err != nil {
+		return nil, err
+	}
+	where, args, err := whereClause(source.dialect, filter.conditions())
+	if err != nil {
+		return nil, err
+	}
+	condition, args := k.sqlCondition(source.dialect, args)
+	if condition != "" && where != "" {
+		where += " AND " + condition
+	} else if condition != "" {
+		where = " WHERE " + condition
+	}
+
+	// one row past the page tells whether there is a next one
+	var query string
+	if source.dialect.Name == dialect.MSSQL.Name {
+		query = fmt.Sprintf("SELECT TOP %d * FROM %s%s%s", k.size+1, source.from, where, k.sqlOrderBy(source.dialect))
+	} else {
+		query = fmt.Sprintf("SELECT * FROM %s%s%s LIMIT %d", source.from, where, k.sqlOrderBy(source.dialect), k.size+1)
+	}
+	result, err := source.fetch(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	var next, prev string
+	result.Rows, next, prev, err = keysetPage(k, result.Rows, func(row []interface{}, key string) interface{} {
+		return row[result.Index(key)]
+	})
+	if err != nil {
+		return nil, err
+	}
+	count, err := countRows(ctx, source, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	dbMap := make(map[string]interface{})
+	dbMap["data"] = result
+	dbMap["count"] = count
+	dbMap["next"] = next
+	dbMap["prev"] = prev
+	return dbMap, nil
+}
+
+// countRows returns the count reported with a page, nil when none is wanted
+func countRows(ctx context.Context, source sqlSource, filter Filter) (interface{}, error) {
+	switch filter.Count {
+	case CountNone:
+		return nil, nil
+	case CountEstimate:
+		// the statistics count every row, those the policy hides too
+		if source.estimate != nil && filter.Policy == nil {
+			return source.estimate(ctx, source.table)
+		}
+	}
+	where, args, err := whereClause(source.dialect, filter.conditions())
+	if err != nil {
+		return nil, err
+	}
+	rows, err := source.fetch(ctx, fmt.Sprintf("SELECT COUNT(*) AS count FROM %s%s", source.from, where), args)
+	if err != nil {
+		return nil, err
+	}
+	return firstValue(rows, "count"), nil
+}
+
+// exactCount tells whether an offset page counts the matching rows itself
+func (filter Filter) exactCount() bool {
+	return filter.Count == "" || filter.Count == CountExact
+}
+
+// pageCountColumn carries the total count of offset pages, named so as not to
+// clash with the columns of the table
+const pageCountColumn = "butler_total_count"
+
+// offsetColumns is the select list of an offset page, which carries the total
+// count in a window column when an exact count is wanted
+func offsetColumns(filter Filter) string {
+	if filter.exactCount() {
+		return "*, COUNT(*) OVER() AS " + pageCountColumn
+	}
+	return "*"
+}
+
+func firstValue(result *internals.ResultSet, column string) interface{} {
+	return result.Value(0, column)
+}
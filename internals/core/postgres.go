@@ -2,22 +2,24 @@ package core
 
 import (
 	"butler-server/internals"
+	"butler-server/internals/dialect"
+	"butler-server/internals/export"
+	"context"
 	"database/sql"
 	"fmt"
-	"regexp"
 	"strconv"
-	"strings"
 	"sync"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type PostgreSQLDatabase struct {
-	conn   *sql.DB
-	config DatabaseConfig
+	conn      *sql.DB
+	connector *pq.Connector
+	config    DatabaseConfig
 }
 
-func (this *PostgreSQLDatabase) Connect() error {
+func (this *PostgreSQLDatabase) Connect(ctx context.Context) error {
 	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s", this.config.Hostname, this.config.Port, this.config.Username, this.config.Password)
 	if this.config.Database != "" {
 		connStr += " dbname=" + this.config.Database
@@ -25,22 +27,24 @@ func (this *PostgreSQLDatabase) Connect() error {
 		connStr += " dbname=postgres"
 	}
 	connStr += " sslmode=disable"
-	db, err := sql.Open("postgres", connStr)
+	connector, err := pq.NewConnector(connStr)
 	if err != nil {
 		return err
 	}
+	db := sql.OpenDB(connector)
 
-	if err = db.Ping(); err != nil {
+	if err = db.PingContext(ctx); err != nil {
 		return err
 	}
 	this.conn = db
+	this.connector = connector
 	fmt.Println("Connected to PostgreSQL database")
 	return nil
 }
 
-func (m *PostgreSQLDatabase) Databases() ([]string, error) {
+func (m *PostgreSQLDatabase) Databases(ctx context.Context) ([]string, error) {
 	databaseQuery := "SELECT datname FROM pg_database"
-	rows, err := m.conn.Query(databaseQuery)
+	rows, err := m.conn.QueryContext(ctx, databaseQuery)
 	if err != nil {
 		return nil, err
 	}
@@ -57,9 +61,9 @@ func (m *PostgreSQLDatabase) Databases() ([]string, error) {
 	}
 	return databases, nil
 }
-func (m *PostgreSQLDatabase) Tables() ([]string, error) {
-	query := fmt.Sprintf("SELECT table_name FROM information_schema.tables WHERE table_schema = 'public' AND table_catalog = '%s'", m.config.Database)
-	rows, err := m.conn.Query(query)
+func (m *PostgreSQLDatabase) Tables(ctx context.Context) ([]string, error) {
+	query := "SELECT table_name FROM information_schema.tables WHERE table_schema = 'public' AND table_catalog = $1"
+	rows, err := m.conn.QueryContext(ctx, query, m.config.Database)
 	if err != nil {
 		return nil, err
 	}
@@ -77,7 +81,7 @@ func (m *PostgreSQLDatabase) Tables() ([]string, error) {
 
 	return tables, nil
 }
-func (this *PostgreSQLDatabase) Metadata(table string) (map[string]internals.SchemaDetails, error) {
+func (this *PostgreSQLDatabase) Metadata(ctx context.Context, table string) (map[string]internals.SchemaDetails, error) {
 	resultCh := make(chan Result, 3)
 	var wg sync.WaitGroup
 	wg.Add(3)
@@ -87,7 +91,7 @@ func (this *PostgreSQLDatabase) Metadata(table string) (map[string]internals.Sch
 		SELECT column_name, data_type, character_maximum_length, is_nullable, column_default, udt_name, ordinal_position 
 		FROM information_schema.columns 
 		WHERE table_name = $1;`
-		schemaDetails, err := internals.FetchSchemaDetails(this.conn, query, table)
+		schemaDetails, err := internals.FetchSchemaDetails(ctx, this.conn, query, table)
 		if err != nil {
 			resultCh <- Result{Details: nil, Error: err, Type: "schema"}
 			return
@@ -114,7 +118,7 @@ func (this *PostgreSQLDatabase) Metadata(table string) (map[string]internals.Sch
 		) sub
 		JOIN pg_attribute AS ta ON ta.attrelid = conrelid AND ta.attnum = conkey
 		JOIN pg_attribute AS fa ON fa.attrelid = confrelid AND fa.attnum = confkey;`
-		foreignKeyDetails, err := internals.FetchForeignKeyDetails(this.conn, query, table)
+		foreignKeyDetails, err := internals.FetchForeignKeyDetails(ctx, this.conn, query, table)
 		if err != nil {
 			resultCh <- Result{Details: nil, Error: err, Type: "foreign key"}
 			return
@@ -128,7 +132,7 @@ func (this *PostgreSQLDatabase) Metadata(table string) (map[string]internals.Sch
 		SELECT indexname, indexdef
         FROM pg_indexes
         WHERE tablename = $1;`
-		indexDetails, err := internals.FetchIndexDetails(this.conn, query, table)
+		indexDetails, err := internals.FetchIndexDetails(ctx, this.conn, query, table)
 		if err != nil {
 			resultCh <- Result{Details: nil, Error: err, Type: "index"}
 			return
@@ -151,24 +155,35 @@ func (this *PostgreSQLDatabase) Metadata(table string) (map[string]internals.Sch
 	return schemaDetails, nil
 }
 
-func (m *PostgreSQLDatabase) Data(table string, filter Filter) (map[string]interface{}, error) {
+func (m *PostgreSQLDatabase) Data(ctx context.Context, table string, filter Filter) (map[string]interface{}, error) {
+	// lib/pq sends a cancel request to the backend when ctx is done, which
+	// stops the statement the same way pg_cancel_backend does
+	ctx, cancel := withTimeout(ctx, m.config)
+	defer cancel()
+	if filter.Pagination == PaginationCursor {
+		return keysetData(ctx, m.source(table), filter)
+	}
 
-	filterMap := internals.ParseFilterParam(filter.Filter)
-	query, err := m.parseSQLQuery(table, filter, filterMap)
+	query, args, err := m.parseSQLQuery(table, filter)
 	if err != nil {
 		return nil, err
 	}
 	fmt.Println(query)
-	rows, err := m.conn.Query(query, internals.FilterValues(filterMap)...)
+	rows, err := m.conn.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	result, count, err := internals.ParseRows(rows)
+	result, count, err := internals.ParsePage(rows, pageCountColumn)
 	if err != nil {
 		return nil, err
 	}
+	if !filter.exactCount() {
+		if count, err = countRows(ctx, m.source(table), filter); err != nil {
+			return nil, err
+		}
+	}
 
 	dbMap := make(map[string]interface{})
 	dbMap["data"] = result
@@ -176,67 +191,118 @@ func (m *PostgreSQLDatabase) Data(table string, filter Filter) (map[string]inter
 	return dbMap, nil
 }
 
-func (this *PostgreSQLDatabase) Query(query string, page int, size int) ([]map[string]interface{}, error) {
-
-	if ok, err := regexp.MatchString(`(?i)limit`, query); !ok || err != nil {
-		query += fmt.Sprintf(` LIMIT %d`, size)
-	}
-	if ok, err := regexp.MatchString(`(?i)offset`, query); !ok || err != nil {
-		query += fmt.Sprintf(` OFFSET %d`, page*size)
+func (m *PostgreSQLDatabase) source(table string) sqlSource {
+	return sqlSource{
+		dialect:  dialect.Postgres,
+		table:    table,
+		from:     dialect.Postgres.QuoteIdentifier(table),
+		fetch:    m.fetch,
+		stream:   m.stream,
+		estimate: m.estimatedCount,
 	}
-	rows, err := this.conn.Query(query)
+}
+
+func (m *PostgreSQLDatabase) fetch(ctx context.Context, query string, args []interface{}) (*internals.ResultSet, error) {
+	var result *internals.ResultSet
+	err := m.stream(ctx, query, args, func(rows *sql.Rows) error {
+		var err error
+		result, err = internals.ParseRows(rows)
+		return err
+	})
+	return result, err
+}
+
+func (m *PostgreSQLDatabase) stream(ctx context.Context, query string, args []interface{}, fn func(rows *sql.Rows) error) error {
+	rows, err := m.conn.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer rows.Close()
+	return fn(rows)
+}
+
+func (m *PostgreSQLDatabase) Export(ctx context.Context, table string, filter Filter, w export.Writer) error {
+	return exportData(ctx, m.source(table), filter, w)
+}
+
+func (m *PostgreSQLDatabase) ExportQuery(ctx context.Context, query string, w export.Writer) error {
+	return exportAdHoc(ctx, m.conn, m.config, dialect.Postgres, query, w)
+}
 
-	result, _, err := internals.ParseRows(rows)
+// estimatedCount reads the row estimate kept by VACUUM and ANALYZE, which is
+// -1 until the table has been analyzed once
+func (m *PostgreSQLDatabase) estimatedCount(ctx context.Context, table string) (interface{}, error) {
+	query := `SELECT GREATEST(reltuples, 0)::bigint AS count FROM pg_class WHERE oid = to_regclass($1)`
+	rows, err := m.fetch(ctx, query, []interface{}{dialect.Postgres.QuoteIdentifier(table)})
 	if err != nil {
 		return nil, err
 	}
-	return result, nil
+	return firstValue(rows, "count"), nil
+}
+
+func (this *PostgreSQLDatabase) Query(ctx context.Context, query string, page int, size int) (*internals.ResultSet, error) {
+	return queryAdHoc(ctx, this.conn, this.config, dialect.Postgres, query, page, size)
+}
+
+// Script runs a script reporting the notices of every statement
+func (m *PostgreSQLDatabase) Script(ctx context.Context, script string, page int, size int) ([]StatementResult, error) {
+	db, notices := m.noticeDB()
+	defer db.Close()
+	return runScript(ctx, db, m.config, dialect.Postgres, script, page, size, notices)
+}
+
+func (m *PostgreSQLDatabase) DryRun(ctx context.Context, queries []string) ([]StatementResult, error) {
+	db, notices := m.noticeDB()
+	defer db.Close()
+	return dryRun(ctx, db, m.config, dialect.Postgres, queries, notices)
 }
 
-func (m *PostgreSQLDatabase) parseSQLQuery(table string, filter Filter, filterMap map[string]string) (string, error) {
+// noticeDB opens a pool of its own whose notices are read by the returned
+// reader, since lib/pq hands the notices of every connection of a pool to the
+// same handler. The pool must be closed after use.
+func (m *PostgreSQLDatabase) noticeDB() (*sql.DB, noticeReader) {
+	var mu sync.Mutex
+	var notices []Notice
+	db := sql.OpenDB(pq.ConnectorWithNoticeHandler(m.connector, func(notice *pq.Error) {
+		mu.Lock()
+		defer mu.Unlock()
+		notices = append(notices, Notice{Level: notice.Severity, Code: string(notice.Code), Message: notice.Message})
+	}))
+	return db, func(ctx context.Context, q querier) []Notice {
+		mu.Lock()
+		defer mu.Unlock()
+		statementNotices := notices
+		notices = nil
+		return statementNotices
+	}
+}
+
+func (m *PostgreSQLDatabase) parseSQLQuery(table string, filter Filter) (string, []interface{}, error) {
 	page, err := strconv.Atoi(filter.Page)
 	if err != nil {
-		return "", nil
+		return "", nil, err
 	}
 	size, err := strconv.Atoi(filter.Size)
 	if err != nil {
-		return "", nil
+		return "", nil, err
 	}
 	if filter.Order != "asc" && filter.Order != "desc" {
-		return "", fmt.Errorf("invalid order parameter")
+		return "", nil, fmt.Errorf("invalid order parameter")
 	}
 	offset := (page) * size
 
-	query := fmt.Sprintf(`SELECT *, COUNT(*) OVER() as total_count FROM "%s"`, table)
-	var operator string
-	if filter.Operator == "and" {
-		operator = "AND"
-	} else if filter.Operator == "or" {
-		operator = "OR"
-	}
-
-	if len(filterMap) > 0 {
-		whereClauses := make([]string, 0)
-		for key, value := range filterMap {
-			operator, conditionValue := internals.ParseOperatorAndValue(value)
-			whereClauses = append(whereClauses, internals.ConstructCondition(key, operator, conditionValue, whereClauses))
-		}
-		if operator != "" {
-			query += " WHERE " + strings.Join(whereClauses, " "+operator+" ")
-		} else {
-			query += " WHERE " + whereClauses[0]
-		}
+	query := fmt.Sprintf(`SELECT %s FROM %s`, offsetColumns(filter), dialect.Postgres.QuoteIdentifier(table))
+	where, args, err := whereClause(dialect.Postgres, filter.conditions())
+	if err != nil {
+		return "", nil, err
 	}
+	query += where
 	if filter.Sort != "" {
-		query += fmt.Sprintf(" ORDER BY %s %s", filter.Sort, filter.Order)
+		query += fmt.Sprintf(" ORDER BY %s %s", dialect.Postgres.QuoteIdentifier(filter.Sort), filter.Order)
 	}
 	query += fmt.Sprintf(" LIMIT %d OFFSET %d;", size, offset)
 
-	return query, nil
+	return query, args, nil
 }
 
 func (this *PostgreSQLDatabase) Close() error {
@@ -249,27 +315,8 @@ func (this *PostgreSQLDatabase) Close() error {
 	return nil
 }
 
-func (p *PostgreSQLDatabase) Execute(queries []string) error {
-	tx, err := p.conn.Begin()
-	if err != nil {
-		return err
-	}
-
-	defer func() {
-		if err := tx.Rollback(); err != nil {
-			fmt.Println(err)
-		}
-	}()
-
-	for _, query := range queries {
-		_, err := tx.Exec(fmt.Sprintf(` %s `, query))
-		if err != nil {
-			return err
-		}
-	}
-
-	if err := tx.Commit(); err != nil {
-		return err
-	}
-	return nil
+func (p *PostgreSQLDatabase) Execute(ctx context.Context, queries []string, revert bool) ([]StatementResult, error) {
+	db, notices := p.noticeDB()
+	defer db.Close()
+	return execute(ctx, p, db, dialect.Postgres, queries, revert, notices)
 }
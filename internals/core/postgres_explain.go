@@ -0,0 +1,86 @@
+package core
+
+import (
+	"butler-server/internals/dialect"
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Explain runs EXPLAIN (FORMAT JSON), with ANALYZE and BUFFERS when analyze is
+// set
+func (m *PostgreSQLDatabase) Explain(ctx context.Context, query string, analyze bool) (*Plan, error) {
+	statement, err := explainable(dialect.Postgres, query, analyze)
+	if err != nil {
+		return nil, err
+	}
+	options := "FORMAT JSON"
+	if analyze {
+		options += ", ANALYZE, BUFFERS"
+	}
+	raw, err := explainText(ctx, m.conn, explainConfig(m.config, analyze), dialect.Postgres, fmt.Sprintf("EXPLAIN (%s) %s", options, statement.Text), 0)
+	if err != nil {
+		return nil, err
+	}
+	return parsePostgresPlan(raw, analyze)
+}
+
+func parsePostgresPlan(raw string, analyze bool) (*Plan, error) {
+	var explained []struct {
+		Plan          map[string]interface{} `json:"Plan"`
+		PlanningTime  *float64               `json:"Planning Time"`
+		ExecutionTime *float64               `json:"Execution Time"`
+	}
+	if err := json.Unmarshal([]byte(raw), &explained); err != nil {
+		return nil, fmt.Errorf("failed to read the plan: %w", err)
+	}
+	if len(explained) == 0 {
+		return nil, fmt.Errorf("the server returned an empty plan")
+	}
+	return &Plan{
+		Root:        postgresPlanNode(explained[0].Plan),
+		Analyzed:    analyze,
+		PlanningMs:  explained[0].PlanningTime,
+		ExecutionMs: explained[0].ExecutionTime,
+		Raw:         raw,
+		Format:      "json",
+	}, nil
+}
+
+func postgresPlanNode(plan map[string]interface{}) *PlanNode {
+	node := newPlanNode(fmt.Sprint(plan["Node Type"]))
+	if strategy, ok := plan["Strategy"].(string); ok && strategy != "Plain" {
+		node.Type = strategy + " " + node.Type
+	}
+	if join, ok := plan["Join Type"].(string); ok {
+		node.Type += " (" + join + ")"
+	}
+	node.Relation, _ = plan["Relation Name"].(string)
+	if alias, ok := plan["Alias"].(string); ok && alias != node.Relation && node.Relation != "" {
+		node.Relation += " " + alias
+	}
+	node.Index, _ = plan["Index Name"].(string)
+	for _, key := range []string{"Index Cond", "Hash Cond", "Merge Cond", "Filter", "Join Filter", "Recheck Cond", "Sort Key", "Group Key"} {
+		if value, ok := plan[key]; ok {
+			if node.Detail != "" {
+				node.Detail += "; "
+			}
+			node.Detail += fmt.Sprintf("%s: %v", key, value)
+		}
+	}
+	loops := planNumber(plan["Actual Loops"])
+	node.EstimatedRows = planNumber(plan["Plan Rows"])
+	node.ActualRows = perLoop(planNumber(plan["Actual Rows"]), loops)
+	node.StartupCost = planNumber(plan["Startup Cost"])
+	node.Cost = planNumber(plan["Total Cost"])
+	node.ActualTimeMs = perLoop(planNumber(plan["Actual Total Time"]), loops)
+	node.Loops = loops
+
+	children, _ := plan["Plans"].([]interface{})
+	for _, child := range children {
+		if child, ok := child.(map[string]interface{}); ok {
+			node.Children = append(node.Children, postgresPlanNode(child))
+		}
+	}
+	return node
+}
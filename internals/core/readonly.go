@@ -0,0 +1,79 @@
+package core
+
+import (
+	"butler-server/internals/dialect"
+	"butler-server/internals/sqlparse"
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// querier runs statements, it is a pool, a connection or a transaction
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// session is a pool or a connection transactions can be started on
+type session interface {
+	querier
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// readOnly runs the ad-hoc statements of fn on s. On read only clusters they
+// run in a transaction that is always rolled back: Postgres and MySQL start
+// it READ ONLY, SQL Server reads from a snapshot and SQLite and DuckDB, which
+// have no read only transactions, only undo the writes. None of them undo DDL
+// that commits implicitly, which CheckReadOnly keeps out beforehand.
+func readOnly(ctx context.Context, s session, config DatabaseConfig, d dialect.Dialect, fn func(q querier) error) error {
+	if !config.ReadOnly {
+		return fn(s)
+	}
+	options := &sql.TxOptions{ReadOnly: true}
+	switch d.Name {
+	case dialect.MSSQL.Name:
+		options = &sql.TxOptions{Isolation: sql.LevelSnapshot}
+	case dialect.DuckDB.Name:
+		options = nil
+	}
+	tx, err := s.BeginTx(ctx, options)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	return fn(tx)
+}
+
+// ReadOnlyError is a statement that may change data refused outside of the
+// commit workflow, on a read only cluster or for a user who may not execute
+// commits
+type ReadOnlyError struct {
+	Statement string
+	Line      int
+}
+
+func (e *ReadOnlyError) Error() string {
+	return fmt.Sprintf("statement at line %d may change data, which only commits may do: %s", e.Line, e.Statement)
+}
+
+// CheckReadOnly returns a ReadOnlyError for the first statement of a query or
+// script that may change data, a sqlparse.SyntaxError when it cannot be split
+func CheckReadOnly(driver string, script string) error {
+	if driver == "mongodb" {
+		return checkMongoReadOnly(script)
+	}
+	d, ok := dialect.ForDriver(driver)
+	if !ok {
+		return fmt.Errorf("unsupported driver %q", driver)
+	}
+	statements, err := sqlparse.Split(d, script)
+	if err != nil {
+		return err
+	}
+	for _, statement := range statements {
+		if !statement.ReadOnly() {
+			return &ReadOnlyError{Statement: statement.Text, Line: statement.Line}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package core
+
+import (
+	"butler-server/internals/dialect"
+	"butler-server/internals/filters"
+	"butler-server/internals/sqlparse"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Policies are the row policies of the tables of a database the user is
+// under, by table name
+type Policies map[string]*filters.Node
+
+// For returns the policy restricting the rows of a table, nil when it has
+// none. Names match case insensitively and qualified tables match the
+// policies of their unqualified name too.
+func (p Policies) For(table string) *filters.Node {
+	name := table
+	if dot := strings.LastIndex(table, "."); dot >= 0 {
+		name = table[dot+1:]
+	}
+	var policies []*filters.Node
+	for key, policy := range p {
+		if policy != nil && (strings.EqualFold(key, table) || strings.EqualFold(key, name)) {
+			policies = append(policies, policy)
+		}
+	}
+	switch len(policies) {
+	case 0:
+		return nil
+	case 1:
+		return policies[0]
+	}
+	return &filters.Node{And: policies}
+}
+
+// RestrictedError is an ad-hoc statement touching a table under a row policy
+// in a way the policy cannot be applied to, such as a write
+type RestrictedError struct {
+	Table string
+}
+
+func (e *RestrictedError) Error() string {
+	return fmt.Sprintf("table %s is under a row policy, only plain queries may read it", e.Table)
+}
+
+// OpaqueStatementError is a statement of an ad-hoc query whose tables cannot
+// be told from its text, either because it is not a plain query or because
+// it calls Function, which runs SQL given as text or reads a table given by
+// name. Such statements are refused on databases with row policies or masks.
+type OpaqueStatementError struct {
+	Keyword  string
+	Function string
+}
+
+func (e *OpaqueStatementError) Error() string {
+	if e.Function != "" {
+		return fmt.Sprintf("%s runs SQL that row policies and masks cannot be applied to", e.Function)
+	}
+	return fmt.Sprintf("only plain queries may run on a database with row policies or masks, not %s", e.Keyword)
+}
+
+// checkPlain refuses a statement that is not a plain query or that calls a
+// function running SQL given as text
+func checkPlain(statement sqlparse.Statement) error {
+	if function := statement.SQLTextCall(); function != "" {
+		return &OpaqueStatementError{Keyword: statement.Keyword(), Function: function}
+	}
+	if !statement.IsQuery() {
+		keyword := statement.Keyword()
+		if keyword == "" {
+			keyword = "this statement"
+		}
+		return &OpaqueStatementError{Keyword: keyword}
+	}
+	return nil
+}
+
+// CheckPlainQueries refuses with an OpaqueStatementError the SQL scripts
+// holding a statement whose tables cannot be told from its text. MongoDB
+// commands name their collection and always pass.
+func CheckPlainQueries(driver string, query string) error {
+	if driver == "mongodb" {
+		return nil
+	}
+	d, ok := dialect.ForDriver(driver)
+	if !ok {
+		return fmt.Errorf("unsupported driver %q", driver)
+	}
+	statements, err := sqlparse.Split(d, query)
+	if err != nil {
+		return err
+	}
+	for _, statement := range statements {
+		if err := checkPlain(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestrictQuery rewrites an ad-hoc query or script so that it only reads the
+// rows the policies let through. Every table of a plain SQL query under a
+// policy is replaced with a subquery filtering it, under the name of the table
+// unless it has an alias, so columns qualified with the schema of the table no
+// longer resolve. MongoDB commands get the policy of their collection added
+// to their filter or as a first $match stage. Any other statement touching a
+// table under a policy is refused with a RestrictedError, any statement
+// reading from an item of a FROM clause that is neither a table, a subquery, a
+// table function nor a join with an UnknownSourceError, and every other
+// statement that is not a plain query or that runs SQL given as text with an
+// OpaqueStatementError. Views and routines reading those tables are not
+// restricted.
+func RestrictQuery(driver string, query string, policies Policies) (string, error) {
+	if len(policies) == 0 {
+		return query, nil
+	}
+	if driver == "mongodb" {
+		return restrictMongo(query, policies)
+	}
+	d, ok := dialect.ForDriver(driver)
+	if !ok {
+		return "", fmt.Errorf("unsupported driver %q", driver)
+	}
+	statements, err := sqlparse.Split(d, query)
+	if err != nil {
+		return "", err
+	}
+	var restricted strings.Builder
+	last := 0
+	for _, statement := range statements {
+		tables, err := sqlparse.Tables(d, statement.Text)
+		if err != nil {
+			return "", err
+		}
+		// an item of a FROM clause that is not told apart may hide a table
+		references, err := statement.TableReferences()
+		if err != nil {
+			return "", err
+		}
+		for _, table := range tables {
+			if policies.For(table) == nil {
+				continue
+			}
+			if !statement.IsQuery() || !referenced(references, table) {
+				return "", &RestrictedError{Table: table}
+			}
+		}
+		// a common table expression named like a table under a policy may
+		// read the table itself
+		for name := range statement.CTENames() {
+			if policies.For(name) != nil {
+				return "", &RestrictedError{Table: name}
+			}
+		}
+		// the tables of anything else, such as COPY, HANDLER, EXEC or
+		// query_to_xml, cannot be told so they cannot be restricted
+		if err := checkPlain(statement); err != nil {
+			return "", err
+		}
+		for _, reference := range references {
+			policy := policies.For(reference.Name)
+			if policy == nil {
+				continue
+			}
+			condition, err := literalCondition(d, policy)
+			if err != nil {
+				return "", err
+			}
+			restricted.WriteString(query[last:reference.Start])
+			fmt.Fprintf(&restricted, "(SELECT * FROM %s WHERE %s)", query[reference.Start:reference.End], condition)
+			if !reference.Aliased {
+				name := reference.Name
+				if dot := strings.LastIndex(name, "."); dot >= 0 {
+					name = name[dot+1:]
+				}
+				restricted.WriteString(" " + d.QuoteIdentifier(name))
+			}
+			last = reference.End
+		}
+	}
+	restricted.WriteString(query[last:])
+	return restricted.String(), nil
+}
+
+func referenced(references []sqlparse.TableReference, table string) bool {
+	for _, reference := range references {
+		if reference.Name == table {
+			return true
+		}
+	}
+	return false
+}
+
+// literalCondition compiles a policy into a condition of the dialect with its
+// values written as constants, as ad-hoc queries run without arguments
+func literalCondition(d dialect.Dialect, policy *filters.Node) (string, error) {
+	marker := func(n int) string {
+		return fmt.Sprintf("\x00%d\x00", n)
+	}
+	marked := d
+	marked.Placeholder = marker
+	condition, args, err := policy.SQL(marked, nil)
+	if err != nil {
+		return "", err
+	}
+	replacements := make([]string, 0, 2*len(args))
+	for i, arg := range args {
+		replacements = append(replacements, marker(i+1), policyLiteral(d, arg))
+	}
+	return strings.NewReplacer(replacements...).Replace(condition), nil
+}
+
+// policyLiteral writes a value of a filter as a constant of dialect d
+func policyLiteral(d dialect.Dialect, value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		if d.Name == dialect.MSSQL.Name {
+			if v {
+				return "1"
+			}
+			return "0"
+		}
+		return strings.ToUpper(strconv.FormatBool(v))
+	case string:
+		return stringLiteral(d, v)
+	}
+	return stringLiteral(d, fmt.Sprint(value))
+}
@@ -0,0 +1,197 @@
+package core
+
+import (
+	"butler-server/internals/filters"
+	"butler-server/internals/sqlparse"
+	"errors"
+	"testing"
+)
+
+func TestRestrictQuery(t *testing.T) {
+	policies := Policies{"users": &filters.Node{Column: "tenant", Operator: "=", Value: int64(7)}}
+	tests := []struct {
+		name   string
+		driver string
+		query  string
+		want   string
+	}{
+		{
+			"plain", "postgres",
+			"SELECT * FROM users",
+			`SELECT * FROM (SELECT * FROM users WHERE "tenant" = 7) "users"`,
+		},
+		{
+			"alias", "postgres",
+			"SELECT u.id FROM users AS u",
+			`SELECT u.id FROM (SELECT * FROM users WHERE "tenant" = 7) AS u`,
+		},
+		{
+			"schema", "postgres",
+			"SELECT * FROM public.users u",
+			`SELECT * FROM (SELECT * FROM public.users WHERE "tenant" = 7) u`,
+		},
+		{
+			"only", "postgres",
+			"SELECT * FROM ONLY users",
+			`SELECT * FROM (SELECT * FROM ONLY users WHERE "tenant" = 7) "users"`,
+		},
+		{
+			"quoted", "postgres",
+			`SELECT * FROM "users" u`,
+			`SELECT * FROM (SELECT * FROM "users" WHERE "tenant" = 7) u`,
+		},
+		{
+			"backticks", "mysql",
+			"SELECT * FROM `users`",
+			"SELECT * FROM (SELECT * FROM `users` WHERE `tenant` = 7) `users`",
+		},
+		{
+			"brackets", "mssql",
+			"SELECT * FROM [dbo].[users] u",
+			"SELECT * FROM (SELECT * FROM [dbo].[users] WHERE [tenant] = 7) u",
+		},
+		{
+			"parenthesised join", "postgres",
+			"SELECT * FROM (users JOIN orders ON users.id = orders.uid)",
+			`SELECT * FROM ((SELECT * FROM users WHERE "tenant" = 7) "users" JOIN orders ON users.id = orders.uid)`,
+		},
+		{
+			"parenthesised table", "mysql",
+			"SELECT * FROM (users)",
+			"SELECT * FROM ((SELECT * FROM users WHERE `tenant` = 7) `users`)",
+		},
+		{
+			"comma after join", "postgres",
+			"SELECT * FROM orders JOIN items ON items.oid = orders.id, users",
+			`SELECT * FROM orders JOIN items ON items.oid = orders.id, (SELECT * FROM users WHERE "tenant" = 7) "users"`,
+		},
+		{
+			"lateral", "postgres",
+			"SELECT * FROM orders o, LATERAL (SELECT * FROM users WHERE users.id = o.uid) u",
+			`SELECT * FROM orders o, LATERAL (SELECT * FROM (SELECT * FROM users WHERE "tenant" = 7) "users" WHERE users.id = o.uid) u`,
+		},
+		{
+			"cte", "postgres",
+			"WITH mine AS (SELECT * FROM users) SELECT * FROM mine",
+			`WITH mine AS (SELECT * FROM (SELECT * FROM users WHERE "tenant" = 7) "users") SELECT * FROM mine`,
+		},
+		{
+			"unrestricted", "postgres",
+			"SELECT * FROM orders",
+			"SELECT * FROM orders",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			restricted, err := RestrictQuery(test.driver, test.query, policies)
+			if err != nil {
+				t.Fatalf("RestrictQuery(%q) failed: %v", test.query, err)
+			}
+			if restricted != test.want {
+				t.Errorf("RestrictQuery(%q) = %q, want %q", test.query, restricted, test.want)
+			}
+		})
+	}
+}
+
+func TestRestrictQueryRefused(t *testing.T) {
+	policies := Policies{"users": &filters.Node{Column: "tenant", Operator: "=", Value: int64(7)}}
+	tests := []struct {
+		name   string
+		driver string
+		query  string
+	}{
+		{"write", "postgres", "DELETE FROM users"},
+		{"insert without into", "mssql", "INSERT users (id) VALUES (1)"},
+		{"cte named like the table", "postgres", "WITH users AS (SELECT * FROM users) SELECT * FROM users"},
+		{"select into", "postgres", "SELECT * INTO copy FROM users"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := RestrictQuery(test.driver, test.query, policies)
+			var restricted *RestrictedError
+			if !errors.As(err, &restricted) {
+				t.Errorf("RestrictQuery(%q) = %v, want a RestrictedError", test.query, err)
+			}
+		})
+	}
+}
+
+func TestRestrictQueryUnknownSource(t *testing.T) {
+	policies := Policies{"users": &filters.Node{Column: "tenant", Operator: "=", Value: int64(7)}}
+	_, err := RestrictQuery("mysql", `SELECT * FROM "users"`, policies)
+	var unknown *sqlparse.UnknownSourceError
+	if !errors.As(err, &unknown) {
+		t.Errorf("RestrictQuery refused %v, want an UnknownSourceError", err)
+	}
+}
+
+func TestRestrictQueryOpaque(t *testing.T) {
+	policies := Policies{"users": &filters.Node{Column: "tenant_id", Operator: "=", Value: int64(7)}}
+	tests := []struct {
+		name     string
+		driver   string
+		query    string
+		function string
+	}{
+		{"query to xml", "postgres", "SELECT * FROM query_to_xml('select * from users', true, true, '')", "QUERY_TO_XML"},
+		{"table to xml", "postgres", "SELECT table_to_xml('users', true, true, '')", "TABLE_TO_XML"},
+		{"cursor to xml", "postgres", "SELECT cursor_to_xml('c', 10, true, true, '')", "CURSOR_TO_XML"},
+		{"quoted function", "postgres", `SELECT * FROM "query_to_xml"('select * from users', true, true, '')`, "QUERY_TO_XML"},
+		{"dblink", "postgres", "SELECT * FROM dblink('dbname=app', 'select * from users') AS u (id int)", "DBLINK"},
+		{"openquery", "mssql", "SELECT * FROM OPENQUERY(srv, 'select * from users')", "OPENQUERY"},
+		{"openrowset", "mssql", "SELECT * FROM OPENROWSET('SQLNCLI', 'Server=.;', 'select * from users') AS u", "OPENROWSET"},
+		{"opendatasource", "mssql", "SELECT * FROM OPENDATASOURCE('SQLNCLI', 'Data Source=.').app.dbo.users", "OPENDATASOURCE"},
+		{"copy", "postgres", "COPY users TO STDOUT", ""},
+		{"handler open", "mysql", "HANDLER users OPEN", ""},
+		{"handler read", "mysql", "HANDLER users READ FIRST", ""},
+		{"exec", "mssql", "EXEC('SELECT * FROM users')", ""},
+		{"select into variable", "mysql", "SELECT tenant_id INTO @t FROM orders", ""},
+		{"explain", "postgres", "EXPLAIN SELECT * FROM orders", ""},
+		{"after a query", "postgres", "SELECT 1; COPY users TO STDOUT", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := RestrictQuery(test.driver, test.query, policies)
+			var opaque *OpaqueStatementError
+			if !errors.As(err, &opaque) {
+				t.Fatalf("RestrictQuery(%q) = %v, want an OpaqueStatementError", test.query, err)
+			}
+			if opaque.Function != test.function {
+				t.Errorf("RestrictQuery(%q) refused function %q, want %q", test.query, opaque.Function, test.function)
+			}
+		})
+	}
+
+	// without policies the statements run as written
+	for _, test := range tests {
+		if restricted, err := RestrictQuery(test.driver, test.query, nil); err != nil || restricted != test.query {
+			t.Errorf("RestrictQuery(%q) without policies = %q, %v", test.query, restricted, err)
+		}
+	}
+}
+
+func TestCheckPlainQueries(t *testing.T) {
+	tests := []struct {
+		driver  string
+		query   string
+		refused bool
+	}{
+		{"postgres", "SELECT email FROM users", false},
+		{"mssql", "SELECT TOP 10 email FROM users; SELECT 1", false},
+		{"mongodb", `{"find": "users"}`, false},
+		{"postgres", "SELECT * FROM query_to_xml('select email from users', true, true, '')", true},
+		{"mysql", "HANDLER users READ FIRST", true},
+		{"mssql", "EXEC('SELECT email FROM users')", true},
+		{"mysql", "SELECT email INTO @v FROM users; SELECT @v", true},
+		{"postgres", "SELECT email FROM users FOR UPDATE", true},
+		{"postgres", "UPDATE users SET name = email", true},
+	}
+	for _, test := range tests {
+		err := CheckPlainQueries(test.driver, test.query)
+		var opaque *OpaqueStatementError
+		if refused := errors.As(err, &opaque); refused != test.refused {
+			t.Errorf("CheckPlainQueries(%q) = %v, want refused %v", test.query, err, test.refused)
+		}
+	}
+}
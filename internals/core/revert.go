@@ -0,0 +1,328 @@
+package core
+
+import (
+	"butler-server/internals"
+	"butler-server/internals/dialect"
+	"butler-server/internals/export"
+	"butler-server/internals/sqlparse"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reverter writes the statements undoing the queries of a commit. The keys
+// of the tables are looked up before the transaction opens, the rows a query
+// changes are read in the transaction right before it runs.
+//
+// An INSERT is undone by deleting its rows by the primary key values it
+// writes out, an UPDATE by setting back the columns it sets on every row it
+// matches and a DELETE by inserting its rows again. Tables without a primary
+// key, statements DML does not describe and updates of key columns cannot be
+// undone. Identity columns a DELETE removed are inserted again as they were,
+// which servers refusing explicit identity values reject at revert time.
+type reverter struct {
+	d     dialect.Dialect
+	steps []revertStep
+}
+
+type revertStep struct {
+	dml *sqlparse.DML
+	// keys are the primary key columns of the table and columns all of its
+	// columns, in table order
+	keys    []string
+	columns []string
+	// err is why the query cannot be undone
+	err error
+	// snapshot holds the rows read before the query ran
+	snapshot []snapshotRow
+}
+
+type snapshotRow struct {
+	columns []string
+	values  []string
+}
+
+// planReverts parses queries and looks up the keys of the tables they change
+func planReverts(ctx context.Context, db Database, d dialect.Dialect, queries []string) *reverter {
+	r := &reverter{d: d, steps: make([]revertStep, len(queries))}
+	tables := make(map[string]map[string]internals.SchemaDetails)
+	for i, query := range queries {
+		step := &r.steps[i]
+		statements, err := sqlparse.Split(d, query)
+		if err != nil {
+			step.err = err
+			continue
+		}
+		if len(statements) != 1 {
+			step.err = fmt.Errorf("queries of %d statements are not supported", len(statements))
+			continue
+		}
+		if step.dml, err = statements[0].DML(); err != nil {
+			step.err = err
+			continue
+		}
+
+		metadata, ok := tables[step.dml.Name]
+		if !ok {
+			if metadata, err = db.Metadata(ctx, step.dml.Name); err != nil {
+				step.err = err
+				continue
+			}
+			tables[step.dml.Name] = metadata
+		}
+		step.keys = primaryKey(metadata)
+		step.columns = byPosition(metadata, nil)
+		if len(step.keys) == 0 {
+			step.err = fmt.Errorf("table %s has no primary key", step.dml.Name)
+			continue
+		}
+		step.err = step.check()
+	}
+	return r
+}
+
+// check refuses the queries whose rows cannot be told apart afterwards
+func (step *revertStep) check() error {
+	switch step.dml.Verb {
+	case "UPDATE":
+		for _, column := range step.dml.Columns {
+			if indexOf(step.keys, column) >= 0 {
+				return fmt.Errorf("the update sets primary key column %s", column)
+			}
+		}
+	case "INSERT":
+		columns := step.dml.Columns
+		if columns == nil {
+			columns = step.columns
+		}
+		for _, key := range step.keys {
+			position := indexOf(columns, key)
+			if position < 0 {
+				return fmt.Errorf("the insert leaves primary key column %s to the server", key)
+			}
+			for _, row := range step.dml.Rows {
+				if position >= len(row) || !row[position].Literal {
+					return fmt.Errorf("the insert does not write out primary key column %s as a constant", key)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// snapshot reads the rows query i is about to change on q
+func (r *reverter) snapshot(ctx context.Context, q querier, i int) error {
+	step := &r.steps[i]
+	if step.err != nil || step.dml.Verb == "INSERT" {
+		return nil
+	}
+	selected := "*"
+	if step.dml.Verb == "UPDATE" {
+		columns := append(append([]string{}, step.keys...), step.dml.Columns...)
+		for i, column := range columns {
+			columns[i] = r.d.QuoteIdentifier(column)
+		}
+		selected = strings.Join(columns, ", ")
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s", selected, step.dml.Target)
+	if step.dml.Condition != "" {
+		query += " " + step.dml.Condition
+	}
+
+	rows, err := q.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.ColumnTypes()
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = column.Name()
+	}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return err
+		}
+		row := snapshotRow{columns: names, values: make([]string, len(columns))}
+		for i, value := range values {
+			if row.values[i], err = sqlLiteral(r.d, value, columns[i]); err != nil {
+				// the revert cannot be written, the query still runs
+				step.err = fmt.Errorf("column %s: %w", names[i], err)
+				return nil
+			}
+		}
+		step.snapshot = append(step.snapshot, row)
+	}
+	return rows.Err()
+}
+
+// statements returns the statements undoing query i, or why there are none
+func (r *reverter) statements(i int) ([]string, error) {
+	step := &r.steps[i]
+	if step.err != nil {
+		return nil, step.err
+	}
+	table := step.dml.Table
+	statements := []string{}
+	switch step.dml.Verb {
+	case "INSERT":
+		columns := step.dml.Columns
+		if columns == nil {
+			columns = step.columns
+		}
+		for _, row := range step.dml.Rows {
+			values := make([]string, len(columns))
+			for i := range columns {
+				values[i] = row[i].Text
+			}
+			statements = append(statements, fmt.Sprintf("DELETE FROM %s WHERE %s", table, r.keyCondition(step.keys, columns, values)))
+		}
+	case "UPDATE":
+		for _, row := range step.snapshot {
+			var set []string
+			for i, column := range row.columns[len(step.keys):] {
+				set = append(set, fmt.Sprintf("%s = %s", r.d.QuoteIdentifier(column), row.values[len(step.keys)+i]))
+			}
+			statements = append(statements, fmt.Sprintf("UPDATE %s SET %s WHERE %s", table, strings.Join(set, ", "), r.keyCondition(step.keys, row.columns, row.values)))
+		}
+	case "DELETE":
+		for _, row := range step.snapshot {
+			columns := make([]string, len(row.columns))
+			for i, column := range row.columns {
+				columns[i] = r.d.QuoteIdentifier(column)
+			}
+			statements = append(statements, fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, strings.Join(columns, ", "), strings.Join(row.values, ", ")))
+		}
+	}
+	return statements, nil
+}
+
+// keyCondition matches the row whose key columns hold values
+func (r *reverter) keyCondition(keys, columns, values []string) string {
+	conditions := make([]string, len(keys))
+	for i, key := range keys {
+		conditions[i] = fmt.Sprintf("%s = %s", r.d.QuoteIdentifier(key), values[indexOf(columns, key)])
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+// sqlLiteral writes a value scanned from column as a constant of dialect d
+func sqlLiteral(d dialect.Dialect, value interface{}, column *sql.ColumnType) (string, error) {
+	typeName := strings.ToUpper(column.DatabaseTypeName())
+	switch v := value.(type) {
+	case nil:
+		return "NULL", nil
+	case time.Time:
+		return stringLiteral(d, timeLiteral(d, v, typeName)), nil
+	case []byte:
+		if typeName == "UUID" && len(v) == 16 {
+			text := hex.EncodeToString(v)
+			return stringLiteral(d, text[:8]+"-"+text[8:12]+"-"+text[12:16]+"-"+text[16:20]+"-"+text[20:]), nil
+		}
+	}
+
+	kind := export.KindOf(typeName)
+	converted, err := export.Convert(kind, value)
+	if err != nil {
+		return "", err
+	}
+	switch v := converted.(type) {
+	case string:
+		return stringLiteral(d, v), nil
+	case json.RawMessage:
+		return stringLiteral(d, string(v)), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return stringLiteral(d, strconv.FormatFloat(v, 'g', -1, 64)), nil
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case bool:
+		if d.Name == dialect.MSSQL.Name {
+			if v {
+				return "1", nil
+			}
+			return "0", nil
+		}
+		return strings.ToUpper(strconv.FormatBool(v)), nil
+	case time.Time:
+		return stringLiteral(d, timeLiteral(d, v, typeName)), nil
+	case []byte:
+		return binaryLiteral(d, v), nil
+	}
+	return "", fmt.Errorf("values of type %s are not supported", typeName)
+}
+
+// stringLiteral quotes a string, escaping backslashes where MySQL reads them
+// as escapes and marking it Unicode on SQL Server
+func stringLiteral(d dialect.Dialect, value string) string {
+	value = strings.ReplaceAll(value, "'", "''")
+	switch d.Name {
+	case dialect.MySQL.Name:
+		return "'" + strings.ReplaceAll(value, `\`, `\\`) + "'"
+	case dialect.MSSQL.Name:
+		return "N'" + value + "'"
+	}
+	return "'" + value + "'"
+}
+
+func binaryLiteral(d dialect.Dialect, value []byte) string {
+	digits := hex.EncodeToString(value)
+	switch d.Name {
+	case dialect.Postgres.Name:
+		return `'\x` + digits + `'::bytea`
+	case dialect.MSSQL.Name:
+		return "0x" + digits
+	case dialect.DuckDB.Name:
+		var escaped strings.Builder
+		for i := 0; i < len(digits); i += 2 {
+			escaped.WriteString(`\x` + digits[i:i+2])
+		}
+		return "'" + escaped.String() + "'::BLOB"
+	}
+	return "X'" + digits + "'"
+}
+
+// timeLiteral writes a time for a column of typeName, with the offset only
+// for types keeping it. SQL Server keeps up to 7 fractional digits.
+func timeLiteral(d dialect.Dialect, value time.Time, typeName string) string {
+	fraction := ".999999"
+	if d.Name == dialect.MSSQL.Name {
+		fraction = ".9999999"
+	}
+	switch {
+	case typeName == "DATE":
+		return value.Format("2006-01-02")
+	case strings.Contains(typeName, "TIME") && !strings.Contains(typeName, "STAMP") && !strings.Contains(typeName, "DATETIME"):
+		return value.Format("15:04:05" + fraction)
+	case strings.Contains(typeName, "TZ") || strings.Contains(typeName, "ZONE") || strings.Contains(typeName, "OFFSET"):
+		return value.Format("2006-01-02 15:04:05" + fraction + "-07:00")
+	}
+	return value.Format("2006-01-02 15:04:05" + fraction)
+}
+
+// indexOf finds a column ignoring case, as statements may spell columns
+// differently from the catalog
+func indexOf(columns []string, column string) int {
+	for i, c := range columns {
+		if strings.EqualFold(c, column) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,153 @@
+package core
+
+import (
+	"butler-server/internals"
+	"butler-server/internals/dialect"
+	"context"
+	"database/sql/driver"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// accounts is a table keyed by id whose name is text, balance an integer and
+// opened a timestamp
+var accounts = catalog{
+	tables: []string{"accounts"},
+	metadata: map[string]internals.SchemaDetails{
+		"id":      {Position: "1", IsNullable: "NO", IsPrimary: true},
+		"name":    {Position: "2", IsNullable: "NO"},
+		"balance": {Position: "3", IsNullable: "YES"},
+		"opened":  {Position: "4", IsNullable: "YES"},
+	},
+}
+
+func TestPlanRevertsRefused(t *testing.T) {
+	keyless := catalog{metadata: map[string]internals.SchemaDetails{"name": {Position: "1"}}}
+	tests := []struct {
+		name   string
+		db     Database
+		query  string
+		reason string
+	}{
+		{"update of the key", accounts, "UPDATE accounts SET id = id + 1 WHERE id = 1", "primary key column id"},
+		{"update of the key spelled differently", accounts, "UPDATE accounts SET ID = 2 WHERE id = 1", "primary key column ID"},
+		{"insert leaving the key out", accounts, "INSERT INTO accounts (name) VALUES ('ada')", "leaves primary key column id"},
+		{"insert computing the key", accounts, "INSERT INTO accounts (id, name) VALUES (nextval('ids'), 'ada')", "as a constant"},
+		{"insert with default key", accounts, "INSERT INTO accounts (id, name) VALUES (1, 'ada'), (DEFAULT, 'bob')", "as a constant"},
+		{"table without key", keyless, "DELETE FROM logs WHERE name = 'x'", "has no primary key"},
+		{"upsert", accounts, "INSERT INTO accounts (id, name) VALUES (1, 'ada') ON CONFLICT (id) DO NOTHING", "upserts"},
+		{"insert ignore", accounts, "INSERT IGNORE INTO accounts (id, name) VALUES (1, 'ada')", "INSERT IGNORE"},
+		{"insert select", accounts, "INSERT INTO accounts (id, name) SELECT id, name FROM staff", "INSERT ... VALUES"},
+		{"join", accounts, "UPDATE accounts JOIN staff ON staff.id = accounts.id SET accounts.name = staff.name", "several tables"},
+		{"several statements", accounts, "DELETE FROM accounts WHERE id = 1; DELETE FROM accounts WHERE id = 2", "2 statements"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reverts := planReverts(context.Background(), test.db, dialect.MySQL, []string{test.query})
+			statements, err := reverts.statements(0)
+			if err == nil || !strings.Contains(err.Error(), test.reason) {
+				t.Errorf("statements(%q) = %q, %v, want an error about %q", test.query, statements, err, test.reason)
+			}
+		})
+	}
+}
+
+func TestExecuteReverts(t *testing.T) {
+	opened := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	conn, server := openFakeServer(t, map[string]fakeRows{
+		`SELECT "id", "name", "balance" FROM accounts`: {
+			columns: []string{"id", "name", "balance"},
+			types:   []string{"INT4", "TEXT", "INT4"},
+			values:  [][]driver.Value{{int64(1), "ada", int64(10)}, {int64(2), "o'brien", nil}},
+		},
+		"SELECT * FROM accounts": {
+			columns: []string{"id", "name", "balance", "opened"},
+			types:   []string{"INT4", "TEXT", "INT4", "TIMESTAMP"},
+			values:  [][]driver.Value{{int64(3), "cy", int64(5), opened}},
+		},
+	})
+	queries := []string{
+		"INSERT INTO accounts (id, name) VALUES (7, 'eve'), (8, 'fay')",
+		"UPDATE accounts SET name = upper(name), balance = 0 WHERE balance > 1",
+		"DELETE FROM accounts WHERE id = 3",
+		"UPDATE accounts SET id = 9 WHERE id = 7",
+	}
+	results, err := execute(context.Background(), accounts, conn, dialect.Postgres, queries, true, nil)
+	if err != nil {
+		t.Fatalf("execute failed: %v", err)
+	}
+
+	want := [][]string{
+		{
+			`DELETE FROM accounts WHERE "id" = 7`,
+			`DELETE FROM accounts WHERE "id" = 8`,
+		},
+		{
+			`UPDATE accounts SET "name" = 'ada', "balance" = 10 WHERE "id" = 1`,
+			`UPDATE accounts SET "name" = 'o''brien', "balance" = NULL WHERE "id" = 2`,
+		},
+		{
+			`INSERT INTO accounts ("id", "name", "balance", "opened") VALUES (3, 'cy', 5, '2024-03-01 12:30:00')`,
+		},
+		nil,
+	}
+	for i, result := range results {
+		if !reflect.DeepEqual(result.Revert, want[i]) {
+			t.Errorf("revert of %q = %q, want %q", queries[i], result.Revert, want[i])
+		}
+	}
+	if notices := results[3].Notices; len(notices) != 1 || !strings.Contains(notices[0].Message, "primary key column id") {
+		t.Errorf("notices of the key update = %v, want why it has no revert", notices)
+	}
+
+	// the rows are read right before the statements changing them run
+	if !reflect.DeepEqual(server.execs, queries) {
+		t.Errorf("execute ran %q, want %q", server.execs, queries)
+	}
+	for fragment := range server.answers {
+		if _, ok := server.args[fragment]; !ok {
+			t.Errorf("execute never read the rows of %q", fragment)
+		}
+	}
+}
+
+func TestExecuteRevertsWithoutRows(t *testing.T) {
+	conn, _ := openFakeServer(t, map[string]fakeRows{
+		"SELECT * FROM accounts": {columns: []string{"id", "name", "balance", "opened"}},
+	})
+	results, err := execute(context.Background(), accounts, conn, dialect.Postgres, []string{"DELETE FROM accounts WHERE id = 99"}, true, nil)
+	if err != nil {
+		t.Fatalf("execute failed: %v", err)
+	}
+	if revert := results[0].Revert; revert == nil || len(revert) != 0 {
+		t.Errorf("revert of a delete matching nothing = %#v, want an empty revert", revert)
+	}
+}
+
+func TestRevertLiterals(t *testing.T) {
+	conn, _ := openFakeServer(t, map[string]fakeRows{
+		"SELECT * FROM accounts": {
+			columns: []string{"id", "name", "balance", "opened"},
+			types:   []string{"INT", "NVARCHAR", "BIT", "VARBINARY"},
+			values:  [][]driver.Value{{int64(3), `it's \ fine`, true, []byte{0xca, 0xfe}}},
+		},
+	})
+	tests := []struct {
+		dialect dialect.Dialect
+		want    string
+	}{
+		{dialect.MySQL, "INSERT INTO accounts (`id`, `name`, `balance`, `opened`) VALUES (3, 'it''s \\\\ fine', TRUE, X'cafe')"},
+		{dialect.MSSQL, "INSERT INTO accounts ([id], [name], [balance], [opened]) VALUES (3, N'it''s \\ fine', 1, 0xcafe)"},
+	}
+	for _, test := range tests {
+		results, err := execute(context.Background(), accounts, conn, test.dialect, []string{"DELETE FROM accounts WHERE id = 3"}, true, nil)
+		if err != nil {
+			t.Fatalf("execute failed: %v", err)
+		}
+		if want := []string{test.want}; !reflect.DeepEqual(results[0].Revert, want) {
+			t.Errorf("%s revert = %q, want %q", test.dialect.Name, results[0].Revert, want)
+		}
+	}
+}
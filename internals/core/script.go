@@ -0,0 +1,164 @@
+package core
+
+import (
+	"butler-server/internals"
+	"butler-server/internals/dialect"
+	"butler-server/internals/sqlparse"
+	"context"
+	"database/sql"
+	"time"
+)
+
+// StatementResult reports one statement of a script. Statements returning
+// rows carry a Result, the others the number of rows they affected when the
+// driver reports it.
+type StatementResult struct {
+	Statement    string               `json:"statement"`
+	Line         int                  `json:"line,omitempty"`
+	Result       *internals.ResultSet `json:"result,omitempty"`
+	RowsAffected *int64               `json:"rowsAffected,omitempty"`
+	Notices      []Notice             `json:"notices,omitempty"`
+	DurationMs   float64              `json:"durationMs"`
+	Error        string               `json:"error,omitempty"`
+	// Skipped is set on the statements after a failing one, which are not
+	// run
+	Skipped bool `json:"skipped,omitempty"`
+	// RolledBack is set on the statements Execute ran successfully before
+	// another one failed and the transaction was rolled back
+	RolledBack bool `json:"rolledBack,omitempty"`
+	// Revert holds the statements undoing a statement Execute applied when
+	// asked to write them, empty when it changed no rows and nil when it
+	// cannot be undone
+	Revert []string `json:"revert,omitempty"`
+}
+
+// Notice is a message the server sent along with a statement, such as a
+// Postgres NOTICE or a MySQL warning
+type Notice struct {
+	Level   string `json:"level"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+// noticeReader returns the notices of the statement that just ran on q
+type noticeReader func(ctx context.Context, q querier) []Notice
+
+// runScript runs a script on a connection of its own taken from db
+func runScript(ctx context.Context, db *sql.DB, config DatabaseConfig, d dialect.Dialect, script string, page, size int, notices noticeReader) ([]StatementResult, error) {
+	statements, err := sqlparse.Split(d, script)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withTimeout(ctx, config)
+	defer cancel()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var results []StatementResult
+	err = readOnly(ctx, conn, config, d, func(q querier) error {
+		results = runStatements(ctx, q, d, statements, page, size, notices)
+		return nil
+	})
+	return results, err
+}
+
+// runStatements runs the statements of a script one after the other on q,
+// paging the plain queries among them. The statements after a failing one
+// are reported as skipped.
+func runStatements(ctx context.Context, q querier, d dialect.Dialect, statements []sqlparse.Statement, page, size int, notices noticeReader) []StatementResult {
+	results := make([]StatementResult, len(statements))
+	failed := false
+	for i, statement := range statements {
+		results[i] = StatementResult{Statement: statement.Text, Line: statement.Line}
+		if failed {
+			results[i].Skipped = true
+			continue
+		}
+
+		start := time.Now()
+		err := runStatement(ctx, q, d, statement, page, size, &results[i])
+		results[i].DurationMs = float64(time.Since(start).Microseconds()) / 1000
+		if notices != nil {
+			results[i].Notices = notices(ctx, q)
+		}
+		if err != nil {
+			results[i].Error = err.Error()
+			failed = true
+		}
+	}
+	return results
+}
+
+func runStatement(ctx context.Context, q querier, d dialect.Dialect, statement sqlparse.Statement, page, size int, result *StatementResult) error {
+	if !statement.ReturnsRows() {
+		res, err := q.ExecContext(ctx, statement.Text)
+		if err != nil {
+			return err
+		}
+		if affected, err := res.RowsAffected(); err == nil {
+			result.RowsAffected = &affected
+		}
+		return nil
+	}
+
+	rows, err := q.QueryContext(ctx, sqlparse.Paginate(d, statement, page, size))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	// batches may return several results, the last one with columns is
+	// the one reported
+	for {
+		set, err := internals.ParseRows(rows)
+		if err != nil {
+			return err
+		}
+		if len(set.Columns) > 0 || result.Result == nil {
+			result.Result = set
+		}
+		if !rows.NextResultSet() {
+			break
+		}
+	}
+	return rows.Err()
+}
+
+// pagedQuery pages a single ad-hoc query with Paginate, scripts of several
+// statements are run as written
+func pagedQuery(d dialect.Dialect, query string, page, size int) (string, error) {
+	statements, err := sqlparse.Split(d, query)
+	if err != nil {
+		return "", err
+	}
+	if len(statements) != 1 {
+		return query, nil
+	}
+	return sqlparse.Paginate(d, statements[0], page, size), nil
+}
+
+// queryAdHoc runs an ad-hoc statement on s, paging plain queries with
+// Paginate
+func queryAdHoc(ctx context.Context, s session, config DatabaseConfig, d dialect.Dialect, query string, page, size int) (*internals.ResultSet, error) {
+	query, err := pagedQuery(d, query, page, size)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withTimeout(ctx, config)
+	defer cancel()
+	var result *internals.ResultSet
+	err = readOnly(ctx, s, config, d, func(q querier) error {
+		rows, err := q.QueryContext(ctx, query)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		result, err = internals.ParseRows(rows)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
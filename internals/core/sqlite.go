@@ -0,0 +1,427 @@
+package core
+
+import (
+	"butler-server/internals"
+	"butler-server/internals/dialect"
+	"butler-server/internals/export"
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteDatabase browses a local SQLite file. The cluster host holds the path
+// of the file and the database name selects one of the attached databases,
+// defaulting to main.
+type SQLiteDatabase struct {
+	conn   *sql.DB
+	config DatabaseConfig
+}
+
+func (this *SQLiteDatabase) Connect(ctx context.Context) error {
+	db, err := sql.Open("sqlite", this.config.Hostname)
+	if err != nil {
+		return err
+	}
+	// ATTACH only applies to the connection it runs on, keep a single one so
+	// attached databases stay visible to every call
+	db.SetMaxOpenConns(1)
+
+	if err = db.PingContext(ctx); err != nil {
+		return err
+	}
+
+	this.conn = db
+	fmt.Println("Connected to SQLite database")
+	return nil
+}
+
+func (this *SQLiteDatabase) schema() string {
+	if this.config.Database == "" {
+		return "main"
+	}
+	return this.config.Database
+}
+
+func (this *SQLiteDatabase) qualifiedTable(table string) string {
+	return dialect.SQLite.QuoteIdentifier(this.schema()) + "." + dialect.SQLite.QuoteIdentifier(table)
+}
+
+// Databases lists the attached databases, main being the opened file
+func (this *SQLiteDatabase) Databases(ctx context.Context) ([]string, error) {
+	rows, err := this.conn.QueryContext(ctx, "SELECT name FROM pragma_database_list WHERE name != 'temp'")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var databases []string
+	for rows.Next() {
+		var dbName string
+		err := rows.Scan(&dbName)
+		if err != nil {
+			return nil, err
+		}
+		databases = append(databases, dbName)
+	}
+	return databases, nil
+}
+
+func (this *SQLiteDatabase) Tables(ctx context.Context) ([]string, error) {
+	query := fmt.Sprintf(`SELECT name FROM %s.sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%%' ORDER BY name`, dialect.SQLite.QuoteIdentifier(this.schema()))
+	rows, err := this.conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var tableName string
+		err := rows.Scan(&tableName)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, tableName)
+	}
+
+	return tables, nil
+}
+
+func (this *SQLiteDatabase) Metadata(ctx context.Context, table string) (map[string]internals.SchemaDetails, error) {
+	resultCh := make(chan Result, 3)
+	var wg sync.WaitGroup
+
+	wg.Add(3)
+
+	go func() {
+		defer wg.Done()
+		schemaDetails, err := this.fetchSchemaDetails(ctx, table)
+		if err != nil {
+			resultCh <- Result{Details: nil, Error: err, Type: "schema"}
+			return
+		}
+		resultCh <- Result{Details: schemaDetails, Error: nil, Type: "schema"}
+	}()
+	go func() {
+		defer wg.Done()
+		foreignKeyDetails, err := this.fetchForeignKeyDetails(ctx, table)
+		if err != nil {
+			resultCh <- Result{Details: nil, Error: err, Type: "foreign key"}
+			return
+		}
+		resultCh <- Result{Details: foreignKeyDetails, Error: nil, Type: "foreign key"}
+	}()
+
+	go func() {
+		defer wg.Done()
+		indexDetails, err := this.fetchIndexDetails(ctx, table)
+		if err != nil {
+			resultCh <- Result{Details: nil, Error: err, Type: "index"}
+			return
+		}
+		resultCh <- Result{Details: indexDetails, Error: nil, Type: "index"}
+	}()
+
+	wg.Wait()
+
+	results := make(map[string]interface{})
+
+	for i := 0; i < 3; i++ {
+		result := <-resultCh
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		results[result.Type] = result.Details
+	}
+	schemaDetails := internals.MergeMetaData(results["schema"].(map[string]internals.SchemaDetails), results["index"].([]internals.IndexDetails), results["foreign key"].([]internals.ForeignKeyDetails))
+	return schemaDetails, nil
+}
+
+func (this *SQLiteDatabase) Data(ctx context.Context, table string, filter Filter) (map[string]interface{}, error) {
+	ctx, cancel := withTimeout(ctx, this.config)
+	defer cancel()
+	if filter.Pagination == PaginationCursor {
+		return keysetData(ctx, this.source(table), filter)
+	}
+
+	query, args, err := this.parseSQLQuery(table, filter)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := this.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result, count, err := internals.ParsePage(rows, pageCountColumn)
+	if err != nil {
+		return nil, err
+	}
+	if !filter.exactCount() {
+		if count, err = countRows(ctx, this.source(table), filter); err != nil {
+			return nil, err
+		}
+	}
+
+	dbMap := make(map[string]interface{})
+	dbMap["data"] = result
+	dbMap["count"] = count
+	return dbMap, nil
+}
+
+func (this *SQLiteDatabase) source(table string) sqlSource {
+	return sqlSource{
+		dialect: dialect.SQLite,
+		table:   table,
+		from:    this.qualifiedTable(table),
+		fetch:   this.fetch,
+		stream:  this.stream,
+	}
+}
+
+func (this *SQLiteDatabase) fetch(ctx context.Context, query string, args []interface{}) (*internals.ResultSet, error) {
+	var result *internals.ResultSet
+	err := this.stream(ctx, query, args, func(rows *sql.Rows) error {
+		var err error
+		result, err = internals.ParseRows(rows)
+		return err
+	})
+	return result, err
+}
+
+func (this *SQLiteDatabase) stream(ctx context.Context, query string, args []interface{}, fn func(rows *sql.Rows) error) error {
+	rows, err := this.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	return fn(rows)
+}
+
+func (this *SQLiteDatabase) Export(ctx context.Context, table string, filter Filter, w export.Writer) error {
+	return exportData(ctx, this.source(table), filter, w)
+}
+
+func (this *SQLiteDatabase) ExportQuery(ctx context.Context, query string, w export.Writer) error {
+	return exportAdHoc(ctx, this.conn, this.config, dialect.SQLite, query, w)
+}
+
+func (this *SQLiteDatabase) Query(ctx context.Context, query string, page int, size int) (*internals.ResultSet, error) {
+	return queryAdHoc(ctx, this.conn, this.config, dialect.SQLite, query, page, size)
+}
+
+func (this *SQLiteDatabase) parseSQLQuery(table string, filter Filter) (string, []interface{}, error) {
+	page, err := strconv.Atoi(filter.Page)
+	if err != nil {
+		return "", nil, err
+	}
+	size, err := strconv.Atoi(filter.Size)
+	if err != nil {
+		return "", nil, err
+	}
+	if filter.Order != "asc" && filter.Order != "desc" {
+		return "", nil, fmt.Errorf("invalid order parameter")
+	}
+	offset := (page) * size
+
+	query := fmt.Sprintf(`SELECT %s FROM %s`, offsetColumns(filter), this.qualifiedTable(table))
+	where, args, err := whereClause(dialect.SQLite, filter.conditions())
+	if err != nil {
+		return "", nil, err
+	}
+	query += where
+	if filter.Sort != "" {
+		query += fmt.Sprintf(" ORDER BY %s %s", dialect.SQLite.QuoteIdentifier(filter.Sort), filter.Order)
+	}
+	query += fmt.Sprintf(" LIMIT %d OFFSET %d;", size, offset)
+
+	return query, args, nil
+}
+
+func (this *SQLiteDatabase) Script(ctx context.Context, script string, page int, size int) ([]StatementResult, error) {
+	return runScript(ctx, this.conn, this.config, dialect.SQLite, script, page, size, nil)
+}
+
+func (this *SQLiteDatabase) DryRun(ctx context.Context, queries []string) ([]StatementResult, error) {
+	return dryRun(ctx, this.conn, this.config, dialect.SQLite, queries, nil)
+}
+
+// Explain builds the plan from EXPLAIN QUERY PLAN, whose rows name their
+// parent. SQLite keeps no row estimates and cannot analyze a statement.
+func (this *SQLiteDatabase) Explain(ctx context.Context, query string, analyze bool) (*Plan, error) {
+	if analyze {
+		return nil, fmt.Errorf("SQLite cannot analyze statements")
+	}
+	statement, err := explainable(dialect.SQLite, query, analyze)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withTimeout(ctx, this.config)
+	defer cancel()
+	rows, err := this.conn.QueryContext(ctx, "EXPLAIN QUERY PLAN "+statement.Text)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result, err := fetchAll(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	root := newPlanNode("Query")
+	nodes := map[string]*PlanNode{}
+	var lines []string
+	for _, row := range result {
+		id, parent, detail := row[0], row[1], row[3]
+		lines = append(lines, detail)
+		node := sqlitePlanNode(detail)
+		nodes[id] = node
+		if parentNode, ok := nodes[parent]; ok {
+			parentNode.Children = append(parentNode.Children, node)
+		} else {
+			root.Children = append(root.Children, node)
+		}
+	}
+	if len(root.Children) == 1 {
+		root = root.Children[0]
+	}
+	return &Plan{Root: root, Raw: strings.Join(lines, "\n"), Format: "text"}, nil
+}
+
+// sqlitePlanNode reads a line of EXPLAIN QUERY PLAN such as
+// SEARCH t USING INDEX t_a (a=?)
+func sqlitePlanNode(detail string) *PlanNode {
+	fields := strings.Fields(detail)
+	if len(fields) < 2 || (fields[0] != "SCAN" && fields[0] != "SEARCH") || fields[1] == "CONSTANT" {
+		return newPlanNode(detail)
+	}
+	node := newPlanNode(fields[0][:1] + strings.ToLower(fields[0][1:]))
+	// older versions write SCAN TABLE t
+	if fields[1] == "TABLE" && len(fields) > 2 {
+		fields = fields[1:]
+	}
+	node.Relation = fields[1]
+	rest := fields[2:]
+	for i, field := range rest {
+		if field == "INDEX" && i+1 < len(rest) && !strings.HasPrefix(rest[i+1], "(") {
+			node.Index = rest[i+1]
+		}
+	}
+	node.Detail = strings.Join(rest, " ")
+	return node
+}
+
+func (this *SQLiteDatabase) Close() error {
+	if this.conn != nil {
+		if err := this.conn.Close(); err != nil {
+			return err
+		}
+		fmt.Println("Closed SQLite database connection")
+	}
+	return nil
+}
+
+func (this *SQLiteDatabase) Execute(ctx context.Context, queries []string, revert bool) ([]StatementResult, error) {
+	return execute(ctx, this, this.conn, dialect.SQLite, queries, revert, nil)
+}
+
+func (this *SQLiteDatabase) fetchSchemaDetails(ctx context.Context, table string) (map[string]internals.SchemaDetails, error) {
+	query := `SELECT cid, name, type, "notnull", dflt_value, pk FROM pragma_table_info(?, ?)`
+	rows, err := this.conn.QueryContext(ctx, query, table, this.schema())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schemaDetails := make(map[string]internals.SchemaDetails)
+	for rows.Next() {
+		var position, notNull, primaryKey int
+		var columnName, dataType string
+		var columnDefault sql.NullString
+
+		err := rows.Scan(&position, &columnName, &dataType, &notNull, &columnDefault, &primaryKey)
+		if err != nil {
+			return nil, err
+		}
+		isNullable := "YES"
+		if notNull == 1 || primaryKey > 0 {
+			isNullable = "NO"
+		}
+		schemaDetails[columnName] = internals.SchemaDetails{
+			DataType:      dataType,
+			IsNullable:    isNullable,
+			Position:      strconv.Itoa(position + 1),
+			ColumnDefault: columnDefault,
+			IsPrimary:     primaryKey > 0,
+		}
+	}
+
+	return schemaDetails, nil
+}
+
+func (this *SQLiteDatabase) fetchIndexDetails(ctx context.Context, table string) ([]internals.IndexDetails, error) {
+	query := `
+		SELECT il.name, il."unique", ii.name
+		FROM pragma_index_list(?, ?) AS il
+		JOIN pragma_index_info(il.name, ?) AS ii
+		WHERE ii.name IS NOT NULL
+		ORDER BY il.name, ii.seqno`
+	rows, err := this.conn.QueryContext(ctx, query, table, this.schema(), this.schema())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var indexes []internals.IndexDetails
+	for rows.Next() {
+		var indexName, columnName string
+		var unique int
+		err := rows.Scan(&indexName, &unique, &columnName)
+		if err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, internals.IndexDetails{
+			IndexName:      indexName,
+			IndexAlgorithm: "btree",
+			IsUnique:       unique == 1,
+			ColumnName:     columnName,
+		})
+	}
+
+	return indexes, nil
+}
+
+func (this *SQLiteDatabase) fetchForeignKeyDetails(ctx context.Context, table string) ([]internals.ForeignKeyDetails, error) {
+	query := `SELECT id, "table", "from", "to" FROM pragma_foreign_key_list(?, ?)`
+	rows, err := this.conn.QueryContext(ctx, query, table, this.schema())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var foreignKeys []internals.ForeignKeyDetails
+	for rows.Next() {
+		var id int
+		var columnName, foreignTableName string
+		var foreignColumnName sql.NullString
+
+		err := rows.Scan(&id, &foreignTableName, &columnName, &foreignColumnName)
+		if err != nil {
+			return nil, err
+		}
+		foreignKeys = append(foreignKeys, internals.ForeignKeyDetails{
+			ConstraintName:    fmt.Sprintf("%s_fk_%d", table, id),
+			TableName:         table,
+			ColumnName:        columnName,
+			ForeignTableName:  foreignTableName,
+			ForeignColumnName: foreignColumnName.String,
+		})
+	}
+	return foreignKeys, nil
+}
@@ -0,0 +1,46 @@
+package core
+
+import (
+	"butler-server/internals/dialect"
+	"butler-server/internals/sqlparse"
+	"fmt"
+)
+
+// Tables returns the tables a query touches, the one it changes first, read
+// the way the driver of the cluster reads the query. A MongoDB statement
+// touches the collection it writes to.
+func Tables(driver string, query string) ([]string, error) {
+	if driver == "mongodb" {
+		statement, err := parseMongoStatement(query)
+		if err != nil {
+			return nil, err
+		}
+		return []string{statement.collection()}, nil
+	}
+	d, ok := dialect.ForDriver(driver)
+	if !ok {
+		return nil, fmt.Errorf("unsupported driver %q", driver)
+	}
+	return sqlparse.Tables(d, query)
+}
+
+// QueryReferences returns the tables an ad-hoc query or script reads and the
+// columns it names, the fields for MongoDB commands.
+func QueryReferences(driver string, query string) ([]string, []sqlparse.Reference, error) {
+	if driver == "mongodb" {
+		return mongoReferences(query)
+	}
+	d, ok := dialect.ForDriver(driver)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported driver %q", driver)
+	}
+	tables, err := sqlparse.Tables(d, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	references, err := sqlparse.References(d, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tables, references, nil
+}
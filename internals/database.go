@@ -1,8 +1,8 @@
 package internals
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"regexp"
 	"strings"
@@ -20,6 +20,16 @@ type SchemaDetails struct {
 	Index         bool           `json:"index"`
 	IsPrimary     bool           `json:"isPrimary"`
 	ForeignKey    string         `json:"foreignKey"`
+	// Frequency and Types are only set for schemas inferred from sampled
+	// documents, where a field may be missing or hold several types
+	Frequency float64         `json:"frequency,omitempty"`
+	Types     []TypeFrequency `json:"types,omitempty"`
+}
+
+type TypeFrequency struct {
+	Type      string  `json:"type"`
+	Count     int     `json:"count"`
+	Frequency float64 `json:"frequency"`
 }
 
 type IndexDetails struct {
@@ -105,146 +115,6 @@ func ExecuteQuery(db *sql.DB, query string) (*sql.Rows, error) {
 	return result, nil
 }
 
-func ParseFilterParam(filterParam string) map[string]string {
-	filterMap := make(map[string]string)
-	if filterParam != "" {
-		filters := strings.Split(filterParam, "|")
-		for _, pair := range filters {
-			filter := strings.Split(pair, ":")
-			if len(filter) == 3 && filter[0] != "" {
-				val := strings.Join(filter[1:3], ":")
-				if val != ":" {
-					filterMap[filter[0]] = val
-
-				}
-			}
-		}
-	}
-	return filterMap
-}
-
-func ParseRows(rows *sql.Rows) ([]map[string]interface{}, interface{}, error) {
-	columns, err := rows.Columns()
-	if err != nil {
-		return nil, 0, err
-	}
-	columnTypes, err := rows.ColumnTypes()
-	if err != nil {
-		return nil, 0, err
-	}
-	var totalCount interface{}
-	var result []map[string]interface{}
-	values := make([]interface{}, len(columns))
-	for i := range values {
-		values[i] = new(interface{})
-	}
-	for rows.Next() {
-		err := rows.Scan(values...)
-		if err != nil {
-			return nil, 0, err
-		}
-		rowData := make(map[string]interface{})
-		for i, column := range columns {
-			decodedValue, _ := decodeColumnValue(*values[i].(*interface{}), columnTypes[i])
-			if column != "total_count" {
-				rowData[column] = decodedValue
-			} else {
-				totalCount = decodedValue
-			}
-		}
-		result = append(result, rowData)
-	}
-	return result, totalCount, err
-}
-
-func decodeColumnValue(value interface{}, columnType *sql.ColumnType) (interface{}, error) {
-	dataType := columnType.DatabaseTypeName()
-	switch v := value.(type) {
-	case []byte:
-		if strings.Contains(strings.ToLower(dataType), "json") {
-			var data map[string]interface{}
-			err := json.Unmarshal(v, &data)
-			if err != nil {
-				return nil, err
-			}
-			return data, nil
-		}
-		return string(v), nil
-	default:
-		return v, nil
-
-	}
-}
-
-func FilterValues(filters map[string]string) []interface{} {
-	values := make([]interface{}, 0, len(filters))
-	for _, value := range filters {
-		_, val := ParseOperatorAndValue(value)
-		values = append(values, val)
-	}
-	return values
-}
-
-// parseOperatorAndValue extracts the operator and condition value from the filter string
-func ParseOperatorAndValue(filterValue string) (string, string) {
-	parts := strings.SplitN(filterValue, ":", 2)
-	if len(parts) == 2 {
-		return parts[0], parts[1]
-	}
-	return "", ""
-}
-
-// constructCondition constructs the SQL condition based on the operator and condition value
-func ConstructCondition(column, operator, value string, whereClauses []string) string {
-	switch operator {
-	case "=":
-		return fmt.Sprintf(`"%s" = $%d`, column, len(whereClauses)+1)
-	case "!=":
-		return fmt.Sprintf(`"%s" != $%d`, column, len(whereClauses)+1)
-	case "<":
-		return fmt.Sprintf(`"%s" < $%d`, column, len(whereClauses)+1)
-	case ">":
-		return fmt.Sprintf(`"%s" > $%d`, column, len(whereClauses)+1)
-	case ">=":
-		return fmt.Sprintf(`"%s" >= $%d`, column, len(whereClauses)+1)
-	case "<=":
-		return fmt.Sprintf(`"%s" <= $%d`, column, len(whereClauses)+1)
-	case "in":
-		// Assuming value is a comma-separated list, adjust as needed
-		return fmt.Sprintf(`"%s" IN ($%d)`, column, len(whereClauses)+1)
-	case "not in":
-		// Assuming value is a comma-separated list, adjust as needed
-		return fmt.Sprintf(`"%s" NOT IN ($%d)`, column, len(whereClauses)+1)
-	case "is null":
-		return fmt.Sprintf(`"%s" IS NULL`, column)
-	case "is not null":
-		return fmt.Sprintf(`"%s" IS NOT NULL`, column)
-	case "between":
-		// Assuming value is a comma-separated range, adjust as needed
-		return fmt.Sprintf(`"%s" BETWEEN $%d AND $%d`, column, len(whereClauses)+1, len(whereClauses)+2)
-	case "not between":
-		// Assuming value is a comma-separated range, adjust as needed
-		return fmt.Sprintf(`"%s" NOT BETWEEN $%d AND $%d`, column, len(whereClauses)+1, len(whereClauses)+2)
-	case "contains":
-		// Assuming case-sensitive contains
-		return fmt.Sprintf(`"%s" LIKE $%d`, column, len(whereClauses)+1)
-	case "not contains":
-		// Assuming case-sensitive not contains
-		return fmt.Sprintf(`"%s" NOT LIKE $%d`, column, len(whereClauses)+1)
-	case "contains_ci":
-		// Assuming case-insensitive contains
-		return fmt.Sprintf(`"%s" ILIKE $%d`, column, len(whereClauses)+1)
-	case "not contains_ci":
-		// Assuming case-insensitive not contains
-		return fmt.Sprintf(`"%s" NOT ILIKE $%d`, column, len(whereClauses)+1)
-	case "has suffix":
-		return fmt.Sprintf(`"%s" LIKE $%d`, column, len(whereClauses)+1)
-	case "has prefix":
-		return fmt.Sprintf(`"%s" LIKE $%d`, column, len(whereClauses)+1)
-	}
-	return ""
-}
-
 func ConvertIndexDef(sqlStatement string) (map[string]interface{}, error) {
 	pattern := `^CREATE\s+(\w+)\s+INDEX\s+(\w+)\s+ON\s+public\.(\w+)\s+USING\s+(\w+)\s+\((\w+)\)`
 
@@ -267,8 +137,8 @@ func ConvertIndexDef(sqlStatement string) (map[string]interface{}, error) {
 	return indexInfo, nil
 }
 
-func FetchSchemaDetails(db *sql.DB, query, tableName string) (map[string]SchemaDetails, error) {
-	rows, err := db.Query(query, tableName)
+func FetchSchemaDetails(ctx context.Context, db *sql.DB, query, tableName string) (map[string]SchemaDetails, error) {
+	rows, err := db.QueryContext(ctx, query, tableName)
 	if err != nil {
 		return nil, err
 	}
@@ -299,8 +169,8 @@ func FetchSchemaDetails(db *sql.DB, query, tableName string) (map[string]SchemaD
 	return schemaDetails, nil
 }
 
-func FetchIndexDetails(db *sql.DB, query, tableName string) ([]IndexDetails, error) {
-	rows, err := db.Query(query, tableName)
+func FetchIndexDetails(ctx context.Context, db *sql.DB, query, tableName string) ([]IndexDetails, error) {
+	rows, err := db.QueryContext(ctx, query, tableName)
 	if err != nil {
 		return nil, err
 	}
@@ -331,8 +201,8 @@ func FetchIndexDetails(db *sql.DB, query, tableName string) ([]IndexDetails, err
 	return indexes, nil
 }
 
-func FetchForeignKeyDetails(db *sql.DB, query, schemaName string) ([]ForeignKeyDetails, error) {
-	rows, err := db.Query(query)
+func FetchForeignKeyDetails(ctx context.Context, db *sql.DB, query, schemaName string) ([]ForeignKeyDetails, error) {
+	rows, err := db.QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
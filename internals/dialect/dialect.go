@@ -0,0 +1,129 @@
+package dialect
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Dialect describes how a SQL database spells identifiers and bind parameters
+type Dialect struct {
+	Name string
+	// QuoteIdentifier quotes a single identifier, escaping the quote character
+	QuoteIdentifier func(name string) string
+	// Placeholder returns the bind parameter for the n-th argument, starting at 1
+	Placeholder func(n int) string
+	// EscapeLike escapes the LIKE wildcards of a literal pattern fragment and
+	// LikeEscape is the ESCAPE clause it relies on, if any
+	EscapeLike func(value string) string
+	LikeEscape string
+	// CaseInsensitive rewrites column and pattern so that LIKE ignores case,
+	// nil when the database has ILIKE
+	CaseInsensitive func(column, pattern string) (string, string)
+}
+
+// Like returns the LIKE (or NOT LIKE) condition matching column against the
+// bound pattern
+func (d Dialect) Like(column, pattern string, negate, ignoreCase bool) string {
+	operator := "LIKE"
+	if ignoreCase {
+		if d.CaseInsensitive == nil {
+			operator = "ILIKE"
+		} else {
+			column, pattern = d.CaseInsensitive(column, pattern)
+		}
+	}
+	if negate {
+		operator = "NOT " + operator
+	}
+	condition := fmt.Sprintf("%s %s %s", column, operator, pattern)
+	if d.LikeEscape != "" {
+		condition += " " + d.LikeEscape
+	}
+	return condition
+}
+
+var Postgres = Dialect{
+	Name:            "postgres",
+	QuoteIdentifier: doubleQuote,
+	Placeholder:     dollarPlaceholder,
+	EscapeLike:      backslashEscape,
+	LikeEscape:      `ESCAPE '\'`,
+}
+
+var MySQL = Dialect{
+	Name: "mysql",
+	QuoteIdentifier: func(name string) string {
+		return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+	},
+	Placeholder: func(int) string {
+		return "?"
+	},
+	// backslash is already the default escape character, and spelling it out
+	// would need a second backslash unless NO_BACKSLASH_ESCAPES is set
+	EscapeLike:      backslashEscape,
+	CaseInsensitive: lower,
+}
+
+var MSSQL = Dialect{
+	Name: "mssql",
+	QuoteIdentifier: func(name string) string {
+		return "[" + strings.ReplaceAll(name, "]", "]]") + "]"
+	},
+	Placeholder: func(n int) string {
+		return fmt.Sprintf("@p%d", n)
+	},
+	// T-SQL has no default escape character, wildcards are bracketed instead
+	EscapeLike: strings.NewReplacer("[", "[[]", "%", "[%]", "_", "[_]").Replace,
+	CaseInsensitive: func(column, pattern string) (string, string) {
+		return column + " COLLATE Latin1_General_CI_AS", pattern
+	},
+}
+
+var SQLite = Dialect{
+	Name:            "sqlite",
+	QuoteIdentifier: doubleQuote,
+	Placeholder:     dollarPlaceholder,
+	EscapeLike:      backslashEscape,
+	LikeEscape:      `ESCAPE '\'`,
+	CaseInsensitive: lower,
+}
+
+var DuckDB = Dialect{
+	Name:            "duckdb",
+	QuoteIdentifier: doubleQuote,
+	Placeholder:     dollarPlaceholder,
+	EscapeLike:      backslashEscape,
+	LikeEscape:      `ESCAPE '\'`,
+}
+
+var drivers = map[string]Dialect{
+	"postgres": Postgres,
+	"mysql":    MySQL,
+	"mariadb":  MySQL,
+	"mssql":    MSSQL,
+	"sqlite":   SQLite,
+	"duckdb":   DuckDB,
+}
+
+// ForDriver returns the dialect spoken by a cluster driver, false for non SQL drivers
+func ForDriver(driver string) (Dialect, bool) {
+	d, ok := drivers[driver]
+	return d, ok
+}
+
+func doubleQuote(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func dollarPlaceholder(n int) string {
+	return fmt.Sprintf("$%d", n)
+}
+
+func backslashEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
+}
+
+// lower folds both sides where LIKE has no case-insensitive variant
+func lower(column, pattern string) (string, string) {
+	return "LOWER(" + column + ")", "LOWER(" + pattern + ")"
+}
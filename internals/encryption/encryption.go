@@ -0,0 +1,318 @@
+// Package encryption seals the credentials the server stores, the passwords
+// of clusters, with AES-256-GCM envelope encryption. Every value is encrypted
+// with a random data key of its own, which is in turn encrypted with a
+// versioned key encryption key, so that rotating those keys only rewraps the
+// data keys. Sealed values read
+//
+//	enc:v<version>:<base64 of the wrapped data key and the ciphertext>
+//
+// and are bound to a context, such as the cluster a password belongs to, so
+// that they cannot be swapped between records.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// KeySize is the size of the key encryption keys and of the data keys, which
+// makes them AES-256 keys
+const KeySize = 32
+
+// prefix starts every sealed value, values without it are plaintext
+const prefix = "enc:v"
+
+// nonceSize is the size of the GCM nonces, overhead that of the GCM tags
+const (
+	nonceSize = 12
+	overhead  = 16
+)
+
+// wrappedSize is the size of a wrapped data key with its nonce
+const wrappedSize = nonceSize + KeySize + overhead
+
+var (
+	// ErrMalformed is a sealed value that cannot be decoded
+	ErrMalformed = errors.New("malformed sealed value")
+	// ErrUnknownVersion is a value sealed with a key that is not loaded
+	ErrUnknownVersion = errors.New("value sealed with an unknown key version")
+	// ErrNoKeys is a keyring used before keys are loaded
+	ErrNoKeys = errors.New("no encryption keys are loaded")
+)
+
+// Keyring holds the versions of the key encryption keys, values are sealed
+// with the current one and opened with the one they were sealed with
+type Keyring struct {
+	keys    map[int][]byte
+	current int
+}
+
+// NewKeyring returns a keyring sealing values with the current version,
+// which must be one of keys
+func NewKeyring(keys map[int][]byte, current int) (*Keyring, error) {
+	for version, key := range keys {
+		if version < 0 {
+			return nil, fmt.Errorf("key version %d should not be negative", version)
+		}
+		if len(key) != KeySize {
+			return nil, fmt.Errorf("key version %d should be %d bytes long, not %d", version, KeySize, len(key))
+		}
+	}
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("current key version %d is not among the keys", current)
+	}
+	return &Keyring{keys: keys, current: current}, nil
+}
+
+// ParseKeys reads comma separated version:key pairs, with keys in standard
+// base64, such as 1:<key>,2:<key>
+func ParseKeys(spec string) (map[int][]byte, error) {
+	keys := make(map[int][]byte)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		versionText, encoded, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("key %q should be written version:key", pair)
+		}
+		version, err := strconv.Atoi(strings.TrimSpace(versionText))
+		if err != nil {
+			return nil, fmt.Errorf("invalid key version %q", versionText)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("key version %d is not valid base64: %w", version, err)
+		}
+		if _, ok := keys[version]; ok {
+			return nil, fmt.Errorf("key version %d is set twice", version)
+		}
+		keys[version] = key
+	}
+	return keys, nil
+}
+
+// Versions returns the loaded key versions in ascending order
+func (k *Keyring) Versions() []int {
+	if k == nil {
+		return nil
+	}
+	versions := make([]int, 0, len(k.keys))
+	for version := range k.keys {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+	return versions
+}
+
+// Current returns the version new values are sealed with
+func (k *Keyring) Current() int {
+	if k == nil {
+		return -1
+	}
+	return k.current
+}
+
+// Sealed reports whether a value is sealed rather than plaintext
+func Sealed(value string) bool {
+	_, ok := Version(value)
+	return ok
+}
+
+// Version returns the key version a value was sealed with
+func Version(value string) (int, bool) {
+	if !strings.HasPrefix(value, prefix) {
+		return 0, false
+	}
+	versionText, _, ok := strings.Cut(value[len(prefix):], ":")
+	if !ok {
+		return 0, false
+	}
+	version, err := strconv.Atoi(versionText)
+	if err != nil || version < 0 {
+		return 0, false
+	}
+	return version, true
+}
+
+// Seal encrypts plaintext for context with a fresh data key wrapped by the
+// current key
+func (k *Keyring) Seal(plaintext, context string) (string, error) {
+	if k == nil {
+		return "", ErrNoKeys
+	}
+	dataKey := make([]byte, KeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	wrapped, err := k.wrap(dataKey, k.current)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := seal(dataKey, []byte(plaintext), []byte(context))
+	if err != nil {
+		return "", err
+	}
+	return encode(k.current, append(wrapped, ciphertext...)), nil
+}
+
+// Open decrypts a value sealed for context. Plaintext values are returned as
+// they are, which only exists so that values stored before encryption was in
+// place keep working until the reencrypt command seals them, and is logged
+// so that leftover plaintext credentials show.
+func (k *Keyring) Open(value, context string) (string, error) {
+	version, ok := Version(value)
+	if !ok {
+		// empty values, such as the passwords of SQLite clusters, hold
+		// nothing to seal
+		if value != "" {
+			log.Printf("opening a plaintext value for %s, run reencrypt to seal it", context)
+		}
+		return value, nil
+	}
+	if k == nil {
+		return "", ErrNoKeys
+	}
+	payload, err := decode(value)
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := k.unwrap(payload[:wrappedSize], version)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(dataKey, payload[wrappedSize:], []byte(context))
+	if err != nil {
+		return "", fmt.Errorf("failed to open the value sealed with key version %d: %w", version, err)
+	}
+	return string(plaintext), nil
+}
+
+// Rewrap returns the value sealed with the current key, reporting whether it
+// changed. The data key of a value sealed with an older key is unwrapped and
+// wrapped again, leaving the ciphertext as it is, and plaintext values are
+// sealed.
+func (k *Keyring) Rewrap(value, context string) (string, bool, error) {
+	version, ok := Version(value)
+	if !ok {
+		sealed, err := k.Seal(value, context)
+		return sealed, err == nil, err
+	}
+	if k == nil {
+		return "", false, ErrNoKeys
+	}
+	if version == k.current {
+		return value, false, nil
+	}
+	payload, err := decode(value)
+	if err != nil {
+		return "", false, err
+	}
+	dataKey, err := k.unwrap(payload[:wrappedSize], version)
+	if err != nil {
+		return "", false, err
+	}
+	// the context is checked before the value is relabelled
+	if _, err := open(dataKey, payload[wrappedSize:], []byte(context)); err != nil {
+		return "", false, fmt.Errorf("failed to open the value sealed with key version %d: %w", version, err)
+	}
+	wrapped, err := k.wrap(dataKey, k.current)
+	if err != nil {
+		return "", false, err
+	}
+	return encode(k.current, append(wrapped, payload[wrappedSize:]...)), true, nil
+}
+
+// wrap encrypts a data key with a key version, bound to the version so that
+// it cannot be relabelled
+func (k *Keyring) wrap(dataKey []byte, version int) ([]byte, error) {
+	return seal(k.keys[version], dataKey, versionData(version))
+}
+
+func (k *Keyring) unwrap(wrapped []byte, version int) ([]byte, error) {
+	key, ok := k.keys[version]
+	if !ok {
+		return nil, fmt.Errorf("%w %d", ErrUnknownVersion, version)
+	}
+	dataKey, err := open(key, wrapped, versionData(version))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap the data key with key version %d: %w", version, err)
+	}
+	return dataKey, nil
+}
+
+func versionData(version int) []byte {
+	return []byte(prefix + strconv.Itoa(version))
+}
+
+// seal encrypts plaintext with AES-GCM under a random nonce, which leads the
+// result
+func seal(key, plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, nonceSize, nonceSize+len(plaintext)+overhead)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(key, sealed, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < nonceSize+overhead {
+		return nil, ErrMalformed
+	}
+	return aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encode(version int, payload []byte) string {
+	return prefix + strconv.Itoa(version) + ":" + base64.RawURLEncoding.EncodeToString(payload)
+}
+
+// decode returns the wrapped data key followed by the ciphertext of a sealed
+// value
+func decode(value string) ([]byte, error) {
+	_, encoded, _ := strings.Cut(value[len(prefix):], ":")
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(payload) < wrappedSize+nonceSize+overhead {
+		return nil, ErrMalformed
+	}
+	return payload, nil
+}
+
+// credentials is the keyring of the server, loaded at startup
+var credentials *Keyring
+
+// SetDefault makes k the keyring the credentials of the server are sealed
+// with
+func SetDefault(k *Keyring) {
+	credentials = k
+}
+
+// Default returns the keyring the credentials of the server are sealed with,
+// nil before one is loaded
+func Default() *Keyring {
+	return credentials
+}
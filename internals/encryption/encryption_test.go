@@ -0,0 +1,209 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, KeySize)
+}
+
+func testKeyring(t *testing.T, current int, versions ...int) *Keyring {
+	t.Helper()
+	keys := make(map[int][]byte)
+	for _, version := range versions {
+		keys[version] = testKey(byte(version))
+	}
+	keyring, err := NewKeyring(keys, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+func TestSealOpen(t *testing.T) {
+	keyring := testKeyring(t, 1, 1)
+	for _, plaintext := range []string{"", "hunter2", strings.Repeat("p@ss", 100)} {
+		sealed, err := keyring.Seal(plaintext, "cluster:1")
+		if err != nil {
+			t.Fatalf("Seal failed: %v", err)
+		}
+		if !strings.HasPrefix(sealed, "enc:v1:") || (plaintext != "" && strings.Contains(sealed, plaintext)) {
+			t.Errorf("Seal(%q) = %q", plaintext, sealed)
+		}
+		opened, err := keyring.Open(sealed, "cluster:1")
+		if err != nil || opened != plaintext {
+			t.Errorf("Open(Seal(%q)) = %q, %v", plaintext, opened, err)
+		}
+	}
+
+	first, _ := keyring.Seal("hunter2", "cluster:1")
+	second, _ := keyring.Seal("hunter2", "cluster:1")
+	if first == second {
+		t.Error("Seal sealed the same value twice the same way")
+	}
+}
+
+func TestOpenOtherContext(t *testing.T) {
+	keyring := testKeyring(t, 1, 1)
+	sealed, err := keyring.Seal("hunter2", "cluster:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened, err := keyring.Open(sealed, "cluster:2"); err == nil {
+		t.Errorf("Open with another context = %q, want an error", opened)
+	}
+}
+
+func TestOlderVersions(t *testing.T) {
+	old := testKeyring(t, 1, 1)
+	sealed, err := old.Seal("hunter2", "cluster:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := testKeyring(t, 2, 1, 2)
+	if opened, err := rotated.Open(sealed, "cluster:1"); err != nil || opened != "hunter2" {
+		t.Errorf("Open of a version 1 value = %q, %v", opened, err)
+	}
+	if _, _, err := rotated.Rewrap(sealed, "cluster:2"); err == nil {
+		t.Error("Rewrap with another context succeeded")
+	}
+	rewrapped, changed, err := rotated.Rewrap(sealed, "cluster:1")
+	if err != nil || !changed {
+		t.Fatalf("Rewrap = %v, %v", changed, err)
+	}
+	if version, _ := Version(rewrapped); version != 2 {
+		t.Errorf("Rewrap sealed with version %d, want 2", version)
+	}
+	if opened, err := rotated.Open(rewrapped, "cluster:1"); err != nil || opened != "hunter2" {
+		t.Errorf("Open of the rewrapped value = %q, %v", opened, err)
+	}
+	if again, changed, err := rotated.Rewrap(rewrapped, "cluster:1"); err != nil || changed || again != rewrapped {
+		t.Errorf("Rewrap of a current value = %q, %v, %v", again, changed, err)
+	}
+
+	// once the old key is dropped only rewrapped values open
+	current := testKeyring(t, 2, 2)
+	if _, err := current.Open(sealed, "cluster:1"); !errors.Is(err, ErrUnknownVersion) {
+		t.Errorf("Open without the key of the value = %v, want ErrUnknownVersion", err)
+	}
+	if opened, err := current.Open(rewrapped, "cluster:1"); err != nil || opened != "hunter2" {
+		t.Errorf("Open of the rewrapped value = %q, %v", opened, err)
+	}
+}
+
+func TestRelabelledVersion(t *testing.T) {
+	keyring := testKeyring(t, 2, 1, 2)
+	sealed, err := keyring.Seal("hunter2", "cluster:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relabelled := "enc:v1:" + strings.TrimPrefix(sealed, "enc:v2:")
+	if _, err := keyring.Open(relabelled, "cluster:1"); err == nil {
+		t.Error("Open of a value relabelled with another version succeeded")
+	}
+}
+
+func TestTampered(t *testing.T) {
+	keyring := testKeyring(t, 1, 1)
+	sealed, err := keyring.Seal("hunter2", "cluster:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(sealed, "enc:v1:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	flip := func(i int) string {
+		tampered := append([]byte(nil), payload...)
+		tampered[i] ^= 1
+		return "enc:v1:" + base64.RawURLEncoding.EncodeToString(tampered)
+	}
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"wrapped key", flip(nonceSize + 1)},
+		{"ciphertext", flip(len(payload) - overhead - 1)},
+		{"tag", flip(len(payload) - 1)},
+		{"truncated", sealed[:len(sealed)-4]},
+		{"too short", "enc:v1:" + base64.RawURLEncoding.EncodeToString(payload[:wrappedSize])},
+		{"not base64", "enc:v1:***"},
+		{"empty payload", "enc:v1:"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if opened, err := keyring.Open(test.value, "cluster:1"); err == nil {
+				t.Errorf("Open(%q) = %q, want an error", test.value, opened)
+			}
+		})
+	}
+}
+
+func TestPlaintext(t *testing.T) {
+	keyring := testKeyring(t, 1, 1)
+	if opened, err := keyring.Open("hunter2", "cluster:1"); err != nil || opened != "hunter2" {
+		t.Errorf("Open of a plaintext value = %q, %v", opened, err)
+	}
+	sealed, changed, err := keyring.Rewrap("hunter2", "cluster:1")
+	if err != nil || !changed || !Sealed(sealed) {
+		t.Fatalf("Rewrap of a plaintext value = %q, %v, %v", sealed, changed, err)
+	}
+	if opened, err := keyring.Open(sealed, "cluster:1"); err != nil || opened != "hunter2" {
+		t.Errorf("Open of the sealed plaintext = %q, %v", opened, err)
+	}
+	var missing *Keyring
+	if _, err := missing.Seal("hunter2", "cluster:1"); !errors.Is(err, ErrNoKeys) {
+		t.Errorf("Seal without keys = %v, want ErrNoKeys", err)
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	one := base64.StdEncoding.EncodeToString(testKey(1))
+	two := base64.StdEncoding.EncodeToString(testKey(2))
+	keys, err := ParseKeys(" 1:" + one + " , 2:" + two + ",")
+	if err != nil {
+		t.Fatalf("ParseKeys failed: %v", err)
+	}
+	if len(keys) != 2 || !bytes.Equal(keys[1], testKey(1)) || !bytes.Equal(keys[2], testKey(2)) {
+		t.Errorf("ParseKeys = %v", keys)
+	}
+
+	tests := []struct {
+		name string
+		spec string
+	}{
+		{"no version", one},
+		{"bad version", "one:" + one},
+		{"bad base64", "1:not*base64"},
+		{"duplicate", "1:" + one + ",1:" + two},
+	}
+	for _, test := range tests {
+		if _, err := ParseKeys(test.spec); err == nil {
+			t.Errorf("ParseKeys(%s) succeeded, want an error", test.name)
+		}
+	}
+}
+
+func TestNewKeyring(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    map[int][]byte
+		current int
+	}{
+		{"short key", map[int][]byte{1: testKey(1)[:16]}, 1},
+		{"negative version", map[int][]byte{-1: testKey(1)}, -1},
+		{"unknown current", map[int][]byte{1: testKey(1)}, 2},
+		{"no keys", map[int][]byte{}, 0},
+	}
+	for _, test := range tests {
+		if _, err := NewKeyring(test.keys, test.current); err == nil {
+			t.Errorf("NewKeyring(%s) succeeded, want an error", test.name)
+		}
+	}
+}
@@ -16,13 +16,33 @@ func HandleError(err error) {
 }
 
 func InternalServerError(err error, c *gin.Context, message string) {
-	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "message": message})
+	c.JSON(http.StatusInternalServerError, gin.H{"error": errorMessage(err), "message": message})
 }
 
 func BadRequestError(err error, c *gin.Context, message string) {
-	c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "message": message})
+	c.JSON(http.StatusBadRequest, gin.H{"error": errorMessage(err), "message": message})
 }
 
 func UnAuthorizedError(err error, c *gin.Context, message string) {
-	c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error(), "message": message})
+	c.JSON(http.StatusUnauthorized, gin.H{"error": errorMessage(err), "message": message})
+}
+
+func ForbiddenError(err error, c *gin.Context, message string) {
+	c.JSON(http.StatusForbidden, gin.H{"error": errorMessage(err), "message": message})
+}
+
+func NotFoundError(err error, c *gin.Context, message string) {
+	c.JSON(http.StatusNotFound, gin.H{"error": errorMessage(err), "message": message})
+}
+
+func ConflictError(err error, c *gin.Context, message string) {
+	c.JSON(http.StatusConflict, gin.H{"error": errorMessage(err), "message": message})
+}
+
+// errorMessage tolerates a nil error for failures that carry only a message
+func errorMessage(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
 }
@@ -0,0 +1,51 @@
+package export
+
+import (
+	"encoding/csv"
+	"io"
+)
+
+// csvFlushRows is how many rows are buffered before they are sent on
+const csvFlushRows = 500
+
+// csvWriter writes a header line followed by one line per row. NULL is an
+// empty field, binary values are base64 and JSON values their raw text.
+type csvWriter struct {
+	writer  *csv.Writer
+	record  []string
+	pending int
+}
+
+func newCSVWriter(w io.Writer) Writer {
+	return &csvWriter{writer: csv.NewWriter(w)}
+}
+
+func (this *csvWriter) Begin(columns []Column) error {
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = column.Name
+	}
+	this.record = make([]string, len(columns))
+	return this.writer.Write(names)
+}
+
+func (this *csvWriter) Write(values []interface{}) error {
+	for i, value := range values {
+		this.record[i] = Text(value)
+	}
+	if err := this.writer.Write(this.record); err != nil {
+		return err
+	}
+	this.pending++
+	if this.pending >= csvFlushRows {
+		this.pending = 0
+		this.writer.Flush()
+		return this.writer.Error()
+	}
+	return nil
+}
+
+func (this *csvWriter) Close() error {
+	this.writer.Flush()
+	return this.writer.Error()
+}
@@ -0,0 +1,350 @@
+package export
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+// Kind is the type of an exported column. Values handed to a Writer are nil
+// for NULL or, by kind, a string, int64, float64, bool, time.Time, []byte,
+// json.RawMessage or, for decimals, the exact digits as a string.
+type Kind int
+
+const (
+	KindString Kind = iota
+	KindInt
+	KindFloat
+	KindDecimal
+	KindBool
+	KindTime
+	KindBytes
+	KindJSON
+)
+
+type Column struct {
+	Name string
+	Kind Kind
+}
+
+// Writer encodes a stream of rows. Begin is called once with the columns,
+// then Write once per row with the values in column order, and Close when
+// the rows are exhausted to write whatever the format keeps until the end.
+type Writer interface {
+	Begin(columns []Column) error
+	Write(values []interface{}) error
+	Close() error
+}
+
+// Format describes an export format
+type Format struct {
+	Name        string
+	ContentType string
+	Extension   string
+	new         func(w io.Writer) Writer
+}
+
+var formats = map[string]Format{
+	"csv": {
+		Name:        "csv",
+		ContentType: "text/csv; charset=utf-8",
+		Extension:   "csv",
+		new:         newCSVWriter,
+	},
+	"ndjson": {
+		Name:        "ndjson",
+		ContentType: "application/x-ndjson",
+		Extension:   "ndjson",
+		new:         newNDJSONWriter,
+	},
+	"parquet": {
+		Name:        "parquet",
+		ContentType: "application/vnd.apache.parquet",
+		Extension:   "parquet",
+		new:         newParquetWriter,
+	},
+	"xlsx": {
+		Name:        "xlsx",
+		ContentType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		Extension:   "xlsx",
+		new:         newXLSXWriter,
+	},
+}
+
+// FormatByName returns the export format called name, false if there is none
+func FormatByName(name string) (Format, bool) {
+	format, ok := formats[strings.ToLower(name)]
+	return format, ok
+}
+
+// NewWriter returns a Writer encoding rows in the format onto w
+func (format Format) NewWriter(w io.Writer) Writer {
+	return format.new(w)
+}
+
+// KindOf classifies a column by the type name its driver reports
+func KindOf(databaseTypeName string) Kind {
+	name := strings.ToUpper(databaseTypeName)
+	switch {
+	case strings.Contains(name, "JSON"):
+		return KindJSON
+	case name == "BOOL" || name == "BOOLEAN" || name == "BIT":
+		return KindBool
+	case name == "HUGEINT" || name == "UHUGEINT" || name == "UBIGINT":
+		// wider than int64
+		return KindDecimal
+	case strings.Contains(name, "INTERVAL") || strings.Contains(name, "POINT"):
+		return KindString
+	case strings.Contains(name, "INT"):
+		return KindInt
+	case strings.Contains(name, "DECIMAL") || strings.Contains(name, "NUMERIC") || strings.Contains(name, "MONEY"):
+		return KindDecimal
+	case strings.Contains(name, "FLOAT") || strings.Contains(name, "DOUBLE") || name == "REAL":
+		return KindFloat
+	case strings.Contains(name, "TIMESTAMP") || strings.Contains(name, "DATETIME") || name == "DATE":
+		return KindTime
+	case name == "BYTEA" || strings.Contains(name, "BLOB") || strings.Contains(name, "BINARY") || name == "IMAGE":
+		return KindBytes
+	}
+	return KindString
+}
+
+// timeLayouts are the textual timestamps drivers return when they do not
+// parse them themselves, e.g. MySQL without parseTime
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// Convert turns a value scanned from a driver into the representation of
+// kind described on Kind
+func Convert(kind Kind, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	if b, ok := value.([]byte); ok && kind != KindBytes && kind != KindJSON && kind != KindBool {
+		value = string(b)
+	}
+
+	switch kind {
+	case KindInt:
+		switch v := value.(type) {
+		case int64:
+			return v, nil
+		case int32:
+			return int64(v), nil
+		case int:
+			return int64(v), nil
+		case int16:
+			return int64(v), nil
+		case int8:
+			return int64(v), nil
+		case uint32:
+			return int64(v), nil
+		case uint16:
+			return int64(v), nil
+		case uint8:
+			return int64(v), nil
+		case uint64:
+			// unsigned BIGINT as sent by the MySQL binary protocol
+			if v > math.MaxInt64 {
+				return nil, fmt.Errorf("%d overflows int64", v)
+			}
+			return int64(v), nil
+		case string:
+			return strconv.ParseInt(v, 10, 64)
+		}
+	case KindFloat:
+		switch v := value.(type) {
+		case float64:
+			return v, nil
+		case float32:
+			return float64(v), nil
+		case int64:
+			return float64(v), nil
+		case string:
+			return strconv.ParseFloat(v, 64)
+		}
+	case KindDecimal:
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), nil
+		case int64:
+			return strconv.FormatInt(v, 10), nil
+		case duckdb.Decimal:
+			return decimalDigits(v.Value, int(v.Scale)), nil
+		}
+		return fmt.Sprint(value), nil
+	case KindBool:
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case int64:
+			return v != 0, nil
+		case []byte:
+			// MySQL returns BIT(1) as a single raw byte
+			if len(v) == 1 && v[0] <= 1 {
+				return v[0] == 1, nil
+			}
+			return strconv.ParseBool(string(v))
+		case string:
+			return strconv.ParseBool(v)
+		}
+	case KindTime:
+		switch v := value.(type) {
+		case time.Time:
+			return v, nil
+		case string:
+			for _, layout := range timeLayouts {
+				if t, err := time.Parse(layout, v); err == nil {
+					return t, nil
+				}
+			}
+			return nil, fmt.Errorf("cannot read %q as a timestamp", v)
+		}
+	case KindBytes:
+		switch v := value.(type) {
+		case []byte:
+			return v, nil
+		case string:
+			return []byte(v), nil
+		}
+	case KindJSON:
+		switch v := value.(type) {
+		case []byte:
+			return json.RawMessage(v), nil
+		case string:
+			return json.RawMessage(v), nil
+		}
+		data, err := json.Marshal(value)
+		return json.RawMessage(data), err
+	case KindString:
+		return Text(value), nil
+	}
+	return nil, fmt.Errorf("cannot export %T value as %s", value, kind)
+}
+
+// decimalDigits writes an unscaled integer with scale digits after the point
+func decimalDigits(unscaled *big.Int, scale int) string {
+	digits := new(big.Int).Abs(unscaled).String()
+	if scale > 0 {
+		if len(digits) <= scale {
+			digits = strings.Repeat("0", scale-len(digits)+1) + digits
+		}
+		digits = digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+	}
+	if unscaled.Sign() < 0 {
+		digits = "-" + digits
+	}
+	return digits
+}
+
+// Text renders a converted value for the text based formats
+func Text(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v)
+	case json.RawMessage:
+		return string(v)
+	}
+	return fmt.Sprint(value)
+}
+
+func (kind Kind) String() string {
+	switch kind {
+	case KindInt:
+		return "int"
+	case KindFloat:
+		return "float"
+	case KindDecimal:
+		return "decimal"
+	case KindBool:
+		return "bool"
+	case KindTime:
+		return "timestamp"
+	case KindBytes:
+		return "bytes"
+	case KindJSON:
+		return "json"
+	}
+	return "string"
+}
+
+// Rows streams a query result into w one row at a time
+func Rows(rows *sql.Rows, w Writer) error {
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return err
+	}
+	columns := make([]Column, len(columnTypes))
+	for i, columnType := range columnTypes {
+		columns[i] = Column{Name: columnType.Name(), Kind: KindOf(columnType.DatabaseTypeName())}
+	}
+	if err := w.Begin(columns); err != nil {
+		return err
+	}
+
+	scanned := make([]interface{}, len(columns))
+	for i := range scanned {
+		scanned[i] = new(interface{})
+	}
+	values := make([]interface{}, len(columns))
+	for rows.Next() {
+		if err := rows.Scan(scanned...); err != nil {
+			return err
+		}
+		for i, column := range columns {
+			values[i], err = Convert(column.Kind, *scanned[i].(*interface{}))
+			if err != nil {
+				return fmt.Errorf("column %s: %w", column.Name, err)
+			}
+		}
+		if err := w.Write(values); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// uniqueNames returns the column names with repeated ones, as produced by
+// joins, suffixed with their occurrence
+func uniqueNames(columns []Column) []string {
+	seen := make(map[string]int, len(columns))
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		seen[column.Name]++
+		names[i] = column.Name
+		if n := seen[column.Name]; n > 1 {
+			names[i] = fmt.Sprintf("%s_%d", column.Name, n)
+		}
+	}
+	return names
+}
@@ -0,0 +1,81 @@
+package export
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"math"
+)
+
+// ndjsonFlushRows is how many rows are buffered before they are sent on
+const ndjsonFlushRows = 500
+
+// ndjsonWriter writes one JSON object per line with the keys in column
+// order. Binary values are base64 strings, JSON values are embedded as they
+// are and decimals stay strings so that no precision is lost.
+type ndjsonWriter struct {
+	writer  *bufio.Writer
+	keys    [][]byte
+	pending int
+}
+
+func newNDJSONWriter(w io.Writer) Writer {
+	return &ndjsonWriter{writer: bufio.NewWriter(w)}
+}
+
+func (this *ndjsonWriter) Begin(columns []Column) error {
+	names := uniqueNames(columns)
+	this.keys = make([][]byte, len(names))
+	for i, name := range names {
+		key, err := json.Marshal(name)
+		if err != nil {
+			return err
+		}
+		this.keys[i] = append(key, ':')
+	}
+	return nil
+}
+
+func (this *ndjsonWriter) Write(values []interface{}) error {
+	this.writer.WriteByte('{')
+	for i, value := range values {
+		if i > 0 {
+			this.writer.WriteByte(',')
+		}
+		this.writer.Write(this.keys[i])
+		data, err := ndjsonValue(value)
+		if err != nil {
+			return err
+		}
+		this.writer.Write(data)
+	}
+	if _, err := this.writer.WriteString("}\n"); err != nil {
+		return err
+	}
+	this.pending++
+	if this.pending >= ndjsonFlushRows {
+		this.pending = 0
+		return this.writer.Flush()
+	}
+	return nil
+}
+
+func ndjsonValue(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case json.RawMessage:
+		if !json.Valid(v) {
+			return json.Marshal(string(v))
+		}
+		return v, nil
+	case float64:
+		// JSON has no NaN or infinities
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return json.Marshal(Text(v))
+		}
+	}
+	return json.Marshal(value)
+}
+
+func (this *ndjsonWriter) Close() error {
+	return this.writer.Flush()
+}
@@ -0,0 +1,82 @@
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// parquetRowGroupSize bounds the rows held in memory before a row group is
+// written out
+const parquetRowGroupSize = 16 * 1024 * 1024
+
+// parquetWriter writes every column as an optional field typed after its
+// kind. Timestamps are stored as UTC microseconds, decimals as their digits
+// in a UTF8 string and JSON values as JSON strings.
+type parquetWriter struct {
+	out     io.Writer
+	writer  *writer.CSVWriter
+	columns []Column
+	record  []interface{}
+}
+
+func newParquetWriter(w io.Writer) Writer {
+	return &parquetWriter{out: w}
+}
+
+// parquetTypes maps kinds to the type and converted type of their field
+var parquetTypes = map[Kind]string{
+	KindString:  "type=BYTE_ARRAY, convertedtype=UTF8",
+	KindInt:     "type=INT64",
+	KindFloat:   "type=DOUBLE",
+	KindDecimal: "type=BYTE_ARRAY, convertedtype=UTF8",
+	KindBool:    "type=BOOLEAN",
+	KindTime:    "type=INT64, convertedtype=TIMESTAMP_MICROS",
+	KindBytes:   "type=BYTE_ARRAY",
+	KindJSON:    "type=BYTE_ARRAY, convertedtype=JSON",
+}
+
+func (this *parquetWriter) Begin(columns []Column) error {
+	// the schema is written as comma separated key=value pairs
+	sanitize := strings.NewReplacer(",", "_", "=", "_")
+	metadata := make([]string, len(columns))
+	for i, name := range uniqueNames(columns) {
+		metadata[i] = fmt.Sprintf("name=%s, %s, repetitiontype=OPTIONAL", sanitize.Replace(name), parquetTypes[columns[i].Kind])
+	}
+	pw, err := writer.NewCSVWriterFromWriter(metadata, this.out, 1)
+	if err != nil {
+		return err
+	}
+	pw.RowGroupSize = parquetRowGroupSize
+	this.writer = pw
+	this.columns = columns
+	this.record = make([]interface{}, len(columns))
+	return nil
+}
+
+func (this *parquetWriter) Write(values []interface{}) error {
+	for i, value := range values {
+		switch v := value.(type) {
+		case time.Time:
+			this.record[i] = v.UnixMicro()
+		case []byte:
+			this.record[i] = string(v)
+		case json.RawMessage:
+			this.record[i] = string(v)
+		default:
+			this.record[i] = v
+		}
+	}
+	return this.writer.Write(this.record)
+}
+
+func (this *parquetWriter) Close() error {
+	if err := this.writer.WriteStop(); err != nil {
+		return err
+	}
+	return this.writer.PFile.Close()
+}
@@ -0,0 +1,78 @@
+package export
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/xuri/excelize/v2"
+)
+
+const xlsxSheet = "Sheet1"
+
+// xlsxWriter writes a header row followed by one row per result row on a
+// single sheet. Rows are spilled to a temporary file while streaming and the
+// workbook is written out on Close, as the zip container needs its contents
+// up front. Binary values are base64 and JSON values their raw text.
+type xlsxWriter struct {
+	out    io.Writer
+	file   *excelize.File
+	stream *excelize.StreamWriter
+	row    int
+	cells  []interface{}
+}
+
+func newXLSXWriter(w io.Writer) Writer {
+	return &xlsxWriter{out: w}
+}
+
+func (this *xlsxWriter) Begin(columns []Column) error {
+	this.file = excelize.NewFile()
+	stream, err := this.file.NewStreamWriter(xlsxSheet)
+	if err != nil {
+		return err
+	}
+	this.stream = stream
+	header := make([]interface{}, len(columns))
+	for i, column := range columns {
+		header[i] = column.Name
+	}
+	this.cells = make([]interface{}, len(columns))
+	return this.writeRow(header)
+}
+
+func (this *xlsxWriter) Write(values []interface{}) error {
+	for i, value := range values {
+		switch v := value.(type) {
+		case []byte:
+			this.cells[i] = base64.StdEncoding.EncodeToString(v)
+		case json.RawMessage:
+			this.cells[i] = string(v)
+		default:
+			this.cells[i] = v
+		}
+	}
+	return this.writeRow(this.cells)
+}
+
+func (this *xlsxWriter) writeRow(cells []interface{}) error {
+	this.row++
+	if this.row > excelize.TotalRows {
+		return fmt.Errorf("xlsx sheets are limited to %d rows", excelize.TotalRows)
+	}
+	cell, err := excelize.CoordinatesToCellName(1, this.row)
+	if err != nil {
+		return err
+	}
+	return this.stream.SetRow(cell, cells)
+}
+
+func (this *xlsxWriter) Close() error {
+	defer this.file.Close()
+	if err := this.stream.Flush(); err != nil {
+		return err
+	}
+	_, err := this.file.WriteTo(this.out)
+	return err
+}
@@ -0,0 +1,107 @@
+package filters
+
+import (
+	"fmt"
+	"regexp"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// BSON compiles the tree into a MongoDB query document
+func (n *Node) BSON() (bson.D, error) {
+	switch {
+	case n.And != nil:
+		return n.bsonGroup("$and", n.And)
+	case n.Or != nil:
+		return n.bsonGroup("$or", n.Or)
+	case n.Not != nil:
+		child, err := n.Not.BSON()
+		if err != nil {
+			return nil, err
+		}
+		return bson.D{{Key: "$nor", Value: bson.A{child}}}, nil
+	}
+	return n.bsonCondition()
+}
+
+func (n *Node) bsonGroup(operator string, children []*Node) (bson.D, error) {
+	if len(children) == 0 {
+		if operator == "$and" {
+			return bson.D{}, nil
+		}
+		// $or rejects an empty array, match nothing instead
+		return bson.D{{Key: "_id", Value: bson.D{{Key: "$exists", Value: false}}}}, nil
+	}
+	conditions := make(bson.A, 0, len(children))
+	for _, child := range children {
+		condition, err := child.BSON()
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, condition)
+	}
+	return bson.D{{Key: operator, Value: conditions}}, nil
+}
+
+func (n *Node) bsonCondition() (bson.D, error) {
+	field := func(value interface{}) (bson.D, error) {
+		return bson.D{{Key: n.Column, Value: value}}, nil
+	}
+	regex := func(pattern, options string) primitive.Regex {
+		return primitive.Regex{Pattern: pattern, Options: options}
+	}
+	text := fmt.Sprint(n.Value)
+
+	switch n.Operator {
+	case "=":
+		return field(bson.D{{Key: "$eq", Value: n.Value}})
+	case "!=":
+		return field(bson.D{{Key: "$ne", Value: n.Value}})
+	case "<":
+		return field(bson.D{{Key: "$lt", Value: n.Value}})
+	case ">":
+		return field(bson.D{{Key: "$gt", Value: n.Value}})
+	case ">=":
+		return field(bson.D{{Key: "$gte", Value: n.Value}})
+	case "<=":
+		return field(bson.D{{Key: "$lte", Value: n.Value}})
+	case "in", "not in":
+		values, ok := n.Value.([]interface{})
+		if !ok {
+			values = []interface{}{n.Value}
+		}
+		operator := "$in"
+		if n.Operator == "not in" {
+			operator = "$nin"
+		}
+		return field(bson.D{{Key: operator, Value: values}})
+	case "is null":
+		return field(bson.D{{Key: "$eq", Value: nil}})
+	case "is not null":
+		return field(bson.D{{Key: "$ne", Value: nil}})
+	case "between", "not between":
+		values, ok := n.Value.([]interface{})
+		if !ok || len(values) != 2 {
+			return nil, fmt.Errorf("invalid filter: %s on %q needs exactly two values", n.Operator, n.Column)
+		}
+		between := bson.D{{Key: "$gte", Value: values[0]}, {Key: "$lte", Value: values[1]}}
+		if n.Operator == "not between" {
+			return field(bson.D{{Key: "$not", Value: between}})
+		}
+		return field(between)
+	case "contains":
+		return field(regex(regexp.QuoteMeta(text), ""))
+	case "not contains":
+		return field(bson.D{{Key: "$not", Value: regex(regexp.QuoteMeta(text), "")}})
+	case "contains_ci":
+		return field(regex(regexp.QuoteMeta(text), "i"))
+	case "not contains_ci":
+		return field(bson.D{{Key: "$not", Value: regex(regexp.QuoteMeta(text), "i")}})
+	case "has prefix":
+		return field(regex("^"+regexp.QuoteMeta(text), ""))
+	case "has suffix":
+		return field(regex(regexp.QuoteMeta(text)+"$", ""))
+	}
+	return nil, fmt.Errorf("invalid filter: unsupported operator %q", n.Operator)
+}
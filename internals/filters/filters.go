@@ -0,0 +1,231 @@
+package filters
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Node is one node of a filter tree. A node is either a group, combining its
+// children with And or Or or negating a single child with Not, or a leaf
+// comparing Column with Value using Operator. In JSON:
+//
+//	{"and": [
+//		{"column": "age", "op": ">=", "value": 18},
+//		{"or": [
+//			{"column": "country", "op": "in", "value": ["DE", "FR"]},
+//			{"not": {"column": "email", "op": "is null"}}
+//		]}
+//	]}
+type Node struct {
+	And []*Node `json:"and,omitempty"`
+	Or  []*Node `json:"or,omitempty"`
+	Not *Node   `json:"not,omitempty"`
+
+	Column   string      `json:"column,omitempty"`
+	Operator string      `json:"op,omitempty"`
+	Value    interface{} `json:"value,omitempty"`
+}
+
+// operators lists the supported leaf operators and whether they take a value
+var operators = map[string]bool{
+	"=":               true,
+	"!=":              true,
+	"<":               true,
+	">":               true,
+	">=":              true,
+	"<=":              true,
+	"in":              true,
+	"not in":          true,
+	"is null":         false,
+	"is not null":     false,
+	"between":         true,
+	"not between":     true,
+	"contains":        true,
+	"not contains":    true,
+	"contains_ci":     true,
+	"not contains_ci": true,
+	"has prefix":      true,
+	"has suffix":      true,
+}
+
+// Parse reads the filter parameter of /cluster/data. A value starting with {
+// or [ is a JSON filter tree, where a top level array is shorthand for an and
+// group. Anything else is the legacy col:op:value|col:op:value syntax whose
+// conditions are joined with operator, and unless it is "or". An empty filter
+// yields a nil tree.
+func Parse(filter, operator string) (*Node, error) {
+	filter = strings.TrimSpace(filter)
+	if filter == "" {
+		return nil, nil
+	}
+	if filter[0] == '{' || filter[0] == '[' {
+		return parseJSON(filter)
+	}
+	return parseLegacy(filter, operator)
+}
+
+func parseJSON(filter string) (*Node, error) {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(filter)))
+	decoder.UseNumber()
+
+	var root *Node
+	if filter[0] == '[' {
+		var children []*Node
+		if err := decoder.Decode(&children); err != nil {
+			return nil, fmt.Errorf("invalid filter: %w", err)
+		}
+		root = &Node{And: children}
+	} else if err := decoder.Decode(&root); err != nil {
+		return nil, fmt.Errorf("invalid filter: %w", err)
+	}
+	if err := root.normalize(); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// parseLegacy reads col:op:value conditions, where the values of in and
+// between operators are comma separated
+func parseLegacy(filter, operator string) (*Node, error) {
+	root := &Node{}
+	for _, pair := range strings.Split(filter, "|") {
+		parts := strings.SplitN(pair, ":", 3)
+		if len(parts) != 3 || parts[0] == "" {
+			continue
+		}
+		takesValue, ok := operators[parts[1]]
+		if !ok {
+			continue
+		}
+		leaf := &Node{Column: parts[0], Operator: parts[1]}
+		if takesValue {
+			leaf.Value = parts[2]
+		}
+		switch leaf.Operator {
+		case "in", "not in", "between", "not between":
+			values := []interface{}{}
+			for _, value := range strings.Split(parts[2], ",") {
+				values = append(values, value)
+			}
+			leaf.Value = values
+		}
+		if err := leaf.checkValue(); err != nil {
+			return nil, err
+		}
+		if operator == "or" {
+			root.Or = append(root.Or, leaf)
+		} else {
+			root.And = append(root.And, leaf)
+		}
+	}
+	if len(root.And) == 0 && len(root.Or) == 0 {
+		return nil, nil
+	}
+	return root, nil
+}
+
+// normalize validates the tree and converts JSON numbers to int64 or float64
+func (n *Node) normalize() error {
+	if n == nil {
+		return fmt.Errorf("invalid filter: empty node")
+	}
+	kinds := 0
+	if n.And != nil {
+		kinds++
+	}
+	if n.Or != nil {
+		kinds++
+	}
+	if n.Not != nil {
+		kinds++
+	}
+	if n.Column != "" || n.Operator != "" {
+		kinds++
+	}
+	if kinds != 1 {
+		return fmt.Errorf("invalid filter: a node must be exactly one of and, or, not or a column condition")
+	}
+
+	for _, children := range [][]*Node{n.And, n.Or} {
+		for _, child := range children {
+			if err := child.normalize(); err != nil {
+				return err
+			}
+		}
+	}
+	if n.Not != nil {
+		return n.Not.normalize()
+	}
+	if n.Column == "" && n.Operator == "" {
+		return nil
+	}
+
+	takesValue, ok := operators[n.Operator]
+	if !ok {
+		return fmt.Errorf("invalid filter: unsupported operator %q", n.Operator)
+	}
+	if n.Column == "" {
+		return fmt.Errorf("invalid filter: operator %q is missing a column", n.Operator)
+	}
+	if !takesValue {
+		n.Value = nil
+		return nil
+	}
+	n.Value = normalizeValue(n.Value)
+	return n.checkValue()
+}
+
+// checkValue validates the value of a leaf against its operator
+func (n *Node) checkValue() error {
+	values, isList := n.Value.([]interface{})
+	switch n.Operator {
+	case "in", "not in":
+		return nil
+	case "between", "not between":
+		if !isList || len(values) != 2 {
+			return fmt.Errorf("invalid filter: %s on %q needs exactly two values", n.Operator, n.Column)
+		}
+		return nil
+	}
+	if isList {
+		return fmt.Errorf("invalid filter: %s on %q takes a single value", n.Operator, n.Column)
+	}
+	return nil
+}
+
+func normalizeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		for i := range v {
+			v[i] = normalizeValue(v[i])
+		}
+		return v
+	}
+	return value
+}
+
+// Columns returns every column referenced by the tree
+func (n *Node) Columns() []string {
+	if n == nil {
+		return nil
+	}
+	var columns []string
+	for _, children := range [][]*Node{n.And, n.Or} {
+		for _, child := range children {
+			columns = append(columns, child.Columns()...)
+		}
+	}
+	columns = append(columns, n.Not.Columns()...)
+	if n.Column != "" {
+		columns = append(columns, n.Column)
+	}
+	return columns
+}
@@ -0,0 +1,95 @@
+package filters
+
+import (
+	"butler-server/internals/dialect"
+	"fmt"
+	"strings"
+)
+
+// SQL compiles the tree into a boolean SQL expression for d. Placeholders are
+// numbered after the arguments already in args, and the returned slice is
+// args extended with the values the expression binds, in placeholder order.
+func (n *Node) SQL(d dialect.Dialect, args []interface{}) (string, []interface{}, error) {
+	switch {
+	case n.And != nil:
+		return n.group(d, args, n.And, " AND ", "1 = 1")
+	case n.Or != nil:
+		return n.group(d, args, n.Or, " OR ", "1 = 0")
+	case n.Not != nil:
+		condition, args, err := n.Not.SQL(d, args)
+		if err != nil {
+			return "", nil, err
+		}
+		return "NOT (" + condition + ")", args, nil
+	}
+	return n.condition(d, args)
+}
+
+func (n *Node) group(d dialect.Dialect, args []interface{}, children []*Node, separator, empty string) (string, []interface{}, error) {
+	if len(children) == 0 {
+		return empty, args, nil
+	}
+	conditions := make([]string, 0, len(children))
+	for _, child := range children {
+		condition, childArgs, err := child.SQL(d, args)
+		if err != nil {
+			return "", nil, err
+		}
+		args = childArgs
+		conditions = append(conditions, condition)
+	}
+	if len(conditions) == 1 {
+		return conditions[0], args, nil
+	}
+	return "(" + strings.Join(conditions, separator) + ")", args, nil
+}
+
+func (n *Node) condition(d dialect.Dialect, args []interface{}) (string, []interface{}, error) {
+	column := d.QuoteIdentifier(n.Column)
+	bind := func(value interface{}) string {
+		args = append(args, value)
+		return d.Placeholder(len(args))
+	}
+
+	switch n.Operator {
+	case "=", "!=", "<", ">", ">=", "<=":
+		return fmt.Sprintf(`%s %s %s`, column, n.Operator, bind(n.Value)), args, nil
+	case "in", "not in":
+		values, ok := n.Value.([]interface{})
+		if !ok {
+			values = []interface{}{n.Value}
+		}
+		if len(values) == 0 {
+			// an empty list matches nothing, and everything once negated
+			if n.Operator == "in" {
+				return "1 = 0", args, nil
+			}
+			return "1 = 1", args, nil
+		}
+		placeholders := make([]string, len(values))
+		for i, value := range values {
+			placeholders[i] = bind(value)
+		}
+		return fmt.Sprintf(`%s %s (%s)`, column, strings.ToUpper(n.Operator), strings.Join(placeholders, ", ")), args, nil
+	case "is null":
+		return fmt.Sprintf(`%s IS NULL`, column), args, nil
+	case "is not null":
+		return fmt.Sprintf(`%s IS NOT NULL`, column), args, nil
+	case "between", "not between":
+		values, ok := n.Value.([]interface{})
+		if !ok || len(values) != 2 {
+			return "", nil, fmt.Errorf("invalid filter: %s on %q needs exactly two values", n.Operator, n.Column)
+		}
+		return fmt.Sprintf(`%s %s %s AND %s`, column, strings.ToUpper(n.Operator), bind(values[0]), bind(values[1])), args, nil
+	case "contains", "not contains", "contains_ci", "not contains_ci":
+		pattern := "%" + d.EscapeLike(fmt.Sprint(n.Value)) + "%"
+		negate := strings.HasPrefix(n.Operator, "not ")
+		ignoreCase := strings.HasSuffix(n.Operator, "_ci")
+		return d.Like(column, bind(pattern), negate, ignoreCase), args, nil
+	case "has prefix":
+		return d.Like(column, bind(d.EscapeLike(fmt.Sprint(n.Value))+"%"), false, false), args, nil
+	case "has suffix":
+		return d.Like(column, bind("%"+d.EscapeLike(fmt.Sprint(n.Value))), false, false), args, nil
+	}
+	return "", nil, fmt.Errorf("invalid filter: unsupported operator %q", n.Operator)
+}
@@ -0,0 +1,353 @@
+package masking
+
+import (
+	"butler-server/internals"
+	"butler-server/internals/export"
+	"butler-server/internals/sqlparse"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Strategies of a Rule. Redact replaces values with a fixed placeholder,
+// partial keeps the last Reveal characters, hash replaces values with a
+// keyed hash that still tells equal values apart and format replaces every
+// letter and digit with another one of the same class, keyed the same way.
+const (
+	StrategyRedact  = "redact"
+	StrategyPartial = "partial"
+	StrategyHash    = "hash"
+	StrategyFormat  = "format"
+)
+
+// redacted replaces the values of redacted columns
+const redacted = "****"
+
+// defaultReveal is the number of characters partial masks keep when the rule
+// sets none
+const defaultReveal = 4
+
+// Rule masks a column of a table, of any table of the database when Table is
+// empty and of any database when Database is empty. Users with one of the
+// Exempt roles see the values as they are. Only top level fields of MongoDB
+// documents can be masked, a field nested in a subdocument is hidden by
+// masking the top level field holding it.
+type Rule struct {
+	Database string
+	Table    string
+	Column   string
+	Strategy string
+	Reveal   int
+	Exempt   []string
+}
+
+// Validate checks the strategy and the column of the rule, which may not be
+// a dotted path
+func (r Rule) Validate() error {
+	if r.Column == "" {
+		return errors.New("column is mandatory")
+	}
+	// results are masked by column name, so a dotted path to a nested field
+	// of a document would never match and leave the field as it is
+	if strings.Contains(r.Column, ".") {
+		return errors.New("column should be a top level field, mask the field holding a nested one")
+	}
+	switch r.Strategy {
+	case StrategyRedact, StrategyHash, StrategyFormat:
+	case StrategyPartial:
+		if r.Reveal < 0 {
+			return errors.New("reveal should not be negative")
+		}
+	default:
+		return fmt.Errorf("strategy should be %s, %s, %s or %s", StrategyRedact, StrategyPartial, StrategyHash, StrategyFormat)
+	}
+	return nil
+}
+
+// RevealError is an ad-hoc query that may return masked values under other
+// names or let them be inferred. Row errors read whole rows of tables with
+// masked columns through Column, which is then a table, an alias, a wildcard
+// or a function.
+type RevealError struct {
+	Column string
+	Row    bool
+}
+
+func (e *RevealError) Error() string {
+	if e.Row {
+		return fmt.Sprintf("rows of tables with masked columns may not be read whole through %s", e.Column)
+	}
+	return fmt.Sprintf("masked column %s may only be selected as it is", e.Column)
+}
+
+// Masker masks the results read from one database for a user
+type Masker struct {
+	rules []Rule
+	key   []byte
+}
+
+// New keeps the rules of the database the role is not exempt from. key is
+// the secret of the hash and format strategies.
+func New(rules []Rule, database, role string, key []byte) *Masker {
+	m := &Masker{key: key}
+	for _, rule := range rules {
+		if rule.Database != "" && rule.Database != database {
+			continue
+		}
+		exempt := false
+		for _, r := range rule.Exempt {
+			exempt = exempt || r == role
+		}
+		if !exempt {
+			m.rules = append(m.rules, rule)
+		}
+	}
+	return m
+}
+
+// Empty reports whether nothing is masked
+func (m *Masker) Empty() bool {
+	return m == nil || len(m.rules) == 0
+}
+
+// rule returns the rule masking the column of one of the tables, matching
+// names case insensitively and tables by their unqualified name too
+func (m *Masker) rule(tables []string, column string) *Rule {
+	if m == nil {
+		return nil
+	}
+	for i, rule := range m.rules {
+		if strings.EqualFold(rule.Column, column) && rule.applies(tables) {
+			return &m.rules[i]
+		}
+	}
+	return nil
+}
+
+// applies reports whether the rule masks a column of one of the tables
+func (r Rule) applies(tables []string) bool {
+	if r.Table == "" {
+		return true
+	}
+	for _, table := range tables {
+		name := table
+		if dot := strings.LastIndex(table, "."); dot >= 0 {
+			name = table[dot+1:]
+		}
+		if strings.EqualFold(r.Table, table) || strings.EqualFold(r.Table, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Masked reports whether the column of one of the tables is masked
+func (m *Masker) Masked(tables []string, column string) bool {
+	return m.rule(tables, column) != nil
+}
+
+// maskedTables reports whether any column of the tables is masked
+func (m *Masker) maskedTables(tables []string) bool {
+	if m == nil {
+		return false
+	}
+	for _, rule := range m.rules {
+		if rule.applies(tables) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check refuses the references of an ad-hoc query to masked columns of the
+// tables it reads that are not plain. Masks apply to result columns by name,
+// a plain reference returns the column under its own name where it is
+// masked, while any other could return it under another name or filter,
+// sort or group by it. Row references are refused when any column of the
+// tables is masked, as they carry the values of every column in one.
+func (m *Masker) Check(tables []string, references []sqlparse.Reference) error {
+	masked := m.maskedTables(tables)
+	for _, reference := range references {
+		if reference.Row && masked {
+			return &RevealError{Column: reference.Name, Row: true}
+		}
+		if !reference.Plain && m.Masked(tables, reference.Name) {
+			return &RevealError{Column: reference.Name}
+		}
+	}
+	return nil
+}
+
+// ResultSet masks the columns of a result read from the tables
+func (m *Masker) ResultSet(tables []string, result *internals.ResultSet) {
+	if m.Empty() || result == nil {
+		return
+	}
+	for i, column := range result.Columns {
+		rule := m.rule(tables, column.Name)
+		if rule == nil {
+			continue
+		}
+		result.Columns[i].Kind = export.KindString.String()
+		for _, row := range result.Rows {
+			row[i] = m.value(*rule, row[i])
+		}
+	}
+}
+
+// Documents masks the top level fields of documents read from a collection,
+// masking a field masks the whole subdocument or array it holds
+func (m *Masker) Documents(collection string, documents []map[string]interface{}) {
+	if m.Empty() {
+		return
+	}
+	tables := []string{collection}
+	for _, document := range documents {
+		for field, value := range document {
+			if rule := m.rule(tables, field); rule != nil {
+				document[field] = m.value(*rule, value)
+			}
+		}
+	}
+}
+
+// Writer masks the rows written to w, read from the tables
+func (m *Masker) Writer(tables []string, w export.Writer) export.Writer {
+	if m.Empty() {
+		return w
+	}
+	return &maskedWriter{masker: m, tables: tables, writer: w}
+}
+
+type maskedWriter struct {
+	masker *Masker
+	tables []string
+	writer export.Writer
+	rules  []*Rule
+}
+
+func (w *maskedWriter) Begin(columns []export.Column) error {
+	masked := make([]export.Column, len(columns))
+	w.rules = make([]*Rule, len(columns))
+	for i, column := range columns {
+		masked[i] = column
+		if w.rules[i] = w.masker.rule(w.tables, column.Name); w.rules[i] != nil {
+			masked[i].Kind = export.KindString
+		}
+	}
+	return w.writer.Begin(masked)
+}
+
+func (w *maskedWriter) Write(values []interface{}) error {
+	masked := make([]interface{}, len(values))
+	for i, value := range values {
+		masked[i] = value
+		if i < len(w.rules) && w.rules[i] != nil {
+			masked[i] = w.masker.value(*w.rules[i], value)
+		}
+	}
+	return w.writer.Write(masked)
+}
+
+func (w *maskedWriter) Close() error {
+	return w.writer.Close()
+}
+
+// value masks a value by the strategy of rule, keeping NULL as it is
+func (m *Masker) value(rule Rule, value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	text := valueText(value)
+	switch rule.Strategy {
+	case StrategyPartial:
+		return partial(text, rule.Reveal)
+	case StrategyHash:
+		return hex.EncodeToString(m.mac(text, 0)[:16])
+	case StrategyFormat:
+		return m.format(text)
+	}
+	return redacted
+}
+
+// partial keeps the last reveal characters of text, never more than half of
+// them
+func partial(text string, reveal int) string {
+	if reveal == 0 {
+		reveal = defaultReveal
+	}
+	runes := []rune(text)
+	if reveal > len(runes)/2 {
+		reveal = len(runes) / 2
+	}
+	return strings.Repeat("*", len(runes)-reveal) + string(runes[len(runes)-reveal:])
+}
+
+// format replaces digits with digits and letters with letters of the same
+// case, keeping the other characters, so that masked values keep the shape
+// of the originals. Equal values are masked the same way.
+func (m *Masker) format(text string) string {
+	var stream []byte
+	var masked strings.Builder
+	for i, r := range []rune(text) {
+		if i >= len(stream) {
+			stream = append(stream, m.mac(text, uint64(len(stream)/sha256.Size))...)
+		}
+		b := int(stream[i])
+		switch {
+		case r >= '0' && r <= '9':
+			masked.WriteRune(rune('0' + b%10))
+		case r >= 'a' && r <= 'z':
+			masked.WriteRune(rune('a' + b%26))
+		case r >= 'A' && r <= 'Z':
+			masked.WriteRune(rune('A' + b%26))
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			masked.WriteRune('x')
+		default:
+			masked.WriteRune(r)
+		}
+	}
+	return masked.String()
+}
+
+// mac returns block n of the keyed hash of text
+func (m *Masker) mac(text string, n uint64) []byte {
+	h := hmac.New(sha256.New, m.key)
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], n)
+	h.Write(counter[:])
+	h.Write([]byte(text))
+	return h.Sum(nil)
+}
+
+// valueText writes a value the way it is shown to users
+func valueText(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.RawMessage:
+		return string(v)
+	case []byte:
+		if utf8.Valid(v) {
+			return string(v)
+		}
+		return base64.StdEncoding.EncodeToString(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case int, int32, int64, float32, float64, bool:
+		return fmt.Sprint(v)
+	}
+	if encoded, err := json.Marshal(value); err == nil {
+		return string(encoded)
+	}
+	return fmt.Sprint(value)
+}
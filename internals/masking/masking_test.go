@@ -0,0 +1,106 @@
+package masking
+
+import (
+	"butler-server/internals/dialect"
+	"butler-server/internals/sqlparse"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	masker := New([]Rule{{Table: "users", Column: "email", Strategy: StrategyRedact}}, "", "viewer", nil)
+	tests := []struct {
+		name    string
+		dialect dialect.Dialect
+		query   string
+		refused bool
+	}{
+		{"plain column", dialect.Postgres, "SELECT email FROM users", false},
+		{"wildcard", dialect.Postgres, "SELECT * FROM users u", false},
+		{"qualified wildcard", dialect.Postgres, "SELECT u.* FROM users u", false},
+		{"count", dialect.Postgres, "SELECT COUNT(*) FROM users", false},
+		{"multiplication", dialect.Postgres, "SELECT id * 2 FROM users", false},
+		{"unmasked rows", dialect.Postgres, "SELECT row_to_json(o) FROM orders o", false},
+		{"parenthesised join", dialect.Postgres, "SELECT * FROM (users JOIN orders ON users.id = orders.uid)", false},
+		{"renamed", dialect.Postgres, "SELECT email AS contact FROM users", true},
+		{"row to json", dialect.Postgres, "SELECT row_to_json(u) FROM users u", true},
+		{"table to jsonb", dialect.Postgres, "SELECT to_jsonb(users) FROM users", true},
+		{"alias", dialect.Postgres, "SELECT u FROM users u", true},
+		{"row of wildcard", dialect.Postgres, "SELECT ROW(u.*) FROM users u", true},
+		{"function of wildcard", dialect.Postgres, "SELECT concat(u.*) FROM users u", true},
+		{"wildcard in subquery", dialect.Postgres, "SELECT x.e FROM (SELECT * FROM users) AS x (i, e)", true},
+		{"for json", dialect.MSSQL, "SELECT email FROM users FOR JSON AUTO", true},
+		{"cte shadowing the table", dialect.Postgres, "WITH users AS (SELECT * FROM users) SELECT * FROM users", true},
+		{"cte reading the table", dialect.Postgres, "WITH mine AS (SELECT email AS e FROM users) SELECT e FROM mine", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tables, err := sqlparse.Tables(test.dialect, test.query)
+			if err != nil {
+				t.Fatalf("Tables(%q) failed: %v", test.query, err)
+			}
+			references, err := sqlparse.References(test.dialect, test.query)
+			if err != nil {
+				t.Fatalf("References(%q) failed: %v", test.query, err)
+			}
+			err = masker.Check(tables, references)
+			var reveal *RevealError
+			if refused := errors.As(err, &reveal); refused != test.refused {
+				t.Errorf("Check(%q) = %v, want refused %v", test.query, err, test.refused)
+			}
+		})
+	}
+}
+
+func TestCheckTables(t *testing.T) {
+	tests := []struct {
+		query  string
+		tables []string
+	}{
+		{"WITH users AS (SELECT * FROM users) SELECT * FROM users", []string{"users"}},
+		{"WITH RECURSIVE users AS (SELECT 1 UNION ALL SELECT * FROM users) SELECT * FROM users", nil},
+		{"WITH a AS (SELECT 1), users AS (SELECT * FROM a JOIN users ON true) SELECT * FROM users", []string{"users"}},
+		{"SELECT * FROM (users JOIN orders ON users.id = orders.uid)", []string{"users", "orders"}},
+	}
+	for _, test := range tests {
+		tables, err := sqlparse.Tables(dialect.Postgres, test.query)
+		if err != nil {
+			t.Fatalf("Tables(%q) failed: %v", test.query, err)
+		}
+		if len(tables) == 0 && len(test.tables) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(tables, test.tables) {
+			t.Errorf("Tables(%q) = %q, want %q", test.query, tables, test.tables)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		rule  Rule
+		valid bool
+	}{
+		{Rule{Column: "email", Strategy: StrategyRedact}, true},
+		{Rule{Column: "email", Strategy: StrategyPartial, Reveal: 2}, true},
+		{Rule{Column: "", Strategy: StrategyRedact}, false},
+		{Rule{Column: "email", Strategy: "shuffle"}, false},
+		{Rule{Column: "email", Strategy: StrategyPartial, Reveal: -1}, false},
+		{Rule{Column: "profile.email", Strategy: StrategyRedact}, false},
+	}
+	for _, test := range tests {
+		if err := test.rule.Validate(); (err == nil) != test.valid {
+			t.Errorf("Validate(%+v) = %v, want valid %v", test.rule, err, test.valid)
+		}
+	}
+}
+
+func TestDocuments(t *testing.T) {
+	masker := New([]Rule{{Table: "users", Column: "profile", Strategy: StrategyRedact}}, "", "viewer", nil)
+	documents := []map[string]interface{}{{"name": "ada", "profile": map[string]interface{}{"email": "ada@example.com"}}}
+	masker.Documents("users", documents)
+	if documents[0]["profile"] != redacted || documents[0]["name"] != "ada" {
+		t.Errorf("Documents masked %v, want the whole profile redacted", documents[0])
+	}
+}
@@ -0,0 +1,182 @@
+package internals
+
+import (
+	"butler-server/internals/export"
+	"database/sql"
+	"encoding/json"
+	"math"
+	"strconv"
+)
+
+// ResultSet is a query result keeping the columns in select order, duplicate
+// names included. Row values are nil for NULL or, by column kind, an int64,
+// float64, bool, a string for text and exact numerics, a time.Time (RFC3339
+// in JSON), []byte (base64 in JSON) or a json.RawMessage.
+type ResultSet struct {
+	Columns []ResultColumn  `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+type ResultColumn struct {
+	Name string `json:"name"`
+	// Type is the type name reported by the driver, Kind the representation
+	// of its values
+	Type      string `json:"type"`
+	Kind      string `json:"kind,omitempty"`
+	Nullable  *bool  `json:"nullable,omitempty"`
+	Precision *int64 `json:"precision,omitempty"`
+	Scale     *int64 `json:"scale,omitempty"`
+	Length    *int64 `json:"length,omitempty"`
+}
+
+// Index returns the position of the first column called name, -1 if there
+// is none
+func (r *ResultSet) Index(name string) int {
+	for i, column := range r.Columns {
+		if column.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Value returns the value of the named column in the given row, nil when
+// either does not exist
+func (r *ResultSet) Value(row int, column string) interface{} {
+	i := r.Index(column)
+	if i < 0 || row >= len(r.Rows) {
+		return nil
+	}
+	return r.Rows[row][i]
+}
+
+// Begin, Write and Close collect rows streamed as an export.Writer
+func (r *ResultSet) Begin(columns []export.Column) error {
+	r.Columns = make([]ResultColumn, len(columns))
+	for i, column := range columns {
+		r.Columns[i] = ResultColumn{Name: column.Name, Type: column.Kind.String(), Kind: column.Kind.String()}
+	}
+	r.Rows = [][]interface{}{}
+	return nil
+}
+
+func (r *ResultSet) Write(values []interface{}) error {
+	row := make([]interface{}, len(values))
+	for i, value := range values {
+		row[i] = jsonSafe(value)
+	}
+	r.Rows = append(r.Rows, row)
+	return nil
+}
+
+func (r *ResultSet) Close() error {
+	return nil
+}
+
+// ParseRows reads a query result into a ResultSet
+func ParseRows(rows *sql.Rows) (*ResultSet, error) {
+	result, _, err := parseRows(rows, "")
+	return result, err
+}
+
+// ParsePage reads a page of table data into a ResultSet. The countColumn
+// carrying the total count, as added by the offset pages of Data, is left out
+// and returned on its own.
+func ParsePage(rows *sql.Rows, countColumn string) (*ResultSet, interface{}, error) {
+	return parseRows(rows, countColumn)
+}
+
+func parseRows(rows *sql.Rows, countName string) (*ResultSet, interface{}, error) {
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, nil, err
+	}
+	result := &ResultSet{Rows: [][]interface{}{}}
+	kinds := make([]export.Kind, len(columnTypes))
+	countColumn := -1
+	for i, columnType := range columnTypes {
+		if countName != "" && columnType.Name() == countName {
+			countColumn = i
+		}
+		kinds[i] = export.KindOf(columnType.DatabaseTypeName())
+		if columnType.DatabaseTypeName() == "" {
+			kinds[i] = kindUnknown
+		}
+		result.Columns = append(result.Columns, resultColumn(columnType, kinds[i]))
+	}
+	if countColumn >= 0 {
+		result.Columns = append(result.Columns[:countColumn], result.Columns[countColumn+1:]...)
+	}
+
+	var totalCount interface{}
+	values := make([]interface{}, len(columnTypes))
+	for i := range values {
+		values[i] = new(interface{})
+	}
+	for rows.Next() {
+		if err := rows.Scan(values...); err != nil {
+			return nil, nil, err
+		}
+		row := make([]interface{}, 0, len(result.Columns))
+		for i := range columnTypes {
+			value := decodeColumnValue(kinds[i], *values[i].(*interface{}))
+			if i == countColumn {
+				totalCount = value
+				continue
+			}
+			row = append(row, value)
+		}
+		result.Rows = append(result.Rows, row)
+	}
+	return result, totalCount, rows.Err()
+}
+
+func resultColumn(columnType *sql.ColumnType, kind export.Kind) ResultColumn {
+	column := ResultColumn{Name: columnType.Name(), Type: columnType.DatabaseTypeName()}
+	if kind != kindUnknown {
+		column.Kind = kind.String()
+	}
+	if nullable, ok := columnType.Nullable(); ok {
+		column.Nullable = &nullable
+	}
+	if precision, scale, ok := columnType.DecimalSize(); ok {
+		column.Precision, column.Scale = &precision, &scale
+	}
+	// drivers report unbounded text and blobs as math.MaxInt64
+	if length, ok := columnType.Length(); ok && length != math.MaxInt64 {
+		column.Length = &length
+	}
+	return column
+}
+
+// kindUnknown marks columns without a declared type, such as expressions in
+// SQLite, whose values are kept as the driver returns them
+const kindUnknown export.Kind = -1
+
+// decodeColumnValue converts a scanned value for its column kind. Values the
+// driver returns in a shape the kind does not expect, such as Postgres arrays
+// of integers, are kept as text rather than failing the whole result.
+func decodeColumnValue(kind export.Kind, value interface{}) interface{} {
+	if kind == kindUnknown {
+		return jsonSafe(value)
+	}
+	converted, err := export.Convert(kind, value)
+	if err != nil {
+		if b, ok := value.([]byte); ok {
+			return string(b)
+		}
+		return export.Text(value)
+	}
+	if data, ok := converted.(json.RawMessage); ok && !json.Valid(data) {
+		return string(data)
+	}
+	return jsonSafe(converted)
+}
+
+// jsonSafe spells out the floats JSON has no literal for
+func jsonSafe(value interface{}) interface{} {
+	if f, ok := value.(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	return value
+}
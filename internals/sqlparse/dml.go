@@ -0,0 +1,333 @@
+package sqlparse
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DML describes a single table INSERT, UPDATE or DELETE well enough to
+// select the rows it touches and to write the statements undoing it
+type DML struct {
+	Verb string
+	// Table is the target table as written, possibly qualified, and Name
+	// its last part unquoted
+	Table string
+	Name  string
+	// Target is the table followed by the alias the statement gives it, to
+	// select the rows the statement touches from
+	Target string
+	// Condition is the text from the WHERE, ORDER BY or LIMIT clause that
+	// picks the rows of an UPDATE or DELETE to the end of the statement,
+	// empty when every row is touched
+	Condition string
+	// Columns are the columns an UPDATE sets or an INSERT lists, nil for an
+	// INSERT without a column list
+	Columns []string
+	// Rows are the rows of an INSERT ... VALUES
+	Rows [][]Expression
+}
+
+// Expression is a value expression as written
+type Expression struct {
+	Text string
+	// Literal is set on constants: strings, numbers, NULL and booleans
+	Literal bool
+}
+
+// UnsupportedError is a statement DML cannot describe
+type UnsupportedError struct {
+	Reason string
+}
+
+func (e *UnsupportedError) Error() string {
+	return e.Reason
+}
+
+func unsupported(format string, args ...interface{}) *UnsupportedError {
+	return &UnsupportedError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// verbModifiers may follow the verb of a DML statement before the table
+var verbModifiers = map[string]bool{"LOW_PRIORITY": true, "QUICK": true, "ONLY": true}
+
+// DML describes the statement when it is a single table INSERT ... VALUES,
+// UPDATE or DELETE. Joins, upserts, INSERT ... SELECT and statements with a
+// WITH clause are refused with an UnsupportedError.
+func (s Statement) DML() (*DML, error) {
+	if s.Batch || s.Keyword() != s.Verb() {
+		return nil, unsupported("only single statements without a WITH clause are supported")
+	}
+	verb := s.Verb()
+	p := dmlParser{s: s, dml: &DML{Verb: verb}, i: 1}
+	var err error
+	switch verb {
+	case "INSERT":
+		err = p.insert()
+	case "UPDATE":
+		err = p.update()
+	case "DELETE":
+		err = p.delete()
+	default:
+		return nil, unsupported("%s statements are not supported", verb)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p.dml, nil
+}
+
+type dmlParser struct {
+	s   Statement
+	dml *DML
+	// i is the index of the next token
+	i int
+}
+
+func (p *dmlParser) done() bool {
+	return p.i >= len(p.s.Tokens)
+}
+
+func (p *dmlParser) peek() Token {
+	if p.done() {
+		return Token{}
+	}
+	return p.s.Tokens[p.i]
+}
+
+// accept moves past the next token when it is the keyword or punctuation
+func (p *dmlParser) accept(keyword string) bool {
+	if token := p.peek(); token.Is(keyword) || (token.Kind == Punctuation && token.Text == keyword) {
+		p.i++
+		return true
+	}
+	return false
+}
+
+// text returns the statement from token from up to token to, excluded
+func (p *dmlParser) text(from, to int) string {
+	if from >= len(p.s.Tokens) {
+		return ""
+	}
+	end := len(p.s.Text)
+	if to < len(p.s.Tokens) {
+		end = p.s.Tokens[to].Pos - p.s.Pos
+	}
+	return strings.TrimSpace(p.s.Text[p.s.Tokens[from].Pos-p.s.Pos : end])
+}
+
+// modifiers skips the priority and IGNORE modifiers, refusing the ones that
+// let a statement leave rows alone or replace them
+func (p *dmlParser) modifiers() error {
+	for {
+		token := p.peek()
+		switch {
+		case token.Is("IGNORE") && p.dml.Verb == "INSERT":
+			return unsupported("INSERT IGNORE may leave existing rows in place")
+		case token.Is("OR"):
+			return unsupported("%s OR ... is not supported", p.dml.Verb)
+		case token.Is("TOP"):
+			return unsupported("%s TOP is not supported", p.dml.Verb)
+		case token.Is("IGNORE") || (token.Kind == Word && verbModifiers[strings.ToUpper(token.Text)]):
+			p.i++
+		default:
+			return nil
+		}
+	}
+}
+
+// table reads a possibly qualified table name and the alias after it
+func (p *dmlParser) table(aliased bool) error {
+	start := p.i
+	for {
+		token := p.peek()
+		if token.Kind != Word && token.Kind != QuotedIdentifier {
+			return unsupported("expected a table name")
+		}
+		p.dml.Name = token.Value()
+		p.i++
+		if p.peek().Text != "." {
+			break
+		}
+		p.i++
+	}
+	p.dml.Table = p.text(start, p.i)
+	if aliased {
+		p.accept("AS")
+		if token := p.peek(); token.Kind == QuotedIdentifier || (token.Kind == Word && !aliasStops[strings.ToUpper(token.Text)]) {
+			p.i++
+		}
+	}
+	p.dml.Target = p.text(start, p.i)
+	if p.peek().Text == "," || p.peek().Is("JOIN") {
+		return unsupported("%s of several tables is not supported", p.dml.Verb)
+	}
+	return nil
+}
+
+// aliasStops are the keywords that may follow the table of a DML statement
+var aliasStops = map[string]bool{
+	"SET": true, "WHERE": true, "USING": true, "FROM": true, "ORDER": true, "LIMIT": true,
+	"RETURNING": true, "OUTPUT": true, "VALUES": true, "DEFAULT": true, "SELECT": true,
+	"PARTITION": true, "WITH": true, "INNER": true, "LEFT": true, "RIGHT": true, "CROSS": true, "JOIN": true,
+}
+
+// setStops are the keywords ending the SET clause of an UPDATE
+var setStops = map[string]bool{"WHERE": true, "FROM": true, "ORDER": true, "LIMIT": true, "RETURNING": true, "OUTPUT": true}
+
+// condition reads the clauses picking the rows of an UPDATE or DELETE, up to
+// a RETURNING clause
+func (p *dmlParser) condition() error {
+	if p.done() {
+		return nil
+	}
+	token := p.peek()
+	switch {
+	case token.Is("FROM"), token.Is("USING"):
+		return unsupported("%s with %s is not supported", p.dml.Verb, strings.ToUpper(token.Text))
+	case token.Is("OUTPUT"):
+		return unsupported("%s with OUTPUT is not supported", p.dml.Verb)
+	case token.Is("RETURNING"):
+		return nil
+	case !token.Is("WHERE") && !token.Is("ORDER") && !token.Is("LIMIT"):
+		return unsupported("unexpected %q", token.Text)
+	}
+	start := p.i
+	for ; !p.done(); p.i++ {
+		token := p.peek()
+		if token.Depth == 0 && token.Is("RETURNING") {
+			break
+		}
+		if token.Depth == 0 && token.Is("CURRENT") && p.s.Tokens[p.i-1].Is("WHERE") {
+			return unsupported("WHERE CURRENT OF is not supported")
+		}
+	}
+	p.dml.Condition = p.text(start, p.i)
+	return nil
+}
+
+func (p *dmlParser) update() error {
+	if err := p.modifiers(); err != nil {
+		return err
+	}
+	if err := p.table(true); err != nil {
+		return err
+	}
+	if !p.accept("SET") {
+		return unsupported("expected SET")
+	}
+	for {
+		start := p.i
+		for !p.done() && p.peek().Text != "=" {
+			if p.peek().Text == "(" {
+				return unsupported("assigning several columns at once is not supported")
+			}
+			p.i++
+		}
+		if p.done() || p.i == start {
+			return unsupported("expected a column assignment")
+		}
+		p.dml.Columns = append(p.dml.Columns, p.s.Tokens[p.i-1].Value())
+		for p.i++; !p.done(); p.i++ {
+			token := p.peek()
+			if token.Depth == 0 && (token.Text == "," || (token.Kind == Word && setStops[strings.ToUpper(token.Text)])) {
+				break
+			}
+		}
+		if !p.accept(",") {
+			break
+		}
+	}
+	return p.condition()
+}
+
+func (p *dmlParser) delete() error {
+	if err := p.modifiers(); err != nil {
+		return err
+	}
+	from := p.accept("FROM")
+	if err := p.modifiers(); err != nil {
+		return err
+	}
+	if err := p.table(true); err != nil {
+		return err
+	}
+	if !from && p.peek().Is("FROM") {
+		return unsupported("DELETE of several tables is not supported")
+	}
+	return p.condition()
+}
+
+func (p *dmlParser) insert() error {
+	if err := p.modifiers(); err != nil {
+		return err
+	}
+	p.accept("INTO")
+	if err := p.table(false); err != nil {
+		return err
+	}
+	if p.accept("AS") {
+		p.i++
+	}
+	if p.peek().Text == "(" {
+		p.i++
+		for !p.done() && p.peek().Text != ")" {
+			token := p.peek()
+			if token.Kind == Word || token.Kind == QuotedIdentifier {
+				p.dml.Columns = append(p.dml.Columns, token.Value())
+			}
+			p.i++
+		}
+		p.i++
+	}
+	if !p.accept("VALUES") {
+		return unsupported("only INSERT ... VALUES is supported")
+	}
+	for p.peek().Text == "(" {
+		p.i++
+		var row []Expression
+		start := p.i
+		for ; !p.done(); p.i++ {
+			token := p.peek()
+			if (token.Depth == 0 && token.Text == ")") || (token.Depth == 1 && token.Text == ",") {
+				row = append(row, p.expression(start, p.i))
+				start = p.i + 1
+				if token.Text == ")" {
+					break
+				}
+			}
+		}
+		p.i++
+		if p.dml.Columns != nil && len(row) != len(p.dml.Columns) {
+			return unsupported("a row of the INSERT has %d values for %d columns", len(row), len(p.dml.Columns))
+		}
+		p.dml.Rows = append(p.dml.Rows, row)
+		if !p.accept(",") {
+			break
+		}
+	}
+	if len(p.dml.Rows) == 0 {
+		return unsupported("expected the rows of the INSERT")
+	}
+	if p.peek().Is("ON") || p.peek().Is("AS") {
+		return unsupported("upserts may change existing rows")
+	}
+	if !p.done() && !p.peek().Is("RETURNING") {
+		return unsupported("INSERT with %s is not supported", strings.ToUpper(p.peek().Text))
+	}
+	return nil
+}
+
+// expression returns the expression of tokens from up to to, excluded
+func (p *dmlParser) expression(from, to int) Expression {
+	tokens := p.s.Tokens[from:to]
+	expression := Expression{Text: p.text(from, to)}
+	if len(tokens) == 2 && (tokens[0].Text == "-" || tokens[0].Text == "+") {
+		tokens = tokens[1:]
+	}
+	if len(tokens) == 1 {
+		token := tokens[0]
+		expression.Literal = token.Kind == String || token.Kind == Number ||
+			token.Is("NULL") || token.Is("TRUE") || token.Is("FALSE")
+	}
+	return expression
+}
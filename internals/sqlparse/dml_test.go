@@ -0,0 +1,120 @@
+package sqlparse
+
+import (
+	"butler-server/internals/dialect"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDML(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect dialect.Dialect
+		query   string
+		want    DML
+	}{
+		{
+			"insert", dialect.Postgres,
+			"INSERT INTO users (id, name) VALUES (1, 'ada'), (-2, now())",
+			DML{Verb: "INSERT", Table: "users", Name: "users", Target: "users", Columns: []string{"id", "name"}, Rows: [][]Expression{
+				{{Text: "1", Literal: true}, {Text: "'ada'", Literal: true}},
+				{{Text: "-2", Literal: true}, {Text: "now()"}},
+			}},
+		},
+		{
+			"insert without columns", dialect.MySQL,
+			"INSERT INTO `shop`.`users` VALUES (1, NULL)",
+			DML{Verb: "INSERT", Table: "`shop`.`users`", Name: "users", Target: "`shop`.`users`", Rows: [][]Expression{
+				{{Text: "1", Literal: true}, {Text: "NULL", Literal: true}},
+			}},
+		},
+		{
+			"insert returning", dialect.Postgres,
+			"INSERT INTO users (id) VALUES (1) RETURNING id",
+			DML{Verb: "INSERT", Table: "users", Name: "users", Target: "users", Columns: []string{"id"}, Rows: [][]Expression{{{Text: "1", Literal: true}}}},
+		},
+		{
+			"update", dialect.Postgres,
+			`UPDATE users AS u SET "name" = 'x', age = age + 1 WHERE u.id IN (1, 2)`,
+			DML{Verb: "UPDATE", Table: "users", Name: "users", Target: "users AS u", Condition: "WHERE u.id IN (1, 2)", Columns: []string{"name", "age"}},
+		},
+		{
+			"update everything", dialect.MySQL,
+			"UPDATE LOW_PRIORITY users SET name = 'x' ORDER BY id LIMIT 10",
+			DML{Verb: "UPDATE", Table: "users", Name: "users", Target: "users", Condition: "ORDER BY id LIMIT 10", Columns: []string{"name"}},
+		},
+		{
+			"delete", dialect.MSSQL,
+			"DELETE FROM [dbo].[users] WHERE id = 3",
+			DML{Verb: "DELETE", Table: "[dbo].[users]", Name: "users", Target: "[dbo].[users]", Condition: "WHERE id = 3"},
+		},
+		{
+			"delete returning", dialect.Postgres,
+			"DELETE FROM ONLY users u WHERE u.id = 3 RETURNING *",
+			DML{Verb: "DELETE", Table: "users", Name: "users", Target: "users u", Condition: "WHERE u.id = 3"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			statements, err := Split(test.dialect, test.query)
+			if err != nil {
+				t.Fatalf("Split(%q) failed: %v", test.query, err)
+			}
+			dml, err := statements[0].DML()
+			if err != nil {
+				t.Fatalf("DML(%q) failed: %v", test.query, err)
+			}
+			if !reflect.DeepEqual(*dml, test.want) {
+				t.Errorf("DML(%q) = %+v, want %+v", test.query, *dml, test.want)
+			}
+		})
+	}
+}
+
+func TestDMLUnsupported(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect dialect.Dialect
+		query   string
+	}{
+		{"on conflict", dialect.Postgres, "INSERT INTO users (id) VALUES (1) ON CONFLICT (id) DO UPDATE SET name = 'x'"},
+		{"on conflict do nothing", dialect.SQLite, "INSERT INTO users (id) VALUES (1) ON CONFLICT DO NOTHING"},
+		{"on duplicate key", dialect.MySQL, "INSERT INTO users (id) VALUES (1) ON DUPLICATE KEY UPDATE name = 'x'"},
+		{"row alias upsert", dialect.MySQL, "INSERT INTO users (id) VALUES (1) AS new ON DUPLICATE KEY UPDATE id = new.id"},
+		{"insert ignore", dialect.MySQL, "INSERT IGNORE INTO users (id) VALUES (1)"},
+		{"insert or replace", dialect.SQLite, "INSERT OR REPLACE INTO users (id) VALUES (1)"},
+		{"replace", dialect.MySQL, "REPLACE INTO users (id) VALUES (1)"},
+		{"insert select", dialect.Postgres, "INSERT INTO users (id) SELECT id FROM staff"},
+		{"insert default values", dialect.Postgres, "INSERT INTO users DEFAULT VALUES"},
+		{"insert top", dialect.MSSQL, "INSERT TOP (1) INTO users (id) VALUES (1)"},
+		{"insert output", dialect.MSSQL, "INSERT INTO users (id) OUTPUT inserted.id VALUES (1)"},
+		{"with", dialect.Postgres, "WITH s AS (SELECT 1) INSERT INTO users (id) VALUES (1)"},
+		{"merge", dialect.MSSQL, "MERGE users USING staff ON users.id = staff.id WHEN MATCHED THEN DELETE"},
+		{"update from", dialect.Postgres, "UPDATE users SET name = staff.name FROM staff WHERE staff.id = users.id"},
+		{"update join", dialect.MySQL, "UPDATE users JOIN staff ON staff.id = users.id SET users.name = staff.name"},
+		{"update several tables", dialect.MySQL, "UPDATE users, staff SET users.name = staff.name WHERE staff.id = users.id"},
+		{"update row", dialect.Postgres, "UPDATE users SET (name, age) = ('x', 1)"},
+		{"update current of", dialect.Postgres, "UPDATE users SET name = 'x' WHERE CURRENT OF c"},
+		{"update top", dialect.MSSQL, "UPDATE TOP (1) users SET name = 'x'"},
+		{"update output", dialect.MSSQL, "UPDATE users SET name = 'x' OUTPUT inserted.id WHERE id = 1"},
+		{"delete using", dialect.Postgres, "DELETE FROM users USING staff WHERE staff.id = users.id"},
+		{"delete join", dialect.MySQL, "DELETE users FROM users JOIN staff ON staff.id = users.id"},
+		{"delete several tables", dialect.MySQL, "DELETE FROM users, staff USING users JOIN staff"},
+		{"select", dialect.Postgres, "SELECT * FROM users"},
+		{"ddl", dialect.Postgres, "TRUNCATE users"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			statements, err := Split(test.dialect, test.query)
+			if err != nil {
+				t.Fatalf("Split(%q) failed: %v", test.query, err)
+			}
+			dml, err := statements[0].DML()
+			var unsupported *UnsupportedError
+			if !errors.As(err, &unsupported) {
+				t.Errorf("DML(%q) = %+v, %v, want an UnsupportedError", test.query, dml, err)
+			}
+		})
+	}
+}
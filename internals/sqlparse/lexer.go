@@ -0,0 +1,411 @@
+// Package sqlparse splits and classifies SQL scripts without a full grammar.
+// It knows the quoting and comment rules of every supported dialect, which is
+// enough to find statement boundaries, the leading keywords of a statement
+// and the clauses at its top level.
+package sqlparse
+
+import (
+	"butler-server/internals/dialect"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type TokenKind int
+
+const (
+	// Word is a keyword or a bare identifier
+	Word TokenKind = iota
+	QuotedIdentifier
+	String
+	Number
+	// Parameter is a bind parameter or a session variable, such as $1, ?,
+	// :name or @name
+	Parameter
+	Punctuation
+)
+
+type Token struct {
+	Kind TokenKind
+	Text string
+	// Pos is the byte offset of the token in the input
+	Pos int
+	// Depth is the parenthesis nesting of the token, a parenthesis has the
+	// depth of the expression around it
+	Depth int
+}
+
+// Is reports whether the token is the keyword, ignoring case
+func (t Token) Is(keyword string) bool {
+	return t.Kind == Word && strings.EqualFold(t.Text, keyword)
+}
+
+// Value returns the identifier a word or quoted identifier names, with the
+// quotes removed and quoted quotes unescaped
+func (t Token) Value() string {
+	if t.Kind != QuotedIdentifier || len(t.Text) < 2 {
+		return t.Text
+	}
+	quote, body := t.Text[:1], t.Text[1:len(t.Text)-1]
+	switch quote {
+	case "[":
+		return strings.ReplaceAll(body, "]]", "]")
+	case "`":
+		return strings.ReplaceAll(body, "``", "`")
+	}
+	return strings.ReplaceAll(body, `""`, `"`)
+}
+
+// SyntaxError is a script that cannot be tokenized or split, with the position
+// of the offending character
+type SyntaxError struct {
+	Pos     int
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at line %d, column %d: %s", e.Line, e.Column, e.Message)
+}
+
+func syntaxError(input string, pos int, format string, args ...interface{}) *SyntaxError {
+	line, column := Position(input, pos)
+	return &SyntaxError{Pos: pos, Line: line, Column: column, Message: fmt.Sprintf(format, args...)}
+}
+
+// Position returns the 1-based line and column, counted in characters, of a
+// byte offset
+func Position(input string, pos int) (int, int) {
+	if pos > len(input) {
+		pos = len(input)
+	}
+	before := input[:pos]
+	line := strings.Count(before, "\n") + 1
+	column := utf8.RuneCountInString(before[strings.LastIndex(before, "\n")+1:]) + 1
+	return line, column
+}
+
+// rules are the lexical differences between dialects
+type rules struct {
+	backticks        bool // `identifier`
+	brackets         bool // [identifier]
+	dollarQuotes     bool // $tag$string$tag$
+	backslashEscapes bool // 'it\'s'
+	doubleQuoteText  bool // "string" rather than "identifier"
+	hashComments     bool // # comment
+	nestedComments   bool // /* /* */ */
+	hashIdentifiers  bool // #temp tables
+}
+
+func rulesFor(d dialect.Dialect) rules {
+	switch d.Name {
+	case dialect.Postgres.Name:
+		return rules{dollarQuotes: true, nestedComments: true}
+	case dialect.DuckDB.Name:
+		return rules{dollarQuotes: true, nestedComments: true}
+	case dialect.MySQL.Name:
+		return rules{backticks: true, backslashEscapes: true, doubleQuoteText: true, hashComments: true}
+	case dialect.MSSQL.Name:
+		return rules{brackets: true, hashIdentifiers: true}
+	case dialect.SQLite.Name:
+		return rules{backticks: true, brackets: true}
+	}
+	return rules{}
+}
+
+// operators are the punctuation tokens longer than one character, longest
+// first
+var operators = []string{"->>", "::", "<=", ">=", "<>", "!=", "||", "->", ":=", "=>", "<<", ">>", "#>>", "#>", "@>", "<@", "&&", "**"}
+
+type lexer struct {
+	input string
+	pos   int
+	rules rules
+	depth int
+	// opens holds the positions of the parentheses still open
+	opens []int
+	// stop is a custom statement delimiter that ends any word or number
+	// running into it, as in END$$
+	stop string
+}
+
+func newLexer(d dialect.Dialect, input string) *lexer {
+	return &lexer{input: input, rules: rulesFor(d)}
+}
+
+// Tokenize returns the tokens of the input, leaving out whitespace and
+// comments
+func Tokenize(d dialect.Dialect, input string) ([]Token, error) {
+	l := newLexer(d, input)
+	var tokens []Token
+	for {
+		if err := l.skip(); err != nil {
+			return nil, err
+		}
+		if l.done() {
+			break
+		}
+		token, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	if err := l.balanced(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (l *lexer) done() bool {
+	return l.pos >= len(l.input)
+}
+
+func (l *lexer) rest() string {
+	return l.input[l.pos:]
+}
+
+// balanced reports the first parenthesis left open
+func (l *lexer) balanced() error {
+	if len(l.opens) > 0 {
+		return syntaxError(l.input, l.opens[0], "unclosed parenthesis")
+	}
+	return nil
+}
+
+// skip moves past whitespace and comments
+func (l *lexer) skip() error {
+	for !l.done() {
+		r, size := utf8.DecodeRuneInString(l.rest())
+		switch {
+		case unicode.IsSpace(r):
+			l.pos += size
+		case strings.HasPrefix(l.rest(), "--") || (l.rules.hashComments && r == '#'):
+			end := strings.IndexByte(l.rest(), '\n')
+			if end < 0 {
+				l.pos = len(l.input)
+			} else {
+				l.pos += end + 1
+			}
+		case strings.HasPrefix(l.rest(), "/*"):
+			if err := l.blockComment(); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (l *lexer) blockComment() error {
+	start := l.pos
+	nesting := 0
+	for i := l.pos; i < len(l.input)-1; i++ {
+		switch l.input[i : i+2] {
+		case "/*":
+			if nesting == 0 || l.rules.nestedComments {
+				nesting++
+			}
+			i++
+		case "*/":
+			nesting--
+			i++
+			if nesting == 0 {
+				l.pos = i + 1
+				return nil
+			}
+		}
+	}
+	return syntaxError(l.input, start, "unterminated comment")
+}
+
+// next reads the token at the current position, which must not be
+// whitespace or a comment
+func (l *lexer) next() (Token, error) {
+	start := l.pos
+	rest := l.rest()
+	r, size := utf8.DecodeRuneInString(rest)
+
+	token := Token{Pos: start, Depth: l.depth}
+	var err error
+	switch {
+	case r == '\'':
+		token.Kind = String
+		err = l.quoted('\'', l.rules.backslashEscapes)
+	case (r == 'E' || r == 'e') && strings.HasPrefix(rest[1:], "'"):
+		token.Kind = String
+		l.pos++
+		err = l.quoted('\'', true)
+	case (r == 'N' || r == 'n' || r == 'X' || r == 'x' || r == 'B' || r == 'b') && strings.HasPrefix(rest[1:], "'"):
+		token.Kind = String
+		l.pos++
+		err = l.quoted('\'', l.rules.backslashEscapes)
+	case r == '"':
+		token.Kind = QuotedIdentifier
+		if l.rules.doubleQuoteText {
+			token.Kind = String
+		}
+		err = l.quoted('"', l.rules.doubleQuoteText && l.rules.backslashEscapes)
+	case r == '`' && l.rules.backticks:
+		token.Kind = QuotedIdentifier
+		err = l.quoted('`', false)
+	case r == '[' && l.rules.brackets:
+		token.Kind = QuotedIdentifier
+		err = l.quoted(']', false)
+	case r == '$' && l.rules.dollarQuotes && dollarTag(rest) != "":
+		token.Kind = String
+		err = l.dollarQuoted(dollarTag(rest))
+	case r == '$' && len(rest) > 1 && isDigit(rest[1]):
+		token.Kind = Parameter
+		l.pos++
+		l.advanceWhile(func(r rune) bool { return r < utf8.RuneSelf && isDigit(byte(r)) })
+	case r == '?':
+		token.Kind = Parameter
+		l.pos++
+	case r == ':' && len(rest) > 1 && isWordStart(rune(rest[1])):
+		token.Kind = Parameter
+		l.pos++
+		l.advanceWhile(isWordPart)
+	case r == '@':
+		token.Kind = Parameter
+		l.pos++
+		for strings.HasPrefix(l.rest(), "@") {
+			l.pos++
+		}
+		l.advanceWhile(func(r rune) bool { return isWordPart(r) || r == '.' })
+	case r == '#' && l.rules.hashIdentifiers:
+		token.Kind = Word
+		l.advanceWhile(func(r rune) bool { return r == '#' || isWordPart(r) })
+	case isDigit(byte(r)) || (r == '.' && len(rest) > 1 && isDigit(rest[1])):
+		token.Kind = Number
+		l.number()
+	case isWordStart(r):
+		token.Kind = Word
+		l.advanceWhile(isWordPart)
+	default:
+		token.Kind = Punctuation
+		l.pos += size
+		for _, operator := range operators {
+			if strings.HasPrefix(rest, operator) {
+				l.pos = start + len(operator)
+				break
+			}
+		}
+		switch r {
+		case '(':
+			l.opens = append(l.opens, start)
+			l.depth++
+		case ')':
+			if l.depth == 0 {
+				return token, syntaxError(l.input, start, "unexpected closing parenthesis")
+			}
+			l.opens = l.opens[:len(l.opens)-1]
+			l.depth--
+			token.Depth = l.depth
+		}
+	}
+	if err != nil {
+		return token, err
+	}
+	token.Text = l.input[start:l.pos]
+	return token, nil
+}
+
+// quoted moves past a string or quoted identifier that starts at the current
+// position and ends with closing, where a doubled closing character stands
+// for itself
+func (l *lexer) quoted(closing byte, backslashEscapes bool) error {
+	start := l.pos
+	for i := l.pos + 1; i < len(l.input); i++ {
+		switch l.input[i] {
+		case '\\':
+			if backslashEscapes {
+				i++
+			}
+		case closing:
+			if i+1 < len(l.input) && l.input[i+1] == closing {
+				i++
+				continue
+			}
+			l.pos = i + 1
+			return nil
+		}
+	}
+	if closing == '\'' || l.rules.doubleQuoteText && closing == '"' {
+		return syntaxError(l.input, start, "unterminated string")
+	}
+	return syntaxError(l.input, start, "unterminated quoted identifier")
+}
+
+func (l *lexer) dollarQuoted(tag string) error {
+	start := l.pos
+	end := strings.Index(l.input[start+len(tag):], tag)
+	if end < 0 {
+		return syntaxError(l.input, start, "unterminated dollar-quoted string")
+	}
+	l.pos = start + len(tag) + end + len(tag)
+	return nil
+}
+
+// dollarTag returns the opening tag of a dollar-quoted string at the start
+// of s, such as $$ or $body$, empty if there is none
+func dollarTag(s string) string {
+	for i := 1; i < len(s); i++ {
+		r := rune(s[i])
+		switch {
+		case r == '$':
+			return s[:i+1]
+		case i == 1 && isDigit(s[i]), !isWordPart(r):
+			return ""
+		}
+	}
+	return ""
+}
+
+func (l *lexer) number() {
+	if strings.HasPrefix(l.rest(), "0x") || strings.HasPrefix(l.rest(), "0X") {
+		l.pos += 2
+		l.advanceWhile(func(r rune) bool { return unicode.Is(unicode.ASCII_Hex_Digit, r) })
+		return
+	}
+	l.advanceWhile(func(r rune) bool { return r < utf8.RuneSelf && (isDigit(byte(r)) || r == '.') })
+	rest := l.rest()
+	if len(rest) > 1 && (rest[0] == 'e' || rest[0] == 'E') {
+		exponent := 1
+		if rest[1] == '+' || rest[1] == '-' {
+			exponent++
+		}
+		if len(rest) > exponent && isDigit(rest[exponent]) {
+			l.pos += exponent
+			l.advanceWhile(func(r rune) bool { return r < utf8.RuneSelf && isDigit(byte(r)) })
+		}
+	}
+}
+
+func (l *lexer) advanceWhile(accept func(r rune) bool) {
+	for !l.done() {
+		if l.stop != "" && strings.HasPrefix(l.rest(), l.stop) {
+			return
+		}
+		r, size := utf8.DecodeRuneInString(l.rest())
+		if !accept(r) {
+			return
+		}
+		l.pos += size
+	}
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isWordStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
+
+func isWordPart(r rune) bool {
+	return r == '_' || r == '$' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
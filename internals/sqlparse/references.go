@@ -0,0 +1,158 @@
+package sqlparse
+
+import (
+	"butler-server/internals/dialect"
+	"strings"
+)
+
+// Reference is a name a statement mentions that may be a column. Plain
+// references are items of the select list of the main query returning a
+// column as it is, under its own name. Row references stand for whole rows
+// rather than columns: a table or an alias of the statement named on its
+// own, a wildcard that is not a plain item of the select list, a function
+// building a value out of rows or a FOR JSON or FOR XML clause.
+type Reference struct {
+	Name  string
+	Plain bool
+	Row   bool
+}
+
+// setOperations combine queries whose later columns come out under the names
+// of the first one
+var setOperations = map[string]bool{"UNION": true, "INTERSECT": true, "EXCEPT": true, "MINUS": true}
+
+// rowFunctions build a single value out of whole rows or of the columns a
+// wildcard stands for
+var rowFunctions = map[string]bool{
+	"ROW": true, "ROW_TO_JSON": true, "TO_JSON": true, "TO_JSONB": true, "JSON_AGG": true, "JSONB_AGG": true,
+	"ARRAY_TO_JSON": true, "HSTORE": true, "JSON_OBJECT": true, "JSON_OBJECTAGG": true, "JSON_ARRAYAGG": true,
+	"JSON_OBJECT_AGG": true, "JSONB_OBJECT_AGG": true, "COLUMNS": true,
+}
+
+// References returns the names the statements of a script mention, leaving
+// out the qualifiers of qualified names. Mentions in subqueries, in clauses
+// other than the select list, in expressions and in statements combining
+// queries are not plain.
+func References(d dialect.Dialect, script string) ([]Reference, error) {
+	statements, err := Split(d, script)
+	if err != nil {
+		return nil, err
+	}
+	var references []Reference
+	for _, statement := range statements {
+		references = append(references, statement.references()...)
+	}
+	return references, nil
+}
+
+func (s Statement) references() []Reference {
+	combined := false
+	for _, token := range s.Tokens {
+		if token.Kind == Word && setOperations[strings.ToUpper(token.Text)] {
+			combined = true
+		}
+	}
+	sources, named := s.sourceNames()
+
+	var references []Reference
+	at := func(i int) Token {
+		if i < 0 || i >= len(s.Tokens) {
+			return Token{}
+		}
+		return s.Tokens[i]
+	}
+	selectList := false
+	for i, token := range s.Tokens {
+		if token.Depth == 0 && token.Kind == Word {
+			switch strings.ToUpper(token.Text) {
+			case "SELECT":
+				selectList = true
+				continue
+			case "FROM", "INTO", "WHERE", "GROUP", "HAVING", "ORDER", "LIMIT", "WINDOW":
+				selectList = false
+			}
+		}
+		wildcard := token.Kind == Punctuation && token.Text == "*" && s.wildcard(i)
+		if token.Kind != Word && token.Kind != QuotedIdentifier && !wildcard {
+			continue
+		}
+		if token.Is("FOR") && (at(i+1).Is("JSON") || at(i+1).Is("XML")) {
+			references = append(references, Reference{Name: "FOR " + strings.ToUpper(at(i+1).Text), Row: true})
+			continue
+		}
+		if at(i+1).Text == "." {
+			continue
+		}
+		first := i
+		for at(first-1).Text == "." && first >= 2 {
+			first -= 2
+		}
+		previous, next := at(first-1), at(i+1)
+		plain := !combined && selectList && token.Depth == 0 &&
+			(previous.Is("SELECT") || previous.Is("DISTINCT") || previous.Is("ALL") || (previous.Kind == Punctuation && previous.Text == ",")) &&
+			(next.Text == "" || next.Is("FROM") || next.Is("INTO") || (next.Kind == Punctuation && (next.Text == "," || next.Text == ";")))
+		switch {
+		case wildcard:
+			if plain || (previous.Text == "(" && at(first-2).Is("COUNT")) {
+				continue
+			}
+			name := token.Text
+			if first < i {
+				name = at(i-2).Value() + ".*"
+			}
+			references = append(references, Reference{Name: name, Row: true})
+			continue
+		case next.Text == "(" && token.Kind == Word && rowFunctions[strings.ToUpper(token.Text)]:
+			references = append(references, Reference{Name: token.Text, Row: true})
+			continue
+		}
+		row := first == i && next.Text != "(" && !named[i] && sources[strings.ToLower(token.Value())]
+		references = append(references, Reference{Name: token.Value(), Plain: plain && !row, Row: row})
+	}
+	return references
+}
+
+// wildcard reports whether the asterisk at i stands for columns rather than
+// for a multiplication
+func (s Statement) wildcard(i int) bool {
+	if i == 0 {
+		return false
+	}
+	previous := s.Tokens[i-1]
+	switch previous.Text {
+	case ",", "(", ".":
+		return true
+	}
+	return previous.Is("SELECT") || previous.Is("DISTINCT") || previous.Is("ALL")
+}
+
+// sourceNames returns the lower case names the tables, common table
+// expressions and aliases of the statement go by, with the indexes of the
+// tokens naming them where they are defined
+func (s Statement) sourceNames() (map[string]bool, map[int]bool) {
+	sources := make(map[string]bool)
+	named := make(map[int]bool)
+	main := s.main()
+	if main < 0 {
+		return sources, named
+	}
+	scanner := tableScanner{s: s, main: main}
+	scanner.scan(0, len(s.Tokens))
+	for _, table := range scanner.tables {
+		sources[strings.ToLower(table.name)] = true
+		if dot := strings.LastIndex(table.name, "."); dot >= 0 {
+			sources[strings.ToLower(table.name[dot+1:])] = true
+		}
+		for j := table.from; j < table.to; j++ {
+			named[j] = true
+		}
+	}
+	for _, alias := range scanner.aliases {
+		sources[strings.ToLower(s.Tokens[alias].Value())] = true
+		named[alias] = true
+	}
+	for _, scope := range s.cteScopes() {
+		named[scope.index] = true
+	}
+	return sources, named
+}
@@ -0,0 +1,258 @@
+package sqlparse
+
+import (
+	"butler-server/internals/dialect"
+	"regexp"
+	"strings"
+)
+
+// Statement is one statement of a script
+type Statement struct {
+	// Text is the statement as written, without the delimiter ending it
+	Text string
+	// Pos is the byte offset of Text in the script and Line its 1-based line
+	Pos    int
+	Line   int
+	Tokens []Token
+	// Batch is set on T-SQL batches declaring variables, which are kept
+	// whole since variables only live for the batch they are declared in,
+	// and on T-SQL control flow blocks. Either may return several results.
+	Batch bool
+}
+
+// goPattern matches the batch separator of the SQL Server tools, which must
+// stand on a line of its own
+var goPattern = regexp.MustCompile(`(?i)^[ \t]*GO(?:[ \t]+\d+)?[ \t]*(?:--[^\n]*)?(?:\r?\n|$)`)
+
+// transactionWords follow a BEGIN that starts a transaction rather than a
+// block
+var transactionWords = map[string]bool{
+	"TRAN": true, "TRANSACTION": true, "DISTRIBUTED": true, "WORK": true,
+	"DEFERRED": true, "IMMEDIATE": true, "EXCLUSIVE": true, "ISOLATION": true, "READ": true,
+}
+
+// routineWords make a CREATE statement one whose body may contain semicolons
+var routineWords = map[string]bool{"PROCEDURE": true, "PROC": true, "FUNCTION": true, "TRIGGER": true, "EVENT": true}
+
+// splitter collects the tokens of the statement being read
+type splitter struct {
+	d          dialect.Dialect
+	input      string
+	statements []Statement
+	tokens     []Token
+	// blocks counts the BEGIN and CASE blocks open in a routine body or,
+	// on SQL Server, a batch
+	blocks int
+	// pending is the BEGIN or END keyword waiting for the next token to
+	// tell what it opens or closes
+	pending *Token
+	routine bool
+	// control is set once a T-SQL block opens outside a routine
+	control bool
+	// batchStart is the index in statements of the first statement of the
+	// current T-SQL batch
+	batchStart int
+}
+
+// Split splits a script into statements at semicolons, leaving alone the ones
+// in strings, comments and the bodies of procedures, functions and triggers.
+// MySQL scripts may change the delimiter with DELIMITER lines and SQL Server
+// scripts may separate batches with GO lines. Empty statements are dropped.
+func Split(d dialect.Dialect, script string) ([]Statement, error) {
+	l := newLexer(d, script)
+	s := &splitter{d: d, input: script}
+	delimiter := ";"
+
+	for {
+		if err := l.skip(); err != nil {
+			return nil, err
+		}
+		if l.done() {
+			break
+		}
+
+		if s.atLineStart(l.pos) {
+			if d.Name == dialect.MySQL.Name {
+				line := l.rest()
+				if end := strings.IndexByte(line, '\n'); end >= 0 {
+					line = line[:end]
+				}
+				if fields := strings.Fields(line); len(fields) >= 2 && strings.EqualFold(fields[0], "DELIMITER") {
+					if err := s.end(l); err != nil {
+						return nil, err
+					}
+					delimiter = fields[1]
+					l.stop = ""
+					if delimiter != ";" {
+						l.stop = delimiter
+					}
+					l.pos += len(line)
+					continue
+				}
+			}
+			if d.Name == dialect.MSSQL.Name {
+				if separator := goPattern.FindString(l.rest()); separator != "" {
+					if err := s.end(l); err != nil {
+						return nil, err
+					}
+					s.endBatch()
+					l.pos += len(separator)
+					continue
+				}
+			}
+		}
+		if delimiter != ";" && strings.HasPrefix(l.rest(), delimiter) {
+			if err := s.end(l); err != nil {
+				return nil, err
+			}
+			l.pos += len(delimiter)
+			continue
+		}
+
+		token, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		consumed := s.pending != nil && s.resolve(token)
+		if delimiter == ";" && token.Text == ";" && token.Depth == 0 && s.blocks == 0 {
+			if err := s.end(l); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		s.add(token, !consumed)
+	}
+	if s.pending != nil {
+		s.resolve(Token{})
+	}
+	if err := s.end(l); err != nil {
+		return nil, err
+	}
+	s.endBatch()
+	return s.statements, nil
+}
+
+func (s *splitter) atLineStart(pos int) bool {
+	start := strings.LastIndexByte(s.input[:pos], '\n') + 1
+	return strings.TrimSpace(s.input[start:pos]) == ""
+}
+
+// counting tells whether BEGIN and END delimit blocks in the statement
+func (s *splitter) counting() bool {
+	return s.routine || s.d.Name == dialect.MSSQL.Name
+}
+
+// add appends a token to the statement, count tells whether it may open or
+// close a block
+func (s *splitter) add(token Token, count bool) {
+	s.tokens = append(s.tokens, token)
+	if token.Kind != Word || token.Depth != 0 {
+		return
+	}
+	if !s.routine && len(s.tokens) <= 8 && routineWords[strings.ToUpper(token.Text)] &&
+		(s.tokens[0].Is("CREATE") || s.tokens[0].Is("ALTER")) {
+		s.routine = true
+	}
+	if !count || !s.counting() {
+		return
+	}
+	switch {
+	case token.Is("BEGIN"), token.Is("END"):
+		s.pending = &token
+	case token.Is("CASE"):
+		s.blocks++
+	}
+}
+
+// resolve settles the pending BEGIN or END now that the token after it is
+// known, reporting whether that token only names the block being closed, as
+// in END CASE or END TRY
+func (s *splitter) resolve(next Token) bool {
+	pending := s.pending
+	s.pending = nil
+	word := ""
+	if next.Kind == Word {
+		word = strings.ToUpper(next.Text)
+	}
+
+	if pending.Is("BEGIN") {
+		switch {
+		case next.Text == ";" || next.Text == "" || transactionWords[word]:
+		case s.d.Name == dialect.Postgres.Name || s.d.Name == dialect.DuckDB.Name:
+			// SQL standard routine bodies, the others are quoted
+			if word == "ATOMIC" {
+				s.blocks++
+			}
+		default:
+			s.blocks++
+			s.control = s.control || !s.routine
+		}
+		return false
+	}
+
+	switch word {
+	case "IF", "LOOP", "WHILE", "REPEAT":
+		// closes a control statement, which never opened a block
+		return true
+	}
+	if s.blocks > 0 {
+		s.blocks--
+	}
+	return word == "CASE" || word == "TRY" || word == "CATCH"
+}
+
+// end closes the statement being read
+func (s *splitter) end(l *lexer) error {
+	if s.pending != nil {
+		s.resolve(Token{})
+	}
+	if err := l.balanced(); err != nil {
+		return err
+	}
+	tokens, control := s.tokens, s.control
+	s.tokens, s.blocks, s.routine, s.control = nil, 0, false, false
+	if len(tokens) == 0 {
+		return nil
+	}
+	first, last := tokens[0], tokens[len(tokens)-1]
+	line, _ := Position(s.input, first.Pos)
+	s.statements = append(s.statements, Statement{
+		Text:   s.input[first.Pos : last.Pos+len(last.Text)],
+		Pos:    first.Pos,
+		Line:   line,
+		Tokens: tokens,
+		Batch:  control,
+	})
+	return nil
+}
+
+// endBatch merges the statements of a T-SQL batch into one when the batch
+// declares variables
+func (s *splitter) endBatch() {
+	if s.d.Name != dialect.MSSQL.Name {
+		return
+	}
+	batch := s.statements[s.batchStart:]
+	declares := false
+	for _, statement := range batch {
+		if statement.Keyword() == "DECLARE" {
+			declares = true
+		}
+	}
+	if declares && len(batch) > 1 {
+		first, last := batch[0], batch[len(batch)-1]
+		merged := Statement{
+			Text:  s.input[first.Pos : last.Pos+len(last.Text)],
+			Pos:   first.Pos,
+			Line:  first.Line,
+			Batch: true,
+		}
+		for _, statement := range batch {
+			merged.Tokens = append(merged.Tokens, statement.Tokens...)
+		}
+		s.statements = append(s.statements[:s.batchStart], merged)
+	} else if declares {
+		s.statements[s.batchStart].Batch = true
+	}
+	s.batchStart = len(s.statements)
+}
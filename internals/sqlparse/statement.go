@@ -0,0 +1,275 @@
+package sqlparse
+
+import (
+	"butler-server/internals/dialect"
+	"fmt"
+	"strings"
+)
+
+// Keyword returns the first word of the statement in upper case, empty if
+// it does not start with one
+func (s Statement) Keyword() string {
+	if len(s.Tokens) == 0 || s.Tokens[0].Kind != Word {
+		return ""
+	}
+	return strings.ToUpper(s.Tokens[0].Text)
+}
+
+// mainVerbs are the statements a WITH clause may introduce
+var mainVerbs = map[string]bool{
+	"SELECT": true, "INSERT": true, "UPDATE": true, "DELETE": true, "MERGE": true,
+	"VALUES": true, "TABLE": true, "REPLACE": true,
+}
+
+// main returns the index of the token starting the statement proper, past a
+// leading WITH clause, -1 if there is none
+func (s Statement) main() int {
+	if len(s.Tokens) == 0 {
+		return -1
+	}
+	if !s.Tokens[0].Is("WITH") {
+		return 0
+	}
+	for i, token := range s.Tokens[1:] {
+		if token.Depth == 0 && token.Kind == Word && mainVerbs[strings.ToUpper(token.Text)] && s.Tokens[i].Text == ")" {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// Verb returns the keyword of the statement proper in upper case, which for
+// statements with a WITH clause is the one following the common table
+// expressions
+func (s Statement) Verb() string {
+	main := s.main()
+	if main < 0 || s.Tokens[main].Kind != Word {
+		return ""
+	}
+	return strings.ToUpper(s.Tokens[main].Text)
+}
+
+// topLevel returns the index of the first word out of keywords found outside
+// parentheses after the start of the statement proper, -1 if there is none
+func (s Statement) topLevel(keywords ...string) int {
+	main := s.main()
+	if main < 0 {
+		return -1
+	}
+	for i := main; i < len(s.Tokens); i++ {
+		token := s.Tokens[i]
+		if token.Depth != 0 || token.Kind != Word {
+			continue
+		}
+		for _, keyword := range keywords {
+			if token.Is(keyword) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// IsQuery reports whether the statement is a plain query, a SELECT, VALUES or
+// TABLE that neither stores its rows with INTO nor locks them with FOR
+func (s Statement) IsQuery() bool {
+	if s.Batch {
+		return false
+	}
+	switch s.Verb() {
+	case "SELECT", "VALUES", "TABLE":
+		return s.topLevel("INTO", "FOR") < 0
+	}
+	return false
+}
+
+// sqlTextFunctions run SQL given as text, read tables given by name or read
+// from other servers, so what they touch cannot be told from the statement
+// calling them
+var sqlTextFunctions = map[string]bool{
+	"QUERY_TO_XML": true, "QUERY_TO_XMLSCHEMA": true, "QUERY_TO_XML_AND_XMLSCHEMA": true,
+	"TABLE_TO_XML": true, "TABLE_TO_XMLSCHEMA": true, "TABLE_TO_XML_AND_XMLSCHEMA": true,
+	"CURSOR_TO_XML": true, "CURSOR_TO_XMLSCHEMA": true, "SCHEMA_TO_XML": true, "DATABASE_TO_XML": true,
+	"TS_STAT": true, "DBLINK": true, "DBLINK_EXEC": true, "DBLINK_OPEN": true, "DBLINK_FETCH": true,
+	"OPENQUERY": true, "OPENROWSET": true, "OPENDATASOURCE": true, "QUERY": true, "QUERY_TABLE": true,
+}
+
+// SQLTextCall returns the name in upper case of the first function the
+// statement calls that runs SQL given as text or reads a table given by
+// name, empty if it calls none
+func (s Statement) SQLTextCall() string {
+	for i := 0; i+1 < len(s.Tokens); i++ {
+		token := s.Tokens[i]
+		if token.Kind != Word && token.Kind != QuotedIdentifier || s.Tokens[i+1].Text != "(" {
+			continue
+		}
+		if name := strings.ToUpper(token.Value()); sqlTextFunctions[name] {
+			return name
+		}
+	}
+	return ""
+}
+
+// ReturnsRows reports whether running the statement yields a result set
+func (s Statement) ReturnsRows() bool {
+	if s.Batch {
+		return true
+	}
+	switch s.Verb() {
+	case "SELECT", "VALUES", "TABLE":
+		return s.topLevel("INTO") < 0
+	}
+	switch s.Keyword() {
+	case "SHOW", "EXPLAIN", "DESCRIBE", "DESC", "PRAGMA", "EXEC", "EXECUTE", "CALL":
+		return true
+	}
+	return s.topLevel("RETURNING", "OUTPUT") >= 0
+}
+
+// HasPaging reports whether the query limits its own rows
+func (s Statement) HasPaging() bool {
+	return s.topLevel("LIMIT", "OFFSET", "FETCH", "TOP") >= 0
+}
+
+// Paginate returns the text of the statement limited to one page of rows.
+// Only plain queries without paging of their own are changed, everything
+// else runs as written.
+func Paginate(d dialect.Dialect, s Statement, page, size int) string {
+	if !s.IsQuery() || s.HasPaging() {
+		return s.Text
+	}
+	if d.Name != dialect.MSSQL.Name {
+		return s.Text + fmt.Sprintf(" LIMIT %d OFFSET %d", size, page*size)
+	}
+
+	// T-SQL has no LIMIT: the first page of an unordered SELECT takes the
+	// TOP rows and any other page needs an ORDER BY for OFFSET/FETCH
+	paging := fmt.Sprintf(" OFFSET %d ROWS FETCH NEXT %d ROWS ONLY", page*size, size)
+	if s.topLevel("ORDER") >= 0 {
+		return s.Text + paging
+	}
+	main := s.main()
+	if page == 0 && s.Verb() == "SELECT" && s.topLevel("UNION", "EXCEPT", "INTERSECT") < 0 {
+		insert := main + 1
+		if insert < len(s.Tokens) && (s.Tokens[insert].Is("DISTINCT") || s.Tokens[insert].Is("ALL")) {
+			insert++
+		}
+		at := len(s.Text)
+		if insert < len(s.Tokens) {
+			at = s.Tokens[insert].Pos - s.Pos
+		}
+		return s.Text[:at] + fmt.Sprintf("TOP (%d) ", size) + s.Text[at:]
+	}
+	return s.Text + " ORDER BY (SELECT NULL)" + paging
+}
+
+// ReadOnly reports whether the statement only reads data: a query that does
+// not store or lock its rows and has no data-modifying WITH clause, a SHOW or
+// DESCRIBE, an EXPLAIN of such a query or a PRAGMA that does not set a value.
+// T-SQL batches, procedure calls and anything unrecognised count as writes.
+func (s Statement) ReadOnly() bool {
+	if s.Batch {
+		return false
+	}
+	switch s.Keyword() {
+	case "SHOW", "DESCRIBE", "DESC", "SUMMARIZE":
+		return true
+	case "EXPLAIN":
+		// EXPLAIN ANALYZE runs the statement, so it is judged by what it
+		// explains
+		for i, token := range s.Tokens[1:] {
+			if token.Depth == 0 && (token.Is("WITH") || token.Kind == Word && mainVerbs[strings.ToUpper(token.Text)]) {
+				return Statement{Tokens: s.Tokens[i+1:]}.ReadOnly()
+			}
+		}
+		return false
+	case "PRAGMA":
+		return s.readOnlyPragma()
+	}
+
+	main := s.main()
+	if main < 0 {
+		return false
+	}
+	for i := 1; i < main; i++ {
+		if s.Tokens[i].Kind == Word && modifyingVerbs[strings.ToUpper(s.Tokens[i].Text)] && s.Tokens[i-1].Text == "(" {
+			return false
+		}
+	}
+	switch s.Verb() {
+	case "SELECT", "VALUES", "TABLE":
+	default:
+		return false
+	}
+	if s.topLevel("INTO") >= 0 {
+		return false
+	}
+	if i := s.topLevel("FOR"); i >= 0 && i+1 < len(s.Tokens) {
+		next := s.Tokens[i+1]
+		return !next.Is("UPDATE") && !next.Is("SHARE") && !next.Is("NO") && !next.Is("KEY")
+	}
+	return true
+}
+
+// modifyingVerbs start the statements a data-modifying WITH clause may hold
+var modifyingVerbs = map[string]bool{"INSERT": true, "UPDATE": true, "DELETE": true, "MERGE": true}
+
+// readOnlyPragma tells SQLite pragmas reading a value or listing schema
+// objects from the ones setting a value, written PRAGMA name = value or
+// PRAGMA name(value)
+func (s Statement) readOnlyPragma() bool {
+	if len(s.Tokens) < 2 {
+		return false
+	}
+	name := ""
+	for _, token := range s.Tokens[1:] {
+		switch {
+		case token.Text == "=":
+			return false
+		case token.Text == "(":
+			return strings.HasSuffix(name, "_list") || strings.HasSuffix(name, "_info") || strings.HasSuffix(name, "_xinfo")
+		case token.Kind == Word:
+			name = strings.ToLower(token.Text)
+		}
+	}
+	return true
+}
+
+// mysqlImplicitCommits start the MySQL statements that commit the
+// transaction they run in
+var mysqlImplicitCommits = map[string]bool{
+	"ALTER": true, "CREATE": true, "DROP": true, "RENAME": true, "TRUNCATE": true,
+	"GRANT": true, "REVOKE": true, "LOCK": true, "UNLOCK": true, "INSTALL": true, "UNINSTALL": true,
+	"ANALYZE": true, "OPTIMIZE": true, "REPAIR": true, "CHECK": true, "CACHE": true, "FLUSH": true, "RESET": true,
+}
+
+// EndsTransaction reports whether running the statement ends the transaction
+// it runs in, either as transaction control or, on MySQL, by committing
+// implicitly as DDL and administration statements do
+func (s Statement) EndsTransaction(d dialect.Dialect) bool {
+	if s.Batch {
+		for _, token := range s.Tokens {
+			if token.Is("COMMIT") || token.Is("ROLLBACK") {
+				return true
+			}
+		}
+		return false
+	}
+	keyword := s.Keyword()
+	switch keyword {
+	case "COMMIT", "ROLLBACK", "ABORT", "END", "START", "BEGIN":
+		return true
+	}
+	if d.Name != dialect.MySQL.Name {
+		return false
+	}
+	if keyword == "SET" {
+		for _, token := range s.Tokens {
+			if strings.HasSuffix(strings.ToLower(token.Text), "autocommit") {
+				return true
+			}
+		}
+	}
+	temporary := len(s.Tokens) > 1 && s.Tokens[1].Is("TEMPORARY")
+	return mysqlImplicitCommits[keyword] && !temporary
+}
@@ -0,0 +1,165 @@
+package sqlparse
+
+import (
+	"butler-server/internals/dialect"
+	"testing"
+)
+
+func TestReadOnly(t *testing.T) {
+	tests := []struct {
+		name     string
+		dialect  dialect.Dialect
+		query    string
+		readOnly bool
+	}{
+		{"select", dialect.Postgres, "SELECT * FROM users", true},
+		{"values", dialect.Postgres, "VALUES (1), (2)", true},
+		{"table", dialect.Postgres, "TABLE users", true},
+		{"cte", dialect.Postgres, "WITH u AS (SELECT * FROM users) SELECT * FROM u", true},
+		{"insert", dialect.Postgres, "INSERT INTO users (id) VALUES (1)", false},
+		{"update", dialect.MySQL, "UPDATE users SET name = 'x'", false},
+		{"ddl", dialect.Postgres, "DROP TABLE users", false},
+		{"deleting cte", dialect.Postgres, "WITH d AS (DELETE FROM users RETURNING *) SELECT * FROM d", false},
+		{"inserting cte", dialect.Postgres, "WITH u AS (SELECT 1), i AS (INSERT INTO users (id) VALUES (1) RETURNING id) SELECT * FROM i", false},
+		{"updating cte", dialect.Postgres, "WITH u AS (UPDATE users SET name = 'x' RETURNING *) SELECT count(*) FROM u", false},
+		{"cte reading a table named delete", dialect.Postgres, `WITH d AS (SELECT * FROM "delete") SELECT * FROM d`, true},
+		{"cte before an insert", dialect.Postgres, "WITH u AS (SELECT 1) INSERT INTO users (id) SELECT * FROM u", false},
+		{"select into", dialect.Postgres, "SELECT * INTO copy FROM users", false},
+		{"select into variable", dialect.MySQL, "SELECT name INTO @name FROM users", false},
+		{"select into outfile", dialect.MySQL, "SELECT * FROM users INTO OUTFILE '/tmp/users'", false},
+		{"into in a subquery", dialect.MSSQL, "SELECT * FROM (SELECT 1 AS n) AS into_table", true},
+		{"for update", dialect.Postgres, "SELECT * FROM users FOR UPDATE", false},
+		{"for share", dialect.Postgres, "SELECT * FROM users FOR SHARE", false},
+		{"for no key update", dialect.Postgres, "SELECT * FROM users FOR NO KEY UPDATE", false},
+		{"for key share", dialect.Postgres, "SELECT * FROM users FOR KEY SHARE", false},
+		{"for json", dialect.MSSQL, "SELECT * FROM users FOR JSON AUTO", true},
+		{"for xml", dialect.MSSQL, "SELECT * FROM users FOR XML PATH", true},
+		{"show", dialect.MySQL, "SHOW TABLES", true},
+		{"describe", dialect.MySQL, "DESCRIBE users", true},
+		{"summarize", dialect.DuckDB, "SUMMARIZE users", true},
+		{"explain", dialect.Postgres, "EXPLAIN SELECT * FROM users", true},
+		{"explain delete", dialect.Postgres, "EXPLAIN DELETE FROM users", false},
+		{"explain analyze select", dialect.Postgres, "EXPLAIN ANALYZE SELECT * FROM users", true},
+		{"explain analyze delete", dialect.Postgres, "EXPLAIN ANALYZE DELETE FROM users", false},
+		{"explain with options", dialect.Postgres, "EXPLAIN (ANALYZE, BUFFERS) UPDATE users SET name = 'x'", false},
+		{"explain deleting cte", dialect.Postgres, "EXPLAIN ANALYZE WITH d AS (DELETE FROM users RETURNING *) SELECT * FROM d", false},
+		{"pragma read", dialect.SQLite, "PRAGMA journal_mode", true},
+		{"pragma table info", dialect.SQLite, "PRAGMA table_info(users)", true},
+		{"pragma index list", dialect.SQLite, "PRAGMA index_list('users')", true},
+		{"pragma set", dialect.SQLite, "PRAGMA journal_mode = WAL", false},
+		{"pragma call", dialect.SQLite, "PRAGMA user_version(7)", false},
+		{"pragma schema set", dialect.SQLite, "PRAGMA main.synchronous = OFF", false},
+		{"exec", dialect.MSSQL, "EXEC sp_who", false},
+		{"call", dialect.MySQL, "CALL refresh()", false},
+		{"copy", dialect.Postgres, "COPY users TO STDOUT", false},
+		{"set", dialect.Postgres, "SET search_path TO public", false},
+		{"unknown", dialect.Postgres, "VACUUM users", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			statements, err := Split(test.dialect, test.query)
+			if err != nil {
+				t.Fatalf("Split(%q) failed: %v", test.query, err)
+			}
+			if len(statements) != 1 {
+				t.Fatalf("Split(%q) = %d statements, want 1", test.query, len(statements))
+			}
+			if readOnly := statements[0].ReadOnly(); readOnly != test.readOnly {
+				t.Errorf("ReadOnly(%q) = %v, want %v", test.query, readOnly, test.readOnly)
+			}
+		})
+	}
+}
+
+func TestReadOnlyBatch(t *testing.T) {
+	batches := []string{
+		"DECLARE @n INT = 1; SELECT @n",
+		"DECLARE @id INT; SELECT @id = id FROM users; DELETE FROM users WHERE id = @id",
+	}
+	for _, batch := range batches {
+		statements, err := Split(dialect.MSSQL, batch)
+		if err != nil {
+			t.Fatalf("Split(%q) failed: %v", batch, err)
+		}
+		for _, statement := range statements {
+			if statement.Batch && statement.ReadOnly() {
+				t.Errorf("ReadOnly of the batch %q = true, want false", statement.Text)
+			}
+		}
+		if len(statements) != 1 || !statements[0].Batch {
+			t.Errorf("Split(%q) = %d statements, want a single batch", batch, len(statements))
+		}
+	}
+}
+
+func TestEndsTransaction(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect dialect.Dialect
+		query   string
+		ends    bool
+	}{
+		{"commit", dialect.Postgres, "COMMIT", true},
+		{"rollback", dialect.MySQL, "ROLLBACK", true},
+		{"abort", dialect.Postgres, "ABORT", true},
+		{"end", dialect.Postgres, "END", true},
+		{"begin", dialect.Postgres, "BEGIN", true},
+		{"start transaction", dialect.MySQL, "START TRANSACTION", true},
+		{"insert", dialect.MySQL, "INSERT INTO users (id) VALUES (1)", false},
+		{"select", dialect.MySQL, "SELECT * FROM users", false},
+		{"create table", dialect.MySQL, "CREATE TABLE t (id INT)", true},
+		{"create temporary table", dialect.MySQL, "CREATE TEMPORARY TABLE t (id INT)", false},
+		{"drop temporary table", dialect.MySQL, "DROP TEMPORARY TABLE t", false},
+		{"alter", dialect.MySQL, "ALTER TABLE users ADD COLUMN age INT", true},
+		{"drop", dialect.MySQL, "DROP TABLE users", true},
+		{"rename", dialect.MySQL, "RENAME TABLE a TO b", true},
+		{"truncate", dialect.MySQL, "TRUNCATE TABLE users", true},
+		{"grant", dialect.MySQL, "GRANT SELECT ON db.* TO 'u'", true},
+		{"revoke", dialect.MySQL, "REVOKE SELECT ON db.* FROM 'u'", true},
+		{"lock tables", dialect.MySQL, "LOCK TABLES users READ", true},
+		{"unlock tables", dialect.MySQL, "UNLOCK TABLES", true},
+		{"analyze", dialect.MySQL, "ANALYZE TABLE users", true},
+		{"optimize", dialect.MySQL, "OPTIMIZE TABLE users", true},
+		{"flush", dialect.MySQL, "FLUSH PRIVILEGES", true},
+		{"set autocommit", dialect.MySQL, "SET autocommit = 1", true},
+		{"set session autocommit", dialect.MySQL, "SET @@session.autocommit = 1", true},
+		{"set other", dialect.MySQL, "SET @x = 1", false},
+		{"postgres ddl", dialect.Postgres, "CREATE TABLE t (id INT)", false},
+		{"postgres truncate", dialect.Postgres, "TRUNCATE users", false},
+		{"mssql ddl", dialect.MSSQL, "CREATE TABLE t (id INT)", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			statements, err := Split(test.dialect, test.query)
+			if err != nil {
+				t.Fatalf("Split(%q) failed: %v", test.query, err)
+			}
+			if ends := statements[0].EndsTransaction(test.dialect); ends != test.ends {
+				t.Errorf("EndsTransaction(%q) = %v, want %v", test.query, ends, test.ends)
+			}
+		})
+	}
+}
+
+func TestEndsTransactionBatch(t *testing.T) {
+	tests := []struct {
+		batch string
+		ends  bool
+	}{
+		{"DECLARE @n INT = 1; UPDATE users SET n = @n", false},
+		{"DECLARE @n INT = 1; BEGIN TRANSACTION; UPDATE users SET n = @n; COMMIT", true},
+		{"DECLARE @n INT = 1; IF @n > 0 ROLLBACK", true},
+	}
+	for _, test := range tests {
+		statements, err := Split(dialect.MSSQL, test.batch)
+		if err != nil {
+			t.Fatalf("Split(%q) failed: %v", test.batch, err)
+		}
+		if len(statements) != 1 || !statements[0].Batch {
+			t.Fatalf("Split(%q) = %d statements, want a single batch", test.batch, len(statements))
+		}
+		if ends := statements[0].EndsTransaction(dialect.MSSQL); ends != test.ends {
+			t.Errorf("EndsTransaction(%q) = %v, want %v", test.batch, ends, test.ends)
+		}
+	}
+}
@@ -0,0 +1,591 @@
+package sqlparse
+
+import (
+	"butler-server/internals/dialect"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Tables returns the tables the statements of a script touch, in the order
+// they appear with the tables of WITH clauses last, so that the table a
+// statement changes or defines comes first. Common table expressions and
+// table functions are left out. Statements that change or define a table
+// without naming one are syntax errors.
+func Tables(d dialect.Dialect, script string) ([]string, error) {
+	statements, err := Split(d, script)
+	if err != nil {
+		return nil, err
+	}
+	var tables []string
+	seen := make(map[string]bool)
+	for _, statement := range statements {
+		found, err := statement.tables(script)
+		if err != nil {
+			return nil, err
+		}
+		for _, table := range found {
+			if !seen[table] {
+				seen[table] = true
+				tables = append(tables, table)
+			}
+		}
+	}
+	return tables, nil
+}
+
+// targetVerbs are the statements that must name the table they act on
+var targetVerbs = map[string]bool{
+	"INSERT": true, "REPLACE": true, "UPDATE": true, "DELETE": true, "MERGE": true,
+	"CREATE": true, "ALTER": true, "DROP": true, "TRUNCATE": true,
+}
+
+// definedObjects are the objects of DDL statements that must be named
+var definedObjects = map[string]bool{"TABLE": true, "VIEW": true}
+
+// expressionFroms are the functions taking a FROM in their arguments
+var expressionFroms = map[string]bool{"EXTRACT": true, "SUBSTRING": true, "TRIM": true, "OVERLAY": true}
+
+// nameModifiers may stand between a keyword and the table it introduces
+var nameModifiers = map[string]bool{
+	"ONLY": true, "IGNORE": true, "LOW_PRIORITY": true, "HIGH_PRIORITY": true, "DELAYED": true, "QUICK": true,
+}
+
+// aliasEnds are the keywords that may follow a table reference in place of
+// an alias
+var aliasEnds = map[string]bool{
+	"WHERE": true, "JOIN": true, "INNER": true, "LEFT": true, "RIGHT": true, "FULL": true, "CROSS": true,
+	"NATURAL": true, "OUTER": true, "STRAIGHT_JOIN": true, "ON": true, "USING": true, "GROUP": true,
+	"ORDER": true, "LIMIT": true, "HAVING": true, "UNION": true, "EXCEPT": true, "INTERSECT": true,
+	"SET": true, "WINDOW": true, "OFFSET": true, "FETCH": true, "FOR": true, "RETURNING": true,
+	"VALUES": true, "SELECT": true, "WITH": true, "PARTITION": true, "TABLESAMPLE": true, "FORCE": true,
+	"USE": true, "IGNORE": true, "APPLY": true, "OUTPUT": true, "DEFAULT": true, "QUALIFY": true,
+	"INTO": true, "WHEN": true, "DO": true, "TO": true, "CASCADE": true, "RESTRICT": true, "ADD": true,
+	"RENAME": true, "AS": true, "FROM": true, "LOCK": true, "OPTION": true, "PIVOT": true, "UNPIVOT": true,
+	"INSERT": true, "UPDATE": true, "DELETE": true, "CONFLICT": true, "DUPLICATE": true,
+}
+
+// sourceEnds are the keywords ending the items of a FROM like clause that
+// follow the item they are read from, JOIN like ones start an item read on
+// its own
+var sourceEnds = map[string]bool{
+	"WHERE": true, "GROUP": true, "HAVING": true, "ORDER": true, "LIMIT": true, "OFFSET": true,
+	"FETCH": true, "WINDOW": true, "QUALIFY": true, "UNION": true, "EXCEPT": true, "INTERSECT": true,
+	"MINUS": true, "FOR": true, "RETURNING": true, "SET": true, "VALUES": true, "SELECT": true,
+	"INTO": true, "OPTION": true, "WHEN": true, "OUTPUT": true, "FROM": true, "LOCK": true,
+	"JOIN": true, "STRAIGHT_JOIN": true, "USING": true, "APPLY": true, "DEFAULT": true,
+}
+
+// subqueryStarts are the keywords starting a query in parentheses, other
+// parenthesised FROM items being joins
+var subqueryStarts = map[string]bool{"SELECT": true, "WITH": true, "VALUES": true, "TABLE": true, "FROM": true}
+
+// UnknownSourceError is an item of a FROM like clause that is neither a
+// table, a subquery, a table function nor a join in parentheses
+type UnknownSourceError struct {
+	Text string
+	Pos  int
+}
+
+func (e *UnknownSourceError) Error() string {
+	return fmt.Sprintf("cannot tell what %s at offset %d reads from", e.Text, e.Pos)
+}
+
+// TableReference is a table named in a FROM like clause of a statement.
+// Start and End are the offsets in the script of the name, with the
+// modifiers before it such as ONLY, and Aliased tells whether an alias
+// follows it.
+type TableReference struct {
+	Name    string
+	Start   int
+	End     int
+	Aliased bool
+}
+
+// tableName is a table named by a statement, at the offset of its name and
+// spanning the tokens from up to to, excluded
+type tableName struct {
+	name     string
+	pos      int
+	from, to int
+}
+
+type tableScanner struct {
+	s          Statement
+	main       int
+	tables     []tableName
+	references []TableReference
+	// aliases are the indexes of the aliases of the FROM like items,
+	// subqueries and table functions included
+	aliases []int
+	// unknown are the FROM like items that could not be read
+	unknown []Token
+	// onTable is set by CREATE INDEX and CREATE TRIGGER, whose table
+	// follows the next ON
+	onTable bool
+}
+
+func (s Statement) tables(script string) ([]string, error) {
+	main := s.main()
+	if main < 0 {
+		end := s.Pos + len(s.Text)
+		return nil, syntaxError(script, end, "expected a statement after the WITH clause")
+	}
+	scanner := tableScanner{s: s, main: main}
+	scanner.scan(main, len(s.Tokens))
+	scanner.scan(0, main)
+	scopes := s.cteScopes()
+	var tables []string
+	for _, table := range scanner.tables {
+		if !scopes.hides(table.name, table.pos) {
+			tables = append(tables, table.name)
+		}
+	}
+
+	verb := s.Verb()
+	if len(tables) == 0 && targetVerbs[verb] && (s.Keyword() != verb || !isDDL(verb) || s.defines()) {
+		token := s.Tokens[main]
+		return nil, syntaxError(script, token.Pos, "expected a table name after %s", strings.ToUpper(token.Text))
+	}
+	return tables, nil
+}
+
+// TableReferences returns the tables named in the FROM like clauses of the
+// statement, those of its WITH clause and subqueries included, in the order
+// they appear. Common table expressions and table functions are left out. An
+// item the statement reads from that cannot be told apart is returned as an
+// UnknownSourceError.
+func (s Statement) TableReferences() ([]TableReference, error) {
+	main := s.main()
+	if main < 0 {
+		return nil, nil
+	}
+	scanner := tableScanner{s: s, main: main}
+	scanner.scan(0, len(s.Tokens))
+	if len(scanner.unknown) > 0 {
+		token := scanner.unknown[0]
+		return nil, &UnknownSourceError{Text: token.Text, Pos: token.Pos}
+	}
+	scopes := s.cteScopes()
+	var references []TableReference
+	for _, reference := range scanner.references {
+		if !scopes.hides(reference.Name, reference.Start) {
+			references = append(references, reference)
+		}
+	}
+	sort.Slice(references, func(i, j int) bool {
+		return references[i].Start < references[j].Start
+	})
+	return references, nil
+}
+
+// CTENames returns the names of the common table expressions of the WITH
+// clause of the statement, in lower case
+func (s Statement) CTENames() map[string]bool {
+	names := make(map[string]bool)
+	for _, scope := range s.cteScopes() {
+		names[scope.name] = true
+	}
+	return names
+}
+
+// cteScope is a common table expression named by the token at index, whose
+// lower case name stands for it from the offset from on
+type cteScope struct {
+	name  string
+	index int
+	from  int
+}
+
+type cteScopes []cteScope
+
+// cteScopes returns the common table expressions of the WITH clause of the
+// statement. A name stands for its expression after the body of the
+// expression, or within it too in a recursive WITH clause, so that a body
+// reading the table it shadows reads the table.
+func (s Statement) cteScopes() cteScopes {
+	var scopes cteScopes
+	main := s.main()
+	if !s.Tokens[0].Is("WITH") || main < 0 {
+		return scopes
+	}
+	recursive := s.Tokens[1].Is("RECURSIVE")
+	for i := 1; i < main; i++ {
+		token, previous := s.Tokens[i], s.Tokens[i-1]
+		if token.Depth != 0 || (token.Kind != Word && token.Kind != QuotedIdentifier) || token.Is("RECURSIVE") {
+			continue
+		}
+		if !previous.Is("WITH") && !previous.Is("RECURSIVE") && previous.Text != "," {
+			continue
+		}
+		from := token.Pos
+		if !recursive {
+			// the body ends at the comma before the next expression or at
+			// the main statement
+			end := i + 1
+			for end < main && (s.Tokens[end].Depth != 0 || s.Tokens[end].Text != ",") {
+				end++
+			}
+			from = s.Tokens[end].Pos
+		}
+		scopes = append(scopes, cteScope{name: strings.ToLower(token.Value()), index: i, from: from})
+	}
+	return scopes
+}
+
+// hides reports whether the table named at offset pos is a common table
+// expression
+func (c cteScopes) hides(table string, pos int) bool {
+	for _, scope := range c {
+		if scope.name == strings.ToLower(table) && pos >= scope.from {
+			return true
+		}
+	}
+	return false
+}
+
+func isDDL(verb string) bool {
+	return verb == "CREATE" || verb == "ALTER" || verb == "DROP"
+}
+
+// defines reports whether a DDL statement is about a table or a view, rather
+// than about an index, a schema, a role or a function
+func (s Statement) defines() bool {
+	for _, token := range s.Tokens[1:] {
+		if token.Kind != Word {
+			continue
+		}
+		name := strings.ToUpper(token.Text)
+		if definedObjects[name] {
+			return true
+		}
+		switch name {
+		case "OR", "REPLACE", "TEMP", "TEMPORARY", "UNLOGGED", "GLOBAL", "LOCAL", "UNIQUE", "CLUSTERED",
+			"NONCLUSTERED", "MATERIALIZED", "RECURSIVE", "EXTERNAL", "VIRTUAL", "IF", "NOT", "EXISTS":
+			continue
+		}
+		return false
+	}
+	return false
+}
+
+// scan collects the tables named by the tokens from up to to, excluded
+func (t *tableScanner) scan(from, to int) {
+	tokens := t.s.Tokens
+	for i := from; i < to; i++ {
+		token := tokens[i]
+		if token.Kind != Word {
+			continue
+		}
+		previous := Token{}
+		if i > 0 {
+			previous = tokens[i-1]
+		}
+		// verbs also start common table expressions and the statements of
+		// routine bodies
+		verbPosition := i == t.main || previous.Text == "(" || previous.Text == ";" ||
+			previous.Is("BEGIN") || previous.Is("THEN") || previous.Is("ELSE")
+
+		switch strings.ToUpper(token.Text) {
+		case "FROM":
+			if previous.Is("DISTINCT") || t.inExpressionFrom(i) {
+				continue
+			}
+			t.sources(i + 1)
+		case "JOIN", "STRAIGHT_JOIN", "APPLY":
+			t.sources(i + 1)
+		case "USING":
+			// the columns of JOIN ... USING (...)
+			if t.at(i+1).Text == "(" && t.joinUsing(i) {
+				continue
+			}
+			t.sources(i + 1)
+		case "INTO":
+			if next := t.at(i + 1); next.Is("OUTFILE") || next.Is("DUMPFILE") {
+				continue
+			}
+			t.list(i + 1)
+		case "UPDATE":
+			if verbPosition {
+				t.sources(i + 1)
+			}
+		case "INSERT", "REPLACE", "DELETE":
+			// T-SQL and MySQL may leave out INTO and FROM
+			if !verbPosition {
+				continue
+			}
+			j := t.skipModifiers(i + 1)
+			if next := t.at(j); !next.Is("INTO") && !next.Is("FROM") {
+				t.list(j)
+			}
+		case "MERGE":
+			if verbPosition && !t.at(i+1).Is("INTO") {
+				t.sources(i + 1)
+			}
+		case "TABLE", "VIEW":
+			if next := t.at(i + 1); next.Text != "(" {
+				t.list(i + 1)
+			}
+		case "TRUNCATE":
+			if !t.at(i + 1).Is("TABLE") {
+				t.list(i + 1)
+			}
+		case "INDEX", "TRIGGER":
+			t.onTable = token.Depth == 0
+		case "ON":
+			if t.onTable {
+				t.onTable = false
+				t.list(i + 1)
+			}
+		case "REFERENCES":
+			t.list(i + 1)
+		case "TO":
+			if t.s.Keyword() == "RENAME" {
+				t.list(i + 1)
+			}
+		}
+	}
+}
+
+func (t *tableScanner) at(i int) Token {
+	if i < 0 || i >= len(t.s.Tokens) {
+		return Token{}
+	}
+	return t.s.Tokens[i]
+}
+
+// inExpressionFrom reports whether the FROM at i is an argument of a function
+// such as EXTRACT(YEAR FROM ...)
+func (t *tableScanner) inExpressionFrom(i int) bool {
+	depth := t.s.Tokens[i].Depth
+	if depth == 0 {
+		return false
+	}
+	for j := i - 1; j > 0; j-- {
+		token := t.s.Tokens[j]
+		if token.Text == "(" && token.Depth == depth-1 {
+			return expressionFroms[strings.ToUpper(t.s.Tokens[j-1].Text)]
+		}
+	}
+	return false
+}
+
+// skipModifiers moves past IF [NOT] EXISTS and the modifiers that may stand
+// before a table name
+func (t *tableScanner) skipModifiers(i int) int {
+	for {
+		token := t.at(i)
+		switch {
+		case token.Is("IF"):
+			i++
+			if t.at(i).Is("NOT") {
+				i++
+			}
+			if t.at(i).Is("EXISTS") {
+				i++
+			}
+		case token.Kind == Word && nameModifiers[strings.ToUpper(token.Text)]:
+			i++
+		case token.Is("OR") && t.at(i+1).Kind == Word:
+			// SQLite INSERT OR REPLACE
+			i += 2
+		default:
+			return i
+		}
+	}
+}
+
+// list reads the table name at i and the ones following it after a comma
+func (t *tableScanner) list(i int) {
+	for {
+		i = t.skipModifiers(i)
+		name, next, ok := t.name(i)
+		if !ok {
+			return
+		}
+		t.tables = append(t.tables, tableName{name: name, pos: t.at(i).Pos, from: i, to: next})
+		if t.at(next).Text != "," || t.at(next).Depth != t.at(i).Depth {
+			return
+		}
+		i = next + 1
+	}
+}
+
+// sources reads the items of a FROM like clause starting at i, up to the
+// keyword ending the clause or starting a join read on its own
+func (t *tableScanner) sources(i int) {
+	depth := t.at(i).Depth
+	for {
+		i = t.source(i)
+		cases := 0
+		for ; ; i++ {
+			token := t.at(i)
+			if token.Text == "" || token.Depth < depth {
+				return
+			}
+			if token.Depth > depth {
+				continue
+			}
+			if token.Text == "," && cases == 0 {
+				break
+			}
+			if token.Kind != Word {
+				continue
+			}
+			switch keyword := strings.ToUpper(token.Text); {
+			case keyword == "CASE":
+				cases++
+			case keyword == "END" && cases > 0:
+				cases--
+			case cases > 0, keyword == "FOR" && t.at(i+1).Is("SYSTEM_TIME"):
+			case sourceEnds[keyword]:
+				return
+			}
+		}
+		i++
+	}
+}
+
+// source reads the FROM like item at i, returning the index of the token
+// after it and its alias. In those clauses a name followed by a parenthesis is
+// a table function and a parenthesis not starting a query holds a join.
+func (t *tableScanner) source(i int) int {
+	start := i
+	i = t.skipModifiers(i)
+	if t.at(i).Is("LATERAL") {
+		i++
+	}
+	token := t.at(i)
+	switch {
+	case token.Text == "(":
+		if next := t.at(i + 1); next.Kind != Word || !subqueryStarts[strings.ToUpper(next.Text)] {
+			t.sources(i + 1)
+		}
+		return t.skipAlias(t.skipParentheses(i))
+	case token.Kind == Parameter:
+		// T-SQL table variables
+		return t.skipAlias(i + 1)
+	case token.Is("TABLE") && t.at(i+1).Text == "(":
+		return t.skipAlias(t.skipParentheses(i + 1))
+	}
+	name, next, ok := t.name(i)
+	if !ok {
+		if token.Text == "" || token.Text == ")" {
+			return i
+		}
+		t.unknown = append(t.unknown, token)
+		return i + 1
+	}
+	if t.at(next).Text == "(" {
+		i = t.skipParentheses(next)
+		if t.at(i).Is("WITH") && t.at(i+1).Is("ORDINALITY") {
+			i += 2
+		}
+		return t.skipAlias(i)
+	}
+	t.tables = append(t.tables, tableName{name: name, pos: t.at(start).Pos, from: i, to: next})
+	last := t.at(next - 1)
+	reference := TableReference{
+		Name:    name,
+		Start:   t.at(start).Pos,
+		End:     last.Pos + len(last.Text),
+		Aliased: t.aliased(next),
+	}
+	if !t.referenced(reference.Start) {
+		t.references = append(t.references, reference)
+	}
+	return t.skipAlias(next)
+}
+
+// referenced reports whether the table reference at pos was read already
+func (t *tableScanner) referenced(pos int) bool {
+	for _, reference := range t.references {
+		if reference.Start == pos {
+			return true
+		}
+	}
+	return false
+}
+
+// joinUsing reports whether the USING at i belongs to a join, rather than
+// naming the tables of a DELETE or a MERGE
+func (t *tableScanner) joinUsing(i int) bool {
+	depth := t.at(i).Depth
+	for j := i - 1; j >= 0; j-- {
+		token := t.at(j)
+		if token.Depth < depth {
+			return false
+		}
+		if token.Depth > depth || token.Kind != Word {
+			continue
+		}
+		switch strings.ToUpper(token.Text) {
+		case "JOIN", "STRAIGHT_JOIN":
+			return true
+		case "FROM", "INTO", "MERGE", "DELETE", "UPDATE", "ON":
+			return false
+		}
+	}
+	return false
+}
+
+// name reads a possibly qualified name at i, returning it unquoted with its
+// parts joined by dots and the index of the token after it
+func (t *tableScanner) name(i int) (string, int, bool) {
+	var parts []string
+	for {
+		token := t.at(i)
+		switch {
+		case token.Text == "":
+			return "", i, false
+		case token.Kind == QuotedIdentifier:
+		case token.Kind == Word && !aliasEnds[strings.ToUpper(token.Text)] && !token.Is("LATERAL") && !token.Is("TABLE"):
+		default:
+			return "", i, false
+		}
+		parts = append(parts, token.Value())
+		i++
+		if t.at(i).Text != "." {
+			return strings.Join(parts, "."), i, true
+		}
+		i++
+	}
+}
+
+// skipAlias moves past the alias of a table reference, with its column list,
+// and past T-SQL table hints
+func (t *tableScanner) skipAlias(i int) int {
+	if t.at(i).Is("AS") {
+		i++
+	}
+	if token := t.at(i); token.Kind == QuotedIdentifier || (token.Kind == Word && token.Text != "" && !aliasEnds[strings.ToUpper(token.Text)]) {
+		t.aliases = append(t.aliases, i)
+		i++
+	}
+	if t.at(i).Text == "(" {
+		i = t.skipParentheses(i)
+	}
+	if t.at(i).Is("WITH") && t.at(i+1).Text == "(" {
+		i = t.skipParentheses(i + 1)
+	}
+	return i
+}
+
+// aliased reports whether an alias stands at i, after a table name
+func (t *tableScanner) aliased(i int) bool {
+	token := t.at(i)
+	return token.Is("AS") || token.Kind == QuotedIdentifier ||
+		(token.Kind == Word && token.Text != "" && !aliasEnds[strings.ToUpper(token.Text)])
+}
+
+// skipParentheses returns the index of the token after the parenthesis
+// closing the one at i
+func (t *tableScanner) skipParentheses(i int) int {
+	depth := t.at(i).Depth
+	for i++; i < len(t.s.Tokens); i++ {
+		if token := t.at(i); token.Text == ")" && token.Depth == depth {
+			return i + 1
+		}
+	}
+	return i
+}
@@ -0,0 +1,121 @@
+package sqlparse
+
+import (
+	"butler-server/internals/dialect"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestTables(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect dialect.Dialect
+		query   string
+		tables  []string
+	}{
+		{"plain", dialect.Postgres, "SELECT * FROM users", []string{"users"}},
+		{"alias", dialect.Postgres, "SELECT u.id FROM users AS u", []string{"users"}},
+		{"bare alias", dialect.Postgres, "SELECT u.id FROM users u WHERE u.id = 1", []string{"users"}},
+		{"schema", dialect.Postgres, "SELECT * FROM public.users", []string{"public.users"}},
+		{"only", dialect.Postgres, "SELECT * FROM ONLY users", []string{"users"}},
+		{"quoted", dialect.Postgres, `SELECT * FROM "Users" JOIN "public"."orders" o ON o.uid = "Users".id`, []string{"Users", "public.orders"}},
+		{"backticks", dialect.MySQL, "SELECT * FROM `users` JOIN `shop`.`orders` ON 1 = 1", []string{"users", "shop.orders"}},
+		{"brackets", dialect.MSSQL, "SELECT * FROM [dbo].[users] WITH (NOLOCK)", []string{"dbo.users"}},
+		{"parenthesised join", dialect.Postgres, "SELECT * FROM (users JOIN orders ON users.id = orders.uid)", []string{"users", "orders"}},
+		{"parenthesised table", dialect.MySQL, "SELECT * FROM (users)", []string{"users"}},
+		{"nested joins", dialect.Postgres, "SELECT * FROM ((users u JOIN orders o ON u.id = o.uid) JOIN items i ON i.oid = o.id)", []string{"users", "orders", "items"}},
+		{"only parenthesised", dialect.Postgres, "SELECT * FROM ONLY (users)", []string{"users"}},
+		{"comma after subquery", dialect.Postgres, "SELECT * FROM (SELECT 1) AS one, users", []string{"users"}},
+		{"comma after function", dialect.Postgres, "SELECT * FROM generate_series(1, 3) g, users", []string{"users"}},
+		{"comma after ordinality", dialect.Postgres, "SELECT * FROM unnest(ARRAY[1]) WITH ORDINALITY AS n, users", []string{"users"}},
+		{"comma after join", dialect.Postgres, "SELECT * FROM orders JOIN items ON items.oid = orders.id, users", []string{"orders", "items", "users"}},
+		{"comma after case", dialect.Postgres, "SELECT * FROM orders JOIN items ON CASE WHEN items.oid > 0 THEN true END, users", []string{"orders", "items", "users"}},
+		{"comma after sample", dialect.Postgres, "SELECT * FROM orders TABLESAMPLE SYSTEM (10), users", []string{"orders", "users"}},
+		{"comma after partition", dialect.MySQL, "SELECT * FROM orders PARTITION (p0), users", []string{"orders", "users"}},
+		{"lateral", dialect.Postgres, "SELECT * FROM orders o, LATERAL (SELECT * FROM users WHERE users.id = o.uid) u", []string{"orders", "users"}},
+		{"lateral function", dialect.Postgres, "SELECT * FROM orders o CROSS JOIN LATERAL jsonb_each(o.data) e, users", []string{"orders", "users"}},
+		{"straight join", dialect.MySQL, "SELECT * FROM orders STRAIGHT_JOIN users ON users.id = orders.uid", []string{"orders", "users"}},
+		{"join using", dialect.Postgres, "SELECT * FROM orders JOIN users USING (id)", []string{"orders", "users"}},
+		{"delete using", dialect.Postgres, "DELETE FROM orders USING users WHERE users.id = orders.uid", []string{"orders", "users"}},
+		{"cte", dialect.Postgres, "WITH recent AS (SELECT * FROM orders) SELECT * FROM recent JOIN users ON users.id = recent.uid", []string{"users", "orders"}},
+		{"values", dialect.Postgres, "SELECT * FROM (VALUES (1), (2)) AS v (n)", nil},
+		{"insert values", dialect.MSSQL, "INSERT users (id) VALUES (1), (2)", []string{"users"}},
+		{"update", dialect.MySQL, "UPDATE users, orders SET users.total = orders.total WHERE users.id = orders.uid", []string{"users", "orders"}},
+		{"apply", dialect.MSSQL, "SELECT * FROM orders CROSS APPLY (SELECT TOP 1 * FROM users) u", []string{"orders", "users"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tables, err := Tables(test.dialect, test.query)
+			if err != nil {
+				t.Fatalf("Tables(%q) failed: %v", test.query, err)
+			}
+			if len(tables) == 0 && len(test.tables) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(tables, test.tables) {
+				t.Errorf("Tables(%q) = %q, want %q", test.query, tables, test.tables)
+			}
+		})
+	}
+}
+
+func TestTableReferences(t *testing.T) {
+	tests := []struct {
+		name       string
+		dialect    dialect.Dialect
+		query      string
+		references []string
+		aliased    []bool
+	}{
+		{"alias", dialect.Postgres, "SELECT * FROM users u", []string{"users"}, []bool{true}},
+		{"no alias", dialect.Postgres, "SELECT * FROM users WHERE id = 1", []string{"users"}, []bool{false}},
+		{"only", dialect.Postgres, "SELECT * FROM ONLY users", []string{"ONLY users"}, []bool{false}},
+		{"quoted", dialect.Postgres, `SELECT * FROM "public"."Users"`, []string{`"public"."Users"`}, []bool{false}},
+		{"parenthesised join", dialect.Postgres, "SELECT * FROM (users JOIN orders ON users.id = orders.uid)", []string{"users", "orders"}, []bool{false, false}},
+		{"in order", dialect.Postgres, "SELECT * FROM (users JOIN orders o ON users.id = o.uid), items", []string{"users", "orders", "items"}, []bool{false, true, false}},
+		{"cte", dialect.Postgres, "WITH recent AS (SELECT * FROM orders) SELECT * FROM recent", []string{"orders"}, []bool{false}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			statements, err := Split(test.dialect, test.query)
+			if err != nil {
+				t.Fatalf("Split(%q) failed: %v", test.query, err)
+			}
+			references, err := statements[0].TableReferences()
+			if err != nil {
+				t.Fatalf("TableReferences(%q) failed: %v", test.query, err)
+			}
+			var texts []string
+			var aliased []bool
+			for _, reference := range references {
+				texts = append(texts, test.query[reference.Start:reference.End])
+				aliased = append(aliased, reference.Aliased)
+			}
+			if !reflect.DeepEqual(texts, test.references) || !reflect.DeepEqual(aliased, test.aliased) {
+				t.Errorf("TableReferences(%q) = %q %v, want %q %v", test.query, texts, aliased, test.references, test.aliased)
+			}
+		})
+	}
+}
+
+func TestTableReferencesUnknownSource(t *testing.T) {
+	tests := []struct {
+		dialect dialect.Dialect
+		query   string
+	}{
+		{dialect.MySQL, `SELECT * FROM "users"`},
+		{dialect.Postgres, "SELECT * FROM 1"},
+	}
+	for _, test := range tests {
+		statements, err := Split(test.dialect, test.query)
+		if err != nil {
+			t.Fatalf("Split(%q) failed: %v", test.query, err)
+		}
+		_, err = statements[0].TableReferences()
+		var unknown *UnknownSourceError
+		if !errors.As(err, &unknown) {
+			t.Errorf("TableReferences(%q) = %v, want an UnknownSourceError", test.query, err)
+		}
+	}
+}
@@ -2,10 +2,12 @@ package utils
 
 import (
 	"butler-server/client"
+	"butler-server/internals/core"
+	"butler-server/internals/encryption"
 	"encoding/json"
-	"strings"
-
-	"github.com/xwb1989/sqlparser"
+	"fmt"
+	"strconv"
+	"time"
 )
 
 func GetClusterData(redisClient *client.RedisClient, clusterId string) (client.ClusterData, error) {
@@ -17,40 +19,59 @@ func GetClusterData(redisClient *client.RedisClient, clusterId string) (client.C
 	if err := json.Unmarshal([]byte(clusterData), &data); err != nil {
 		return client.ClusterData{}, err
 	}
-	return data, nil
+	return data.Open(encryption.Default())
 }
 
-func ProcessQueries(queires []string) (map[string][]string, error) {
-	groupedQueries := make(map[string][]string, 0)
-
-	for _, v := range queires {
-		str := strings.ReplaceAll(v, "\"", "")
-		statement, err := sqlparser.Parse(str)
-		if err != nil {
-			return nil, err
-		}
-		tableName := extractTableName(statement)
-		groupedQueries[tableName] = append(groupedQueries[tableName], v)
+// SetClusterData caches the cluster data read from the Next app, with the
+// password sealed
+func SetClusterData(redisClient *client.RedisClient, data client.ClusterData, ttl time.Duration) error {
+	sealed, err := data.Seal(encryption.Default())
+	if err != nil {
+		return err
 	}
-	return groupedQueries, nil
+	byteData, err := json.Marshal(sealed)
+	if err != nil {
+		return err
+	}
+	return redisClient.SetString(redisClient.GenerateClusterKey(strconv.Itoa(data.Cluster.ID)), string(byteData), ttl)
 }
 
-func extractTableName(stmt sqlparser.Statement) string {
-	var tableName string
+// ProcessedQuery is a query of a commit with the tables it touches. Table is
+// the one it changes, or reads first, which the query is grouped under.
+type ProcessedQuery struct {
+	Query  string
+	Table  string
+	Tables []string
+}
 
-	switch s := stmt.(type) {
-	case *sqlparser.Select:
-		if s.From != nil {
-			tableExprs := s.From
-			tableName = sqlparser.String(tableExprs)
+// QueryError is a query of a commit that cannot be parsed, Index is its
+// position in the commit
+type QueryError struct {
+	Index int
+	Err   error
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("query %d: %v", e.Index+1, e.Err)
+}
+
+func (e *QueryError) Unwrap() error {
+	return e.Err
+}
+
+// ProcessQueries parses the queries of a commit the way the driver of its
+// cluster reads them, keeping their order
+func ProcessQueries(driver string, queries []string) ([]ProcessedQuery, error) {
+	processed := make([]ProcessedQuery, len(queries))
+	for i, query := range queries {
+		tables, err := core.Tables(driver, query)
+		if err != nil {
+			return nil, &QueryError{Index: i, Err: err}
+		}
+		processed[i] = ProcessedQuery{Query: query, Tables: tables}
+		if len(tables) > 0 {
+			processed[i].Table = tables[0]
 		}
-	case *sqlparser.Insert:
-		tableName = sqlparser.String(s.Table)
-	case *sqlparser.Update:
-		tableName = sqlparser.String(s.TableExprs)
-	case *sqlparser.Delete:
-		tableName = sqlparser.String(s.TableExprs)
 	}
-
-	return tableName
+	return processed, nil
 }
@@ -2,7 +2,10 @@ package repository
 
 import (
 	"butler-server/client"
-	"fmt"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
 )
 
 type Account struct {
@@ -19,13 +22,40 @@ type Account struct {
 	SessionState      string `gorm:"column:session_state"`
 }
 
-func CheckAccount(dbClient *client.Database, token string) bool {
+// User is the signed in user accounts belong to, both tables are managed by
+// the Next app
+type User struct {
+	ID    string `gorm:"column:id" json:"id"`
+	Name  string `gorm:"column:name" json:"name"`
+	Email string `gorm:"column:email" json:"email"`
+}
+
+var (
+	ErrUnknownToken = errors.New("unknown access token")
+	ErrTokenExpired = errors.New("access token expired")
+)
+
+// CheckAccount returns the user the access token was issued to, refusing
+// unknown and expired tokens. ExpiresAt is in seconds, accounts without one
+// do not expire.
+func CheckAccount(dbClient *client.Database, token string) (User, error) {
+	if token == "" {
+		return User{}, ErrUnknownToken
+	}
 	var account Account
 	err := dbClient.Db.Where("access_token = ?", token).First(&account).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return User{}, ErrUnknownToken
+	}
 	if err != nil {
-		// Handle error
-		fmt.Println(err.Error())
-		return false
+		return User{}, err
+	}
+	if account.ExpiresAt != 0 && int64(account.ExpiresAt) <= time.Now().Unix() {
+		return User{}, ErrTokenExpired
+	}
+	var user User
+	if err := dbClient.Db.Where("id = ?", account.UserID).First(&user).Error; err != nil {
+		return User{}, err
 	}
-	return true
+	return user, nil
 }
@@ -0,0 +1,51 @@
+package repository
+
+import (
+	"butler-server/client"
+	"butler-server/internals/encryption"
+	"fmt"
+)
+
+// ClusterCredentials are the credentials of a cluster, managed by the Next app
+type ClusterCredentials struct {
+	ID       int    `gorm:"column:id"`
+	Password string `gorm:"column:password"`
+}
+
+func (ClusterCredentials) TableName() string {
+	return "clusters"
+}
+
+// ReencryptClusterPasswords seals the passwords of every cluster with the
+// current key, rewrapping the ones sealed with older keys and sealing the ones
+// still in plaintext, and returns how many it rewrote. A password changed
+// meanwhile is left to the change. The table is owned by the Next app, which
+// reads the passwords too, so this only runs on explicit request once it
+// opens the enc:v<version>: format of package encryption.
+func ReencryptClusterPasswords(dbClient *client.Database, keyring *encryption.Keyring) (int, error) {
+	var clusters []ClusterCredentials
+	if err := dbClient.Db.Find(&clusters).Error; err != nil {
+		return 0, err
+	}
+	rewritten := 0
+	for _, cluster := range clusters {
+		if cluster.Password == "" {
+			continue
+		}
+		password, changed, err := keyring.Rewrap(cluster.Password, client.PasswordContext(cluster.ID))
+		if err != nil {
+			return rewritten, fmt.Errorf("failed to re-encrypt the password of cluster %d: %w", cluster.ID, err)
+		}
+		if !changed {
+			continue
+		}
+		result := dbClient.Db.Model(&ClusterCredentials{}).
+			Where("id = ? AND password = ?", cluster.ID, cluster.Password).
+			Update("password", password)
+		if result.Error != nil {
+			return rewritten, result.Error
+		}
+		rewritten += int(result.RowsAffected)
+	}
+	return rewritten, nil
+}
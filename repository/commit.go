@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type CommitRepository struct {
@@ -16,15 +17,34 @@ func NewCommitRepository(repo Repository) CommitRepository {
 }
 
 type Commit struct {
-	ID         int       `gorm:"column:id" json:"id"`
-	Title      string    `gorm:"column:title" json:"title"`
-	CreatedAT  time.Time `gorm:"column:createdAt" json:"createdAt"`
-	ExecutedAt time.Time `gorm:"column:executedAt" json:"executedAt"`
-	ClusterId  string    `gorm:"column:clusterId" json:"clusterId"`
-	IsExecuted bool      `gorm:"column:isExecuted" json:"isExecuted"`
-	DatabaseId string    `gorm:"column:databaseId" json:"databaseId"`
+	ID          int        `gorm:"column:id" json:"id"`
+	Title       string     `gorm:"column:title" json:"title"`
+	CreatedAT   time.Time  `gorm:"column:createdAt" json:"createdAt"`
+	ExecutedAt  time.Time  `gorm:"column:executedAt" json:"executedAt"`
+	ClusterId   string     `gorm:"column:clusterId" json:"clusterId"`
+	IsExecuted  bool       `gorm:"column:isExecuted" json:"isExecuted"`
+	DatabaseId  string     `gorm:"column:databaseId" json:"databaseId"`
+	Status      string     `gorm:"column:status;default:draft" json:"status"`
+	SubmittedAt *time.Time `gorm:"column:submittedAt" json:"submittedAt"`
+	// AuthorId is the user who saved the commit and SubmittedBy the one who
+	// last submitted it, neither of them may approve it
+	AuthorId    string `gorm:"column:authorId" json:"authorId"`
+	SubmittedBy string `gorm:"column:submittedBy" json:"submittedBy"`
 }
 
+// Commits go from draft to review, where enough approvals make them approved
+// and a single rejection rejects them. Only approved commits are executed,
+// and only executed ones reverted, both being executing while they run.
+const (
+	CommitDraft         = "draft"
+	CommitPendingReview = "pending_review"
+	CommitApproved      = "approved"
+	CommitRejected      = "rejected"
+	CommitExecuting     = "executing"
+	CommitExecuted      = "executed"
+	CommitReverted      = "reverted"
+)
+
 func (Commit) TableName() string {
 	return "commits"
 }
@@ -36,7 +56,7 @@ func (c CommitRepository) SaveCommit(commit Commit) (Commit, error) {
 	return commit, nil
 }
 
-func (c CommitRepository) GetCommits(databaseId, clusterId, commitType, page, size string) ([]Commit, int64, error) {
+func (c CommitRepository) GetCommits(databaseId, clusterId, commitType, status, page, size string) ([]Commit, int64, error) {
 	commits := make([]Commit, 0)
 	if page == "" {
 		page = "0"
@@ -53,6 +73,9 @@ func (c CommitRepository) GetCommits(databaseId, clusterId, commitType, page, si
 	if clusterId != "" {
 		query = query.Where(`"clusterId" = ?`, clusterId)
 	}
+	if status != "" {
+		query = query.Where(`"status" = ?`, status)
+	}
 	if commitType == "executed" {
 		query = query.Order(`"executedAt" DESC`).Where(`"isExecuted" = true`)
 	} else {
@@ -84,6 +107,50 @@ func (c CommitRepository) SaveCommitWithTx(tx *gorm.DB, commit Commit) (Commit,
 	return commit, nil
 }
 
-func (c CommitRepository) UpdateCommits(commits []Commit, isExecuted bool) {
-	c.DB.Model(&commits).Update("isExecuted", isExecuted).Update("executedAt", time.Now())
+func (c CommitRepository) GetCommit(id int) (Commit, error) {
+	var commit Commit
+	if err := c.DB.Where(`"id" = ?`, id).First(&commit).Error; err != nil {
+		return commit, err
+	}
+	return commit, nil
+}
+
+// LockCommit fetches a commit and locks it until the end of the transaction
+// of the repository
+func (c CommitRepository) LockCommit(id int) (Commit, error) {
+	var commit Commit
+	if err := c.DB.Clauses(clause.Locking{Strength: "UPDATE"}).Where(`"id" = ?`, id).First(&commit).Error; err != nil {
+		return commit, err
+	}
+	return commit, nil
+}
+
+func (c CommitRepository) UpdateCommits(commits []Commit, isExecuted bool) error {
+	status := CommitReverted
+	if isExecuted {
+		status = CommitExecuted
+	}
+	return c.DB.Model(&commits).Updates(map[string]interface{}{"isExecuted": isExecuted, "executedAt": time.Now(), "status": status}).Error
+}
+
+// SetStatus moves a commit to status when it is in one of the from states,
+// and reports whether it did. Checking the state in the update itself keeps
+// concurrent reviews from moving a commit twice.
+func (c CommitRepository) SetStatus(id int, status string, from ...string) (bool, error) {
+	return c.setStatus(id, map[string]interface{}{"status": status}, from)
+}
+
+// Submit moves a commit to review when it is in one of the from states,
+// recording who submitted it and when
+func (c CommitRepository) Submit(id int, submittedBy string, from ...string) (bool, error) {
+	updates := map[string]interface{}{"status": CommitPendingReview, "submittedAt": time.Now(), "submittedBy": submittedBy}
+	return c.setStatus(id, updates, from)
+}
+
+func (c CommitRepository) setStatus(id int, updates map[string]interface{}, from []string) (bool, error) {
+	result := c.DB.Model(&Commit{}).Where(`"id" = ? AND "status" IN ?`, id, from).Updates(updates)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
 }
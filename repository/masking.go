@@ -0,0 +1,66 @@
+package repository
+
+import (
+	"butler-server/internals/masking"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// MaskingRule masks a column in the results read from a cluster, see
+// masking.Rule
+type MaskingRule struct {
+	ID          int            `gorm:"column:id" json:"id"`
+	ClusterId   string         `gorm:"column:clusterId;index" json:"clusterId"`
+	Database    string         `gorm:"column:database" json:"database"`
+	Table       string         `gorm:"column:table" json:"table"`
+	Column      string         `gorm:"column:column" json:"column"`
+	Strategy    string         `gorm:"column:strategy" json:"strategy"`
+	Reveal      int            `gorm:"column:reveal" json:"reveal,omitempty"`
+	ExemptRoles pq.StringArray `gorm:"column:exemptRoles;type:text[]" json:"exemptRoles"`
+	UpdatedAt   time.Time      `gorm:"column:updatedAt" json:"updatedAt"`
+}
+
+func (MaskingRule) TableName() string {
+	return "maskingrules"
+}
+
+func (r MaskingRule) Rule() masking.Rule {
+	return masking.Rule{Database: r.Database, Table: r.Table, Column: r.Column, Strategy: r.Strategy, Reveal: r.Reveal, Exempt: r.ExemptRoles}
+}
+
+type MaskingRepository struct {
+	Repository
+}
+
+func NewMaskingRepository(repo Repository) MaskingRepository {
+	return MaskingRepository{repo}
+}
+
+func (m MaskingRepository) GetMaskingRules(clusterId string) ([]MaskingRule, error) {
+	rules := make([]MaskingRule, 0)
+	if err := m.Where(`"clusterId" = ?`, clusterId).Order(`"id"`).Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (m MaskingRepository) GetMaskingRule(id int) (MaskingRule, error) {
+	var rule MaskingRule
+	err := m.First(&rule, id).Error
+	return rule, err
+}
+
+// SaveMaskingRule creates the rule, or replaces the one of the same id
+func (m MaskingRepository) SaveMaskingRule(rule MaskingRule) (MaskingRule, error) {
+	rule.UpdatedAt = time.Now()
+	if rule.ExemptRoles == nil {
+		rule.ExemptRoles = pq.StringArray{}
+	}
+	err := m.Save(&rule).Error
+	return rule, err
+}
+
+func (m MaskingRepository) DeleteMaskingRule(id int) error {
+	return m.Delete(&MaskingRule{}, id).Error
+}
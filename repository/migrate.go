@@ -0,0 +1,37 @@
+package repository
+
+import "gorm.io/gorm"
+
+// Migrate creates or updates the tables owned by this server. Commits,
+// queries and the other shared tables are managed by the Next app, only the
+// review columns of commits and the tables of queries are added here.
+func Migrate(db *gorm.DB) error {
+	if err := db.AutoMigrate(&Run{}, &RunStatement{}, &Review{}, &ReviewPolicy{}, &RoleAssignment{}, &MaskingRule{}, &RowPolicy{}); err != nil {
+		return err
+	}
+	if !db.Migrator().HasColumn(&Commit{}, "Status") {
+		if err := db.Migrator().AddColumn(&Commit{}, "Status"); err != nil {
+			return err
+		}
+		// commits applied before reviews existed keep their outcome
+		if err := db.Model(&Commit{}).Where(`"isExecuted" = true`).Update("status", CommitExecuted).Error; err != nil {
+			return err
+		}
+	}
+	if !db.Migrator().HasColumn(&Commit{}, "SubmittedAt") {
+		if err := db.Migrator().AddColumn(&Commit{}, "SubmittedAt"); err != nil {
+			return err
+		}
+	}
+	for _, column := range []string{"AuthorId", "SubmittedBy"} {
+		if !db.Migrator().HasColumn(&Commit{}, column) {
+			if err := db.Migrator().AddColumn(&Commit{}, column); err != nil {
+				return err
+			}
+		}
+	}
+	if !db.Migrator().HasColumn(&Query{}, "Tables") {
+		return db.Migrator().AddColumn(&Query{}, "Tables")
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package repository
+
+import (
+	"butler-server/internals/filters"
+	"time"
+)
+
+// RowPolicy restricts the rows of a table of a cluster the users with Role
+// may read to those matching Filter, written like the filter of
+// /cluster/data. A policy without Database applies to the table in every
+// database of the cluster.
+type RowPolicy struct {
+	ID        int       `gorm:"column:id" json:"id"`
+	ClusterId string    `gorm:"column:clusterId;index" json:"clusterId"`
+	Database  string    `gorm:"column:database" json:"database"`
+	Table     string    `gorm:"column:table" json:"table"`
+	Role      string    `gorm:"column:role" json:"role"`
+	Filter    string    `gorm:"column:filter;type:text" json:"filter"`
+	UpdatedAt time.Time `gorm:"column:updatedAt" json:"updatedAt"`
+}
+
+func (RowPolicy) TableName() string {
+	return "rowpolicies"
+}
+
+// Node parses the filter of the policy, legacy conditions are joined with and
+func (p RowPolicy) Node() (*filters.Node, error) {
+	return filters.Parse(p.Filter, "and")
+}
+
+type PolicyRepository struct {
+	Repository
+}
+
+func NewPolicyRepository(repo Repository) PolicyRepository {
+	return PolicyRepository{repo}
+}
+
+func (m PolicyRepository) GetRowPolicies(clusterId string) ([]RowPolicy, error) {
+	policies := make([]RowPolicy, 0)
+	if err := m.Where(`"clusterId" = ?`, clusterId).Order(`"id"`).Find(&policies).Error; err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+// GetRolePolicies returns the policies the users with role are under in a
+// database of the cluster
+func (m PolicyRepository) GetRolePolicies(clusterId, database, role string) ([]RowPolicy, error) {
+	policies := make([]RowPolicy, 0)
+	err := m.Where(`"clusterId" = ? AND "role" = ? AND ("database" = ? OR "database" = '')`, clusterId, role, database).
+		Order(`"id"`).Find(&policies).Error
+	if err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+func (m PolicyRepository) GetRowPolicy(id int) (RowPolicy, error) {
+	var policy RowPolicy
+	err := m.First(&policy, id).Error
+	return policy, err
+}
+
+// SaveRowPolicy creates the policy, or replaces the one of the same id
+func (m PolicyRepository) SaveRowPolicy(policy RowPolicy) (RowPolicy, error) {
+	policy.UpdatedAt = time.Now()
+	err := m.Save(&policy).Error
+	return policy, err
+}
+
+func (m PolicyRepository) DeleteRowPolicy(id int) error {
+	return m.Delete(&RowPolicy{}, id).Error
+}
@@ -4,17 +4,20 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/lib/pq"
 	"gorm.io/gorm"
 )
 
 type Query struct {
-	ID         int       `gorm:"column:id" json:"id"`
-	Query      string    `gorm:"column:query" json:"query"`
-	CommitId   int       `gorm:"column:commitId" json:"commitId"`
-	Type       string    `gorm:"column:type" json:"type"`
-	CreatedAT  time.Time `gorm:"column:createdAt" json:"createdAt"`
-	ExecutedAt time.Time `gorm:"column:executedAt;nullable" json:"executedAt"`
-	TableId    string    `gorm:"column:tableId" json:"tableId"`
+	ID         int        `gorm:"column:id" json:"id"`
+	Query      string     `gorm:"column:query" json:"query"`
+	CommitId   int        `gorm:"column:commitId" json:"commitId"`
+	Type       string     `gorm:"column:type" json:"type"`
+	CreatedAT  time.Time  `gorm:"column:createdAt" json:"createdAt"`
+	ExecutedAt *time.Time `gorm:"column:executedAt;nullable" json:"executedAt"`
+	TableId    string     `gorm:"column:tableId" json:"tableId"`
+	// Tables are all the tables the query touches, TableId first
+	Tables pq.StringArray `gorm:"column:tables;type:text[]" json:"tables"`
 }
 
 func (Query) TableName() string {
@@ -42,23 +45,30 @@ func (q QueryRepository) SaveQueries(queries []string, tableId string, commitId
 	return queryEntities, nil
 }
 
-func (q QueryRepository) SaveQueriesWithTx(tx *gorm.DB, queries []string, tableId string, commitId int, queryType string) ([]Query, error) {
-	var queryEntities []Query
-	for _, v := range queries {
-		queryEntities = append(queryEntities, Query{Query: v, TableId: tableId, CreatedAT: time.Now(), CommitId: commitId, Type: queryType})
+func (q QueryRepository) SaveQueriesWithTx(tx *gorm.DB, queries []Query) ([]Query, error) {
+	for i := range queries {
+		queries[i].CreatedAT = time.Now()
 	}
-	if err := tx.Create(&queryEntities).Error; err != nil {
+	if err := tx.Create(&queries).Error; err != nil {
 		return nil, err
 	}
-	return queryEntities, nil
+	return queries, nil
 }
 
 func (q QueryRepository) GetQueriesWithCommitIds(commitIds []int) ([]Query, error) {
 
 	var queries []Query
 
-	if err := q.Where(`"commitId" IN (?)`, commitIds).Find(&queries).Error; err != nil {
+	if err := q.Where(`"commitId" IN (?)`, commitIds).Order(`"id"`).Find(&queries).Error; err != nil {
 		return queries, err
 	}
 	return queries, nil
 }
+
+// MarkExecuted sets the time the queries were applied at
+func (q QueryRepository) MarkExecuted(ids []int, at time.Time) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return q.Model(&Query{}).Where(`"id" IN ?`, ids).Update("executedAt", at).Error
+}
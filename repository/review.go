@@ -0,0 +1,98 @@
+package repository
+
+import (
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// Review is the decision or comment of a reviewer on a commit
+type Review struct {
+	ID        int       `gorm:"column:id" json:"id"`
+	CommitId  int       `gorm:"column:commitId" json:"commitId"`
+	Reviewer  string    `gorm:"column:reviewer" json:"reviewer"`
+	Decision  string    `gorm:"column:decision" json:"decision"`
+	Comment   string    `gorm:"column:comment" json:"comment,omitempty"`
+	CreatedAt time.Time `gorm:"column:createdAt" json:"createdAt"`
+}
+
+func (Review) TableName() string {
+	return "reviews"
+}
+
+const (
+	ReviewApprove = "approve"
+	ReviewReject  = "reject"
+	ReviewComment = "comment"
+)
+
+// ReviewPolicy is the number of approvals the commits of a cluster need
+// before they can be executed
+type ReviewPolicy struct {
+	ClusterId         string    `gorm:"column:clusterId;primaryKey" json:"clusterId"`
+	RequiredApprovals int       `gorm:"column:requiredApprovals" json:"requiredApprovals"`
+	UpdatedAt         time.Time `gorm:"column:updatedAt" json:"updatedAt"`
+}
+
+func (ReviewPolicy) TableName() string {
+	return "reviewpolicies"
+}
+
+type ReviewRepository struct {
+	Repository
+}
+
+func NewReviewRepository(repo Repository) ReviewRepository {
+	return ReviewRepository{repo}
+}
+
+func (r ReviewRepository) SaveReview(review Review) (Review, error) {
+	if err := r.Create(&review).Error; err != nil {
+		return review, err
+	}
+	return review, nil
+}
+
+func (r ReviewRepository) GetReviews(commitId int) ([]Review, error) {
+	reviews := make([]Review, 0)
+	if err := r.Where(`"commitId" = ?`, commitId).Order(`"createdAt"`).Find(&reviews).Error; err != nil {
+		return nil, err
+	}
+	return reviews, nil
+}
+
+// CountApprovals counts the reviewers who approved a commit since it was
+// last submitted, approvals of earlier submissions and of the authors of the
+// commit do not count
+func (r ReviewRepository) CountApprovals(commitId int, since time.Time, authors ...string) (int64, error) {
+	var count int64
+	query := r.Model(&Review{}).
+		Where(`"commitId" = ? AND "decision" = ? AND "createdAt" >= ?`, commitId, ReviewApprove, since)
+	if len(authors) > 0 {
+		query = query.Where(`"reviewer" NOT IN ?`, authors)
+	}
+	err := query.Distinct(`"reviewer"`).Count(&count).Error
+	return count, err
+}
+
+// GetPolicy returns the review policy of a cluster, requiring fallback
+// approvals for clusters without one
+func (r ReviewRepository) GetPolicy(clusterId string, fallback int) (ReviewPolicy, error) {
+	policies := make([]ReviewPolicy, 0, 1)
+	if err := r.Where(`"clusterId" = ?`, clusterId).Limit(1).Find(&policies).Error; err != nil {
+		return ReviewPolicy{}, err
+	}
+	if len(policies) == 0 {
+		return ReviewPolicy{ClusterId: clusterId, RequiredApprovals: fallback}, nil
+	}
+	return policies[0], nil
+}
+
+func (r ReviewRepository) SavePolicy(policy ReviewPolicy) (ReviewPolicy, error) {
+	policy.UpdatedAt = time.Now()
+	err := r.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "clusterId"}},
+		DoUpdates: clause.AssignmentColumns([]string{"requiredApprovals", "updatedAt"}),
+	}).Create(&policy).Error
+	return policy, err
+}
@@ -0,0 +1,101 @@
+package repository
+
+import (
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// Roles in increasing order of rights, each role may do what the ones before
+// it may
+const (
+	RoleViewer   = "viewer"
+	RoleAnalyst  = "analyst"
+	RoleEditor   = "editor"
+	RoleApprover = "approver"
+	RoleAdmin    = "admin"
+)
+
+var roles = []string{RoleViewer, RoleAnalyst, RoleEditor, RoleApprover, RoleAdmin}
+
+// RoleRank orders roles by their rights, -1 for unknown roles
+func RoleRank(role string) int {
+	for i, r := range roles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// RoleAssignment gives a user a role in a workspace, or on a single cluster
+// of it when ClusterId is set, overriding the one of the workspace there
+type RoleAssignment struct {
+	ID          int       `gorm:"column:id" json:"id"`
+	WorkspaceId int       `gorm:"column:workspaceId;uniqueIndex:idx_role_assignment" json:"workspaceId"`
+	ClusterId   string    `gorm:"column:clusterId;not null;default:'';uniqueIndex:idx_role_assignment" json:"clusterId"`
+	UserId      string    `gorm:"column:userId;uniqueIndex:idx_role_assignment" json:"userId"`
+	Role        string    `gorm:"column:role" json:"role"`
+	UpdatedAt   time.Time `gorm:"column:updatedAt" json:"updatedAt"`
+}
+
+func (RoleAssignment) TableName() string {
+	return "roleassignments"
+}
+
+type RoleRepository struct {
+	Repository
+}
+
+func NewRoleRepository(repo Repository) RoleRepository {
+	return RoleRepository{repo}
+}
+
+// GetRole returns the role of a user on a cluster of a workspace, the one of
+// the workspace when the cluster has no override and fallback when the user
+// has neither. An empty clusterId asks for the role in the workspace.
+func (r RoleRepository) GetRole(workspaceId int, clusterId, userId, fallback string) (string, error) {
+	assignments := make([]RoleAssignment, 0, 2)
+	err := r.Where(`"workspaceId" = ? AND "userId" = ? AND "clusterId" IN ?`, workspaceId, userId, []string{"", clusterId}).
+		Find(&assignments).Error
+	if err != nil {
+		return "", err
+	}
+	role := fallback
+	for _, assignment := range assignments {
+		if assignment.ClusterId == clusterId {
+			return assignment.Role, nil
+		}
+		role = assignment.Role
+	}
+	return role, nil
+}
+
+func (r RoleRepository) GetRoles(workspaceId int) ([]RoleAssignment, error) {
+	assignments := make([]RoleAssignment, 0)
+	if err := r.Where(`"workspaceId" = ?`, workspaceId).Order(`"userId", "clusterId"`).Find(&assignments).Error; err != nil {
+		return nil, err
+	}
+	return assignments, nil
+}
+
+func (r RoleRepository) GetRoleAssignment(id int) (RoleAssignment, error) {
+	var assignment RoleAssignment
+	err := r.First(&assignment, id).Error
+	return assignment, err
+}
+
+// SaveRole assigns the role, replacing the one the user had in the same
+// place
+func (r RoleRepository) SaveRole(assignment RoleAssignment) (RoleAssignment, error) {
+	assignment.UpdatedAt = time.Now()
+	err := r.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "workspaceId"}, {Name: "clusterId"}, {Name: "userId"}},
+		DoUpdates: clause.AssignmentColumns([]string{"role", "updatedAt"}),
+	}).Create(&assignment).Error
+	return assignment, err
+}
+
+func (r RoleRepository) DeleteRole(id int) error {
+	return r.Delete(&RoleAssignment{}, id).Error
+}
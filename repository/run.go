@@ -0,0 +1,87 @@
+package repository
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Run is one execution of commits against a database, kept with the outcome
+// of each of its statements
+type Run struct {
+	ID         int            `gorm:"column:id" json:"id"`
+	ClusterId  string         `gorm:"column:clusterId" json:"clusterId"`
+	Database   string         `gorm:"column:database" json:"database"`
+	Type       string         `gorm:"column:type" json:"type"`
+	Status     string         `gorm:"column:status" json:"status"`
+	Error      string         `gorm:"column:error" json:"error,omitempty"`
+	StartedAt  time.Time      `gorm:"column:startedAt" json:"startedAt"`
+	FinishedAt time.Time      `gorm:"column:finishedAt" json:"finishedAt"`
+	Statements []RunStatement `gorm:"foreignKey:RunId" json:"statements"`
+}
+
+func (Run) TableName() string {
+	return "runs"
+}
+
+const (
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"
+)
+
+// RunStatement is a query of a commit as it went in a run: succeeded,
+// failed, skipped after a failure or rolled back along with the others
+type RunStatement struct {
+	ID           int     `gorm:"column:id" json:"id"`
+	RunId        int     `gorm:"column:runId" json:"runId"`
+	CommitId     int     `gorm:"column:commitId" json:"commitId"`
+	QueryId      int     `gorm:"column:queryId" json:"queryId"`
+	Position     int     `gorm:"column:position" json:"position"`
+	Statement    string  `gorm:"column:statement" json:"statement"`
+	Status       string  `gorm:"column:status" json:"status"`
+	RowsAffected *int64  `gorm:"column:rowsAffected" json:"rowsAffected,omitempty"`
+	DurationMs   float64 `gorm:"column:durationMs" json:"durationMs"`
+	Error        string  `gorm:"column:error" json:"error,omitempty"`
+}
+
+func (RunStatement) TableName() string {
+	return "runstatements"
+}
+
+const (
+	StatementSucceeded  = "succeeded"
+	StatementFailed     = "failed"
+	StatementSkipped    = "skipped"
+	StatementRolledBack = "rolled_back"
+)
+
+type RunRepository struct {
+	Repository
+}
+
+func NewRunRepository(repo Repository) RunRepository {
+	return RunRepository{repo}
+}
+
+// SaveRun saves a run along with its statements
+func (r RunRepository) SaveRun(run Run) (Run, error) {
+	if err := r.Create(&run).Error; err != nil {
+		return run, err
+	}
+	return run, nil
+}
+
+// GetRunsByCommit returns the runs that included queries of a commit, latest
+// first
+func (r RunRepository) GetRunsByCommit(commitId int) ([]Run, error) {
+	runs := make([]Run, 0)
+	query := r.Where(`"id" IN (?)`, r.Model(&RunStatement{}).Select(`"runId"`).Where(`"commitId" = ?`, commitId)).
+		Preload("Statements", func(db *gorm.DB) *gorm.DB {
+			return db.Order(`"position"`)
+		}).
+		Order(`"startedAt" DESC`)
+	if err := query.Find(&runs).Error; err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
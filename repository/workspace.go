@@ -0,0 +1,23 @@
+package repository
+
+import "butler-server/client"
+
+// Member is a user of a workspace, managed by the Next app
+type Member struct {
+	WorkspaceID int    `gorm:"column:workspace_id"`
+	UserID      string `gorm:"column:user_id"`
+}
+
+func (Member) TableName() string {
+	return "members"
+}
+
+// IsMember reports whether the user belongs to the workspace
+func IsMember(dbClient *client.Database, workspaceId int, userId string) (bool, error) {
+	var count int64
+	err := dbClient.Db.Model(&Member{}).Where("workspace_id = ? AND user_id = ?", workspaceId, userId).Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}